@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+// Audit webhook delivery result label values
+const (
+	AuditSent    = "sent"    // Event accepted by the webhook
+	AuditFailed  = "failed"  // Event dropped after exhausting its retries
+	AuditDropped = "dropped" // Event dropped because the buffer was full
+)
+
+// Defaults of the audit webhook when not configured.
+const (
+	defaultAuditBufferSize   = 1000
+	defaultAuditMaxRetries   = 3
+	defaultAuditRetryBackoff = time.Second
+	defaultAuditTimeout      = 5 * time.Second
+)
+
+// auditEventsTotal counts audit events per delivery result.
+var auditEventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "lgtm_lbac_proxy",
+	Name:      "audit_events_total",
+	Help:      "Total number of authorization decisions sent to the audit webhook by delivery result.",
+}, []string{"result"})
+
+// AuditEvent is an authorization decision taken by the proxy for an authenticated request.
+type AuditEvent struct {
+	Time      time.Time   `json:"time"`
+	RequestID string      `json:"request_id"`
+	Username  string      `json:"username"`
+	Email     string      `json:"email"`
+	Groups    []string    `json:"groups"`
+	Upstream  string      `json:"upstream"`
+	Method    string      `json:"method"`
+	Path      string      `json:"path"`
+	Decision  string      `json:"decision"`         // allowed, denied or bypassed
+	Reason    string      `json:"reason,omitempty"` // Why the request was denied
+	Rules     []LabelRule `json:"rules,omitempty"`  // Policy rules the query was enforced against, with their _meta
+}
+
+// auditWebhook posts audit events as JSON to a webhook in the background. Events are
+// buffered and delivered in order by a single worker with retries; when the buffer is full,
+// new events are dropped so that request handling never waits for the webhook.
+type auditWebhook struct {
+	url          string
+	headers      map[string]string
+	client       *http.Client
+	maxRetries   int
+	retryBackoff time.Duration
+	events       chan AuditEvent
+	done         chan struct{}
+}
+
+// newAuditWebhook starts the delivery of audit events to the configured webhook, or
+// returns nil if no webhook URL is configured.
+func newAuditWebhook(cfg AuditWebhookConfig) *auditWebhook {
+	if cfg.URL == "" {
+		return nil
+	}
+	if _, err := url.ParseRequestURI(cfg.URL); err != nil {
+		log.Fatal().Err(err).Msg("Failed to parse audit webhook URL")
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = defaultAuditBufferSize
+	}
+	if cfg.MaxRetries < 0 {
+		cfg.MaxRetries = 0
+	} else if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = defaultAuditMaxRetries
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = defaultAuditRetryBackoff
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultAuditTimeout
+	}
+
+	w := &auditWebhook{
+		url:          cfg.URL,
+		headers:      cfg.Headers,
+		client:       &http.Client{Timeout: cfg.Timeout},
+		maxRetries:   cfg.MaxRetries,
+		retryBackoff: cfg.RetryBackoff,
+		events:       make(chan AuditEvent, cfg.BufferSize),
+		done:         make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// emit queues event for delivery without blocking.
+func (w *auditWebhook) emit(event AuditEvent) {
+	select {
+	case w.events <- event:
+	default:
+		auditEventsTotal.WithLabelValues(AuditDropped).Inc()
+		log.Warn().Str("decision", event.Decision).Str("request_id", event.RequestID).Msg("Audit webhook buffer full, dropping event")
+	}
+}
+
+// close stops accepting events and waits until the buffered ones are delivered.
+func (w *auditWebhook) close() {
+	close(w.events)
+	<-w.done
+}
+
+// run delivers queued events until the webhook is closed.
+func (w *auditWebhook) run() {
+	defer close(w.done)
+	for event := range w.events {
+		body, err := json.Marshal(event)
+		if err != nil {
+			auditEventsTotal.WithLabelValues(AuditFailed).Inc()
+			log.Error().Err(err).Msg("Error while marshalling audit event")
+			continue
+		}
+
+		backoff := w.retryBackoff
+		for attempt := 0; ; attempt++ {
+			if err = w.post(body); err == nil {
+				auditEventsTotal.WithLabelValues(AuditSent).Inc()
+				break
+			}
+			if attempt >= w.maxRetries {
+				auditEventsTotal.WithLabelValues(AuditFailed).Inc()
+				log.Error().Err(err).Str("request_id", event.RequestID).Int("attempts", attempt+1).Msg("Failed to send audit event")
+				break
+			}
+			log.Debug().Err(err).Str("request_id", event.RequestID).Dur("backoff", backoff).Msg("Retrying audit event")
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// post sends one JSON encoded event to the webhook.
+func (w *auditWebhook) post(body []byte) error {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("audit webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// WithAudit starts the audit webhook if one is configured.
+func (a *App) WithAudit() *App {
+	a.audit = newAuditWebhook(a.Cfg.Audit.Webhook)
+	if a.audit != nil {
+		log.Info().Int("buffer_size", cap(a.audit.events)).Msg("Audit webhook initialized")
+	}
+	return a
+}
+
+// auditDecision emits the authorization decision taken for r to the audit webhook, if any.
+// policy is the policy the query was enforced against, nil if none was, and err is the
+// reason of denied requests.
+func (a *App) auditDecision(r *http.Request, token OAuthToken, upstream string, decision string, policy *LabelPolicy, err error) {
+	if a.audit == nil {
+		return
+	}
+	event := AuditEvent{
+		Time:      time.Now().UTC(),
+		RequestID: r.Header.Get(RequestIDHeader),
+		Username:  token.PreferredUsername,
+		Email:     token.Email,
+		Groups:    token.Groups,
+		Upstream:  upstream,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Decision:  decision,
+	}
+	if policy != nil {
+		event.Rules = policy.Rules
+	}
+	if err != nil {
+		event.Reason = err.Error()
+	}
+	a.audit.emit(event)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditWebhook(t *testing.T) {
+	events := make(chan AuditEvent, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "secret", r.Header.Get("X-Audit-Token"))
+		var event AuditEvent
+		if assert.NoError(t, json.NewDecoder(r.Body).Decode(&event)) {
+			events <- event
+		}
+	}))
+	defer receiver.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, "ok")
+	}))
+	defer upstream.Close()
+
+	app, tokens := setupTestMain()
+	store := app.LabelStore.(*FileLabelStore)
+	policy, err := store.parser.ParseUserPolicy(RawLabelData{
+		"_meta": map[string]interface{}{"ticket": "OPS-1"},
+		"_rules": []interface{}{
+			map[string]interface{}{"name": "tenant_id", "operator": "=", "values": []interface{}{"allowed_user"}},
+		},
+	}, "")
+	assert.NoError(t, err)
+	store.policyCache["entry:user"] = policy
+	app.Cfg.Loki.URL = upstream.URL
+	app.Cfg.Audit.Webhook.URL = receiver.URL
+	app.Cfg.Audit.Webhook.Headers = map[string]string{"X-Audit-Token": "secret"}
+	app.WithProxies()
+	app.WithAudit()
+	app.WithRoutes()
+
+	tests := []struct {
+		name         string
+		query        string
+		wantStatus   int
+		wantDecision string
+	}{
+		{name: "allowed", query: `{tenant_id="allowed_user"}`, wantStatus: http.StatusOK, wantDecision: EnforcementAllowed},
+		{name: "denied", query: `{tenant_id="forbidden_user"}`, wantStatus: http.StatusForbidden, wantDecision: EnforcementDenied},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/loki/api/v1/query_range?query="+tt.query, nil)
+			req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+			req.Header.Set(RequestIDHeader, "audit-"+tt.name)
+			rr := httptest.NewRecorder()
+			app.e.ServeHTTP(rr, req)
+			assert.Equal(t, tt.wantStatus, rr.Code)
+
+			select {
+			case event := <-events:
+				assert.Equal(t, tt.wantDecision, event.Decision)
+				assert.Equal(t, "audit-"+tt.name, event.RequestID)
+				assert.Equal(t, "user", event.Username)
+				assert.Equal(t, "test@email.com", event.Email)
+				assert.Equal(t, "loki", event.Upstream)
+				assert.Equal(t, "/loki/api/v1/query_range", event.Path)
+				if tt.wantDecision == EnforcementDenied {
+					assert.NotEmpty(t, event.Reason)
+				} else {
+					assert.Empty(t, event.Reason)
+				}
+				if assert.Len(t, event.Rules, 1) {
+					assert.Equal(t, "tenant_id", event.Rules[0].Name)
+					assert.Equal(t, map[string]string{"ticket": "OPS-1"}, event.Rules[0].Meta)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("audit event was not received")
+			}
+		})
+	}
+	app.audit.close()
+}
+
+func TestAuditWebhookFailureDoesNotAffectProxying(t *testing.T) {
+	var attempts int
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, "ok")
+	}))
+	defer upstream.Close()
+
+	app, tokens := setupTestMain()
+	app.Cfg.Loki.URL = upstream.URL
+	app.Cfg.Audit.Webhook.URL = receiver.URL
+	app.Cfg.Audit.Webhook.MaxRetries = 2
+	app.Cfg.Audit.Webhook.RetryBackoff = time.Millisecond
+	app.WithProxies()
+	app.WithAudit()
+	app.WithRoutes()
+
+	failed := auditEventsTotal.WithLabelValues(AuditFailed)
+	before := testutil.ToFloat64(failed)
+
+	req := httptest.NewRequest(http.MethodGet, `/loki/api/v1/query_range?query={tenant_id="allowed_user"}`, nil)
+	req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+	rr := httptest.NewRecorder()
+	app.e.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "ok", rr.Body.String())
+
+	app.audit.close()
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, float64(1), testutil.ToFloat64(failed)-before)
+}
+
+func TestAuditWebhookUntrustedGrafanaHeaders(t *testing.T) {
+	events := make(chan AuditEvent, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event AuditEvent
+		if assert.NoError(t, json.NewDecoder(r.Body).Decode(&event)) {
+			events <- event
+		}
+	}))
+	defer receiver.Close()
+
+	app, _ := setupTestMain()
+	app.Cfg.Loki.URL = "http://127.0.0.1:0"
+	app.Cfg.Audit.Webhook.URL = receiver.URL
+	app.Cfg.Auth.GrafanaHeaders.TrustedCIDRs = []string{"10.0.0.0/8"}
+	assert.NoError(t, app.validateGrafanaHeadersConfig())
+	app.WithProxies()
+	app.WithAudit()
+	app.WithRoutes()
+
+	req := httptest.NewRequest(http.MethodGet, `/loki/api/v1/query_range?query={tenant_id="allowed_user"}`, nil)
+	req.Header.Set("X-Grafana-User", "admin")
+	rr := httptest.NewRecorder()
+	app.e.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	app.audit.close()
+	select {
+	case event := <-events:
+		assert.Equal(t, EnforcementDenied, event.Decision)
+		assert.Equal(t, "X-Grafana-User header from untrusted address 192.0.2.1", event.Reason)
+	default:
+		t.Fatal("audit event was not received")
+	}
+}
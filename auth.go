@@ -1,9 +1,15 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"net/netip"
+	"path"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 	"unicode"
 
 	"github.com/rs/zerolog/log"
@@ -14,17 +20,98 @@ import (
 // OAuthToken represents the structure of an OAuth token.
 // It holds user-related information extracted from the token.
 type OAuthToken struct {
-	Groups            []string `json:"-,omitempty"`
-	PreferredUsername string   `json:"preferred_username"`
-	Email             string   `json:"email"`
+	Groups            []string      `json:"-,omitempty"`
+	PreferredUsername string        `json:"preferred_username"`
+	Email             string        `json:"email"`
+	Scopes            []string      `json:"-"`
+	claims            jwt.MapClaims // All claims of the token, read for the actor claim
 	jwt.RegisteredClaims
 }
 
+// Token failure reasons, reported in logs and metrics and selecting auth.token_error_status
+const (
+	TokenMissing          = "missing"           // No token was sent
+	TokenMalformed        = "malformed"         // The header or token cannot be decoded, likely a client bug
+	TokenExpired          = "expired"           // Expired or older than max_token_age, the client needs to refresh it
+	TokenSignatureInvalid = "signature_invalid" // The signature does not verify, possibly a forged token
+	TokenInvalid          = "invalid"           // Any other failure, e.g. an unknown key or an untrusted identity header
+	TokenPathNotAllowed   = "path_not_allowed"  // The alert token was sent on a path not in alert.allowed_paths
+)
+
+// tokenErrorReasons lists the token failure reasons.
+var tokenErrorReasons = []string{TokenMissing, TokenMalformed, TokenExpired, TokenSignatureInvalid, TokenInvalid, TokenPathNotAllowed}
+
+// TokenError is returned by getToken when the request carries no usable token. Reason tells
+// apart failures clients need to handle differently.
+type TokenError struct {
+	Reason string // One of the Token* failure reasons
+	Err    error
+}
+
+func (e *TokenError) Error() string { return e.Err.Error() }
+
+func (e *TokenError) Unwrap() error { return e.Err }
+
+// tokenErrorReason returns the failure reason of a getToken error, TokenInvalid if it has none.
+func tokenErrorReason(err error) string {
+	var tokenErr *TokenError
+	if errors.As(err, &tokenErr) {
+		return tokenErr.Reason
+	}
+	return TokenInvalid
+}
+
+// jwtErrorReason classifies an error of parsing and validating a JWT.
+func jwtErrorReason(err error) string {
+	switch {
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return TokenMalformed
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return TokenExpired
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid):
+		return TokenSignatureInvalid
+	default:
+		return TokenInvalid
+	}
+}
+
+// writeTokenError answers a request rejected by getToken with the status configured for the
+// failure reason, 403 Forbidden by default, and counts and logs the reason. Forged tokens
+// are logged at warn level, malformed ones at info level and all others at debug level.
+// 401 responses carry a WWW-Authenticate challenge as defined for bearer tokens.
+func (a *App) writeTokenError(w http.ResponseWriter, r *http.Request, err error) {
+	reason := tokenErrorReason(err)
+	authFailuresTotal.WithLabelValues(reason).Inc()
+
+	event := requestLogger(r).Debug()
+	switch reason {
+	case TokenSignatureInvalid:
+		event = requestLogger(r).Warn()
+	case TokenMalformed:
+		event = requestLogger(r).Info()
+	}
+	event.Err(err).Str("reason", reason).Str("remote_addr", r.RemoteAddr).Str("path", r.URL.Path).Msg("Rejected request token")
+
+	status, ok := a.Cfg.Auth.TokenErrorStatus[reason]
+	if !ok {
+		status = http.StatusForbidden
+	}
+	if status == http.StatusUnauthorized {
+		challenge := "Bearer"
+		if reason != TokenMissing {
+			challenge += fmt.Sprintf(` error="invalid_token", error_description=%q`, reason)
+		}
+		w.Header().Set("WWW-Authenticate", challenge)
+	}
+	logAndWriteError(w, status, err, "")
+}
+
 // UserIdentity represents the minimal identity information needed for label lookup.
 // This is authentication-agnostic and focuses on the authorization concern.
 type UserIdentity struct {
 	Username string   // Primary user identifier
 	Groups   []string // Group memberships for the user
+	Email    string   // Email address, whose domain selects a policy when no user or group entry matches
 }
 
 // ToIdentity extracts the identity information from an OAuth token.
@@ -34,12 +121,41 @@ func (t OAuthToken) ToIdentity() UserIdentity {
 	return UserIdentity{
 		Username: t.PreferredUsername,
 		Groups:   t.Groups,
+		Email:    t.Email,
 	}
 }
 
+// claimValues returns the values of the named claims present in the token joined by ":", or
+// an empty string if none is. Only string, number and boolean claims are used. Identities
+// from Grafana headers have no claims.
+func (t OAuthToken) claimValues(names []string) string {
+	var values []string
+	for _, name := range names {
+		switch v := t.claims[name].(type) {
+		case string:
+			if v != "" {
+				values = append(values, v)
+			}
+		case float64:
+			values = append(values, strconv.FormatFloat(v, 'f', -1, 64))
+		case bool:
+			values = append(values, strconv.FormatBool(v))
+		}
+	}
+	return strings.Join(values, ":")
+}
+
 // getToken retrieves the OAuth token from the incoming HTTP request.
-// It extracts, parses, and validates the token from the configured authentication header.
+// Identities asserted by Grafana headers take precedence when enabled. Otherwise it extracts,
+// parses, and validates the token from the configured authentication header, falling back
+// to the forwarded token header and then the alert token header.
 func getToken(r *http.Request, a *App) (OAuthToken, error) {
+	if grafana := a.Cfg.Auth.GrafanaHeaders; len(grafana.trustedPrefixes) > 0 {
+		if username := r.Header.Get(grafana.UserHeader); username != "" {
+			return grafanaHeaderIdentity(r, username, grafana)
+		}
+	}
+
 	scheme := strings.TrimSpace(a.Cfg.Auth.AuthScheme)
 	primaryHeader := a.Cfg.Web.AuthHeader
 	primaryValue := r.Header.Get(primaryHeader)
@@ -53,11 +169,26 @@ func getToken(r *http.Request, a *App) (OAuthToken, error) {
 		return parseAndValidateToken(tokenString, a)
 	}
 
+	// Fall back to a token forwarded by an authenticating proxy (sent without scheme)
+	if forwardedHeader := a.Cfg.Auth.ForwardedTokenHeader; forwardedHeader != "" {
+		if forwardedValue := r.Header.Get(forwardedHeader); forwardedValue != "" {
+			log.Trace().Str("header", forwardedHeader).Str("value", forwardedValue).Msg("Forwarded token header value")
+			tokenString, err := extractTokenValue(forwardedValue, "", forwardedHeader)
+			if err != nil {
+				return OAuthToken{}, err
+			}
+			return parseAndValidateToken(tokenString, a)
+		}
+	}
+
 	if a.Cfg.Alert.Enabled {
 		alertHeader := a.Cfg.Alert.TokenHeader
 		alertValue := r.Header.Get(alertHeader)
 		if alertValue == "" {
-			return OAuthToken{}, fmt.Errorf("no %s header found", primaryHeader)
+			return OAuthToken{}, &TokenError{Reason: TokenMissing, Err: fmt.Errorf("no %s header found", primaryHeader)}
+		}
+		if !alertPathAllowed(r.URL.Path, a.Cfg.Alert.AllowedPaths) {
+			return OAuthToken{}, &TokenError{Reason: TokenPathNotAllowed, Err: fmt.Errorf("%s header not accepted on %s", alertHeader, r.URL.Path)}
 		}
 		log.Trace().Str("header", alertHeader).Str("value", alertValue).Msg("Alert header value")
 		tokenString, err := extractTokenValue(alertValue, scheme, alertHeader)
@@ -67,24 +198,82 @@ func getToken(r *http.Request, a *App) (OAuthToken, error) {
 		return parseAndValidateToken(tokenString, a)
 	}
 
-	return OAuthToken{}, fmt.Errorf("no %s header found", primaryHeader)
+	return OAuthToken{}, &TokenError{Reason: TokenMissing, Err: fmt.Errorf("no %s header found", primaryHeader)}
+}
+
+// alertPathAllowed reports whether the alert token is accepted on requestPath, which is the
+// case if it matches one of the allowed path patterns or none are configured. Malformed
+// patterns match no path.
+func alertPathAllowed(requestPath string, allowedPaths []string) bool {
+	if len(allowedPaths) == 0 {
+		return true
+	}
+	for _, pattern := range allowedPaths {
+		if matched, _ := path.Match(pattern, requestPath); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// grafanaHeaderIdentity builds the identity asserted by Grafana data source proxy headers.
+// The headers are rejected unless the connection comes from a trusted address; the direct
+// peer address is used, as forwarding headers could be set by anyone.
+func grafanaHeaderIdentity(r *http.Request, username string, cfg GrafanaHeadersConfig) (OAuthToken, error) {
+	addr, err := remoteAddr(r)
+	if err != nil {
+		return OAuthToken{}, err
+	}
+	if !slices.ContainsFunc(cfg.trustedPrefixes, func(prefix netip.Prefix) bool { return prefix.Contains(addr) }) {
+		log.Warn().Str("header", cfg.UserHeader).Str("username", username).Str("remote_addr", addr.String()).Msg("Rejected identity header from untrusted address")
+		return OAuthToken{}, fmt.Errorf("%s header from untrusted address %s", cfg.UserHeader, addr)
+	}
+
+	var groups []string
+	if cfg.GroupsHeader != "" {
+		for _, group := range strings.Split(r.Header.Get(cfg.GroupsHeader), ",") {
+			if group = strings.TrimSpace(group); group != "" {
+				groups = append(groups, group)
+			}
+		}
+	}
+	log.Trace().Str("username", username).Strs("groups", groups).Msg("Identity from Grafana headers")
+	return OAuthToken{PreferredUsername: username, Groups: groups}, nil
+}
+
+// remoteAddr returns the IP address of the peer of r.
+func remoteAddr(r *http.Request) (netip.Addr, error) {
+	if addrPort, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		return addrPort.Addr().Unmap(), nil
+	}
+	addr, err := netip.ParseAddr(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid remote address %q", r.RemoteAddr)
+	}
+	return addr.Unmap(), nil
 }
 
 func parseAndValidateToken(tokenString string, a *App) (OAuthToken, error) {
 	oauthToken, token, err := parseJwtToken(tokenString, a)
 	if err != nil {
-		return OAuthToken{}, fmt.Errorf("error parsing token")
+		return OAuthToken{}, err
 	}
 	if !token.Valid {
-		return OAuthToken{}, fmt.Errorf("invalid token")
+		return OAuthToken{}, &TokenError{Reason: TokenInvalid, Err: errors.New("invalid token")}
 	}
 	return oauthToken, nil
 }
 
+// invalidHeaderError is returned for a token header that does not carry a token in the
+// expected scheme.
+func invalidHeaderError(headerName string) error {
+	return &TokenError{Reason: TokenMalformed, Err: fmt.Errorf("invalid %s header", headerName)}
+}
+
 func extractTokenValue(headerValue, scheme, headerName string) (string, error) {
 	value := strings.TrimSpace(headerValue)
 	if value == "" {
-		return "", fmt.Errorf("invalid %s header", headerName)
+		return "", invalidHeaderError(headerName)
 	}
 
 	if strings.TrimSpace(scheme) == "" {
@@ -92,26 +281,28 @@ func extractTokenValue(headerValue, scheme, headerName string) (string, error) {
 	}
 
 	if !strings.HasPrefix(value, scheme) {
-		return "", fmt.Errorf("invalid %s header", headerName)
+		return "", invalidHeaderError(headerName)
 	}
 
 	remainder := value[len(scheme):]
 	if len(remainder) == 0 {
-		return "", fmt.Errorf("invalid %s header", headerName)
+		return "", invalidHeaderError(headerName)
 	}
 
 	if !unicode.IsSpace(rune(remainder[0])) {
-		return "", fmt.Errorf("invalid %s header", headerName)
+		return "", invalidHeaderError(headerName)
 	}
 
 	token := strings.TrimSpace(remainder)
 	if token == "" {
-		return "", fmt.Errorf("invalid %s header", headerName)
+		return "", invalidHeaderError(headerName)
 	}
 	return token, nil
 }
 
 // parseJwtToken parses the JWT token string and constructs an OAuthToken from the parsed claims.
+// Parsing and validation errors are returned as a TokenError telling apart malformed,
+// expired and forged tokens.
 // It returns the constructed OAuthToken, the parsed jwt.Token, and any error that occurred during parsing.
 func parseJwtToken(tokenString string, a *App) (OAuthToken, *jwt.Token, error) {
 	var oAuthToken OAuthToken
@@ -119,8 +310,14 @@ func parseJwtToken(tokenString string, a *App) (OAuthToken, *jwt.Token, error) {
 
 	token, err := jwt.ParseWithClaims(tokenString, &claimsMap, a.Jwks.Keyfunc)
 	if err != nil {
-		log.Error().Err(err).Msg("Error parsing token")
-		return oAuthToken, nil, err
+		reason := jwtErrorReason(err)
+		log.Debug().Err(err).Str("reason", reason).Msg("Error parsing token")
+		return oAuthToken, nil, &TokenError{Reason: reason, Err: fmt.Errorf("error parsing token: %w", err)}
+	}
+
+	if err := validateTokenAge(claimsMap, a.Cfg.Auth.MaxTokenAge); err != nil {
+		log.Debug().Err(err).Msg("Rejecting stale token")
+		return oAuthToken, nil, &TokenError{Reason: jwtErrorReason(err), Err: fmt.Errorf("error parsing token: %w", err)}
 	}
 
 	if !token.Valid {
@@ -140,47 +337,219 @@ func parseJwtToken(tokenString string, a *App) (OAuthToken, *jwt.Token, error) {
 		oAuthToken.Email = v
 	}
 
-	if v, ok := claimsMap[a.Cfg.Web.OAuthGroupName].([]interface{}); ok {
+	oAuthToken.Groups = mapGroups(claimsMap, a.Cfg.Web.OAuthGroupName, a.Cfg.Auth.GroupMappings)
+	oAuthToken.Scopes = tokenScopes(claimsMap)
+	oAuthToken.claims = claimsMap
+
+	return oAuthToken, token, err
+}
+
+// validateTokenAge rejects tokens issued more than maxAge ago, or without "iat" claim. A
+// maxAge of zero disables the check.
+func validateTokenAge(claimsMap jwt.MapClaims, maxAge time.Duration) error {
+	if maxAge <= 0 {
+		return nil
+	}
+	issuedAt, err := claimsMap.GetIssuedAt()
+	if err != nil {
+		return err
+	}
+	if issuedAt == nil {
+		return fmt.Errorf("token has no iat claim, required by max_token_age")
+	}
+	if age := time.Since(issuedAt.Time); age > maxAge {
+		return fmt.Errorf("%w: token issued %s ago exceeds max_token_age of %s", jwt.ErrTokenExpired, age.Round(time.Second), maxAge)
+	}
+	return nil
+}
+
+// mapGroups extracts the groups from the token claims and applies the configured group
+// mappings. Without mappings the values of the groups claim are returned as-is.
+func mapGroups(claimsMap jwt.MapClaims, groupsClaim string, mappings []GroupMapping) []string {
+	var groups []string
+	seen := make(map[string]bool)
+	add := func(group string) {
+		if !seen[group] {
+			seen[group] = true
+			groups = append(groups, group)
+		}
+	}
+
+	mapsGroupsClaim := false
+	for _, mapping := range mappings {
+		claim := mapping.Claim
+		if claim == "" {
+			claim = groupsClaim
+		}
+		if claim == groupsClaim {
+			mapsGroupsClaim = true
+		}
+		for _, value := range claimStrings(claimsMap, claim) {
+			group := mapping.apply(value)
+			log.Trace().Str("claim", claim).Str("value", value).Str("group", group).Msg("Mapped group claim")
+			add(group)
+		}
+	}
+
+	if !mapsGroupsClaim {
+		for _, group := range claimStrings(claimsMap, groupsClaim) {
+			log.Trace().Str("claim", groupsClaim).Str("group", group).Msg("Group claim")
+			add(group)
+		}
+	}
+	return groups
+}
+
+// tokenScopes returns the scopes granted by the token, read from the space-delimited
+// "scope" claim (RFC 8693) and the "scp" claim, which may be an array or a string.
+func tokenScopes(claimsMap jwt.MapClaims) []string {
+	var scopes []string
+	for _, claim := range []string{"scope", "scp"} {
+		switch v := claimsMap[claim].(type) {
+		case string:
+			scopes = append(scopes, strings.Fields(v)...)
+		case []interface{}:
+			scopes = append(scopes, claimStrings(claimsMap, claim)...)
+		}
+	}
+	return scopes
+}
+
+// validateScopes returns an error if the token lacks any of the required scopes.
+func validateScopes(token OAuthToken, required []string) error {
+	for _, scope := range required {
+		if !slices.Contains(token.Scopes, scope) {
+			return fmt.Errorf("token of user %s is missing required scope %s", token.PreferredUsername, scope)
+		}
+	}
+	return nil
+}
+
+// apply transforms a single claim value into a group name.
+func (m GroupMapping) apply(value string) string {
+	value = strings.TrimPrefix(value, m.StripPrefix)
+	if m.Lowercase {
+		value = strings.ToLower(value)
+	}
+	if renamed, ok := m.Rename[value]; ok {
+		value = renamed
+	}
+	return value
+}
+
+// claimStrings returns the string values of an array claim.
+func claimStrings(claimsMap jwt.MapClaims, claim string) []string {
+	var values []string
+	if v, ok := claimsMap[claim].([]interface{}); ok {
 		for _, item := range v {
 			if s, ok := item.(string); ok {
-				log.Trace().Str("claim", a.Cfg.Web.OAuthGroupName).Str("group", s).Msg("Group claim")
-				oAuthToken.Groups = append(oAuthToken.Groups, s)
+				values = append(values, s)
 			}
 		}
 	}
-
-	return oAuthToken, token, err
+	return values
 }
 
 // validateLabelPolicy retrieves and validates the label policy for the user.
 // It checks if the user is an admin and skips label enforcement if true.
+// Cluster-wide access scoped to another upstream than the requested one is ignored.
+// A non-empty routeTenantLabel overrides the upstream's tenant label: rules on the upstream's
+// tenant label are enforced on routeTenantLabel instead.
 // Returns the LabelPolicy, a boolean indicating whether label enforcement should be skipped,
 // and any error that occurred during validation.
-func validateLabelPolicy(token OAuthToken, a *App) (*LabelPolicy, bool, error) {
+func validateLabelPolicy(token OAuthToken, a *App, upstream string, routeTenantLabel string) (*LabelPolicy, bool, error) {
+	upstreamTenantLabel, deny := a.tenantLabel(upstream)
+	tenantLabel := upstreamTenantLabel
+	if routeTenantLabel != "" {
+		tenantLabel = routeTenantLabel
+	}
+
 	if isAdmin(token, a) {
+		policy, err := a.adminPolicy(upstream, tenantLabel)
+		if err != nil {
+			return nil, false, fmt.Errorf("admin %s: %w", token.PreferredUsername, err)
+		}
+		if policy != nil {
+			log.Debug().Str("user", token.PreferredUsername).Bool("Admin", true).Strs("forbidden_tenants", a.Cfg.Admin.ForbiddenTenants).Msg("Excluding forbidden tenants")
+			return policy, false, nil
+		}
 		log.Debug().Str("user", token.PreferredUsername).Bool("Admin", true).Msg("Skipping label enforcement")
 		return nil, true, nil
 	}
 
+	if a.Cfg.LabelStore.RequireGroupMembership && !hasGroupMembership(token.Groups) {
+		return nil, false, fmt.Errorf("user %s is not a member of any group", token.PreferredUsername)
+	}
+
 	policy, err := a.LabelStore.GetLabelPolicy(token.ToIdentity(), "")
 	if err != nil {
 		return nil, false, fmt.Errorf("error getting label policy: %w", err)
 	}
 
 	// Check for cluster-wide access
-	if policy.HasClusterWideAccess() {
-		log.Debug().Str("user", token.PreferredUsername).Bool("ClusterWide", true).Msg("Skipping label enforcement")
+	if policy.HasClusterWideAccessFor(upstream) {
+		log.Debug().Str("user", token.PreferredUsername).Str("upstream", upstream).Bool("ClusterWide", true).Msg("Skipping label enforcement")
 		return nil, true, nil
 	}
+	policy = policy.WithoutScopedClusterWide()
 
 	log.Debug().Str("user", token.PreferredUsername).Int("rules", len(policy.Rules)).Str("logic", policy.Logic).Msg("Label policy retrieved")
 
 	if len(policy.Rules) < 1 {
 		return nil, false, fmt.Errorf("no label rules found")
 	}
+
+	if upstreamTenantLabel != "" && tenantLabel != upstreamTenantLabel {
+		policy = policy.WithRenamedLabel(upstreamTenantLabel, tenantLabel)
+	}
+
+	// Rules on other labels than the tenant label alone may not isolate the tenant
+	if tenantLabel != "" && !policy.HasRuleFor(tenantLabel) {
+		if deny {
+			return nil, false, fmt.Errorf("label policy of user %s has no rule for the %s tenant label %s", token.PreferredUsername, upstream, tenantLabel)
+		}
+		log.Warn().Str("user", token.PreferredUsername).Str("upstream", upstream).Str("tenant_label", tenantLabel).Msg("Label policy has no rule for the tenant label")
+	}
 	return policy, false, nil
 }
 
+// hasGroupMembership reports whether groups contains at least one non-empty group name.
+func hasGroupMembership(groups []string) bool {
+	for _, group := range groups {
+		if strings.TrimSpace(group) != "" {
+			return true
+		}
+	}
+	return false
+}
+
 func isAdmin(token OAuthToken, a *App) bool {
 	return ContainsIgnoreCase(token.Groups, a.Cfg.Admin.Group) && a.Cfg.Admin.Bypass
 }
+
+// adminPolicy returns the policy admins are enforced with on upstream, which excludes the
+// admin.forbidden_tenants from every tenant label (tenantLabel, or Tempo's tenant_labels),
+// or nil if no tenant is forbidden and admins bypass enforcement entirely. Without a tenant label the forbidden tenants cannot
+// be excluded, so an error is returned and the request is denied.
+func (a *App) adminPolicy(upstream string, tenantLabel string) (*LabelPolicy, error) {
+	forbidden := a.Cfg.Admin.ForbiddenTenants
+	if len(forbidden) == 0 {
+		return nil, nil
+	}
+
+	var tenantLabels []string
+	if upstream == "tempo" {
+		tenantLabels = a.Cfg.Tempo.TenantLabels
+	} else if tenantLabel != "" {
+		tenantLabels = []string{tenantLabel}
+	}
+	if len(tenantLabels) == 0 {
+		return nil, fmt.Errorf("admin.forbidden_tenants is set but %s has no tenant label", upstream)
+	}
+
+	policy := &LabelPolicy{Logic: LogicAND}
+	for _, label := range tenantLabels {
+		policy.Rules = append(policy.Rules, LabelRule{Name: label, Operator: OperatorNotEquals, Values: forbidden})
+	}
+	return policy, nil
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -357,3 +363,530 @@ func TestParseJwtToken_MissingCustomClaim(t *testing.T) {
 	assert.Equal(t, "", oauthToken.PreferredUsername)
 	assert.Equal(t, "user@example.com", oauthToken.Email)
 }
+
+func TestGetToken_ForwardedAccessToken(t *testing.T) {
+	app, tokens := setupTestMain()
+	app.Cfg.Auth.ForwardedTokenHeader = "X-Forwarded-Access-Token"
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Forwarded-Access-Token", tokens["groupTenant"])
+
+	token, err := getToken(req, &app)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "not-a-user", token.PreferredUsername)
+	assert.Equal(t, "test@email.com", token.Email)
+	assert.Equal(t, []string{"group1"}, token.ToIdentity().Groups)
+}
+
+func TestGetToken_ForwardedAccessToken_PrimaryHeaderTakesPrecedence(t *testing.T) {
+	app, tokens := setupTestMain()
+	app.Cfg.Auth.ForwardedTokenHeader = "X-Forwarded-Access-Token"
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+	req.Header.Set("X-Forwarded-Access-Token", tokens["groupTenant"])
+
+	token, err := getToken(req, &app)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "user", token.PreferredUsername)
+}
+
+func TestGetToken_ForwardedAccessToken_BeforeAlertFallback(t *testing.T) {
+	app, tokens := setupTestMain()
+	app.Cfg.Auth.ForwardedTokenHeader = "X-Forwarded-Access-Token"
+	app.Cfg.Alert.Enabled = true
+	app.Cfg.Alert.TokenHeader = "X-Alert-Token"
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Forwarded-Access-Token", tokens["groupTenant"])
+	req.Header.Set("X-Alert-Token", "Bearer "+tokens["userTenant"])
+
+	token, err := getToken(req, &app)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "not-a-user", token.PreferredUsername)
+}
+
+func TestGetToken_ForwardedAccessToken_Disabled(t *testing.T) {
+	app, tokens := setupTestMain()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Forwarded-Access-Token", tokens["groupTenant"])
+
+	token, err := getToken(req, &app)
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no Authorization header found")
+	assert.Equal(t, OAuthToken{}, token)
+}
+
+func TestValidateLabelPolicy_EmptyGroupsAllowedByDefault(t *testing.T) {
+	app, tokens := setupTestMain()
+
+	oauthToken, _, err := parseJwtToken(tokens["userTenant"], &app)
+	assert.NoError(t, err)
+
+	policy, skip, err := validateLabelPolicy(oauthToken, &app, "thanos", "")
+
+	assert.NoError(t, err)
+	assert.False(t, skip)
+	assert.NotNil(t, policy)
+}
+
+func TestValidateLabelPolicy_RequireGroupMembership_EmptyGroups(t *testing.T) {
+	app, tokens := setupTestMain()
+	app.Cfg.LabelStore.RequireGroupMembership = true
+
+	for _, name := range []string{"userTenant", "noGroupsTenant"} {
+		t.Run(name, func(t *testing.T) {
+			oauthToken, _, err := parseJwtToken(tokens[name], &app)
+			assert.NoError(t, err)
+
+			policy, skip, err := validateLabelPolicy(oauthToken, &app, "thanos", "")
+
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "not a member of any group")
+			assert.False(t, skip)
+			assert.Nil(t, policy)
+		})
+	}
+}
+
+func TestValidateLabelPolicy_RequireGroupMembership_WithGroups(t *testing.T) {
+	app, tokens := setupTestMain()
+	app.Cfg.LabelStore.RequireGroupMembership = true
+
+	oauthToken, _, err := parseJwtToken(tokens["userAndGroupTenant"], &app)
+	assert.NoError(t, err)
+
+	policy, skip, err := validateLabelPolicy(oauthToken, &app, "thanos", "")
+
+	assert.NoError(t, err)
+	assert.False(t, skip)
+	assert.NotNil(t, policy)
+}
+
+// setScopedClusterWidePolicy grants "user" cluster-wide access on Loki only.
+func setScopedClusterWidePolicy(t *testing.T, app *App) {
+	t.Helper()
+	store, ok := app.LabelStore.(*FileLabelStore)
+	if !ok {
+		t.Fatal("expected a FileLabelStore")
+	}
+	store.policyCache["entry:user"] = &LabelPolicy{
+		Rules: []LabelRule{
+			{Name: "#cluster-wide:loki", Operator: OperatorEquals, Values: []string{"true"}},
+			{Name: "tenant_id", Operator: OperatorEquals, Values: []string{"allowed_user"}},
+		},
+		Logic: LogicAND,
+	}
+}
+
+func TestValidateLabelPolicy_ScopedClusterWide(t *testing.T) {
+	app, tokens := setupTestMain()
+	setScopedClusterWidePolicy(t, &app)
+
+	oauthToken, _, err := parseJwtToken(tokens["userTenant"], &app)
+	assert.NoError(t, err)
+
+	policy, skip, err := validateLabelPolicy(oauthToken, &app, "loki", "")
+	assert.NoError(t, err)
+	assert.True(t, skip)
+	assert.Nil(t, policy)
+
+	policy, skip, err = validateLabelPolicy(oauthToken, &app, "thanos", "")
+	assert.NoError(t, err)
+	assert.False(t, skip)
+	assert.Equal(t, []LabelRule{{Name: "tenant_id", Operator: OperatorEquals, Values: []string{"allowed_user"}}}, policy.Rules)
+}
+
+func TestValidateLabelPolicy_TenantLabel(t *testing.T) {
+	tests := []struct {
+		name        string
+		upstream    string
+		tenantLabel string
+		deny        bool
+		wantErr     string
+	}{
+		{name: "policy has a rule for the tenant label", upstream: "thanos", tenantLabel: "tenant_id", deny: true},
+		{name: "tenant label not configured", upstream: "thanos", deny: true},
+		{name: "missing tenant label is allowed with a warning", upstream: "loki", tenantLabel: "namespace"},
+		{name: "missing tenant label is denied", upstream: "thanos", tenantLabel: "namespace", deny: true, wantErr: "label policy of user user has no rule for the thanos tenant label namespace"},
+		{name: "other upstreams are not affected", upstream: "loki", tenantLabel: "", deny: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, tokens := setupTestMain()
+			app.Cfg.Thanos.TenantLabel = tt.tenantLabel
+			app.Cfg.Thanos.DenyMissingTenantLabel = tt.deny
+			if tt.upstream == "loki" {
+				app.Cfg.Loki.TenantLabel = tt.tenantLabel
+				app.Cfg.Loki.DenyMissingTenantLabel = tt.deny
+				app.Cfg.Thanos.TenantLabel = "namespace"
+				app.Cfg.Thanos.DenyMissingTenantLabel = true
+			}
+
+			oauthToken, _, err := parseJwtToken(tokens["userTenant"], &app)
+			assert.NoError(t, err)
+
+			policy, skip, err := validateLabelPolicy(oauthToken, &app, tt.upstream, "")
+			assert.False(t, skip)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				assert.Nil(t, policy)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, []LabelRule{{Name: "tenant_id", Operator: OperatorEquals, Values: []string{"allowed_user", "also_allowed_user"}}}, policy.Rules)
+		})
+	}
+}
+
+func TestValidateLabelPolicy_AdminForbiddenTenants(t *testing.T) {
+	app, tokens := setupTestMain()
+	app.Cfg.Admin.Bypass = true
+	app.Cfg.Admin.Group = "admins"
+	app.Cfg.Thanos.TenantLabel = "tenant_id"
+	app.Cfg.Loki.TenantLabel = ""
+	app.Cfg.Tempo.TenantLabels = []string{"resource.namespace", "resource.cluster"}
+
+	oauthToken, _, err := parseJwtToken(tokens["adminUserToken"], &app)
+	assert.NoError(t, err)
+
+	// Without forbidden tenants admins bypass enforcement
+	policy, skip, err := validateLabelPolicy(oauthToken, &app, "thanos", "")
+	assert.NoError(t, err)
+	assert.True(t, skip)
+	assert.Nil(t, policy)
+
+	app.Cfg.Admin.ForbiddenTenants = []string{"secret", "vault"}
+
+	policy, skip, err = validateLabelPolicy(oauthToken, &app, "thanos", "")
+	assert.NoError(t, err)
+	assert.False(t, skip)
+	assert.Equal(t, &LabelPolicy{
+		Rules: []LabelRule{{Name: "tenant_id", Operator: OperatorNotEquals, Values: []string{"secret", "vault"}}},
+		Logic: LogicAND,
+	}, policy)
+
+	policy, skip, err = validateLabelPolicy(oauthToken, &app, "tempo", "")
+	assert.NoError(t, err)
+	assert.False(t, skip)
+	assert.Equal(t, []LabelRule{
+		{Name: "resource.namespace", Operator: OperatorNotEquals, Values: []string{"secret", "vault"}},
+		{Name: "resource.cluster", Operator: OperatorNotEquals, Values: []string{"secret", "vault"}},
+	}, policy.Rules)
+
+	// Forbidden tenants cannot be excluded without a tenant label
+	policy, skip, err = validateLabelPolicy(oauthToken, &app, "loki", "")
+	assert.EqualError(t, err, "admin admin: admin.forbidden_tenants is set but loki has no tenant label")
+	assert.False(t, skip)
+	assert.Nil(t, policy)
+}
+
+func TestMapGroups(t *testing.T) {
+	claims := jwt.MapClaims{
+		"groups": []interface{}{"team:Backend", "team:frontend", "ops"},
+		"roles":  []interface{}{"role:admin", "role:viewer"},
+	}
+
+	tests := []struct {
+		name     string
+		mappings []GroupMapping
+		expected []string
+	}{
+		{
+			name:     "no mappings",
+			expected: []string{"team:Backend", "team:frontend", "ops"},
+		},
+		{
+			name:     "strip prefix and lowercase groups claim",
+			mappings: []GroupMapping{{StripPrefix: "team:", Lowercase: true}},
+			expected: []string{"backend", "frontend", "ops"},
+		},
+		{
+			name: "rename roles claim in addition to groups",
+			mappings: []GroupMapping{
+				{Claim: "roles", StripPrefix: "role:", Rename: map[string]string{"admin": "admins"}},
+			},
+			expected: []string{"admins", "viewer", "team:Backend", "team:frontend", "ops"},
+		},
+		{
+			name: "mapped values are deduplicated",
+			mappings: []GroupMapping{
+				{Rename: map[string]string{"ops": "admins"}},
+				{Claim: "roles", StripPrefix: "role:", Rename: map[string]string{"admin": "admins"}},
+			},
+			expected: []string{"team:Backend", "team:frontend", "admins", "viewer"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, mapGroups(claims, "groups", tt.mappings))
+		})
+	}
+}
+
+func TestParseJwtToken_GroupMappings(t *testing.T) {
+	app, _, pk := setupTestMainWithPrivateKey()
+	app.Cfg.Auth.GroupMappings = []GroupMapping{
+		{StripPrefix: "/org/", Lowercase: true},
+		{Claim: "realm_roles", Rename: map[string]string{"role:admin": "admins"}},
+	}
+
+	claims := map[string]interface{}{
+		"preferred_username": "user",
+		"email":              "test@email.com",
+		"groups":             []interface{}{"/org/Group1"},
+		"realm_roles":        []interface{}{"role:admin"},
+	}
+	tokenString, err := genJWKSWithCustomClaims(claims, pk)
+	assert.NoError(t, err)
+
+	oauthToken, _, err := parseJwtToken(tokenString, &app)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"group1", "admins"}, oauthToken.Groups)
+}
+
+func TestTokenScopes(t *testing.T) {
+	tests := []struct {
+		name     string
+		claims   jwt.MapClaims
+		expected []string
+	}{
+		{name: "space-delimited scope", claims: jwt.MapClaims{"scope": "openid logs:read"}, expected: []string{"openid", "logs:read"}},
+		{name: "array scp", claims: jwt.MapClaims{"scp": []interface{}{"logs:read", "metrics:read"}}, expected: []string{"logs:read", "metrics:read"}},
+		{name: "string scp", claims: jwt.MapClaims{"scp": "logs:read"}, expected: []string{"logs:read"}},
+		{name: "no scopes", claims: jwt.MapClaims{}, expected: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tokenScopes(tt.claims))
+		})
+	}
+}
+
+func TestValidateScopes(t *testing.T) {
+	token := OAuthToken{PreferredUsername: "user", Scopes: []string{"openid", "logs:read"}}
+
+	assert.NoError(t, validateScopes(token, nil))
+	assert.NoError(t, validateScopes(token, []string{"logs:read"}))
+
+	err := validateScopes(token, []string{"logs:read", "metrics:read"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "missing required scope metrics:read")
+}
+
+func TestParseJwtToken_MaxTokenAge(t *testing.T) {
+	app, tokens, pk := setupTestMainWithPrivateKey()
+	app.Cfg.Auth.MaxTokenAge = time.Hour
+
+	tests := []struct {
+		name    string
+		iat     any // Omitted from the token if nil
+		wantErr string
+	}{
+		{name: "fresh token", iat: time.Now().Add(-time.Minute).Unix()},
+		{name: "token older than max_token_age", iat: time.Now().Add(-2 * time.Hour).Unix(), wantErr: "exceeds max_token_age of 1h0m0s"},
+		{name: "token without iat", wantErr: "token has no iat claim"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := map[string]interface{}{
+				"preferred_username": "user",
+				"email":              "test@email.com",
+				// Not expired, only the issue time matters
+				"exp": time.Now().Add(time.Hour).Unix(),
+			}
+			if tt.iat != nil {
+				claims["iat"] = tt.iat
+			}
+			tokenString, err := genJWKSWithCustomClaims(claims, pk)
+			assert.NoError(t, err)
+
+			oauthToken, _, err := parseJwtToken(tokenString, &app)
+
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "user", oauthToken.PreferredUsername)
+		})
+	}
+
+	// Disabled by default
+	app.Cfg.Auth.MaxTokenAge = 0
+	_, _, err := parseJwtToken(tokens["userTenant"], &app)
+	assert.NoError(t, err)
+}
+
+func TestTokenErrors(t *testing.T) {
+	app, tokens, pk := setupTestMainWithPrivateKey()
+	app.WithRoutes()
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	sign := func(claims jwt.MapClaims, key *ecdsa.PrivateKey, kid string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+		token.Header["kid"] = kid
+		tokenString, err := token.SignedString(key)
+		assert.NoError(t, err)
+		return tokenString
+	}
+	user := jwt.MapClaims{"preferred_username": "user", "email": "test@email.com"}
+	expired := jwt.MapClaims{"preferred_username": "user", "exp": time.Now().Add(-time.Minute).Unix()}
+	notYetValid := jwt.MapClaims{"preferred_username": "user", "nbf": time.Now().Add(time.Hour).Unix()}
+
+	tests := []struct {
+		name          string
+		authorization string
+		reason        string
+	}{
+		{name: "missing token", reason: TokenMissing},
+		{name: "malformed header", authorization: "Basic dXNlcjpwYXNz", reason: TokenMalformed},
+		{name: "malformed token", authorization: "Bearer not-a-jwt", reason: TokenMalformed},
+		{name: "expired token", authorization: "Bearer " + sign(expired, pk, "testKid"), reason: TokenExpired},
+		{name: "forged signature", authorization: "Bearer " + sign(user, otherKey, "testKid"), reason: TokenSignatureInvalid},
+		{name: "token not yet valid", authorization: "Bearer " + sign(notYetValid, pk, "testKid"), reason: TokenInvalid},
+	}
+
+	request := func(authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rr := httptest.NewRecorder()
+		app.e.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			_, err := getToken(req, &app)
+			assert.Equal(t, tt.reason, tokenErrorReason(err), err)
+
+			// Rejected with 403 by default and counted per reason
+			counter := authFailuresTotal.WithLabelValues(tt.reason)
+			before := testutil.ToFloat64(counter)
+			rr := request(tt.authorization)
+			assert.Equal(t, http.StatusForbidden, rr.Code, rr.Body.String())
+			assert.Empty(t, rr.Header().Get("WWW-Authenticate"))
+			assert.Equal(t, float64(1), testutil.ToFloat64(counter)-before)
+		})
+	}
+
+	t.Run("configured statuses", func(t *testing.T) {
+		app.Cfg.Auth.TokenErrorStatus = map[string]int{TokenExpired: http.StatusUnauthorized, TokenMissing: http.StatusUnauthorized, TokenMalformed: http.StatusBadRequest}
+		defer func() { app.Cfg.Auth.TokenErrorStatus = nil }()
+
+		rr := request("Bearer " + sign(expired, pk, "testKid"))
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Equal(t, `Bearer error="invalid_token", error_description="expired"`, rr.Header().Get("WWW-Authenticate"))
+
+		rr = request("")
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Equal(t, "Bearer", rr.Header().Get("WWW-Authenticate"))
+
+		assert.Equal(t, http.StatusBadRequest, request("Bearer not-a-jwt").Code)
+		assert.Equal(t, http.StatusForbidden, request("Bearer "+sign(user, otherKey, "testKid")).Code, "unlisted reasons keep 403")
+		assert.Equal(t, http.StatusOK, request("Bearer "+tokens["userTenant"]).Code)
+	})
+}
+
+func TestGetToken_GrafanaHeaders(t *testing.T) {
+	tests := []struct {
+		name         string
+		trustedCIDRs []string
+		headers      map[string]string
+		wantUser     string
+		wantGroups   []string
+		wantErr      string
+	}{
+		{
+			name:         "trusted address",
+			trustedCIDRs: []string{"10.0.0.0/8", "192.0.2.0/24"},
+			headers:      map[string]string{"X-Grafana-User": "alice", "X-Grafana-Groups": "team-a, team-b,"},
+			wantUser:     "alice",
+			wantGroups:   []string{"team-a", "team-b"},
+		},
+		{
+			name:         "untrusted address",
+			trustedCIDRs: []string{"10.0.0.0/8"},
+			headers:      map[string]string{"X-Grafana-User": "alice"},
+			wantErr:      "X-Grafana-User header from untrusted address 192.0.2.1",
+		},
+		{
+			name:         "untrusted address with a valid JWT",
+			trustedCIDRs: []string{"10.0.0.0/8"},
+			headers:      map[string]string{"X-Grafana-User": "alice", "Authorization": "userTenant"},
+			wantErr:      "X-Grafana-User header from untrusted address 192.0.2.1",
+		},
+		{
+			name:    "disabled",
+			headers: map[string]string{"X-Grafana-User": "alice"},
+			wantErr: "no Authorization header found",
+		},
+		{
+			name:         "trusted address without user header uses JWT",
+			trustedCIDRs: []string{"192.0.2.0/24"},
+			headers:      map[string]string{"Authorization": "userTenant"},
+			wantUser:     "user",
+		},
+	}
+
+	app, tokens := setupTestMain()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app.Cfg.Auth.GrafanaHeaders = GrafanaHeadersConfig{TrustedCIDRs: tt.trustedCIDRs, GroupsHeader: "X-Grafana-Groups"}
+			assert.NoError(t, app.validateGrafanaHeadersConfig())
+			req := httptest.NewRequest(http.MethodGet, "/", nil) // RemoteAddr is 192.0.2.1
+			for k, v := range tt.headers {
+				if k == "Authorization" {
+					v = "Bearer " + tokens[v]
+				}
+				req.Header.Set(k, v)
+			}
+
+			token, err := getToken(req, &app)
+
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				assert.Equal(t, OAuthToken{}, token)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantUser, token.PreferredUsername)
+			if tt.wantGroups != nil {
+				assert.Equal(t, tt.wantGroups, token.Groups)
+			}
+		})
+	}
+}
+
+func TestGetToken_GrafanaHeaders_IPv6(t *testing.T) {
+	app, _ := setupTestMain()
+	app.Cfg.Auth.GrafanaHeaders = GrafanaHeadersConfig{TrustedCIDRs: []string{"fd00::/8", "127.0.0.1/32"}}
+	assert.NoError(t, app.validateGrafanaHeadersConfig())
+
+	for remoteAddr, trusted := range map[string]bool{
+		"[fd00::1]:3000":          true,
+		"[::ffff:127.0.0.1]:3000": true,
+		"[fe80::1]:3000":          false,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Grafana-User", "alice")
+
+		_, err := getToken(req, &app)
+
+		assert.Equal(t, trusted, err == nil, remoteAddr)
+	}
+}
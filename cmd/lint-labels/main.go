@@ -0,0 +1,374 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// The proxy is built as package main and cannot be imported, so the rule model below
+// mirrors LabelRule, LabelPolicy and the checks of PolicyParser/LabelPolicy.Validate.
+
+// Operator constants for label matching
+const (
+	OperatorEquals       = "="
+	OperatorNotEquals    = "!="
+	OperatorRegexMatch   = "=~"
+	OperatorRegexNoMatch = "!~"
+)
+
+// Logic constants for combining multiple rules
+const (
+	LogicAND = "AND"
+	LogicOR  = "OR"
+)
+
+// clusterWideLabel is the rule name granting cluster-wide access, set with -cluster-wide-label
+// to match the proxy's labelstore.cluster_wide_label.
+var clusterWideLabel = "#cluster-wide"
+
+// LabelRule represents a single label matching rule
+type LabelRule struct {
+	Name     string
+	Operator string
+	Values   []string
+}
+
+// LabelPolicy represents the parsed policy of a user or group entry
+type LabelPolicy struct {
+	Rules []LabelRule
+	Logic string
+}
+
+// Severity of a lint finding
+const (
+	SeverityError   = "ERROR"
+	SeverityWarning = "WARN"
+)
+
+// Finding is a single lint result for an entry.
+type Finding struct {
+	Entry    string
+	Severity string
+	Message  string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%-5s %s: %s", f.Severity, f.Entry, f.Message)
+}
+
+// probeValues are sample label values used to detect regexes that match everything.
+var probeValues = []string{"a", "prod", "kube-system", "Z9_-.", "ns/with/slash"}
+
+func main() {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	input := flag.String("input", "", "Path to labels.yaml file (required)")
+	strict := flag.Bool("strict", false, "Exit with an error code when warnings are found")
+	flag.StringVar(&clusterWideLabel, "cluster-wide-label", clusterWideLabel, "Rule name granting cluster-wide access (labelstore.cluster_wide_label)")
+	flag.Parse()
+
+	if *input == "" {
+		fmt.Println("Usage: lint-labels -input <file> [options]")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	inputData, err := os.ReadFile(*input)
+	if err != nil {
+		log.Fatal().Err(err).Str("file", *input).Msg("Failed to read input file")
+	}
+
+	var data map[string]interface{}
+	if err := yaml.Unmarshal(inputData, &data); err != nil {
+		log.Fatal().Err(err).Msg("Failed to parse YAML")
+	}
+
+	log.Info().Str("file", *input).Int("entries", len(data)).Msg("Loaded label file")
+
+	findings := lintFile(data)
+	errors, warnings := 0, 0
+	for _, f := range findings {
+		fmt.Println(f)
+		if f.Severity == SeverityError {
+			errors++
+		} else {
+			warnings++
+		}
+	}
+
+	fmt.Printf("\n%d entries checked: %d errors, %d warnings\n", len(data), errors, warnings)
+	if errors > 0 || (*strict && warnings > 0) {
+		os.Exit(1)
+	}
+}
+
+// lintFile parses and lints every entry of a labels file, ordered by entry name.
+func lintFile(data map[string]interface{}) []Finding {
+	names := make([]string, 0, len(data))
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var findings []Finding
+	for _, name := range names {
+		entry, ok := data[name].(map[string]interface{})
+		if !ok {
+			findings = append(findings, Finding{Entry: name, Severity: SeverityError, Message: "entry must be a map"})
+			continue
+		}
+		policy, err := parsePolicy(entry)
+		if err != nil {
+			findings = append(findings, Finding{Entry: name, Severity: SeverityError, Message: err.Error()})
+			continue
+		}
+		for _, msg := range lintPolicy(policy) {
+			findings = append(findings, Finding{Entry: name, Severity: SeverityWarning, Message: msg})
+		}
+	}
+	return findings
+}
+
+// parsePolicy converts an extended format entry into a LabelPolicy, applying the same
+// validation as the proxy's PolicyParser.
+func parsePolicy(entry map[string]interface{}) (LabelPolicy, error) {
+	policy := LabelPolicy{Logic: LogicAND}
+
+	if logic, ok := entry["_logic"].(string); ok {
+		policy.Logic = logic
+	}
+	if policy.Logic != LogicAND && policy.Logic != LogicOR {
+		return policy, fmt.Errorf("invalid logic %q: must be AND or OR", policy.Logic)
+	}
+
+	defaultLabel := ""
+	if labelData, ok := entry["_default_label"]; ok {
+		label, ok := labelData.(string)
+		if !ok || label == "" {
+			return policy, fmt.Errorf("_default_label must be a non-empty string")
+		}
+		defaultLabel = label
+	}
+
+	if metaData, ok := entry["_meta"]; ok {
+		if err := validateMeta(metaData); err != nil {
+			return policy, err
+		}
+	}
+
+	rulesData, ok := entry["_rules"]
+	if !ok {
+		return policy, fmt.Errorf("missing required '_rules' key (simple format? run migrate-labels)")
+	}
+	rulesArray, ok := rulesData.([]interface{})
+	if !ok {
+		return policy, fmt.Errorf("_rules must be an array")
+	}
+	if len(rulesArray) == 0 {
+		return policy, fmt.Errorf("label policy must have at least one rule")
+	}
+
+	for i, ruleData := range rulesArray {
+		ruleMap, ok := ruleData.(map[string]interface{})
+		if !ok {
+			return policy, fmt.Errorf("rule %d: must be a map", i)
+		}
+		rule, err := parseRule(ruleMap, defaultLabel)
+		if err != nil {
+			return policy, fmt.Errorf("rule %d: %w", i, err)
+		}
+		policy.Rules = append(policy.Rules, rule)
+	}
+	return policy, nil
+}
+
+// parseRule converts a rule map into a LabelRule and validates it.
+// Rules without a name use the entry's default label, if it is set.
+func parseRule(ruleMap map[string]interface{}, defaultLabel string) (LabelRule, error) {
+	rule := LabelRule{}
+
+	name, ok := ruleMap["name"].(string)
+	if _, hasName := ruleMap["name"]; !hasName && defaultLabel != "" {
+		name, ok = defaultLabel, true
+	}
+	if !ok || name == "" {
+		return rule, fmt.Errorf("rule must have a 'name' field")
+	}
+	rule.Name = name
+
+	operator, ok := ruleMap["operator"].(string)
+	if !ok || operator == "" {
+		return rule, fmt.Errorf("rule must have an 'operator' field")
+	}
+	switch operator {
+	case OperatorEquals, OperatorNotEquals, OperatorRegexMatch, OperatorRegexNoMatch:
+	default:
+		return rule, fmt.Errorf("invalid operator %q: must be one of =, !=, =~, !~", operator)
+	}
+	rule.Operator = operator
+
+	valuesArray, ok := ruleMap["values"].([]interface{})
+	if !ok {
+		return rule, fmt.Errorf("rule must have a 'values' array")
+	}
+	for i, v := range valuesArray {
+		value, ok := v.(string)
+		if !ok {
+			return rule, fmt.Errorf("value %d must be a string", i)
+		}
+		rule.Values = append(rule.Values, value)
+	}
+	if len(rule.Values) == 0 {
+		return rule, fmt.Errorf("label rule must have at least one value")
+	}
+	if metaData, ok := ruleMap["_meta"]; ok {
+		if err := validateMeta(metaData); err != nil {
+			return rule, err
+		}
+	}
+
+	if isRegexOperator(rule.Operator) {
+		for _, value := range rule.Values {
+			if _, err := regexp.Compile(value); err != nil {
+				return rule, fmt.Errorf("invalid regex pattern %q: %w", value, err)
+			}
+		}
+	}
+	return rule, nil
+}
+
+// validateMeta checks that _meta annotations are a map of scalar values, like the proxy's
+// PolicyParser requires.
+func validateMeta(data interface{}) error {
+	meta, ok := data.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("_meta must be a map")
+	}
+	for key, value := range meta {
+		switch value.(type) {
+		case nil, map[string]interface{}, []interface{}:
+			return fmt.Errorf("_meta %q must be a string, number or boolean", key)
+		}
+	}
+	return nil
+}
+
+// lintPolicy runs the semantic checks on a valid policy and returns warning messages.
+func lintPolicy(policy LabelPolicy) []string {
+	var warnings []string
+	warnings = append(warnings, checkRedundantClusterWide(policy)...)
+	warnings = append(warnings, checkBroadRegex(policy)...)
+	warnings = append(warnings, checkUnreachableDeny(policy)...)
+	return warnings
+}
+
+// checkRedundantClusterWide flags entries that grant cluster-wide access alongside
+// specific rules, which are ignored since cluster-wide access skips enforcement.
+func checkRedundantClusterWide(policy LabelPolicy) []string {
+	hasClusterWide := false
+	var others []string
+	for _, rule := range policy.Rules {
+		if rule.Name == clusterWideLabel {
+			hasClusterWide = true
+		} else {
+			others = append(others, rule.Name)
+		}
+	}
+	if !hasClusterWide || len(others) == 0 {
+		return nil
+	}
+	return []string{fmt.Sprintf("cluster-wide access makes rules on %s redundant", strings.Join(others, ", "))}
+}
+
+// checkBroadRegex flags regex values that match every label value: a positive match grants
+// effectively unrestricted access for the label, a negative match denies everything.
+func checkBroadRegex(policy LabelPolicy) []string {
+	var warnings []string
+	for _, rule := range policy.Rules {
+		if !isRegexOperator(rule.Operator) {
+			continue
+		}
+		for _, value := range rule.Values {
+			if !matchesEverything(value) {
+				continue
+			}
+			if rule.Operator == OperatorRegexMatch {
+				warnings = append(warnings, fmt.Sprintf("%s=~%q matches every value; use %s or a narrower pattern", rule.Name, value, clusterWideLabel))
+			} else {
+				warnings = append(warnings, fmt.Sprintf("%s!~%q excludes every value, so the entry can never see data", rule.Name, value))
+			}
+		}
+	}
+	return warnings
+}
+
+// checkUnreachableDeny flags != rules in AND policies whose values are already excluded by
+// an = rule on the same label, so the deny rule can never take effect.
+func checkUnreachableDeny(policy LabelPolicy) []string {
+	if policy.Logic != LogicAND {
+		return nil
+	}
+
+	allowed := make(map[string]map[string]bool)
+	for _, rule := range policy.Rules {
+		if rule.Operator != OperatorEquals {
+			continue
+		}
+		if allowed[rule.Name] == nil {
+			allowed[rule.Name] = make(map[string]bool)
+		}
+		for _, v := range rule.Values {
+			allowed[rule.Name][v] = true
+		}
+	}
+
+	var warnings []string
+	for _, rule := range policy.Rules {
+		values, ok := allowed[rule.Name]
+		if rule.Operator != OperatorNotEquals || !ok {
+			continue
+		}
+		for _, v := range rule.Values {
+			if !values[v] {
+				warnings = append(warnings, fmt.Sprintf("%s!=%q is unreachable: %s is already restricted to %s",
+					rule.Name, v, rule.Name, strings.Join(sortedKeys(values), ", ")))
+			}
+		}
+	}
+	return warnings
+}
+
+// matchesEverything reports whether the anchored regex matches all probe values.
+func matchesEverything(pattern string) bool {
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return false
+	}
+	for _, probe := range probeValues {
+		if !re.MatchString(probe) {
+			return false
+		}
+	}
+	return true
+}
+
+func isRegexOperator(operator string) bool {
+	return operator == OperatorRegexMatch || operator == OperatorRegexNoMatch
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
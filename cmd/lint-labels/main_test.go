@@ -0,0 +1,210 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func loadLabels(t *testing.T, content string) map[string]interface{} {
+	t.Helper()
+	var data map[string]interface{}
+	if err := yaml.Unmarshal([]byte(content), &data); err != nil {
+		t.Fatalf("failed to parse YAML: %v", err)
+	}
+	return data
+}
+
+func TestLintFile_Clean(t *testing.T) {
+	data := loadLabels(t, `
+admins:
+  _rules:
+    - name: '#cluster-wide'
+      operator: '='
+      values: ['true']
+user1:
+  _rules:
+    - name: namespace
+      operator: '='
+      values: ['prod', 'staging']
+    - name: team
+      operator: '=~'
+      values: ['backend-.*']
+  _logic: AND
+`)
+
+	assert.Empty(t, lintFile(data))
+}
+
+func TestLintFile_DefaultLabel(t *testing.T) {
+	data := loadLabels(t, `
+default-label:
+  _default_label: kubernetes_namespace_name
+  _rules:
+    - operator: '='
+      values: ['prod']
+    - name: team
+      operator: '='
+      values: ['backend']
+missing-default-label:
+  _rules:
+    - operator: '='
+      values: ['prod']
+`)
+
+	findings := lintFile(data)
+	assert.Len(t, findings, 1)
+	assert.Equal(t, "missing-default-label", findings[0].Entry)
+	assert.Contains(t, findings[0].Message, "rule must have a 'name' field")
+}
+
+func TestLintFile_InvalidEntries(t *testing.T) {
+	data := loadLabels(t, `
+bad-logic:
+  _rules:
+    - name: namespace
+      operator: '='
+      values: ['prod']
+  _logic: XOR
+bad-operator:
+  _rules:
+    - name: namespace
+      operator: '=='
+      values: ['prod']
+bad-regex:
+  _rules:
+    - name: namespace
+      operator: '=~'
+      values: ['prod-(']
+simple-format:
+  prod: true
+`)
+
+	findings := lintFile(data)
+	assert.Len(t, findings, 4)
+	for _, f := range findings {
+		assert.Equal(t, SeverityError, f.Severity, f.Entry)
+	}
+	assert.Contains(t, findings[0].Message, "invalid logic")
+	assert.Contains(t, findings[1].Message, "invalid operator")
+	assert.Contains(t, findings[2].Message, "invalid regex pattern")
+	assert.Contains(t, findings[3].Message, "missing required '_rules' key")
+}
+
+func TestLintFile_Meta(t *testing.T) {
+	data := loadLabels(t, `
+annotated:
+  _meta: {owner: platform-team}
+  _rules:
+    - name: namespace
+      operator: '='
+      values: ['prod']
+      _meta: {ticket: OPS-1234, expires: 2027-01-01}
+bad-entry-meta:
+  _meta: [OPS-1234]
+  _rules:
+    - name: namespace
+      operator: '='
+      values: ['prod']
+bad-rule-meta:
+  _rules:
+    - name: namespace
+      operator: '='
+      values: ['prod']
+      _meta: {owners: [a, b]}
+`)
+
+	findings := lintFile(data)
+	assert.Len(t, findings, 2)
+	assert.Equal(t, "bad-entry-meta", findings[0].Entry)
+	assert.Contains(t, findings[0].Message, "_meta must be a map")
+	assert.Equal(t, "bad-rule-meta", findings[1].Entry)
+	assert.Contains(t, findings[1].Message, `_meta "owners" must be a string, number or boolean`)
+}
+
+func TestCheckRedundantClusterWide(t *testing.T) {
+	policy := LabelPolicy{
+		Rules: []LabelRule{
+			{Name: clusterWideLabel, Operator: OperatorEquals, Values: []string{"true"}},
+			{Name: "namespace", Operator: OperatorEquals, Values: []string{"prod"}},
+		},
+		Logic: LogicAND,
+	}
+
+	warnings := checkRedundantClusterWide(policy)
+	assert.Equal(t, []string{"cluster-wide access makes rules on namespace redundant"}, warnings)
+
+	policy.Rules = policy.Rules[:1]
+	assert.Empty(t, checkRedundantClusterWide(policy))
+}
+
+func TestCheckBroadRegex(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     LabelRule
+		expected string
+	}{
+		{name: "match all", rule: LabelRule{Name: "namespace", Operator: OperatorRegexMatch, Values: []string{".*"}}, expected: "matches every value"},
+		{name: "match all non-empty", rule: LabelRule{Name: "namespace", Operator: OperatorRegexMatch, Values: []string{"prod", ".+"}}, expected: "matches every value"},
+		{name: "exclude all", rule: LabelRule{Name: "namespace", Operator: OperatorRegexNoMatch, Values: []string{"^.*$"}}, expected: "excludes every value"},
+		{name: "narrow pattern", rule: LabelRule{Name: "namespace", Operator: OperatorRegexMatch, Values: []string{"prod-.*"}}},
+		{name: "literal dot star", rule: LabelRule{Name: "namespace", Operator: OperatorEquals, Values: []string{".*"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			warnings := checkBroadRegex(LabelPolicy{Rules: []LabelRule{tt.rule}, Logic: LogicAND})
+			if tt.expected == "" {
+				assert.Empty(t, warnings)
+				return
+			}
+			assert.Len(t, warnings, 1)
+			assert.Contains(t, warnings[0], tt.expected)
+		})
+	}
+}
+
+func TestCheckUnreachableDeny(t *testing.T) {
+	rules := []LabelRule{
+		{Name: "namespace", Operator: OperatorEquals, Values: []string{"prod", "staging"}},
+		{Name: "namespace", Operator: OperatorNotEquals, Values: []string{"staging", "dev"}},
+	}
+
+	warnings := checkUnreachableDeny(LabelPolicy{Rules: rules, Logic: LogicAND})
+	assert.Equal(t, []string{`namespace!="dev" is unreachable: namespace is already restricted to prod, staging`}, warnings)
+
+	// With OR logic the deny rule grants access on its own and is reachable
+	assert.Empty(t, checkUnreachableDeny(LabelPolicy{Rules: rules, Logic: LogicOR}))
+
+	// Deny rules on labels without an allow list are reachable
+	assert.Empty(t, checkUnreachableDeny(LabelPolicy{Rules: []LabelRule{
+		{Name: "namespace", Operator: OperatorEquals, Values: []string{"prod"}},
+		{Name: "team", Operator: OperatorNotEquals, Values: []string{"external"}},
+	}, Logic: LogicAND}))
+}
+
+func TestLintFile_ReportsWarningsWithEntryNames(t *testing.T) {
+	data := loadLabels(t, `
+broad:
+  _rules:
+    - name: namespace
+      operator: '=~'
+      values: ['.*']
+mixed:
+  _rules:
+    - name: '#cluster-wide'
+      operator: '='
+      values: ['true']
+    - name: team
+      operator: '='
+      values: ['backend']
+`)
+
+	findings := lintFile(data)
+	assert.Len(t, findings, 2)
+	assert.Equal(t, "broad", findings[0].Entry)
+	assert.Equal(t, SeverityWarning, findings[0].Severity)
+	assert.Equal(t, "mixed", findings[1].Entry)
+	assert.Contains(t, findings[1].String(), "WARN  mixed: cluster-wide access makes rules on team redundant")
+}
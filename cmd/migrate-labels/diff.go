@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// diffEntries returns a per-entry diff of the input labels and their converted form, sorted
+// by entry name. Entries the conversion leaves unchanged are omitted.
+func diffEntries(data, converted map[string]interface{}) (string, error) {
+	names := make([]string, 0, len(data))
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		newValue, ok := converted[name]
+		if ok && reflect.DeepEqual(data[name], newValue) {
+			continue
+		}
+
+		fmt.Fprintf(&b, "@@ %s @@\n", name)
+		if err := writeDiffLines(&b, "- ", name, data[name]); err != nil {
+			return "", err
+		}
+		// Entries that are not maps are dropped by the conversion
+		if ok {
+			if err := writeDiffLines(&b, "+ ", name, newValue); err != nil {
+				return "", err
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+// writeDiffLines writes the YAML of an entry with every line prefixed.
+func writeDiffLines(b *strings.Builder, prefix, name string, value interface{}) error {
+	out, err := yaml.Marshal(map[string]interface{}{name: value})
+	if err != nil {
+		return fmt.Errorf("failed to generate YAML for %s: %w", name, err)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(string(out), "\n"), "\n") {
+		b.WriteString(prefix + line + "\n")
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -32,7 +33,9 @@ func main() {
 	output := flag.String("output", "", "Path to output labels.yaml file (default: input-extended.yaml)")
 	defaultLabel := flag.String("default-label", "namespace", "Default label name for simple format conversion")
 	dryRun := flag.Bool("dry-run", false, "Print conversion without writing to file")
+	diff := flag.Bool("diff", false, "Print a per-entry diff of the conversion without writing to file")
 	validate := flag.Bool("validate", false, "Validate input file without conversion")
+	failOnInvalid := flag.Bool("fail-on-invalid", false, "Exit with an error, writing nothing, if a converted entry would be rejected by the proxy")
 	flag.Parse()
 
 	if *input == "" {
@@ -93,10 +96,34 @@ func main() {
 		log.Fatal().Err(err).Msg("Failed to generate YAML")
 	}
 
+	// Check the converted entries the way the proxy parses them
+	invalid, err := validateOutput(outputData)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to validate converted YAML")
+	}
+	if len(invalid) > 0 {
+		printValidationErrors(invalid)
+		if *failOnInvalid {
+			os.Exit(1)
+		}
+	}
+
+	// Diff mode
+	if *diff {
+		diffOutput, err := diffEntries(data, converted)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to generate diff")
+		}
+		fmt.Println("\n--- Conversion diff (dry run) ---")
+		fmt.Print(diffOutput)
+	}
+
 	// Dry run mode
 	if *dryRun {
 		fmt.Println("\n--- Converted YAML (dry run) ---")
 		fmt.Println(string(outputData))
+	}
+	if *diff || *dryRun {
 		return
 	}
 
@@ -173,6 +200,7 @@ func convertToExtended(data map[string]interface{}, defaultLabel string) (map[st
 			for labelKey := range m {
 				values = append(values, labelKey)
 			}
+			sort.Strings(values)
 
 			if len(values) > 0 {
 				rules = append(rules, LabelRule{
@@ -193,6 +221,13 @@ func convertToExtended(data map[string]interface{}, defaultLabel string) (map[st
 	return result, stats
 }
 
+func printValidationErrors(invalid []ValidationError) {
+	fmt.Printf("\n⚠️  WARNING: %d converted entries would be rejected by the proxy:\n", len(invalid))
+	for _, e := range invalid {
+		fmt.Printf("  %s\n", e)
+	}
+}
+
 func printStats(stats Stats) {
 	fmt.Println("\n--- Migration Statistics ---")
 	fmt.Printf("Total entries:     %d\n", stats.TotalEntries)
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func loadLabels(t *testing.T, content string) map[string]interface{} {
+	t.Helper()
+	var data map[string]interface{}
+	if err := yaml.Unmarshal([]byte(content), &data); err != nil {
+		t.Fatalf("failed to parse YAML: %v", err)
+	}
+	return data
+}
+
+// migrate converts the labels and validates the YAML the tool would write.
+func migrate(t *testing.T, content, defaultLabel string) []ValidationError {
+	t.Helper()
+	converted, _ := convertToExtended(loadLabels(t, content), defaultLabel)
+	outputData, err := yaml.Marshal(converted)
+	assert.NoError(t, err)
+	invalid, err := validateOutput(outputData)
+	assert.NoError(t, err)
+	return invalid
+}
+
+func TestValidateOutput_Valid(t *testing.T) {
+	invalid := migrate(t, `
+user1:
+  hogarama: true
+  prod: true
+extended:
+  _default_label: team
+  _rules:
+    - operator: '=~'
+      values: ['backend-.*']
+      _meta: {ticket: OPS-1}
+  _logic: OR
+admins:
+  _rules:
+    - name: '#cluster-wide'
+      operator: '='
+      values: ['true']
+`, "namespace")
+
+	assert.Empty(t, invalid)
+}
+
+func TestValidateOutput_Invalid(t *testing.T) {
+	invalid := migrate(t, `
+user1:
+  prod: true
+empty: {}
+legacy-admins:
+  '#cluster-wide': true
+bad-regex:
+  _rules:
+    - name: namespace
+      operator: '=~'
+      values: ['prod-(']
+bad-operator:
+  _rules:
+    - name: namespace
+      operator: '=='
+      values: ['prod']
+bad-logic:
+  _rules:
+    - name: namespace
+      operator: '='
+      values: ['prod']
+  _logic: XOR
+bad-meta:
+  _meta: {owners: [a, b]}
+  _rules:
+    - name: namespace
+      operator: '='
+      values: ['prod']
+`, "namespace")
+
+	assert.Equal(t, []ValidationError{
+		{Entry: "bad-logic", Message: `invalid policy: invalid logic "XOR": must be AND or OR`},
+		{Entry: "bad-meta", Message: `_meta "owners" must be a string, number or boolean`},
+		{Entry: "bad-operator", Message: `rule 0: invalid operator "==": must be one of =, !=, =~, !~`},
+		{Entry: "bad-regex", Message: "rule 0: invalid regex pattern \"prod-(\": error parsing regexp: missing closing ): `prod-(`"},
+		{Entry: "empty", Message: "invalid policy: label policy must have at least one rule"},
+		{Entry: "legacy-admins", Message: "missing required '_rules' key in label policy"},
+	}, invalid)
+}
+
+func TestValidateOutput_EmptyDefaultLabel(t *testing.T) {
+	invalid := migrate(t, `
+user1:
+  prod: true
+`, "")
+
+	assert.Equal(t, []ValidationError{
+		{Entry: "user1", Message: "rule 0: rule must have a 'name' field"},
+	}, invalid)
+}
+
+func TestDiffEntries(t *testing.T) {
+	data := loadLabels(t, `
+user1:
+  prod: true
+  hogarama: true
+extended:
+  _rules:
+    - name: namespace
+      operator: '='
+      values: ['dev']
+admins:
+  '#cluster-wide': true
+broken: null
+`)
+	converted, stats := convertToExtended(data, "namespace")
+	assert.Equal(t, 1, stats.Converted)
+
+	diff, err := diffEntries(data, converted)
+	assert.NoError(t, err)
+	assert.Equal(t, `@@ broken @@
+- broken: null
+@@ user1 @@
+- user1:
+-     hogarama: true
+-     prod: true
++ user1:
++     _logic: AND
++     _rules:
++         - name: namespace
++           operator: =
++           values:
++             - hogarama
++             - prod
+`, diff)
+}
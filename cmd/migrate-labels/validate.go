@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ValidationError is an entry of the converted file that the proxy would reject when
+// loading it.
+type ValidationError struct {
+	Entry   string
+	Message string
+}
+
+func (e ValidationError) String() string {
+	return fmt.Sprintf("%s: %s", e.Entry, e.Message)
+}
+
+// validateOutput parses the converted YAML the way the proxy loads labels.yaml and returns
+// the entries it would reject, sorted by entry name.
+func validateOutput(outputData []byte) ([]ValidationError, error) {
+	var data map[string]interface{}
+	if err := yaml.Unmarshal(outputData, &data); err != nil {
+		return nil, fmt.Errorf("failed to parse converted YAML: %w", err)
+	}
+
+	names := make([]string, 0, len(data))
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var invalid []ValidationError
+	for _, name := range names {
+		entry, ok := data[name].(map[string]interface{})
+		if !ok {
+			invalid = append(invalid, ValidationError{Entry: name, Message: "entry must be a map"})
+			continue
+		}
+		if err := parseEntry(entry); err != nil {
+			invalid = append(invalid, ValidationError{Entry: name, Message: err.Error()})
+		}
+	}
+	return invalid, nil
+}
+
+// parseEntry applies the validation of the proxy's PolicyParser.ParseUserPolicy to an
+// extended format entry.
+func parseEntry(entry map[string]interface{}) error {
+	rulesData, ok := entry["_rules"]
+	if !ok {
+		return fmt.Errorf("missing required '_rules' key in label policy")
+	}
+
+	defaultLabel := ""
+	if labelData, ok := entry["_default_label"]; ok {
+		label, ok := labelData.(string)
+		if !ok || label == "" {
+			return fmt.Errorf("_default_label must be a non-empty string")
+		}
+		defaultLabel = label
+	}
+
+	if metaData, ok := entry["_meta"]; ok {
+		if err := validateMeta(metaData); err != nil {
+			return err
+		}
+	}
+
+	rulesArray, ok := rulesData.([]interface{})
+	if !ok {
+		return fmt.Errorf("_rules must be an array")
+	}
+	if len(rulesArray) == 0 {
+		return fmt.Errorf("invalid policy: label policy must have at least one rule")
+	}
+	for i, ruleData := range rulesArray {
+		ruleMap, ok := ruleData.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("rule %d: must be a map", i)
+		}
+		if err := parseRule(ruleMap, defaultLabel); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+
+	logic := "AND"
+	if logicData, ok := entry["_logic"].(string); ok {
+		logic = logicData
+	}
+	if logic != "AND" && logic != "OR" {
+		return fmt.Errorf("invalid policy: invalid logic %q: must be AND or OR", logic)
+	}
+	return nil
+}
+
+// parseRule applies the validation of the proxy's PolicyParser to a rule map.
+func parseRule(ruleMap map[string]interface{}, defaultLabel string) error {
+	name, ok := ruleMap["name"].(string)
+	if _, hasName := ruleMap["name"]; !hasName && defaultLabel != "" {
+		name, ok = defaultLabel, true
+	}
+	if !ok || name == "" {
+		return fmt.Errorf("rule must have a 'name' field")
+	}
+
+	operator, ok := ruleMap["operator"].(string)
+	if !ok || operator == "" {
+		return fmt.Errorf("rule must have an 'operator' field")
+	}
+	switch operator {
+	case "=", "!=", "=~", "!~":
+	default:
+		return fmt.Errorf("invalid operator %q: must be one of =, !=, =~, !~", operator)
+	}
+
+	valuesData, ok := ruleMap["values"]
+	if !ok {
+		return fmt.Errorf("rule must have a 'values' field")
+	}
+	valuesArray, ok := valuesData.([]interface{})
+	if !ok {
+		return fmt.Errorf("'values' must be an array")
+	}
+	if len(valuesArray) == 0 {
+		return fmt.Errorf("label rule must have at least one value")
+	}
+	for i, v := range valuesArray {
+		value, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("value %d must be a string", i)
+		}
+		if operator == "=~" || operator == "!~" {
+			if _, err := regexp.Compile(value); err != nil {
+				return fmt.Errorf("invalid regex pattern %q: %w", value, err)
+			}
+		}
+	}
+
+	if metaData, ok := ruleMap["_meta"]; ok {
+		if err := validateMeta(metaData); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateMeta checks that _meta is a map of scalar annotations.
+func validateMeta(data interface{}) error {
+	meta, ok := data.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("_meta must be a map")
+	}
+	for key, value := range meta {
+		switch value.(type) {
+		case nil, map[string]interface{}, []interface{}:
+			return fmt.Errorf("_meta %q must be a string, number or boolean", key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// coalescedRequestsTotal counts requests answered with the response of an identical request
+// already in flight instead of their own upstream request.
+var coalescedRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "lgtm_lbac_proxy",
+	Name:      "coalesced_requests_total",
+	Help:      "Total number of requests served from the upstream response of an identical concurrent request.",
+}, []string{"upstream"})
+
+// coalescedResponse is an upstream response buffered to be written to every coalesced request.
+type coalescedResponse struct {
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (c *coalescedResponse) Header() http.Header { return c.header }
+
+func (c *coalescedResponse) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	return c.body.Write(p)
+}
+
+func (c *coalescedResponse) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+}
+
+// coalesceKeyHeaders are the request headers that can change the upstream response. Other
+// headers, such as the request ID or trace context, differ between otherwise identical
+// requests and are not part of the coalescing key.
+var coalesceKeyHeaders = []string{"Accept", "Accept-Encoding", "Authorization", "X-Scope-OrgID"}
+
+// coalesceKey identifies requests that the upstream answers identically: the same enforced
+// request, sent with the same credentials and tenant, for users with the same label policy
+// (nil for users bypassing enforcement).
+func coalesceKey(upstream string, r *http.Request, policy *LabelPolicy) string {
+	scope := "bypass"
+	if policy != nil {
+		scope = fmt.Sprint(policy.Logic, policy.Rules)
+	}
+	parts := []string{upstream, scope, r.URL.Path, r.URL.RawQuery}
+	for _, header := range coalesceKeyHeaders {
+		parts = append(parts, strings.Join(r.Header.Values(header), ","))
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// requestDeadline returns the deadline of r, set by handlerWithProxy from the timeout of
+// the route, or the given timeout from now if r has none.
+func requestDeadline(r *http.Request, timeout time.Duration) time.Time {
+	if deadline, ok := r.Context().Deadline(); ok {
+		return deadline
+	}
+	return time.Now().Add(timeout)
+}
+
+// serveCoalesced proxies r like proxy.ServeHTTP, but concurrent identical GET requests share
+// a single upstream request, whose buffered response is written to each of them. The shared
+// request is detached from the cancellation of the request that started it, so that the
+// others still get the response if that client goes away; it keeps the request deadline.
+// Other methods are proxied unchanged.
+func (a *App) serveCoalesced(w http.ResponseWriter, r *http.Request, proxy *upstreamProxy, upstream string, policy *LabelPolicy) {
+	if r.Method != http.MethodGet {
+		proxy.ServeHTTP(w, r)
+		return
+	}
+
+	leader := false
+	result := a.coalesced.DoChan(coalesceKey(upstream, r, policy), func() (interface{}, error) {
+		leader = true
+		ctx, cancel := context.WithDeadline(context.WithoutCancel(r.Context()), requestDeadline(r, proxy.cfg.RequestTimeout))
+		defer cancel()
+		resp := &coalescedResponse{header: make(http.Header)}
+		proxy.ServeHTTP(resp, r.WithContext(ctx))
+		return resp, nil
+	})
+
+	var resp *coalescedResponse
+	select {
+	case res := <-result:
+		resp = res.Val.(*coalescedResponse)
+	case <-r.Context().Done():
+		logAndWriteError(w, http.StatusGatewayTimeout, r.Context().Err(), "")
+		return
+	}
+	if !leader {
+		coalescedRequestsTotal.WithLabelValues(upstream).Inc()
+	}
+
+	for k, v := range resp.header {
+		w.Header()[k] = append([]string(nil), v...)
+	}
+	status := resp.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	_, _ = w.Write(resp.body.Bytes())
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoalesceRequests(t *testing.T) {
+	tests := []struct {
+		name      string
+		coalesce  bool
+		sameQuery bool
+		wantCalls int32
+	}{
+		{name: "identical requests are coalesced", coalesce: true, sameQuery: true, wantCalls: 1},
+		{name: "different queries are not coalesced", coalesce: true, sameQuery: false, wantCalls: 5},
+		{name: "disabled", coalesce: false, sameQuery: true, wantCalls: 5},
+	}
+
+	app, tokens := setupTestMain()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const n = 5
+			var calls atomic.Int32
+			arrived := make(chan struct{}, n)
+			release := make(chan struct{})
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				arrived <- struct{}{}
+				<-release
+				_, _ = fmt.Fprint(w, r.URL.Query().Get("query"))
+			}))
+			defer upstream.Close()
+
+			app.Cfg.Loki.URL = upstream.URL
+			app.Cfg.Loki.CoalesceRequests = tt.coalesce
+			app.WithProxies()
+			app.WithRoutes()
+
+			var wg sync.WaitGroup
+			recorders := make([]*httptest.ResponseRecorder, n)
+			for i := range n {
+				query := `{app="api"}`
+				if !tt.sameQuery {
+					query = fmt.Sprintf(`{app="api%d"}`, i)
+				}
+				req := httptest.NewRequest(http.MethodGet, "/loki/api/v1/query_range?query="+query, nil)
+				req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+				req.Header.Set(RequestIDHeader, fmt.Sprintf("coalesce-%d", i))
+				recorders[i] = httptest.NewRecorder()
+				wg.Add(1)
+				go func(rr *httptest.ResponseRecorder) {
+					defer wg.Done()
+					app.e.ServeHTTP(rr, req)
+				}(recorders[i])
+			}
+
+			for range tt.wantCalls {
+				select {
+				case <-arrived:
+				case <-time.After(5 * time.Second):
+					t.Fatal("upstream was not called")
+				}
+			}
+			// Give the remaining requests time to join the one in flight.
+			time.Sleep(100 * time.Millisecond)
+			close(release)
+			wg.Wait()
+
+			assert.Equal(t, tt.wantCalls, calls.Load())
+			for i, rr := range recorders {
+				assert.Equal(t, http.StatusOK, rr.Code)
+				if tt.sameQuery {
+					assert.Equal(t, `{app="api", tenant_id=~"allowed_user|also_allowed_user"}`, rr.Body.String())
+				} else {
+					assert.Equal(t, fmt.Sprintf(`{app="api%d", tenant_id=~"allowed_user|also_allowed_user"}`, i), rr.Body.String())
+				}
+			}
+		})
+	}
+}
@@ -5,19 +5,30 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"fmt"
 	"github.com/fsnotify/fsnotify"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
+	"maps"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 )
 
 type LogConfig struct {
 	Level int `mapstructure:"level"`
+
+	// LogDeniedQueries logs every query denied by enforcement at warn level with the user,
+	// the denied label and value, and the upstream, e.g. to alert on access probing.
+	LogDeniedQueries bool `mapstructure:"log_denied_queries"`
 }
 
 // ClaimsConfig defines the JWT claim field names to extract from tokens.
@@ -35,15 +46,109 @@ type AuthConfig struct {
 	AuthHeader  string       `mapstructure:"auth_header"`   // HTTP header containing the JWT token
 	AuthScheme  string       `mapstructure:"auth_scheme"`   // Authentication scheme/prefix (e.g., "Bearer")
 	Claims      ClaimsConfig `mapstructure:"claims"`        // JWT claim field names
+
+	// JWKS request settings. The proxy does not start until every JWKS endpoint has been
+	// fetched; failed initial fetches are retried JwksRetries times with a backoff starting
+	// at JwksRetryBackoff and doubling per retry. Zero values use the defaults.
+	JwksTimeout      time.Duration `mapstructure:"jwks_timeout"`       // Timeout of each JWKS request (default: 10s)
+	JwksRetries      int           `mapstructure:"jwks_retries"`       // Retries of a failed initial fetch (default: 3)
+	JwksRetryBackoff time.Duration `mapstructure:"jwks_retry_backoff"` // Wait before the first retry (default: 1s)
+	// JwksStaleGrace bounds how long the last known keys of a JWKS endpoint are used once
+	// its hourly refresh fails; tokens signed with them are denied afterwards. Zero keeps
+	// using them until a refresh succeeds.
+	JwksStaleGrace time.Duration `mapstructure:"jwks_stale_grace"`
+
+	// ForwardedTokenHeader is an optional header carrying a raw access token set by an
+	// authenticating reverse proxy (e.g., "X-Forwarded-Access-Token" from oauth2-proxy).
+	// It is consulted only when the primary auth header is absent. Disabled when empty.
+	ForwardedTokenHeader string `mapstructure:"forwarded_token_header"`
+
+	// GroupMappings derive and transform the groups used for policy lookup. Each mapping
+	// reads a claim and contributes its transformed values. Values of the groups claim are
+	// used unchanged unless a mapping reads that claim.
+	GroupMappings []GroupMapping `mapstructure:"group_mappings"`
+
+	// RequiredScopes are OAuth scopes every token must carry, read from the "scope" or "scp"
+	// claim. Upstreams can override them with their own required_scopes.
+	RequiredScopes []string `mapstructure:"required_scopes"`
+
+	// MaxTokenAge rejects tokens issued ("iat" claim) longer ago than this, even if they are
+	// not expired, to limit the reuse of stale tokens. Tokens without "iat" are rejected when
+	// set. Disabled when zero.
+	MaxTokenAge time.Duration `mapstructure:"max_token_age"`
+
+	// GrafanaHeaders derives identities from Grafana data source proxy headers sent from
+	// trusted addresses, bypassing JWT validation. Disabled unless trusted CIDRs are set.
+	GrafanaHeaders GrafanaHeadersConfig `mapstructure:"grafana_headers"`
+
+	// TokenErrorStatus overrides the status of requests rejected for their token per failure
+	// reason (missing, malformed, expired, signature_invalid, invalid), e.g. 401 for expired
+	// tokens so clients refresh them. Reasons not listed are answered with 403 Forbidden.
+	TokenErrorStatus map[string]int `mapstructure:"token_error_status"`
+}
+
+// GrafanaHeadersConfig derives identities from the headers Grafana sends on data source
+// proxy requests instead of a JWT. The headers are only trusted on connections from the
+// trusted CIDRs; requests from other addresses carrying them are rejected.
+type GrafanaHeadersConfig struct {
+	TrustedCIDRs []string `mapstructure:"trusted_cidrs"` // Addresses of Grafana, enables the identity source when set
+	UserHeader   string   `mapstructure:"user_header"`   // Header carrying the username (default: X-Grafana-User)
+	GroupsHeader string   `mapstructure:"groups_header"` // Header carrying comma-separated groups (optional)
+
+	trustedPrefixes []netip.Prefix // Parsed TrustedCIDRs
+}
+
+// GroupMapping transforms the values of a JWT claim into groups. Transforms are applied in
+// field order: the prefix is stripped, the value is lowercased, then renamed.
+type GroupMapping struct {
+	Claim       string            `mapstructure:"claim"`        // Claim to read (default: the groups claim)
+	StripPrefix string            `mapstructure:"strip_prefix"` // Prefix removed from values that have it (e.g., "role:")
+	Lowercase   bool              `mapstructure:"lowercase"`    // Lowercase values
+	Rename      map[string]string `mapstructure:"rename"`       // Exact renames (e.g., admin -> admins)
 }
 
 type WebConfig struct {
-	ProxyPort           int    `mapstructure:"proxy_port"`
-	MetricsPort         int    `mapstructure:"metrics_port"`
-	Host                string `mapstructure:"host"`
-	TLSVerifySkip       bool   `mapstructure:"tls_verify_skip"`
-	TrustedRootCaPath   string `mapstructure:"trusted_root_ca_path"`
-	ServiceAccountToken string `mapstructure:"service_account_token"`
+	ProxyPort     int    `mapstructure:"proxy_port"`
+	MetricsPort   int    `mapstructure:"metrics_port"`
+	Host          string `mapstructure:"host"`
+	ProxySocket   string `mapstructure:"proxy_socket"`   // Unix domain socket to listen on instead of proxy_port
+	MetricsSocket string `mapstructure:"metrics_socket"` // Unix domain socket to listen on instead of metrics_port
+
+	// Timeouts of the proxy and metrics servers. The read header timeout guards against
+	// clients holding connections open by sending headers slowly; read and write timeouts
+	// also cut off long range queries and tail connections, so they are disabled by default.
+	ReadHeaderTimeout   time.Duration `mapstructure:"read_header_timeout"` // Time to read request headers, negative disables (default: 10s)
+	ReadTimeout         time.Duration `mapstructure:"read_timeout"`        // Time to read the whole request (default: none)
+	WriteTimeout        time.Duration `mapstructure:"write_timeout"`       // Time to write the response after reading the headers (default: none)
+	IdleTimeout         time.Duration `mapstructure:"idle_timeout"`        // Time a keep-alive connection may be idle, negative disables (default: 2m)
+	TLSVerifySkip       bool          `mapstructure:"tls_verify_skip"`
+	TrustedRootCaPath   string        `mapstructure:"trusted_root_ca_path"`
+	ServiceAccountToken string        `mapstructure:"service_account_token"`
+
+	// Maintenance mode rejects all proxy requests with 503 while /healthz keeps reporting
+	// process health. It is read per request, so it can be toggled via config reload.
+	MaintenanceMode       bool   `mapstructure:"maintenance_mode"`
+	MaintenanceRetryAfter int    `mapstructure:"maintenance_retry_after"` // Retry-After in seconds (default: 300)
+	MaintenanceMessage    string `mapstructure:"maintenance_message"`     // Response body (default: DefaultMaintenanceMessage)
+
+	NotFoundFormat string `mapstructure:"not_found_format"` // Body format of 404 responses for unknown paths: text (default) or json
+
+	// MaxRegexLength is the maximum length of regex values in policies and queries, guarding
+	// against expensive patterns (default: DefaultMaxRegexLength).
+	MaxRegexLength int `mapstructure:"max_regex_length"`
+
+	// AnchorRegexValues anchors the regex values of queries and filters built from policies as
+	// ^(...)$, preventing partial matches where regexes are not fully anchored, as in TraceQL.
+	AnchorRegexValues bool `mapstructure:"anchor_regex_values"`
+
+	// DeniedMessage replaces the body of 403 responses to authorization failures, e.g. to link
+	// to an access request form. It is a template of deniedMessageData ({{.Label}}, {{.Value}},
+	// {{.Username}}, {{.Upstream}}, {{.Error}}). Upstreams can override it. Empty keeps the error.
+	DeniedMessage string `mapstructure:"denied_message"`
+
+	// StrictConfig rejects configuration keys that do not match a configuration field, so
+	// that misspelled keys fail at startup instead of silently falling back to defaults.
+	StrictConfig bool `mapstructure:"strict_config"`
 
 	// DEPRECATED: These fields are deprecated in favor of AuthConfig.
 	// They are kept for backward compatibility and will be removed in a future version.
@@ -57,6 +162,9 @@ type WebConfig struct {
 type AdminConfig struct {
 	Bypass bool   `mapstructure:"bypass"`
 	Group  string `mapstructure:"group"`
+	// ForbiddenTenants are tenants admins may not query even with Bypass. Their queries are
+	// then enforced with a policy excluding these values of the upstream's tenant label(s).
+	ForbiddenTenants []string `mapstructure:"forbidden_tenants"`
 }
 
 type AlertConfig struct {
@@ -64,6 +172,11 @@ type AlertConfig struct {
 	TokenHeader string `mapstructure:"token_header"`
 	CertURL     string `mapstructure:"alert_cert_url"`
 	Cert        string `mapstructure:"alert_cert"`
+
+	// AllowedPaths restricts the alert token header to requests whose path matches one of
+	// these patterns (path.Match syntax, e.g. /api/v1/query or /loki/api/v1/*). Empty accepts
+	// it on every path.
+	AllowedPaths []string `mapstructure:"allowed_paths"`
 }
 
 type DevConfig struct {
@@ -71,6 +184,19 @@ type DevConfig struct {
 	Username string `mapstructure:"username"`
 }
 
+// DebugConfig lets trusted clients raise the log level of single requests, e.g. to trace a
+// failing query without changing log.level for all requests.
+type DebugConfig struct {
+	// AllowHeaderLogLevel accepts Header with a log level (e.g., "trace" or "debug") on
+	// requests from TrustedCIDRs, which are then logged with a request-scoped logger at that
+	// level. It is only applied at startup, not on config reload.
+	AllowHeaderLogLevel bool     `mapstructure:"allow_header_log_level"`
+	Header              string   `mapstructure:"header"`        // Header carrying the log level (default: X-LBAC-Debug)
+	TrustedCIDRs        []string `mapstructure:"trusted_cidrs"` // Addresses the header is accepted from; without any it is never accepted
+
+	trustedPrefixes []netip.Prefix // Parsed TrustedCIDRs
+}
+
 // ProxyConfig contains HTTP client transport and timeout configuration for reverse proxy operations.
 // These settings optimize connection pooling and request handling for high-throughput scenarios.
 type ProxyConfig struct {
@@ -80,36 +206,204 @@ type ProxyConfig struct {
 	MaxIdleConns        int           `mapstructure:"max_idle_conns"`          // Total idle connections across all upstreams
 	MaxIdleConnsPerHost int           `mapstructure:"max_idle_conns_per_host"` // Idle connections per upstream
 	ForceHTTP2          bool          `mapstructure:"force_http2"`             // Enable HTTP/2 when available
+	KeepAlive           time.Duration `mapstructure:"keep_alive"`              // Interval of TCP keep-alive probes on upstream connections; negative disables them
+	HTTP2PingInterval   time.Duration `mapstructure:"http2_ping_interval"`     // Send an HTTP/2 ping after this long without frames to detect dead connections; 0 disables
+	FlushInterval       time.Duration `mapstructure:"flush_interval"`          // Interval for flushing response data to the client; negative flushes after every write
+	TLSMinVersion       string        `mapstructure:"tls_min_version"`         // Minimum TLS version for upstream connections: 1.0, 1.1, 1.2 or 1.3
+	TLSCipherSuites     []string      `mapstructure:"tls_cipher_suites"`       // Allowed TLS 1.0-1.2 cipher suites by IANA name; empty uses Go defaults
+	RetryAttempts       int           `mapstructure:"retry_attempts"`          // Retries of failed GET and HEAD requests; 0 disables retries
+	RetryBackoff        time.Duration `mapstructure:"retry_backoff"`           // Wait before each retry
+	RetryOnStatus       []int         `mapstructure:"retry_on_status"`         // Upstream statuses retried, besides connection errors (default: 502, 503, 504)
+	BreakerThreshold    int           `mapstructure:"breaker_threshold"`       // Consecutive failures opening the circuit breaker; 0 disables it
+	BreakerCooldown     time.Duration `mapstructure:"breaker_cooldown"`        // Time the open breaker answers 503 before letting a trial request through
+	BreakerOnStatus     []int         `mapstructure:"breaker_on_status"`       // Upstream statuses counted as failures, besides connection errors (default: 500, 502, 503, 504)
+
+	// RouteTimeouts overrides RequestTimeout for routes, keyed by route pattern (e.g.,
+	// /api/v1/query_range or /loki/api/v1/labels). Upstream entries add to the global ones.
+	RouteTimeouts map[string]time.Duration `mapstructure:"route_timeouts"`
+}
+
+// requestTimeout returns the timeout of requests to the route with the given pattern.
+func (c ProxyConfig) requestTimeout(route string) time.Duration {
+	if timeout := c.RouteTimeouts[strings.ToLower(route)]; timeout > 0 {
+		return timeout
+	}
+	return c.RequestTimeout
+}
+
+// mergeRouteTimeouts returns a copy of base with the timeouts of overrides added, keyed by
+// lowercased route pattern as configuration keys are case-insensitive.
+func mergeRouteTimeouts(base, overrides map[string]time.Duration) map[string]time.Duration {
+	merged := make(map[string]time.Duration, len(base)+len(overrides))
+	maps.Copy(merged, base)
+	for route, timeout := range overrides {
+		merged[strings.ToLower(route)] = timeout
+	}
+	return merged
 }
 
 type ThanosConfig struct {
-	URL          string            `mapstructure:"url"`
-	UseMutualTLS bool              `mapstructure:"use_mutual_tls"`
-	Cert         string            `mapstructure:"cert"`
-	Key          string            `mapstructure:"key"`
-	Headers      map[string]string `mapstructure:"headers"`
-	ActorHeader  string            `mapstructure:"actor_header"`
-	Proxy        *ProxyConfig      `mapstructure:"proxy"` // Per-upstream proxy configuration override
+	URL                    string            `mapstructure:"url"`
+	UseMutualTLS           bool              `mapstructure:"use_mutual_tls"`
+	AuthMode               string            `mapstructure:"auth_mode"`            // Upstream credential: sat, static_token, mtls or none (default: sat, or mtls with use_mutual_tls)
+	StaticToken            string            `mapstructure:"static_token"`         // Bearer token sent with auth_mode static_token
+	ClientAuthorization    string            `mapstructure:"client_authorization"` // Client Authorization header: strip, replace or forward (default: replace with sat and static_token, forward otherwise)
+	Cert                   string            `mapstructure:"cert"`
+	Key                    string            `mapstructure:"key"`
+	Headers                map[string]string `mapstructure:"headers"`
+	ActorHeader            string            `mapstructure:"actor_header"`
+	ActorFormat            string            `mapstructure:"actor_format"`             // Actor header value format: base64 (default), plain, username, email, or a template
+	ActorClaim             []string          `mapstructure:"actor_claim"`              // Token claims whose values identify the actor instead of username and email, joined by ":"
+	QueryJSONPath          string            `mapstructure:"query_json_path"`          // Dot-separated path to the query in JSON POST bodies (e.g., "queries.*.expr")
+	NormalizeTrailingSlash string            `mapstructure:"normalize_trailing_slash"` // Trailing slash handling before forwarding: add, strip, or empty to leave paths unchanged
+	RequiredScopes         []string          `mapstructure:"required_scopes"`          // OAuth scopes required for this upstream; overrides auth.required_scopes
+	ExtraQueryParams       map[string]string `mapstructure:"extra_query_params"`       // Query parameters added to upstream requests that do not set them (e.g., dedup: "true")
+	RewriteErrorResponses  bool              `mapstructure:"rewrite_error_responses"`  // Rewrite non-JSON error responses (e.g., HTML error pages) into a JSON error, keeping the status
+	DeniedMessage          string            `mapstructure:"denied_message"`           // Body of 403 responses to authorization failures; overrides web.denied_message
+	CoalesceRequests       bool              `mapstructure:"coalesce_requests"`        // Share one upstream request among concurrent identical GET requests of users with the same policy
+	Proxy                  *ProxyConfig      `mapstructure:"proxy"`                    // Per-upstream proxy configuration override
+
+	AllowedUserLabels   []string `mapstructure:"allowed_user_labels"`   // Non-policy labels users may filter on; empty allows any
+	ForbiddenUserLabels []string `mapstructure:"forbidden_user_labels"` // Non-policy labels users may never filter on
+
+	// TenantLabelOperators are the operators users may apply to the tenant label and the other
+	// labels of their policy (e.g., [=, =~] to reject negations); LabelOperators those they
+	// may apply to all other labels. Empty allows any operator.
+	TenantLabelOperators []string `mapstructure:"tenant_label_operators"`
+	LabelOperators       []string `mapstructure:"label_operators"`
+
+	// TenantLabel is the label tenants are isolated by on this upstream (e.g. namespace).
+	// Policies without a rule on it are logged, and rejected with DenyMissingTenantLabel, as
+	// their rules on other labels alone may grant broader access than intended.
+	TenantLabel            string `mapstructure:"tenant_label"`
+	DenyMissingTenantLabel bool   `mapstructure:"deny_missing_tenant_label"`
+	// RouteTenantLabels overrides TenantLabel for routes, keyed by route pattern (e.g.,
+	// /api/v1/query_exemplars), whose series carry the tenant under another label. Rules on
+	// TenantLabel are enforced on the route's label instead.
+	RouteTenantLabels map[string]string `mapstructure:"route_tenant_labels"`
+	// RouteQueryHandling sets how routes, keyed by route pattern, handle requests whose query
+	// parameter is absent or empty. Both are injected with the policy selector by default.
+	RouteQueryHandling map[string]QueryHandling `mapstructure:"route_query_handling"`
+
+	FilterLabelResponses bool `mapstructure:"filter_label_responses"` // Remove label values not permitted by the policy from label values responses
+	DenyAtModifiers      bool `mapstructure:"deny_at_modifiers"`      // Reject queries using the @ modifier (@ <timestamp>, @ start(), @ end()) with 400
+
+	// Metric metadata (/api/v1/metadata) has no labels and cannot be scoped to a tenant.
+	DenyMetadata  bool `mapstructure:"deny_metadata"`  // Reject metadata requests of enforced users for strict isolation
+	MetadataLimit int  `mapstructure:"metadata_limit"` // Maximum limit forwarded to the metadata endpoint; 0 disables clamping
 }
 
 type LokiConfig struct {
-	URL          string            `mapstructure:"url"`
-	UseMutualTLS bool              `mapstructure:"use_mutual_tls"`
-	Cert         string            `mapstructure:"cert"`
-	Key          string            `mapstructure:"key"`
-	Headers      map[string]string `mapstructure:"headers"`
-	ActorHeader  string            `mapstructure:"actor_header"`
-	Proxy        *ProxyConfig      `mapstructure:"proxy"` // Per-upstream proxy configuration override
+	URL                    string            `mapstructure:"url"`
+	RouteURLs              map[string]string `mapstructure:"route_urls"` // Upstream URLs of routes served by other read paths than URL, keyed by route pattern (e.g., /api/v1/index/volume)
+	UseMutualTLS           bool              `mapstructure:"use_mutual_tls"`
+	AuthMode               string            `mapstructure:"auth_mode"`            // Upstream credential: sat, static_token, mtls or none (default: sat, or mtls with use_mutual_tls)
+	StaticToken            string            `mapstructure:"static_token"`         // Bearer token sent with auth_mode static_token
+	ClientAuthorization    string            `mapstructure:"client_authorization"` // Client Authorization header: strip, replace or forward (default: replace with sat and static_token, forward otherwise)
+	Cert                   string            `mapstructure:"cert"`
+	Key                    string            `mapstructure:"key"`
+	Headers                map[string]string `mapstructure:"headers"`
+	ActorHeader            string            `mapstructure:"actor_header"`
+	ActorFormat            string            `mapstructure:"actor_format"`             // Actor header value format: base64 (default), plain, username, email, or a template
+	ActorClaim             []string          `mapstructure:"actor_claim"`              // Token claims whose values identify the actor instead of username and email, joined by ":"
+	QueryJSONPath          string            `mapstructure:"query_json_path"`          // Dot-separated path to the query in JSON POST bodies (e.g., "queries.*.expr")
+	NormalizeTrailingSlash string            `mapstructure:"normalize_trailing_slash"` // Trailing slash handling before forwarding: add, strip, or empty to leave paths unchanged
+	RequiredScopes         []string          `mapstructure:"required_scopes"`          // OAuth scopes required for this upstream; overrides auth.required_scopes
+	ExtraQueryParams       map[string]string `mapstructure:"extra_query_params"`       // Query parameters added to upstream requests that do not set them (e.g., dedup: "true")
+	RewriteErrorResponses  bool              `mapstructure:"rewrite_error_responses"`  // Rewrite non-JSON error responses (e.g., HTML error pages) into a JSON error, keeping the status
+	DeniedMessage          string            `mapstructure:"denied_message"`           // Body of 403 responses to authorization failures; overrides web.denied_message
+	CoalesceRequests       bool              `mapstructure:"coalesce_requests"`        // Share one upstream request among concurrent identical GET requests of users with the same policy
+	Proxy                  *ProxyConfig      `mapstructure:"proxy"`                    // Per-upstream proxy configuration override
+	Shadow                 ShadowConfig      `mapstructure:"shadow"`                   // Secondary upstream receiving a copy of sampled read traffic
+	Push                   LokiPushConfig    `mapstructure:"push"`                     // Serving of the push route, whose streams are verified against the policy
+
+	AllowedUserLabels   []string `mapstructure:"allowed_user_labels"`   // Non-policy labels users may filter on; empty allows any
+	ForbiddenUserLabels []string `mapstructure:"forbidden_user_labels"` // Non-policy labels users may never filter on
+
+	// TenantLabelOperators are the operators users may apply to the tenant label and the other
+	// labels of their policy (e.g., [=, =~] to reject negations); LabelOperators those they
+	// may apply to all other labels. Empty allows any operator.
+	TenantLabelOperators []string `mapstructure:"tenant_label_operators"`
+	LabelOperators       []string `mapstructure:"label_operators"`
+
+	FilterLabelResponses bool `mapstructure:"filter_label_responses"` // Remove label values not permitted by the policy from label values responses
+
+	// TenantLabel is the label tenants are isolated by on this upstream (e.g. namespace).
+	// Policies without a rule on it are logged, and rejected with DenyMissingTenantLabel, as
+	// their rules on other labels alone may grant broader access than intended.
+	TenantLabel            string `mapstructure:"tenant_label"`
+	DenyMissingTenantLabel bool   `mapstructure:"deny_missing_tenant_label"`
+	// RouteTenantLabels overrides TenantLabel for routes, keyed by route pattern (e.g.,
+	// /api/v1/query_exemplars), whose series carry the tenant under another label. Rules on
+	// TenantLabel are enforced on the route's label instead.
+	RouteTenantLabels map[string]string `mapstructure:"route_tenant_labels"`
+	// RouteQueryHandling sets how routes, keyed by route pattern, handle requests whose query
+	// parameter is absent or empty. Both are injected with the policy selector by default.
+	RouteQueryHandling map[string]QueryHandling `mapstructure:"route_query_handling"`
+}
+
+// LokiPushConfig configures the Loki push route (/loki/api/v1/push). The labels of every
+// pushed stream are verified against the user's policy and the whole push is rejected if any
+// stream is not permitted.
+type LokiPushConfig struct {
+	Enabled bool `mapstructure:"enabled"` // Serve the push route; pushes are rejected as unknown routes otherwise
+	// InjectLabels adds the label of each positive single-value rule of AND policies (e.g.
+	// namespace = team-a) to streams without it, instead of rejecting them.
+	InjectLabels bool `mapstructure:"inject_labels"`
+	// MaxBodySize is the maximum size in bytes of a push body, both as received and once
+	// decompressed; larger pushes are rejected with 413 (default: DefaultMaxPushBodySize).
+	MaxBodySize int64 `mapstructure:"max_body_size"`
+}
+
+// ShadowConfig configures a shadow upstream that receives a copy of a fraction of enforced
+// requests, e.g. to test a new cluster with production traffic. Shadow responses are discarded.
+type ShadowConfig struct {
+	URL        string  `mapstructure:"url"`         // Shadow upstream URL; empty disables mirroring
+	SampleRate float64 `mapstructure:"sample_rate"` // Fraction of requests to mirror, between 0 and 1
 }
 
 type TempoConfig struct {
-	URL          string            `mapstructure:"url"`
-	UseMutualTLS bool              `mapstructure:"use_mutual_tls"`
-	Cert         string            `mapstructure:"cert"`
-	Key          string            `mapstructure:"key"`
-	Headers      map[string]string `mapstructure:"headers"`
-	ActorHeader  string            `mapstructure:"actor_header"`
-	Proxy        *ProxyConfig      `mapstructure:"proxy"` // Per-upstream proxy configuration override
+	URL                    string            `mapstructure:"url"`
+	UseMutualTLS           bool              `mapstructure:"use_mutual_tls"`
+	AuthMode               string            `mapstructure:"auth_mode"`            // Upstream credential: sat, static_token, mtls or none (default: sat, or mtls with use_mutual_tls)
+	StaticToken            string            `mapstructure:"static_token"`         // Bearer token sent with auth_mode static_token
+	ClientAuthorization    string            `mapstructure:"client_authorization"` // Client Authorization header: strip, replace or forward (default: replace with sat and static_token, forward otherwise)
+	Cert                   string            `mapstructure:"cert"`
+	Key                    string            `mapstructure:"key"`
+	Headers                map[string]string `mapstructure:"headers"`
+	ActorHeader            string            `mapstructure:"actor_header"`
+	ActorFormat            string            `mapstructure:"actor_format"`             // Actor header value format: base64 (default), plain, username, email, or a template
+	ActorClaim             []string          `mapstructure:"actor_claim"`              // Token claims whose values identify the actor instead of username and email, joined by ":"
+	QueryJSONPath          string            `mapstructure:"query_json_path"`          // Dot-separated path to the query in JSON POST bodies (e.g., "queries.*.expr")
+	NormalizeTrailingSlash string            `mapstructure:"normalize_trailing_slash"` // Trailing slash handling before forwarding: add, strip, or empty to leave paths unchanged
+	RequiredScopes         []string          `mapstructure:"required_scopes"`          // OAuth scopes required for this upstream; overrides auth.required_scopes
+	ExtraQueryParams       map[string]string `mapstructure:"extra_query_params"`       // Query parameters added to upstream requests that do not set them (e.g., dedup: "true")
+	RewriteErrorResponses  bool              `mapstructure:"rewrite_error_responses"`  // Rewrite non-JSON error responses (e.g., HTML error pages) into a JSON error, keeping the status
+	DeniedMessage          string            `mapstructure:"denied_message"`           // Body of 403 responses to authorization failures; overrides web.denied_message
+	CoalesceRequests       bool              `mapstructure:"coalesce_requests"`        // Share one upstream request among concurrent identical GET requests of users with the same policy
+	Proxy                  *ProxyConfig      `mapstructure:"proxy"`                    // Per-upstream proxy configuration override
+
+	AllowedUserLabels   []string `mapstructure:"allowed_user_labels"`   // Non-policy labels users may filter on; empty allows any
+	ForbiddenUserLabels []string `mapstructure:"forbidden_user_labels"` // Non-policy labels users may never filter on
+
+	// TenantLabelOperators are the operators users may apply to the tenant label and the other
+	// labels of their policy (e.g., [=, =~] to reject negations); LabelOperators those they
+	// may apply to all other labels. Empty allows any operator.
+	TenantLabelOperators []string `mapstructure:"tenant_label_operators"`
+	LabelOperators       []string `mapstructure:"label_operators"`
+
+	// TenantLabels are the scoped attributes policies may isolate tenants by, e.g.
+	// [resource.namespace, resource.cluster]. Policies with rules on other attributes are
+	// rejected for Tempo. Empty allows any attribute.
+	TenantLabels []string `mapstructure:"tenant_labels"`
+
+	// VerifyTraceTenant verifies traces fetched by ID, which have no query to enforce, and
+	// denies them unless the policy permits the resource attributes of every span batch.
+	VerifyTraceTenant bool `mapstructure:"verify_trace_tenant"`
+
+	// RouteQueryHandling sets how routes, keyed by route pattern, handle requests whose query
+	// parameter is absent or empty. Both are injected with the policy selector by default.
+	RouteQueryHandling map[string]QueryHandling `mapstructure:"route_query_handling"`
 }
 
 type Config struct {
@@ -119,11 +413,49 @@ type Config struct {
 	Admin      AdminConfig      `mapstructure:"admin"`
 	Alert      AlertConfig      `mapstructure:"alert"`
 	Dev        DevConfig        `mapstructure:"dev"`
+	Debug      DebugConfig      `mapstructure:"debug"`
 	Proxy      ProxyConfig      `mapstructure:"proxy"` // Global proxy configuration defaults
 	Thanos     ThanosConfig     `mapstructure:"thanos"`
 	Loki       LokiConfig       `mapstructure:"loki"`
 	Tempo      TempoConfig      `mapstructure:"tempo"`
 	LabelStore LabelStoreConfig `mapstructure:"labelstore"`
+	Audit      AuditConfig      `mapstructure:"audit"`
+	Secrets    SecretsConfig    `mapstructure:"secrets"`
+}
+
+// SecretsConfig configures the secret provider that values of the form secret:<ref> are
+// resolved with: the static tokens, certificates and keys of the upstreams and the service
+// account token. Secrets are refetched periodically to pick up rotations.
+type SecretsConfig struct {
+	Provider        string             `mapstructure:"provider"`         // Secret provider: vault; empty disables secret references
+	RefreshInterval time.Duration      `mapstructure:"refresh_interval"` // Interval secrets are refetched at (default: 5m)
+	Timeout         time.Duration      `mapstructure:"timeout"`          // Timeout of fetching a secret (default: 10s)
+	Vault           VaultSecretsConfig `mapstructure:"vault"`
+}
+
+// VaultSecretsConfig configures the HashiCorp Vault KV v2 secret provider. References have
+// the form secret:<path>#<key>, the key defaulting to "value".
+type VaultSecretsConfig struct {
+	Address   string `mapstructure:"address"`   // Vault address (default: VAULT_ADDR)
+	Token     string `mapstructure:"token"`     // Vault token (default: VAULT_TOKEN)
+	Mount     string `mapstructure:"mount"`     // Mount of the KV v2 secrets engine (default: secret)
+	Namespace string `mapstructure:"namespace"` // Vault Enterprise namespace, if any
+}
+
+// AuditConfig configures where authorization decisions are sent.
+type AuditConfig struct {
+	Webhook AuditWebhookConfig `mapstructure:"webhook"`
+}
+
+// AuditWebhookConfig configures a webhook receiving every authorization decision as a JSON
+// POST, e.g. for ingestion by a SIEM. Delivery is asynchronous and never delays requests.
+type AuditWebhookConfig struct {
+	URL          string            `mapstructure:"url"`           // Webhook URL; empty disables the webhook
+	Headers      map[string]string `mapstructure:"headers"`       // Headers sent with every event (e.g., Authorization)
+	Timeout      time.Duration     `mapstructure:"timeout"`       // Timeout of a delivery attempt (default: 5s)
+	BufferSize   int               `mapstructure:"buffer_size"`   // Events buffered while the webhook is slow; further events are dropped (default: 1000)
+	MaxRetries   int               `mapstructure:"max_retries"`   // Retries of a failed delivery, negative disables them (default: 3)
+	RetryBackoff time.Duration     `mapstructure:"retry_backoff"` // Delay before the first retry, doubled for each further one (default: 1s)
 }
 
 // LabelStoreConfig contains configuration needed by label stores during initialization.
@@ -134,11 +466,164 @@ type LabelStoreConfig struct {
 	// Default: ["/etc/config/labels/", "./configs"]
 	ConfigPaths []string `mapstructure:"config_paths"`
 
+	// GroupMergeLogic controls how policies from multiple matching entries (user + groups)
+	// are combined: "AND" requires every merged rule to hold, "OR" lets any single rule grant
+	// access. Rules sharing a label name are always consolidated into one rule whose values
+	// are the union of all entries, so this setting only affects distinct label names.
+	// "OR" refuses to merge an entry with several AND rules, as that would widen its access.
+	// Default: "OR"
+	GroupMergeLogic string `mapstructure:"group_merge_logic"`
+
+	// DefaultLogic is the logic of entries that do not set _logic, e.g. OR for label files
+	// made up of group-style entries, so it need not be repeated on every entry.
+	// Default: "AND"
+	DefaultLogic string `mapstructure:"default_logic"`
+
+	// RequireGroupMembership denies users whose token carries no non-empty groups,
+	// even if a policy entry exists for their username.
+	// Default: false (username-only policies are allowed)
+	RequireGroupMembership bool `mapstructure:"require_group_membership"`
+
+	// WarnOnClusterWide logs a warning at load time for every entry granting cluster-wide
+	// access that is not listed in ClusterWideAllowlist.
+	// Default: false
+	WarnOnClusterWide bool `mapstructure:"warn_on_cluster_wide"`
+
+	// FailOnClusterWide refuses to load labels if any entry not listed in ClusterWideAllowlist
+	// grants cluster-wide access, guarding against accidental broad access.
+	// Default: false
+	FailOnClusterWide bool `mapstructure:"fail_on_cluster_wide"`
+
+	// ClusterWideLabel is the rule name granting cluster-wide access, in case a real label is
+	// named #cluster-wide. Scoped rules append the upstream to it (e.g. <name>:loki).
+	// Default: "#cluster-wide"
+	ClusterWideLabel string `mapstructure:"cluster_wide_label"`
+
+	// ClusterWidePrecedence controls users granted cluster-wide access by one entry and specific
+	// rules by another (e.g. two of their groups): "most_permissive" grants cluster-wide access,
+	// "specific_wins" enforces the specific rules only, "error" denies their requests to catch
+	// the misconfiguration. File label store only.
+	// Default: "most_permissive"
+	ClusterWidePrecedence string `mapstructure:"cluster_wide_precedence"`
+
+	// ClusterWideAllowlist lists the entries (users or groups) expected to have cluster-wide access.
+	ClusterWideAllowlist []string `mapstructure:"cluster_wide_allowlist"`
+
+	// CaseInsensitive matches usernames and groups to entries ignoring case, each independently,
+	// e.g. for groups of an IdP that does not preserve their case. File label store only.
+	// Default: both case-sensitive
+	CaseInsensitive CaseInsensitiveConfig `mapstructure:"case_insensitive"`
+
+	// MatchEmail also looks up the entry keyed by the token's email and merges it like a group
+	// entry, so a user listed under their username, their email or both is granted access.
+	// Emails follow the username case sensitivity. File label store only.
+	// Default: false (users are matched by username only)
+	MatchEmail bool `mapstructure:"match_email"`
+
+	// MaxRegexValues limits the number of values of a single rule, which are emitted as one
+	// regex alternation, e.g. after consolidating the rules of many groups.
+	// Default: 0 (unlimited)
+	MaxRegexValues int `mapstructure:"max_regex_values"`
+
+	// RegexValuesOverflow controls rules with more than MaxRegexValues values: "error" denies
+	// the request, "split" splits the rule into rules of at most MaxRegexValues values, which
+	// is only possible for positive rules of OR policies and negative rules of AND policies.
+	// Default: "error"
+	RegexValuesOverflow string `mapstructure:"regex_values_overflow"`
+
+	// OnReloadError controls what happens when changed labels fail to load: "keep_serving"
+	// keeps enforcing the previously loaded policies, "fail_closed" answers every request
+	// with 503 Service Unavailable until the labels load again.
+	// Default: "keep_serving"
+	OnReloadError string `mapstructure:"on_reload_error"`
+
+	// SimpleFormat controls how entries in the deprecated simple format are handled:
+	// "reject" fails loading, "auto_convert" converts them in memory like cmd/migrate-labels
+	// and logs a deprecation warning for each entry.
+	// Default: "reject"
+	SimpleFormat string `mapstructure:"simple_format"`
+
+	// SimpleFormatLabel is the label that simple format values are converted to.
+	// Default: "namespace"
+	SimpleFormatLabel string `mapstructure:"simple_format_label"`
+
+	// Type selects the label store implementation: "file" reads labels.yaml from ConfigPaths,
+	// "opa" evaluates a Rego policy (see OPA).
+	// Default: "file"
+	Type string `mapstructure:"type"`
+
+	// OPA configures the OPA label store, used when Type is "opa".
+	OPA OPALabelStoreConfig `mapstructure:"opa"`
+
+	// Cache caches the policies returned by non-file label stores, see CachingLabelStore.
+	Cache LabelStoreCacheConfig `mapstructure:"cache"`
+
+	// ValidateLabelsAgainstBackend queries the label names of the Thanos and Loki backends at
+	// startup and warns about policy labels none of them knows, which are likely typos. The
+	// check is best-effort and never fails startup. Requires the file label store.
+	// Default: false
+	ValidateLabelsAgainstBackend bool `mapstructure:"validate_labels_against_backend"`
+
 	// Additional configuration fields can be added here by custom label store implementations
 	// without breaking the existing FileLabelStore. Each label store implementation should
 	// document which fields it uses and ignore the rest.
 }
 
+// Handling of absent or empty query parameters
+const (
+	QueryInject = "inject" // Enforce as an empty query, which selects the policy labels (default)
+	QueryReject = "reject" // Reject the request with 400 Bad Request
+)
+
+// QueryHandling sets how a route handles requests whose query parameter is absent (not sent
+// at all) or empty (e.g. query=): QueryInject or QueryReject.
+type QueryHandling struct {
+	Absent string `mapstructure:"absent"`
+	Empty  string `mapstructure:"empty"`
+}
+
+// CaseInsensitiveConfig selects the token attributes matched to entries ignoring case.
+type CaseInsensitiveConfig struct {
+	Username bool `mapstructure:"username"`
+	Groups   bool `mapstructure:"groups"`
+}
+
+// LabelStoreCacheConfig configures the label store cache. It is enabled if TTL or
+// NegativeTTL is set.
+type LabelStoreCacheConfig struct {
+	// TTL is how long policies are cached. Default: 0 (not cached)
+	TTL time.Duration `mapstructure:"ttl"`
+
+	// NegativeTTL is how long users without policy are cached. Default: 0 (not cached)
+	NegativeTTL time.Duration `mapstructure:"negative_ttl"`
+
+	// MaxSize is the maximum number of cached identities. Default: 10000
+	MaxSize int `mapstructure:"max_size"`
+
+	// RefreshAhead reloads cached policies in the background when they are read within this
+	// long of their expiry, so that reads do not wait for the backend. Default: 0 (disabled)
+	RefreshAhead time.Duration `mapstructure:"refresh_ahead"`
+}
+
+// OPALabelStoreConfig configures the Rego policy evaluated by the OPA label store.
+type OPALabelStoreConfig struct {
+	// PolicyPath is a Rego file, a directory of Rego and data files, or a bundle (.tar.gz).
+	PolicyPath string `mapstructure:"policy_path"`
+
+	// Query is the Rego query returning the label policy for the input identity.
+	// Default: "data.lbac.policy"
+	Query string `mapstructure:"query"`
+}
+
+// unmarshalConfig decodes the configuration of v into cfg. With web.strict_config, keys
+// that do not match a configuration field, such as misspelled ones, are an error listing them.
+func unmarshalConfig(v *viper.Viper, cfg *Config) error {
+	if v.GetBool("web::strict_config") {
+		return v.UnmarshalExact(cfg)
+	}
+	return v.Unmarshal(cfg)
+}
+
 func (a *App) WithConfig() *App {
 	v := viper.NewWithOptions(viper.KeyDelimiter("::"))
 	v.SetConfigName("config")
@@ -155,44 +640,97 @@ func (a *App) WithConfig() *App {
 		return nil
 	}
 	a.Cfg = &Config{}
-	err = v.Unmarshal(a.Cfg)
+	err = unmarshalConfig(v, a.Cfg)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Error while unmarshalling config file")
 	}
-
-	// Migrate legacy configuration to new auth section with backward compatibility
-	a.migrateAuthConfig()
-	// Set default label store config paths if not configured
-	if len(a.Cfg.LabelStore.ConfigPaths) == 0 {
-		a.Cfg.LabelStore.ConfigPaths = []string{"/etc/config/labels/", "./configs"}
+	if err := a.prepareConfig(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid configuration")
+	}
+	SetMaxRegexLength(a.Cfg.Web.MaxRegexLength)
+	if a.mu == nil {
+		a.mu = &sync.RWMutex{}
 	}
-	// Validate Tempo configuration if provided
-	a.validateTempoConfig()
 	v.OnConfigChange(func(e fsnotify.Event) {
 		log.Info().Str("file", e.Name).Msg("Config file changed")
-		err := v.Unmarshal(a.Cfg)
-		if err != nil {
-			log.Error().Err(err).Msg("Error while unmarshalling config file")
-			a.healthy = false
-		}
-		// Migrate legacy configuration to new auth section
-		a.migrateAuthConfig()
-		// Set default label store config paths if not configured
-		if len(a.Cfg.LabelStore.ConfigPaths) == 0 {
-			a.Cfg.LabelStore.ConfigPaths = []string{"/etc/config/labels/", "./configs"}
-		}
-		// Validate Tempo configuration if provided
-		a.validateTempoConfig()
-		zerolog.SetGlobalLevel(zerolog.Level(a.Cfg.Log.Level))
+		a.reloadConfig(v)
 	})
 	v.WatchConfig()
-	zerolog.SetGlobalLevel(zerolog.Level(a.Cfg.Log.Level))
+	if a.Cfg.Debug.AllowHeaderLogLevel {
+		installLevelFilter()
+	}
+	setLogLevel(zerolog.Level(a.Cfg.Log.Level))
 	log.Debug().Any("config", a.Cfg).Msg("")
 	return a
 }
 
+// prepareConfig migrates legacy settings of a.Cfg, applies defaults and validates it.
+func (a *App) prepareConfig() error {
+	// Migrate legacy configuration to new auth section with backward compatibility
+	a.migrateAuthConfig()
+	// Set default label store config paths if not configured
+	if len(a.Cfg.LabelStore.ConfigPaths) == 0 {
+		a.Cfg.LabelStore.ConfigPaths = []string{"/etc/config/labels/", "./configs"}
+	}
+	// Validate the Tempo, identity source, token error and debug settings
+	for _, validate := range []func() error{a.validateTempoConfig, a.validateGrafanaHeadersConfig, a.validateTokenErrorStatus, a.validateDebugConfig} {
+		if err := validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reloadConfig unmarshals the changed configuration of v into a new Config and replaces
+// a.Cfg, the router and the changed proxies with it once prepared, so that requests see either
+// the previous or the new configuration as a whole, routes included. If it cannot be
+// unmarshalled or is invalid, the previous configuration is kept and the proxy reports itself
+// unhealthy until a valid configuration is loaded.
+func (a *App) reloadConfig(v *viper.Viper) {
+	if err := a.applyConfig(v); err != nil {
+		log.Error().Err(err).Msg("Error while reloading config file, keeping the previous configuration")
+		a.mu.Lock()
+		a.healthy = false
+		a.mu.Unlock()
+		return
+	}
+	SetMaxRegexLength(a.Cfg.Web.MaxRegexLength)
+	if a.Cfg.Debug.AllowHeaderLogLevel && !levelFilterInstalled {
+		log.Warn().Msg("debug.allow_header_log_level is only applied on restart")
+	}
+	setLogLevel(zerolog.Level(a.Cfg.Log.Level))
+}
+
+// applyConfig prepares the configuration of v with the proxies and routes it needs and
+// replaces those of a with them. Nothing is replaced if any of them is invalid.
+func (a *App) applyConfig(v *viper.Viper) error {
+	cfg := &Config{}
+	if err := unmarshalConfig(v, cfg); err != nil {
+		return fmt.Errorf("unmarshalling config file: %w", err)
+	}
+	next := a.snapshot()
+	next.Cfg = cfg
+	if err := next.prepareConfig(); err != nil {
+		return err
+	}
+	replaced, err := next.rebuildProxies()
+	if err != nil {
+		return err
+	}
+	// The routes of the new configuration are built before it replaces the previous one
+	if a.router != nil {
+		if next.router, err = next.newRouter(); err != nil {
+			return err
+		}
+	}
+	next.healthy = true
+	a.replace(next, replaced)
+	return nil
+}
+
 func (a *App) WithSAT() *App {
-	if a.Cfg.Dev.Enabled {
+	// A secret reference is kept and resolved per request to follow rotations
+	if a.Cfg.Dev.Enabled || isSecretRef(a.Cfg.Web.ServiceAccountToken) {
 		a.ServiceAccountToken = a.Cfg.Web.ServiceAccountToken
 		return a
 	}
@@ -242,54 +780,78 @@ func (a *App) WithTLSConfig() *App {
 		}
 	}
 
+	config := &tls.Config{
+		InsecureSkipVerify: a.Cfg.Web.TLSVerifySkip,
+		RootCAs:            rootCAs,
+	}
+	cfg := a.Cfg
+	certificates := clientCertificates(cfg)
+	if cache := secretStore.Load(); cache != nil && cfg.hasSecretCertificates() {
+		load := func() []tls.Certificate { return clientCertificates(cfg) }
+		certs := &secretCertificates{load: load, version: cache.version.Load(), certs: certificates}
+		config.GetClientCertificate = certs.GetClientCertificate
+	} else {
+		config.Certificates = certificates
+	}
+
+	http.DefaultTransport.(*http.Transport).TLSClientConfig = config
+	return a
+}
+
+// clientCertificates loads the client certificates of the upstreams.
+func clientCertificates(cfg *Config) []tls.Certificate {
 	var certificates []tls.Certificate
 
-	lokiCert, err := tls.LoadX509KeyPair(a.Cfg.Loki.Cert, a.Cfg.Loki.Key)
+	lokiCert, err := loadX509KeyPair(cfg.Loki.Cert, cfg.Loki.Key)
 	if err != nil {
 		log.Error().Err(err).Msg("Error while loading loki certificate")
 	} else {
-		log.Debug().Str("path", a.Cfg.Loki.Cert).Msg("Adding Loki certificate")
+		log.Debug().Str("path", cfg.Loki.Cert).Msg("Adding Loki certificate")
 		certificates = append(certificates, lokiCert)
 	}
 
-	thanosCert, err := tls.LoadX509KeyPair(a.Cfg.Thanos.Cert, a.Cfg.Thanos.Key)
+	thanosCert, err := loadX509KeyPair(cfg.Thanos.Cert, cfg.Thanos.Key)
 	if err != nil {
 		log.Error().Err(err).Msg("Error while loading thanos certificate")
 	} else {
-		log.Debug().Str("path", a.Cfg.Thanos.Cert).Msg("Adding Thanos certificate")
+		log.Debug().Str("path", cfg.Thanos.Cert).Msg("Adding Thanos certificate")
 		certificates = append(certificates, thanosCert)
 	}
 
-	tempoCert, err := tls.LoadX509KeyPair(a.Cfg.Tempo.Cert, a.Cfg.Tempo.Key)
+	tempoCert, err := loadX509KeyPair(cfg.Tempo.Cert, cfg.Tempo.Key)
 	if err != nil {
 		log.Error().Err(err).Msg("Error while loading tempo certificate")
 	} else {
-		log.Debug().Str("path", a.Cfg.Tempo.Cert).Msg("Adding Tempo certificate")
+		log.Debug().Str("path", cfg.Tempo.Cert).Msg("Adding Tempo certificate")
 		certificates = append(certificates, tempoCert)
 	}
+	return certificates
+}
 
-	config := &tls.Config{
-		InsecureSkipVerify: a.Cfg.Web.TLSVerifySkip,
-		RootCAs:            rootCAs,
-		Certificates:       certificates,
+// hasSecretCertificates reports whether any upstream certificate or key is a secret reference.
+func (c *Config) hasSecretCertificates() bool {
+	for _, value := range []string{c.Thanos.Cert, c.Thanos.Key, c.Loki.Cert, c.Loki.Key, c.Tempo.Cert, c.Tempo.Key} {
+		if isSecretRef(value) {
+			return true
+		}
 	}
-
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = config
-	return a
+	return false
 }
 
 func (a *App) WithJWKS() *App {
 	log.Info().Msg("Init JWKS config")
-	urls := []string{a.Cfg.Web.JwksCertURL}
-	if a.Cfg.Alert.Enabled {
-		urls = []string{a.Cfg.Web.JwksCertURL, a.Cfg.Alert.CertURL}
-	}
+	urls := a.jwksURLs()
 	var cert json.RawMessage
 	cert = nil
 	if a.Cfg.Alert.Cert != "" {
 		cert = json.RawMessage(a.Cfg.Alert.Cert)
 	}
-	jwks, err := NewCombinedJwks(context.Background(), urls, cert)
+	jwks, err := NewCombinedJwks(context.Background(), urls, cert, JWKSOptions{
+		Timeout:      a.Cfg.Auth.JwksTimeout,
+		Retries:      a.Cfg.Auth.JwksRetries,
+		RetryBackoff: a.Cfg.Auth.JwksRetryBackoff,
+		StaleGrace:   a.Cfg.Auth.JwksStaleGrace,
+	})
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to create a keyfunc from the server's URL")
 	}
@@ -298,6 +860,126 @@ func (a *App) WithJWKS() *App {
 	return a
 }
 
+// jwksURLs returns the configured JWKS endpoints: the web URL and, in alert mode, the alert URL.
+func (a *App) jwksURLs() []string {
+	if a.Cfg.Alert.Enabled {
+		return []string{a.Cfg.Web.JwksCertURL, a.Cfg.Alert.CertURL}
+	}
+	return []string{a.Cfg.Web.JwksCertURL}
+}
+
+// requiredScopes returns the OAuth scopes required to query the given upstream: the
+// upstream's required_scopes if set, otherwise auth.required_scopes.
+func (a *App) requiredScopes(upstream string) []string {
+	var scopes []string
+	switch upstream {
+	case "thanos":
+		scopes = a.Cfg.Thanos.RequiredScopes
+	case "loki":
+		scopes = a.Cfg.Loki.RequiredScopes
+	case "tempo":
+		scopes = a.Cfg.Tempo.RequiredScopes
+	}
+	if len(scopes) > 0 {
+		return scopes
+	}
+	return a.Cfg.Auth.RequiredScopes
+}
+
+// tenantLabel returns the tenant label of upstream and whether policies without a rule on
+// it are denied. Tempo restricts policy attributes with tenant_labels instead.
+func (a *App) tenantLabel(upstream string) (string, bool) {
+	switch upstream {
+	case "thanos":
+		return a.Cfg.Thanos.TenantLabel, a.Cfg.Thanos.DenyMissingTenantLabel
+	case "loki":
+		return a.Cfg.Loki.TenantLabel, a.Cfg.Loki.DenyMissingTenantLabel
+	}
+	return "", false
+}
+
+// actorClaim returns the token claims identifying the actor of requests to upstream, if any.
+func (a *App) actorClaim(upstream string) []string {
+	switch upstream {
+	case "thanos":
+		return a.Cfg.Thanos.ActorClaim
+	case "loki":
+		return a.Cfg.Loki.ActorClaim
+	case "tempo":
+		return a.Cfg.Tempo.ActorClaim
+	}
+	return nil
+}
+
+// coalesceRequests reports whether concurrent identical requests to upstream are coalesced.
+func (a *App) coalesceRequests(upstream string) bool {
+	switch upstream {
+	case "thanos":
+		return a.Cfg.Thanos.CoalesceRequests
+	case "loki":
+		return a.Cfg.Loki.CoalesceRequests
+	case "tempo":
+		return a.Cfg.Tempo.CoalesceRequests
+	}
+	return false
+}
+
+// deniedMessage returns the denied message template of upstream, if any.
+func (a *App) deniedMessage(upstream string) string {
+	var message string
+	switch upstream {
+	case "thanos":
+		message = a.Cfg.Thanos.DeniedMessage
+	case "loki":
+		message = a.Cfg.Loki.DeniedMessage
+	case "tempo":
+		message = a.Cfg.Tempo.DeniedMessage
+	}
+	if message != "" {
+		return message
+	}
+	return a.Cfg.Web.DeniedMessage
+}
+
+// extraQueryParams returns the query parameters added to requests to upstream.
+func (a *App) extraQueryParams(upstream string) map[string]string {
+	switch upstream {
+	case "thanos":
+		return a.Cfg.Thanos.ExtraQueryParams
+	case "loki":
+		return a.Cfg.Loki.ExtraQueryParams
+	case "tempo":
+		return a.Cfg.Tempo.ExtraQueryParams
+	}
+	return nil
+}
+
+// filterLabelResponses reports whether label values responses of upstream are filtered by
+// the user's policy.
+func (a *App) filterLabelResponses(upstream string) bool {
+	switch upstream {
+	case "thanos":
+		return a.Cfg.Thanos.FilterLabelResponses
+	case "loki":
+		return a.Cfg.Loki.FilterLabelResponses
+	}
+	return false
+}
+
+// rewriteErrorResponses reports whether non-JSON error responses of upstream are rewritten
+// into the JSON error format.
+func (a *App) rewriteErrorResponses(upstream string) bool {
+	switch upstream {
+	case "thanos":
+		return a.Cfg.Thanos.RewriteErrorResponses
+	case "loki":
+		return a.Cfg.Loki.RewriteErrorResponses
+	case "tempo":
+		return a.Cfg.Tempo.RewriteErrorResponses
+	}
+	return false
+}
+
 // migrateAuthConfig handles backward compatibility by migrating legacy web.* auth fields
 // to the new auth.* configuration structure. It supports three scenarios:
 // 1. New config only (auth section present): Use auth section, set defaults
@@ -371,11 +1053,75 @@ func (a *App) migrateAuthConfig() {
 		Msg("Authentication configuration loaded")
 }
 
+// validateGrafanaHeadersConfig parses the trusted CIDRs of the Grafana header identity
+// source and sets the default user header.
+func (a *App) validateGrafanaHeadersConfig() error {
+	cfg := &a.Cfg.Auth.GrafanaHeaders
+	cfg.trustedPrefixes = nil
+	if len(cfg.TrustedCIDRs) == 0 {
+		return nil
+	}
+	if cfg.UserHeader == "" {
+		cfg.UserHeader = "X-Grafana-User"
+	}
+	for _, cidr := range cfg.TrustedCIDRs {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return fmt.Errorf("invalid auth.grafana_headers.trusted_cidrs %q: %w", cidr, err)
+		}
+		cfg.trustedPrefixes = append(cfg.trustedPrefixes, prefix.Masked())
+	}
+
+	log.Debug().
+		Strs("trusted_cidrs", cfg.TrustedCIDRs).
+		Str("user_header", cfg.UserHeader).
+		Str("groups_header", cfg.GroupsHeader).
+		Msg("Grafana header identity source enabled")
+	return nil
+}
+
+// validateTokenErrorStatus checks that token error statuses are set for known reasons only
+// and are client error statuses.
+func (a *App) validateTokenErrorStatus() error {
+	for reason, status := range a.Cfg.Auth.TokenErrorStatus {
+		if !slices.Contains(tokenErrorReasons, reason) {
+			return fmt.Errorf("unknown auth.token_error_status reason %q: must be one of %s", reason, strings.Join(tokenErrorReasons, ", "))
+		}
+		if status < 400 || status > 499 {
+			return fmt.Errorf("auth.token_error_status of %s must be a 4xx status, got %d", reason, status)
+		}
+	}
+	return nil
+}
+
+// validateDebugConfig parses the trusted CIDRs of the log level header and sets its default.
+func (a *App) validateDebugConfig() error {
+	cfg := &a.Cfg.Debug
+	cfg.trustedPrefixes = nil
+	if !cfg.AllowHeaderLogLevel {
+		return nil
+	}
+	if cfg.Header == "" {
+		cfg.Header = DefaultDebugHeader
+	}
+	if len(cfg.TrustedCIDRs) == 0 {
+		log.Warn().Str("header", cfg.Header).Msg("debug.allow_header_log_level is set without trusted_cidrs, the header is never accepted")
+	}
+	for _, cidr := range cfg.TrustedCIDRs {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return fmt.Errorf("invalid debug.trusted_cidrs %q: %w", cidr, err)
+		}
+		cfg.trustedPrefixes = append(cfg.trustedPrefixes, prefix.Masked())
+	}
+	return nil
+}
+
 // validateTempoConfig validates Tempo configuration settings
-func (a *App) validateTempoConfig() {
+func (a *App) validateTempoConfig() error {
 	// Skip validation if Tempo URL is not configured
 	if a.Cfg.Tempo.URL == "" {
-		return
+		return nil
 	}
 
 	// Validate URL format
@@ -383,24 +1129,93 @@ func (a *App) validateTempoConfig() {
 		log.Warn().Str("url", a.Cfg.Tempo.URL).Msg("Tempo URL should start with http:// or https://")
 	}
 
-	// Validate certificate files exist if mTLS is enabled
+	// Validate certificate files exist if mTLS is enabled; secret references are resolved by WithSecrets
 	if a.Cfg.Tempo.UseMutualTLS {
-		if a.Cfg.Tempo.Cert != "" {
+		if a.Cfg.Tempo.Cert != "" && !isSecretRef(a.Cfg.Tempo.Cert) {
 			if _, err := os.Stat(a.Cfg.Tempo.Cert); os.IsNotExist(err) {
 				log.Error().Str("cert", a.Cfg.Tempo.Cert).Msg("Tempo certificate file not found")
 			}
 		}
-		if a.Cfg.Tempo.Key != "" {
+		if a.Cfg.Tempo.Key != "" && !isSecretRef(a.Cfg.Tempo.Key) {
 			if _, err := os.Stat(a.Cfg.Tempo.Key); os.IsNotExist(err) {
 				log.Error().Str("key", a.Cfg.Tempo.Key).Msg("Tempo key file not found")
 			}
 		}
 	}
 
+	// Policies on attributes without a scope prefix would inject filters Tempo cannot resolve
+	if err := validateTenantLabels(a.Cfg.Tempo.TenantLabels); err != nil {
+		return fmt.Errorf("invalid tempo.tenant_labels: %w", err)
+	}
+
 	log.Debug().
 		Str("url", a.Cfg.Tempo.URL).
 		Bool("use_mutual_tls", a.Cfg.Tempo.UseMutualTLS).
+		Strs("tenant_labels", a.Cfg.Tempo.TenantLabels).
 		Msg("Tempo configuration loaded")
+	return nil
+}
+
+// redactedValue replaces credentials in the configuration served by /-/config.
+const redactedValue = "<redacted>"
+
+// Redacted returns a copy of the configuration with credentials, certificates and header
+// values replaced by redactedValue, and passwords removed from upstream URLs. Unset fields
+// stay empty so that it remains visible which credentials are configured.
+func (c Config) Redacted() Config {
+	c.Web.ServiceAccountToken = redact(c.Web.ServiceAccountToken)
+	c.Alert.Cert = redact(c.Alert.Cert)
+	c.Audit.Webhook.URL = redactURL(c.Audit.Webhook.URL)
+	c.Audit.Webhook.Headers = redactHeaders(c.Audit.Webhook.Headers)
+	c.Secrets.Vault.Token = redact(c.Secrets.Vault.Token)
+
+	c.Thanos.URL = redactURL(c.Thanos.URL)
+	c.Thanos.StaticToken = redact(c.Thanos.StaticToken)
+	c.Thanos.Cert = redact(c.Thanos.Cert)
+	c.Thanos.Key = redact(c.Thanos.Key)
+	c.Thanos.Headers = redactHeaders(c.Thanos.Headers)
+
+	c.Loki.URL = redactURL(c.Loki.URL)
+	c.Loki.Shadow.URL = redactURL(c.Loki.Shadow.URL)
+	c.Loki.StaticToken = redact(c.Loki.StaticToken)
+	c.Loki.Cert = redact(c.Loki.Cert)
+	c.Loki.Key = redact(c.Loki.Key)
+	c.Loki.Headers = redactHeaders(c.Loki.Headers)
+
+	c.Tempo.URL = redactURL(c.Tempo.URL)
+	c.Tempo.StaticToken = redact(c.Tempo.StaticToken)
+	c.Tempo.Cert = redact(c.Tempo.Cert)
+	c.Tempo.Key = redact(c.Tempo.Key)
+	c.Tempo.Headers = redactHeaders(c.Tempo.Headers)
+	return c
+}
+
+func redact(value string) string {
+	if value == "" {
+		return ""
+	}
+	return redactedValue
+}
+
+// redactHeaders returns a copy of headers with redacted values, leaving headers unchanged.
+func redactHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	redacted := make(map[string]string, len(headers))
+	for k, v := range headers {
+		redacted[k] = redact(v)
+	}
+	return redacted
+}
+
+// redactURL masks the password of a URL with user information.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return redact(rawURL)
+	}
+	return u.Redacted()
 }
 
 // GetProxyConfig merges upstream-specific proxy configuration with global defaults.
@@ -415,6 +1230,12 @@ func (c *Config) GetProxyConfig(upstreamProxy *ProxyConfig) ProxyConfig {
 		MaxIdleConns:        500,
 		MaxIdleConnsPerHost: 100,
 		ForceHTTP2:          true,
+		KeepAlive:           30 * time.Second,
+		FlushInterval:       -1,
+		RetryBackoff:        100 * time.Millisecond,
+		RetryOnStatus:       []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+		BreakerCooldown:     30 * time.Second,
+		BreakerOnStatus:     []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
 	}
 
 	// Apply global proxy defaults if set
@@ -437,6 +1258,43 @@ func (c *Config) GetProxyConfig(upstreamProxy *ProxyConfig) ProxyConfig {
 	if c.Proxy.ForceHTTP2 {
 		cfg.ForceHTTP2 = c.Proxy.ForceHTTP2
 	}
+	// A negative keep-alive disables the probes
+	if c.Proxy.KeepAlive != 0 {
+		cfg.KeepAlive = c.Proxy.KeepAlive
+	}
+	if c.Proxy.HTTP2PingInterval > 0 {
+		cfg.HTTP2PingInterval = c.Proxy.HTTP2PingInterval
+	}
+	if c.Proxy.FlushInterval > 0 {
+		cfg.FlushInterval = c.Proxy.FlushInterval
+	}
+	if c.Proxy.TLSMinVersion != "" {
+		cfg.TLSMinVersion = c.Proxy.TLSMinVersion
+	}
+	if len(c.Proxy.TLSCipherSuites) > 0 {
+		cfg.TLSCipherSuites = c.Proxy.TLSCipherSuites
+	}
+	if len(c.Proxy.RouteTimeouts) > 0 {
+		cfg.RouteTimeouts = mergeRouteTimeouts(nil, c.Proxy.RouteTimeouts)
+	}
+	if c.Proxy.RetryAttempts > 0 {
+		cfg.RetryAttempts = c.Proxy.RetryAttempts
+	}
+	if c.Proxy.RetryBackoff > 0 {
+		cfg.RetryBackoff = c.Proxy.RetryBackoff
+	}
+	if len(c.Proxy.RetryOnStatus) > 0 {
+		cfg.RetryOnStatus = c.Proxy.RetryOnStatus
+	}
+	if c.Proxy.BreakerThreshold > 0 {
+		cfg.BreakerThreshold = c.Proxy.BreakerThreshold
+	}
+	if c.Proxy.BreakerCooldown > 0 {
+		cfg.BreakerCooldown = c.Proxy.BreakerCooldown
+	}
+	if len(c.Proxy.BreakerOnStatus) > 0 {
+		cfg.BreakerOnStatus = c.Proxy.BreakerOnStatus
+	}
 
 	// Apply upstream-specific overrides if set
 	if upstreamProxy != nil {
@@ -459,15 +1317,111 @@ func (c *Config) GetProxyConfig(upstreamProxy *ProxyConfig) ProxyConfig {
 		if upstreamProxy.ForceHTTP2 {
 			cfg.ForceHTTP2 = upstreamProxy.ForceHTTP2
 		}
+		if upstreamProxy.KeepAlive != 0 {
+			cfg.KeepAlive = upstreamProxy.KeepAlive
+		}
+		if upstreamProxy.HTTP2PingInterval > 0 {
+			cfg.HTTP2PingInterval = upstreamProxy.HTTP2PingInterval
+		}
+		if upstreamProxy.FlushInterval > 0 {
+			cfg.FlushInterval = upstreamProxy.FlushInterval
+		}
+		if upstreamProxy.TLSMinVersion != "" {
+			cfg.TLSMinVersion = upstreamProxy.TLSMinVersion
+		}
+		if len(upstreamProxy.TLSCipherSuites) > 0 {
+			cfg.TLSCipherSuites = upstreamProxy.TLSCipherSuites
+		}
+		if len(upstreamProxy.RouteTimeouts) > 0 {
+			cfg.RouteTimeouts = mergeRouteTimeouts(cfg.RouteTimeouts, upstreamProxy.RouteTimeouts)
+		}
+		if upstreamProxy.RetryAttempts > 0 {
+			cfg.RetryAttempts = upstreamProxy.RetryAttempts
+		}
+		if upstreamProxy.RetryBackoff > 0 {
+			cfg.RetryBackoff = upstreamProxy.RetryBackoff
+		}
+		if len(upstreamProxy.RetryOnStatus) > 0 {
+			cfg.RetryOnStatus = upstreamProxy.RetryOnStatus
+		}
+		if upstreamProxy.BreakerThreshold > 0 {
+			cfg.BreakerThreshold = upstreamProxy.BreakerThreshold
+		}
+		if upstreamProxy.BreakerCooldown > 0 {
+			cfg.BreakerCooldown = upstreamProxy.BreakerCooldown
+		}
+		if len(upstreamProxy.BreakerOnStatus) > 0 {
+			cfg.BreakerOnStatus = upstreamProxy.BreakerOnStatus
+		}
 	}
 
 	return cfg
 }
 
+// tlsVersions maps the configurable TLS versions to their crypto/tls constants.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// applyTLSSettings returns a copy of tlsConfig restricted to the minimum TLS version and cipher
+// suites of proxyCfg. Unknown versions and cipher suite names, as well as suites crypto/tls
+// considers insecure, are rejected. TLS 1.3 suites are not configurable and always enabled.
+func applyTLSSettings(tlsConfig *tls.Config, proxyCfg ProxyConfig) (*tls.Config, error) {
+	config := tlsConfig.Clone()
+	if proxyCfg.TLSMinVersion == "" && len(proxyCfg.TLSCipherSuites) == 0 {
+		return config, nil
+	}
+	if config == nil {
+		config = &tls.Config{}
+	}
+
+	if proxyCfg.TLSMinVersion != "" {
+		version, ok := tlsVersions[proxyCfg.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid tls_min_version %q: must be one of 1.0, 1.1, 1.2, 1.3", proxyCfg.TLSMinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if len(proxyCfg.TLSCipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		insecure := make(map[string]bool)
+		for _, suite := range tls.InsecureCipherSuites() {
+			insecure[suite.Name] = true
+		}
+
+		config.CipherSuites = make([]uint16, 0, len(proxyCfg.TLSCipherSuites))
+		for _, name := range proxyCfg.TLSCipherSuites {
+			if insecure[name] {
+				return nil, fmt.Errorf("tls_cipher_suites: %s is insecure", name)
+			}
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("tls_cipher_suites: unknown cipher suite %s", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+	}
+	return config, nil
+}
+
 // createTransport creates an HTTP transport with the specified proxy configuration and TLS settings.
 // Each upstream gets its own dedicated transport instance to enable per-upstream connection pooling.
-func (a *App) createTransport(proxyCfg ProxyConfig, tlsConfig *tls.Config) *http.Transport {
-	return &http.Transport{
+// It returns an error if the configured TLS version or cipher suites are invalid.
+func (a *App) createTransport(proxyCfg ProxyConfig, tlsConfig *tls.Config) (*http.Transport, error) {
+	// Transports modify their TLS config, so each gets its own copy
+	tlsConfig, err := applyTLSSettings(tlsConfig, proxyCfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy TLS configuration: %w", err)
+	}
+	transport := &http.Transport{
+		DialContext:         newDialer(proxyCfg).DialContext,
 		TLSClientConfig:     tlsConfig,
 		MaxIdleConns:        proxyCfg.MaxIdleConns,
 		MaxIdleConnsPerHost: proxyCfg.MaxIdleConnsPerHost,
@@ -477,4 +1431,14 @@ func (a *App) createTransport(proxyCfg ProxyConfig, tlsConfig *tls.Config) *http
 		DisableCompression:  false,
 		ForceAttemptHTTP2:   proxyCfg.ForceHTTP2,
 	}
+	if proxyCfg.HTTP2PingInterval > 0 {
+		transport.HTTP2 = &http.HTTP2Config{SendPingTimeout: proxyCfg.HTTP2PingInterval}
+	}
+	return transport, nil
+}
+
+// newDialer returns the dialer of upstream connections. TCP keep-alive probes detect
+// connections broken while idle, e.g. by a backend restart behind a load balancer.
+func newDialer(proxyCfg ProxyConfig) *net.Dialer {
+	return &net.Dialer{KeepAlive: proxyCfg.KeepAlive}
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/rs/zerolog/log"
+)
+
+// deniedTemplates caches parsed denied message templates by format string.
+var deniedTemplates sync.Map
+
+// deniedMessageData is the data available to denied message templates.
+type deniedMessageData struct {
+	Upstream string // Upstream the request was for: thanos, loki or tempo
+	Username string // Username of the denied user
+	Email    string // Email of the denied user
+	Label    string // Policy label of the denied value, empty unless a label value was denied
+	Value    string // Denied label value, empty unless a label value was denied
+	Error    string // Default denial message
+}
+
+// writeDenied answers an authorization failure with 403 Forbidden. The body is the configured
+// denied message of the upstream, rendered with the denied label and value, or the error itself
+// if none is configured or the message cannot be rendered. Requests the label store cannot
+// decide on are answered with 503 Service Unavailable instead, and requests its backend
+// answered with an invalid result with 500 Internal Server Error.
+func (a *App) writeDenied(w http.ResponseWriter, upstream string, token OAuthToken, err error) {
+	if errors.Is(err, ErrLabelStoreUnavailable) {
+		logAndWriteError(w, http.StatusServiceUnavailable, err, "")
+		return
+	}
+	if errors.Is(err, ErrInvalidPolicyResult) {
+		logAndWriteError(w, http.StatusInternalServerError, err, "")
+		return
+	}
+	message := ""
+	if format := a.deniedMessage(upstream); format != "" {
+		data := deniedMessageData{
+			Upstream: upstream,
+			Username: token.PreferredUsername,
+			Email:    token.Email,
+			Error:    err.Error(),
+		}
+		var denied *DeniedLabelError
+		if errors.As(err, &denied) {
+			data.Label, data.Value = denied.Label, denied.Value
+		}
+		var renderErr error
+		if message, renderErr = formatDeniedMessage(format, data); renderErr != nil {
+			log.Error().Err(renderErr).Str("upstream", upstream).Msg("Error rendering denied message, using the default")
+		}
+	}
+	logAndWriteError(w, http.StatusForbidden, err, message)
+}
+
+// logDeniedQuery logs a query denied by enforcement at warn level if log.log_denied_queries
+// is enabled, for security monitoring to alert on users probing for data they may not access.
+// Like request bodies, the query itself is only included at trace level.
+func (a *App) logDeniedQuery(r *http.Request, upstream string, token OAuthToken, query string, err error) {
+	if !a.Cfg.Log.LogDeniedQueries {
+		return
+	}
+	event := requestLogger(r).Warn().
+		Str("event", "denied_query").
+		Str("user", token.PreferredUsername).
+		Str("upstream", upstream).
+		Str("path", r.URL.Path)
+	var denied *DeniedLabelError
+	if errors.As(err, &denied) {
+		event = event.Str("label", denied.Label).Str("value", denied.Value)
+	}
+	if a.Cfg.Log.Level == -1 {
+		event = event.Str("query", query)
+	}
+	event.Err(err).Msg("Denied query")
+}
+
+// formatDeniedMessage renders a denied message template, e.g.
+// "Access to {{.Label}}={{.Value}} denied, request it at https://access.example.com".
+func formatDeniedMessage(format string, data deniedMessageData) (string, error) {
+	var tmpl *template.Template
+	if cached, ok := deniedTemplates.Load(format); ok {
+		tmpl = cached.(*template.Template)
+	} else {
+		parsed, err := template.New("denied").Option("missingkey=error").Parse(format)
+		if err != nil {
+			return "", fmt.Errorf("invalid denied message template: %w", err)
+		}
+		deniedTemplates.Store(format, parsed)
+		tmpl = parsed
+	}
+
+	var message strings.Builder
+	if err := tmpl.Execute(&message, data); err != nil {
+		return "", fmt.Errorf("error executing denied message template: %w", err)
+	}
+	return message.String(), nil
+}
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/rs/zerolog/log"
 )
 
@@ -16,58 +24,429 @@ type EnforceQL interface {
 	Enforce(query string, policy LabelPolicy) (string, error)
 }
 
+// EnforceResult is the outcome of enforcing a single query.
+type EnforceResult struct {
+	Query    string // The enforced query
+	Injected bool   // Policy matchers were added, rather than all found in the query and validated
+}
+
+// ResultEnforcer is implemented by enforcers that report how the policy was enforced.
+type ResultEnforcer interface {
+	EnforceResult(query string, policy LabelPolicy) (EnforceResult, error)
+}
+
+// enforceQuery enforces query with EnforceResult if the enforcer implements it. Other
+// enforcers never report an injection.
+func enforceQuery(enforce EnforceQL, query string, policy LabelPolicy) (EnforceResult, error) {
+	if e, ok := enforce.(ResultEnforcer); ok {
+		return e.EnforceResult(query, policy)
+	}
+	enforced, err := enforce.Enforce(query, policy)
+	return EnforceResult{Query: enforced}, err
+}
+
+// validatingEnforcer checks queries with the wrapped enforcer but leaves them unchanged,
+// for routes that only parse the query, such as format_query, where injected matchers would
+// be returned to the user as part of their query.
+type validatingEnforcer struct {
+	EnforceQL
+}
+
+// Enforce returns the query unchanged if the wrapped enforcer accepts it.
+func (v validatingEnforcer) Enforce(query string, policy LabelPolicy) (string, error) {
+	if _, err := v.EnforceQL.Enforce(query, policy); err != nil {
+		return "", err
+	}
+	return query, nil
+}
+
+// ErrUnsupportedQuery marks queries rejected because they use a feature disabled for the
+// upstream. They are answered with 400 Bad Request rather than 403 Forbidden.
+var ErrUnsupportedQuery = errors.New("unsupported query")
+
+// ErrUnenforceableQuery marks queries that parse but cannot be scoped to the tenant, e.g.
+// PromQL queries without any series selector or queries rewriting a policy label. They are
+// answered with 422 Unprocessable Entity rather than 403 Forbidden.
+var ErrUnenforceableQuery = errors.New("unenforceable query")
+
+// DeniedLabelError is returned when a query selects a value of a policy label that the
+// policy does not permit. The message names the query matcher's operator and the number of
+// values the policy allows for the label, or the negative rule excluding the value, but not
+// the permitted values themselves.
+type DeniedLabelError struct {
+	Label      string
+	Value      string
+	Operator   string // Operator of the query matcher selecting Value (e.g., =~)
+	Allowed    int    // Number of values the policy allows for Label
+	ExcludedBy string // Operator of the negative rule excluding Value, if it was excluded
+}
+
+func (e *DeniedLabelError) Error() string {
+	msg := fmt.Sprintf("unauthorized %s: %s", e.Label, e.Value)
+	switch {
+	case e.Operator == "":
+		return msg
+	case e.ExcludedBy != "":
+		return fmt.Sprintf("%s (matcher %s %s, excluded by a %s rule)", msg, e.Label, e.Operator, e.ExcludedBy)
+	case e.Allowed == 1:
+		return fmt.Sprintf("%s (matcher %s %s, 1 allowed value)", msg, e.Label, e.Operator)
+	default:
+		return fmt.Sprintf("%s (matcher %s %s, %d allowed values)", msg, e.Label, e.Operator, e.Allowed)
+	}
+}
+
+// UserLabelFilter restricts which labels, other than those governed by the label policy,
+// users may filter on in their queries. Enforcers apply it to the labels they extract.
+type UserLabelFilter struct {
+	Allowed   []string // If non-empty, only these labels may be used
+	Forbidden []string // These labels may never be used
+}
+
+// Validate returns an error if any of the given labels is not permitted. Labels with a
+// rule in the policy are always permitted since they are enforced by the policy itself.
+func (f UserLabelFilter) Validate(labelNames []string, policy LabelPolicy) error {
+	if len(f.Allowed) == 0 && len(f.Forbidden) == 0 {
+		return nil
+	}
+
+	policyLabels := make(map[string]bool, len(policy.Rules))
+	for _, rule := range policy.Rules {
+		policyLabels[rule.Name] = true
+	}
+
+	for _, name := range labelNames {
+		if policyLabels[name] {
+			continue
+		}
+		if slices.Contains(f.Forbidden, name) {
+			return fmt.Errorf("filtering on label %s is forbidden", name)
+		}
+		if len(f.Allowed) > 0 && !slices.Contains(f.Allowed, name) {
+			return fmt.Errorf("filtering on label %s is not allowed", name)
+		}
+	}
+	return nil
+}
+
+// LabelOperatorFilter restricts the operators users may apply to labels in their queries,
+// e.g. to reject a negation such as namespace!~".*" on the tenant label.
+type LabelOperatorFilter struct {
+	TenantLabels    []string // Labels TenantOperators applies to, besides those of the policy rules
+	TenantOperators []string // Operators allowed on the tenant and policy labels; empty allows any
+	Operators       []string // Operators allowed on all other labels; empty allows any
+}
+
+// enabled reports whether the filter restricts any operator.
+func (f LabelOperatorFilter) enabled() bool {
+	return len(f.TenantOperators) > 0 || len(f.Operators) > 0
+}
+
+// Validate returns an error if any of the query's matchers uses an operator not allowed on
+// its label.
+func (f LabelOperatorFilter) Validate(matchers []*labels.Matcher, policy LabelPolicy) error {
+	if !f.enabled() {
+		return nil
+	}
+	for _, m := range matchers {
+		if err := f.check(m.Name, m.Type.String(), policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check returns an error if operator is not allowed on label.
+func (f LabelOperatorFilter) check(label, operator string, policy LabelPolicy) error {
+	if slices.Contains(f.TenantLabels, label) || policy.HasRuleFor(label) {
+		if len(f.TenantOperators) > 0 && !slices.Contains(f.TenantOperators, operator) {
+			return fmt.Errorf("operator %s is not allowed on tenant label %s", operator, label)
+		}
+		return nil
+	}
+	if len(f.Operators) > 0 && !slices.Contains(f.Operators, operator) {
+		return fmt.Errorf("operator %s is not allowed on label %s", operator, label)
+	}
+	return nil
+}
+
+// Operators LabelOperatorFilter may allow: those of label matchers, and for TraceQL also
+// the comparisons of attribute values.
+var (
+	matcherOperators = []string{"=", "!=", "=~", "!~"}
+	traceQLOperators = []string{"=", "!=", "=~", "!~", ">", ">=", "<", "<="}
+)
+
+// validateLabelOperators checks that every configured operator is one of valid.
+func validateLabelOperators(operators, valid []string) error {
+	for _, op := range operators {
+		if !slices.Contains(valid, op) {
+			return fmt.Errorf("invalid label operator %q, must be one of %s", op, strings.Join(valid, ", "))
+		}
+	}
+	return nil
+}
+
 // enforceRequest enforces the incoming HTTP request using LabelPolicy.
 // It provides multi-label enforcement with flexible operators and logic.
-func enforceRequest(r *http.Request, enforce EnforceQL, policy *LabelPolicy, queryMatch string) error {
+// JSON POST bodies are enforced at queryJSONPath when it is configured.
+// Absent and empty query parameters are injected or rejected as set by handling.
+// It reports whether policy matchers were injected into any of the request's queries.
+func enforceRequest(r *http.Request, enforce EnforceQL, policy *LabelPolicy, queryMatch string, queryJSONPath string, handling QueryHandling) (bool, error) {
 	switch r.Method {
 	case http.MethodGet:
-		return enforceGet(r, enforce, *policy, queryMatch)
+		return enforceGet(r, enforce, *policy, queryMatch, handling)
 	case http.MethodPost:
-		return enforcePost(r, enforce, *policy, queryMatch)
+		if queryJSONPath != "" && isJSONRequest(r) {
+			return enforceJSON(r, enforce, *policy, queryMatch, queryJSONPath)
+		}
+		return enforcePost(r, enforce, *policy, queryMatch, handling)
 	default:
-		return fmt.Errorf("invalid method")
+		return false, fmt.Errorf("invalid method")
 	}
 }
 
 // enforceGet enforces the query parameters of the incoming GET HTTP request using LabelPolicy.
 // It modifies the request URL's query parameters to ensure they adhere to the label policy.
-func enforceGet(r *http.Request, enforce EnforceQL, policy LabelPolicy, queryMatch string) error {
-	log.Trace().Str("kind", "urlmatch").Str("queryMatch", queryMatch).Str("query", r.URL.Query().Get("query")).Msg("enforcing with policy")
+// The raw query is decoded exactly once and re-encoded after enforcement.
+func enforceGet(r *http.Request, enforce EnforceQL, policy LabelPolicy, queryMatch string, handling QueryHandling) (bool, error) {
+	values := parseQueryLenient(r.URL.RawQuery)
+	log.Trace().Str("kind", "urlmatch").Str("queryMatch", queryMatch).Strs("query", values[queryMatch]).Msg("enforcing with policy")
+	if err := checkQueryPresence(values[queryMatch], queryMatch, handling); err != nil {
+		return false, err
+	}
 
-	query, err := enforce.Enforce(r.URL.Query().Get(queryMatch), policy)
+	queries, injected, err := enforceAll(enforce, policy, values[queryMatch])
 	if err != nil {
-		return err
+		return false, err
 	}
 	log.Trace().Any("url", r.URL).Msg("pre enforced url")
-	values := r.URL.Query()
-	values.Set(queryMatch, query)
+	values[queryMatch] = queries
 	r.URL.RawQuery = values.Encode()
 	log.Trace().Any("url", r.URL).Msg("post enforced url")
 
 	r.Body = io.NopCloser(strings.NewReader(""))
 	r.ContentLength = 0
+	return injected, nil
+}
+
+// enforceAll enforces every value of a repeated query parameter, such as batched Loki
+// queries or several match[] selectors, and fails if any of them is not compliant. A
+// missing parameter is enforced as an empty query, which selects the policy labels.
+// It reports whether policy matchers were injected into any of the queries.
+func enforceAll(enforce EnforceQL, policy LabelPolicy, queries []string) ([]string, bool, error) {
+	if len(queries) == 0 {
+		queries = []string{""}
+	}
+	enforced := make([]string, len(queries))
+	injected := false
+	for i, query := range queries {
+		result, err := enforceQuery(enforce, query, policy)
+		if err != nil {
+			return nil, false, err
+		}
+		enforced[i] = result.Query
+		injected = injected || result.Injected
+	}
+	return enforced, injected, nil
+}
+
+// checkQueryPresence returns an ErrUnsupportedQuery error if the values of the query
+// parameter queryMatch are absent or empty and handling rejects that case.
+func checkQueryPresence(queries []string, queryMatch string, handling QueryHandling) error {
+	if len(queries) == 0 {
+		if handling.Absent == QueryReject {
+			return fmt.Errorf("%w: missing %s parameter", ErrUnsupportedQuery, queryMatch)
+		}
+		return nil
+	}
+	if slices.Contains(queries, "") && handling.Empty == QueryReject {
+		return fmt.Errorf("%w: empty %s parameter", ErrUnsupportedQuery, queryMatch)
+	}
 	return nil
 }
 
+// parseQueryLenient parses a raw URL query like url.ParseQuery, but keeps a '%' that does
+// not start a valid escape as a literal character. url.ParseQuery drops such parameters
+// entirely, which would replace an unencoded query (e.g., printf "%-4s" in a LogQL
+// line_format) with the bare policy selector instead of enforcing it.
+func parseQueryLenient(rawQuery string) url.Values {
+	values := url.Values{}
+	for rawQuery != "" {
+		var pair string
+		pair, rawQuery, _ = strings.Cut(rawQuery, "&")
+		if pair == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(pair, "=")
+		values.Add(queryUnescapeLenient(key), queryUnescapeLenient(value))
+	}
+	return values
+}
+
+// queryUnescapeLenient decodes a query component, keeping invalid '%' escapes literally.
+func queryUnescapeLenient(s string) string {
+	if unescaped, err := url.QueryUnescape(s); err == nil {
+		return unescaped
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '%':
+			if i+2 < len(s) {
+				if decoded, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+					b.WriteByte(byte(decoded))
+					i += 2
+					continue
+				}
+			}
+			b.WriteByte(c)
+		case '+':
+			b.WriteByte(' ')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
 // enforcePost enforces the form values of the incoming POST HTTP request using LabelPolicy.
 // It modifies the request's form values to ensure they adhere to the label policy.
-func enforcePost(r *http.Request, enforce EnforceQL, policy LabelPolicy, queryMatch string) error {
+func enforcePost(r *http.Request, enforce EnforceQL, policy LabelPolicy, queryMatch string, handling QueryHandling) (bool, error) {
 	if err := r.ParseForm(); err != nil {
-		return err
+		return false, err
+	}
+	log.Trace().Str("kind", "bodymatch").Str("queryMatch", queryMatch).Strs("query", r.PostForm[queryMatch]).Msg("enforcing with policy")
+	if err := checkQueryPresence(r.PostForm[queryMatch], queryMatch, handling); err != nil {
+		return false, err
 	}
-	log.Trace().Str("kind", "bodymatch").Str("queryMatch", queryMatch).Str("query", r.PostForm.Get("query")).Msg("enforcing with policy")
 
-	query := r.PostForm.Get(queryMatch)
-	query, err := enforce.Enforce(query, policy)
+	queries, injected, err := enforceAll(enforce, policy, r.PostForm[queryMatch])
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	_ = r.Body.Close()
-	r.PostForm.Set(queryMatch, query)
+	r.PostForm[queryMatch] = queries
 	newBody := r.PostForm.Encode()
 	r.Body = io.NopCloser(strings.NewReader(newBody))
 	r.ContentLength = int64(len(newBody))
 	r.URL.RawQuery = ""
-	return nil
+	// The body is always re-encoded as a form; keep the client's Content-Type, including
+	// its parameters, unless it declared something else
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != formContentType {
+		r.Header.Set("Content-Type", formContentType)
+	}
+	return injected, nil
+}
+
+// formContentType is the media type of enforced POST bodies.
+const formContentType = "application/x-www-form-urlencoded"
+
+// isJSONRequest reports whether the request body is declared as JSON.
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// enforceJSON enforces queries embedded in a JSON request body, such as Grafana's
+// /api/ds/query envelope. Every string found at queryJSONPath is enforced and written back.
+// The path is dot-separated; "*" matches all array elements or object values and numeric
+// segments index arrays (e.g., "queries.*.expr"). Requests without a query at the path are rejected.
+// queryMatch parameters in the URL are enforced as well, as upstreams may read them too.
+func enforceJSON(r *http.Request, enforce EnforceQL, policy LabelPolicy, queryMatch string, queryJSONPath string) (bool, error) {
+	values := parseQueryLenient(r.URL.RawQuery)
+	urlInjected := false
+	if urlQueries, ok := values[queryMatch]; ok {
+		queries, injected, err := enforceAll(enforce, policy, urlQueries)
+		if err != nil {
+			return false, err
+		}
+		values[queryMatch] = queries
+		r.URL.RawQuery = values.Encode()
+		urlInjected = injected
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return false, err
+	}
+	_ = r.Body.Close()
+
+	var payload interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); err != nil {
+		return false, fmt.Errorf("invalid JSON body: %w", err)
+	}
+
+	log.Trace().Str("kind", "jsonmatch").Str("queryJSONPath", queryJSONPath).Msg("enforcing with policy")
+
+	injected := urlInjected
+	payload, enforced, err := rewriteJSONPath(payload, strings.Split(queryJSONPath, "."), func(query string) (string, error) {
+		result, err := enforceQuery(enforce, query, policy)
+		injected = injected || result.Injected
+		return result.Query, err
+	})
+	if err != nil {
+		return false, err
+	}
+	if enforced == 0 {
+		return false, fmt.Errorf("no query found at JSON path %s", queryJSONPath)
+	}
+
+	var newBody bytes.Buffer
+	encoder := json.NewEncoder(&newBody)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(payload); err != nil {
+		return false, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(newBody.Bytes()))
+	r.ContentLength = int64(newBody.Len())
+	return injected, nil
+}
+
+// rewriteJSONPath walks node along path and replaces every string found at the end of
+// the path with the result of rewrite. It returns the updated node and the number of
+// strings rewritten. Missing keys are skipped; non-string values at the path are an error.
+func rewriteJSONPath(node interface{}, path []string, rewrite func(string) (string, error)) (interface{}, int, error) {
+	if len(path) == 0 {
+		query, ok := node.(string)
+		if !ok {
+			return node, 0, fmt.Errorf("value at JSON query path is not a string")
+		}
+		enforced, err := rewrite(query)
+		return enforced, 1, err
+	}
+
+	segment, rest := path[0], path[1:]
+	total := 0
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if segment != "*" && segment != key {
+				continue
+			}
+			updated, count, err := rewriteJSONPath(child, rest, rewrite)
+			if err != nil {
+				return node, 0, err
+			}
+			v[key] = updated
+			total += count
+		}
+	case []interface{}:
+		for i, child := range v {
+			if segment != "*" && segment != strconv.Itoa(i) {
+				continue
+			}
+			updated, count, err := rewriteJSONPath(child, rest, rewrite)
+			if err != nil {
+				return node, 0, err
+			}
+			v[i] = updated
+			total += count
+		}
+	}
+	return node, total, nil
 }
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnforceRequest_JSONPath(t *testing.T) {
+	policy := &LabelPolicy{
+		Rules: []LabelRule{{Name: "namespace", Operator: "=", Values: []string{"prod"}}},
+		Logic: LogicAND,
+	}
+	envelope := `{
+		"from": "now-1h",
+		"to": "now",
+		"queries": [
+			{"refId": "A", "expr": "up", "intervalMs": 15000, "datasource": {"uid": "prom"}},
+			{"refId": "B", "expr": "rate(http_requests_total{namespace=\"prod\"}[5m])"}
+		]
+	}`
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/query", strings.NewReader(envelope))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	_, err := enforceRequest(req, PromQLEnforcer{}, policy, "query", "queries.*.expr", QueryHandling{})
+	assert.NoError(t, err)
+
+	body, err := io.ReadAll(req.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(body)), req.ContentLength)
+
+	var payload struct {
+		From    string `json:"from"`
+		Queries []struct {
+			RefID      string `json:"refId"`
+			Expr       string `json:"expr"`
+			IntervalMs int    `json:"intervalMs"`
+		} `json:"queries"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &payload))
+	assert.Equal(t, "now-1h", payload.From)
+	assert.Equal(t, `up{namespace="prod"}`, payload.Queries[0].Expr)
+	assert.Equal(t, 15000, payload.Queries[0].IntervalMs)
+	assert.Equal(t, `rate(http_requests_total{namespace="prod"}[5m])`, payload.Queries[1].Expr)
+}
+
+func TestEnforceRequest_JSONPathErrors(t *testing.T) {
+	policy := &LabelPolicy{
+		Rules: []LabelRule{{Name: "namespace", Operator: "=", Values: []string{"prod"}}},
+		Logic: LogicAND,
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		errMsg string
+	}{
+		{name: "unauthorized value", body: `{"queries":[{"expr":"up{namespace=\"dev\"}"}]}`, errMsg: "unauthorized namespace"},
+		{name: "missing query", body: `{"queries":[{"refId":"A"}]}`, errMsg: "no query found"},
+		{name: "non-string query", body: `{"queries":[{"expr":42}]}`, errMsg: "not a string"},
+		{name: "invalid JSON", body: `{"queries":`, errMsg: "invalid JSON body"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/query", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			_, err := enforceRequest(req, PromQLEnforcer{}, policy, "query", "queries.*.expr", QueryHandling{})
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+}
+
+func TestEnforceRequest_JSONPathURLQuery(t *testing.T) {
+	policy := &LabelPolicy{
+		Rules: []LabelRule{{Name: "namespace", Operator: "=", Values: []string{"prod"}}},
+		Logic: LogicAND,
+	}
+	body := `{"queries":[{"expr":"up"}]}`
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/query?query="+url.QueryEscape(`up{namespace="secret"}`), strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	_, err := enforceRequest(req, PromQLEnforcer{}, policy, "query", "queries.*.expr", QueryHandling{})
+	assert.ErrorContains(t, err, "unauthorized namespace")
+
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/query?query=up&step=15", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	_, err = enforceRequest(req, PromQLEnforcer{}, policy, "query", "queries.*.expr", QueryHandling{})
+	assert.NoError(t, err)
+	assert.Equal(t, `up{namespace="prod"}`, req.URL.Query().Get("query"))
+	assert.Equal(t, "15", req.URL.Query().Get("step"))
+}
+
+func TestEnforceRequest_JSONPathIgnoredForForms(t *testing.T) {
+	policy := &LabelPolicy{
+		Rules: []LabelRule{{Name: "namespace", Operator: "=", Values: []string{"prod"}}},
+		Logic: LogicAND,
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/query", strings.NewReader("query=up"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	_, err := enforceRequest(req, PromQLEnforcer{}, policy, "query", "queries.*.expr", QueryHandling{})
+	assert.NoError(t, err)
+	assert.Equal(t, `up{namespace="prod"}`, req.PostForm.Get("query"))
+}
+
+func TestUserLabelFilter_Validate(t *testing.T) {
+	policy := LabelPolicy{
+		Rules: []LabelRule{{Name: "namespace", Operator: "=", Values: []string{"prod"}}},
+		Logic: LogicAND,
+	}
+
+	tests := []struct {
+		name      string
+		filter    UserLabelFilter
+		labels    []string
+		expectErr string
+	}{
+		{name: "no restrictions", filter: UserLabelFilter{}, labels: []string{"instance"}},
+		{name: "allowed label", filter: UserLabelFilter{Allowed: []string{"job", "level"}}, labels: []string{"job"}},
+		{name: "label not in allow list", filter: UserLabelFilter{Allowed: []string{"job"}}, labels: []string{"instance"}, expectErr: "filtering on label instance is not allowed"},
+		{name: "forbidden label", filter: UserLabelFilter{Forbidden: []string{"instance"}}, labels: []string{"job", "instance"}, expectErr: "filtering on label instance is forbidden"},
+		{name: "forbidden wins over allowed", filter: UserLabelFilter{Allowed: []string{"instance"}, Forbidden: []string{"instance"}}, labels: []string{"instance"}, expectErr: "forbidden"},
+		{name: "policy label always permitted", filter: UserLabelFilter{Allowed: []string{"job"}, Forbidden: []string{"namespace"}}, labels: []string{"namespace"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.filter.Validate(tt.labels, policy)
+			if tt.expectErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tt.expectErr)
+		})
+	}
+}
+
+func TestEnforcers_UserLabels(t *testing.T) {
+	filter := UserLabelFilter{Allowed: []string{"job", "level", "resource.service.name"}, Forbidden: []string{"instance", "span.http.url"}}
+	policy := LabelPolicy{
+		Rules: []LabelRule{{Name: "namespace", Operator: "=", Values: []string{"prod"}}},
+		Logic: LogicAND,
+	}
+	tracePolicy := LabelPolicy{
+		Rules: []LabelRule{{Name: "resource.namespace", Operator: "=", Values: []string{"prod"}}},
+		Logic: LogicAND,
+	}
+
+	tests := []struct {
+		name      string
+		enforcer  EnforceQL
+		policy    LabelPolicy
+		query     string
+		expectErr string
+	}{
+		{name: "PromQL allowed label", enforcer: PromQLEnforcer{UserLabels: filter}, policy: policy, query: `up{job="api"}`},
+		{name: "PromQL metric name is not a user label", enforcer: PromQLEnforcer{UserLabels: filter}, policy: policy, query: `{__name__="up", namespace="prod"}`},
+		{name: "PromQL forbidden label", enforcer: PromQLEnforcer{UserLabels: filter}, policy: policy, query: `up{instance="host:9090"}`, expectErr: "forbidden"},
+		{name: "PromQL label not allowed", enforcer: PromQLEnforcer{UserLabels: filter}, policy: policy, query: `up{pod="api-0"}`, expectErr: "not allowed"},
+		{name: "PromQL OR policy checks user labels", enforcer: PromQLEnforcer{UserLabels: filter}, policy: LabelPolicy{
+			Rules: []LabelRule{
+				{Name: "namespace", Operator: "=", Values: []string{"prod"}},
+				{Name: "team", Operator: "=", Values: []string{"backend"}},
+			},
+			Logic: LogicOR,
+		}, query: `up{instance="host:9090"}`, expectErr: "forbidden"},
+		{name: "LogQL allowed label", enforcer: LogQLEnforcer{UserLabels: filter}, policy: policy, query: `{level="error"}`},
+		{name: "LogQL forbidden label", enforcer: LogQLEnforcer{UserLabels: filter}, policy: policy, query: `{instance="host"}`, expectErr: "forbidden"},
+		{name: "LogQL label not allowed", enforcer: LogQLEnforcer{UserLabels: filter}, policy: policy, query: `{app="api"}`, expectErr: "not allowed"},
+		{name: "TraceQL allowed attribute", enforcer: TraceQLEnforcer{UserLabels: filter}, policy: tracePolicy, query: `{ resource.service.name = "api" }`},
+		{name: "TraceQL intrinsics are not restricted", enforcer: TraceQLEnforcer{UserLabels: filter}, policy: tracePolicy, query: `{ duration > 1s }`},
+		{name: "TraceQL forbidden attribute", enforcer: TraceQLEnforcer{UserLabels: filter}, policy: tracePolicy, query: `{ span.http.url = "/admin" }`, expectErr: "forbidden"},
+		{name: "TraceQL attribute not allowed", enforcer: TraceQLEnforcer{UserLabels: filter}, policy: tracePolicy, query: `{ span.db.statement = "select" }`, expectErr: "not allowed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.enforcer.Enforce(tt.query, tt.policy)
+			if tt.expectErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tt.expectErr)
+		})
+	}
+}
+
+func TestEnforcers_LabelOperators(t *testing.T) {
+	filter := LabelOperatorFilter{TenantLabels: []string{"namespace"}, TenantOperators: []string{"=", "=~"}}
+	strict := LabelOperatorFilter{TenantLabels: []string{"namespace"}, TenantOperators: []string{"=", "=~"}, Operators: []string{"=", "!="}}
+	traceFilter := LabelOperatorFilter{TenantLabels: []string{"resource.namespace"}, TenantOperators: []string{"=", "=~"}, Operators: []string{"=", ">"}}
+	policy := LabelPolicy{
+		Rules: []LabelRule{{Name: "namespace", Operator: "=~", Values: []string{"prod", "staging"}}},
+		Logic: LogicAND,
+	}
+	teamPolicy := LabelPolicy{
+		Rules: []LabelRule{{Name: "team", Operator: "=", Values: []string{"backend"}}},
+		Logic: LogicAND,
+	}
+	tracePolicy := LabelPolicy{
+		Rules: []LabelRule{{Name: "resource.namespace", Operator: "=", Values: []string{"prod"}}},
+		Logic: LogicAND,
+	}
+
+	tests := []struct {
+		name      string
+		enforcer  EnforceQL
+		policy    LabelPolicy
+		query     string
+		expectErr string
+	}{
+		{name: "PromQL equality on tenant label", enforcer: PromQLEnforcer{Operators: filter}, policy: policy, query: `up{namespace="prod"}`},
+		{name: "PromQL regex on tenant label", enforcer: PromQLEnforcer{Operators: filter}, policy: policy, query: `up{namespace=~"prod|staging"}`},
+		{name: "PromQL negative regex on tenant label", enforcer: PromQLEnforcer{Operators: filter}, policy: policy, query: `up{namespace!~".*"}`, expectErr: "operator !~ is not allowed on tenant label namespace"},
+		{name: "PromQL negation on tenant label", enforcer: PromQLEnforcer{Operators: filter}, policy: policy, query: `up{namespace!="staging"}`, expectErr: "operator != is not allowed on tenant label namespace"},
+		{name: "PromQL negation on other label", enforcer: PromQLEnforcer{Operators: filter}, policy: policy, query: `up{job!="api"}`},
+		{name: "PromQL policy label is a tenant label", enforcer: PromQLEnforcer{Operators: filter}, policy: teamPolicy, query: `up{team!~"frontend"}`, expectErr: "operator !~ is not allowed on tenant label team"},
+		{name: "PromQL operator not allowed on other label", enforcer: PromQLEnforcer{Operators: strict}, policy: policy, query: `up{job=~"api.*"}`, expectErr: "operator =~ is not allowed on label job"},
+		{name: "PromQL metric name is not restricted", enforcer: PromQLEnforcer{Operators: strict}, policy: policy, query: `{__name__=~"up|node_.*"}`},
+		{name: "PromQL injected matchers are not restricted", enforcer: PromQLEnforcer{Operators: strict}, policy: LabelPolicy{
+			Rules: []LabelRule{{Name: "namespace", Operator: "!=", Values: []string{"kube-system"}}},
+			Logic: LogicAND,
+		}, query: ""},
+		{name: "PromQL OR policy checks operators", enforcer: PromQLEnforcer{Operators: filter}, policy: LabelPolicy{
+			Rules: []LabelRule{
+				{Name: "namespace", Operator: "=", Values: []string{"prod"}},
+				{Name: "team", Operator: "=", Values: []string{"backend"}},
+			},
+			Logic: LogicOR,
+		}, query: `up{namespace!~".*"}`, expectErr: "operator !~ is not allowed on tenant label namespace"},
+		{name: "LogQL regex on tenant label", enforcer: LogQLEnforcer{Operators: filter}, policy: policy, query: `{namespace=~"prod"}`},
+		{name: "LogQL negative regex on tenant label", enforcer: LogQLEnforcer{Operators: filter}, policy: policy, query: `{app="api", namespace!~".*"}`, expectErr: "operator !~ is not allowed on tenant label namespace"},
+		{name: "LogQL operator not allowed on other label", enforcer: LogQLEnforcer{Operators: strict}, policy: policy, query: `{app!~"api"}`, expectErr: "operator !~ is not allowed on label app"},
+		{name: "TraceQL equality on tenant attribute", enforcer: TraceQLEnforcer{Operators: traceFilter}, policy: tracePolicy, query: `{ resource.namespace = "prod" }`},
+		{name: "TraceQL negative regex on tenant attribute", enforcer: TraceQLEnforcer{Operators: traceFilter}, policy: tracePolicy, query: `{ resource.namespace !~ ".*" }`, expectErr: "operator !~ is not allowed on tenant label resource.namespace"},
+		{name: "TraceQL comparison on other attribute", enforcer: TraceQLEnforcer{Operators: traceFilter}, policy: tracePolicy, query: `{ span.http.status_code > 499 }`},
+		{name: "TraceQL operator not allowed on other attribute", enforcer: TraceQLEnforcer{Operators: traceFilter}, policy: tracePolicy, query: `{ span.http.url =~ "/admin.*" }`, expectErr: "operator =~ is not allowed on label span.http.url"},
+		{name: "TraceQL intrinsics are not restricted", enforcer: TraceQLEnforcer{Operators: traceFilter}, policy: tracePolicy, query: `{ duration < 1s }`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.enforcer.Enforce(tt.query, tt.policy)
+			if tt.expectErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tt.expectErr)
+		})
+	}
+}
+
+func TestEnforceGet_QueryEncoding(t *testing.T) {
+	policy := &LabelPolicy{
+		Rules: []LabelRule{{Name: "tenant_id", Operator: "=", Values: []string{"t1"}}},
+		Logic: LogicAND,
+	}
+
+	tests := []struct {
+		name     string
+		rawQuery string
+		expected string
+	}{
+		{
+			name:     "encoded percent sequence is decoded once",
+			rawQuery: "query=" + url.QueryEscape(`{app="api"} |= "100%25 done"`),
+			expected: `{app="api", tenant_id="t1"} |= "100%25 done"`,
+		},
+		{
+			name:     "literal percent sign",
+			rawQuery: "query=" + url.QueryEscape(`{app="api"} |= "50%"`),
+			expected: `{app="api", tenant_id="t1"} |= "50%"`,
+		},
+		{
+			name:     "backticks and encoded plus",
+			rawQuery: "query=" + url.QueryEscape("{app=\"api\"} |= `error` != `a+b`"),
+			expected: `{app="api", tenant_id="t1"} |= "error" != "a+b"`,
+		},
+		{
+			name:     "encoded ampersand and equals",
+			rawQuery: "query=" + url.QueryEscape(`{app="api"} |= "a&b=c"`),
+			expected: `{app="api", tenant_id="t1"} |= "a&b=c"`,
+		},
+		{
+			name:     "urldecode pipeline with encoded pattern",
+			rawQuery: "query=" + url.QueryEscape("{app=\"api\"} | json | url=~`.*%2F.*` | line_format `{{.url | urldecode}}`"),
+			expected: `{app="api", tenant_id="t1"} | json | url=~".*%2F.*" | line_format "{{.url | urldecode}}"`,
+		},
+		{
+			name:     "unencoded printf verbs are kept",
+			rawQuery: "query={app=\"api\"} | line_format `{{.method | printf \"%-4s\"}}`",
+			expected: `{app="api", tenant_id="t1"} | line_format "{{.method | printf \"%-4s\"}}"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/loki/api/v1/query_range", nil)
+			req.URL.RawQuery = tt.rawQuery + "&limit=100&start=1690377573787000000"
+
+			_, err := enforceRequest(req, LogQLEnforcer{}, policy, "query", "", QueryHandling{})
+			assert.NoError(t, err)
+
+			// The rewritten query string must be valid and decode exactly once to the enforced query
+			values, err := url.ParseQuery(req.URL.RawQuery)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, values.Get("query"))
+			assert.Equal(t, "100", values.Get("limit"))
+			assert.Equal(t, "1690377573787000000", values.Get("start"))
+		})
+	}
+}
+
+func TestEnforceRequest_RepeatedQueries(t *testing.T) {
+	policy := &LabelPolicy{
+		Rules: []LabelRule{{Name: "tenant_id", Operator: "=", Values: []string{"t1"}}},
+		Logic: LogicAND,
+	}
+	allowed := url.Values{"query": {`{app="api"}`, `{app="db", tenant_id="t1"}`}, "limit": {"100"}}
+	denied := url.Values{"query": {`{app="api"}`, `{app="db", tenant_id="t2"}`}, "limit": {"100"}}
+	expected := []string{`{app="api", tenant_id="t1"}`, `{app="db", tenant_id="t1"}`}
+
+	newGet := func(values url.Values) *http.Request {
+		return httptest.NewRequest(http.MethodGet, "/loki/api/v1/query_range?"+values.Encode(), nil)
+	}
+	newPost := func(values url.Values) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/loki/api/v1/query_range", strings.NewReader(values.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req
+	}
+
+	t.Run("GET enforces every query", func(t *testing.T) {
+		req := newGet(allowed)
+		injected, err := enforceRequest(req, LogQLEnforcer{}, policy, "query", "", QueryHandling{})
+		assert.NoError(t, err)
+		assert.True(t, injected, "the first query has no tenant_id matcher")
+		values, err := url.ParseQuery(req.URL.RawQuery)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, values["query"])
+		assert.Equal(t, "100", values.Get("limit"))
+	})
+
+	t.Run("POST enforces every query", func(t *testing.T) {
+		req := newPost(allowed)
+		injected, err := enforceRequest(req, LogQLEnforcer{}, policy, "query", "", QueryHandling{})
+		assert.NoError(t, err)
+		assert.True(t, injected, "the first query has no tenant_id matcher")
+		body, err := io.ReadAll(req.Body)
+		assert.NoError(t, err)
+		values, err := url.ParseQuery(string(body))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, values["query"])
+	})
+
+	t.Run("GET rejects if any query is unauthorized", func(t *testing.T) {
+		_, err := enforceRequest(newGet(denied), LogQLEnforcer{}, policy, "query", "", QueryHandling{})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "t2")
+	})
+
+	t.Run("POST rejects if any query is unauthorized", func(t *testing.T) {
+		_, err := enforceRequest(newPost(denied), LogQLEnforcer{}, policy, "query", "", QueryHandling{})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "t2")
+	})
+}
+
+func TestEnforceRequest_QueryHandling(t *testing.T) {
+	policy := &LabelPolicy{
+		Rules: []LabelRule{{Name: "tenant_id", Operator: "=", Values: []string{"t1"}}},
+		Logic: LogicAND,
+	}
+	params := map[string]url.Values{
+		"absent":    {"limit": {"100"}},
+		"empty":     {"query": {""}, "limit": {"100"}},
+		"populated": {"query": {"up"}, "limit": {"100"}},
+	}
+	expected := map[string]string{"absent": `{tenant_id="t1"}`, "empty": `{tenant_id="t1"}`, "populated": `up{tenant_id="t1"}`}
+
+	tests := []struct {
+		name     string
+		handling QueryHandling
+		rejected map[string]string // Expected error of the rejected parameter cases
+	}{
+		{name: "default", handling: QueryHandling{}},
+		{name: "inject", handling: QueryHandling{Absent: QueryInject, Empty: QueryInject}},
+		{name: "reject absent", handling: QueryHandling{Absent: QueryReject, Empty: QueryInject}, rejected: map[string]string{"absent": "unsupported query: missing query parameter"}},
+		{name: "reject empty", handling: QueryHandling{Absent: QueryInject, Empty: QueryReject}, rejected: map[string]string{"empty": "unsupported query: empty query parameter"}},
+		{name: "reject both", handling: QueryHandling{Absent: QueryReject, Empty: QueryReject}, rejected: map[string]string{
+			"absent": "unsupported query: missing query parameter",
+			"empty":  "unsupported query: empty query parameter",
+		}},
+	}
+
+	for _, tt := range tests {
+		for _, method := range []string{http.MethodGet, http.MethodPost} {
+			for param, values := range params {
+				t.Run(tt.name+"/"+method+"/"+param, func(t *testing.T) {
+					req := httptest.NewRequest(method, "/api/v1/query?"+values.Encode(), nil)
+					if method == http.MethodPost {
+						req = httptest.NewRequest(method, "/api/v1/query", strings.NewReader(values.Encode()))
+						req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+					}
+
+					_, err := enforceRequest(req, PromQLEnforcer{}, policy, "query", "", tt.handling)
+					if message, ok := tt.rejected[param]; ok {
+						assert.ErrorIs(t, err, ErrUnsupportedQuery)
+						assert.EqualError(t, err, message)
+						return
+					}
+					assert.NoError(t, err)
+					enforced := req.URL.Query()
+					if method == http.MethodPost {
+						enforced = req.PostForm
+					}
+					assert.Equal(t, []string{expected[param]}, enforced["query"])
+				})
+			}
+		}
+	}
+}
+
+func TestEnforceQuery_Injected(t *testing.T) {
+	policy := LabelPolicy{
+		Rules: []LabelRule{{Name: "namespace", Operator: "=", Values: []string{"prod"}}},
+		Logic: LogicAND,
+	}
+	orPolicy := LabelPolicy{
+		Rules: []LabelRule{
+			{Name: "namespace", Operator: "=", Values: []string{"prod"}},
+			{Name: "team", Operator: "=", Values: []string{"backend"}},
+		},
+		Logic: LogicOR,
+	}
+	tests := []struct {
+		name     string
+		enforcer EnforceQL
+		query    string
+		policy   LabelPolicy
+		injected bool
+	}{
+		{name: "PromQL empty query", enforcer: PromQLEnforcer{}, query: "", policy: policy, injected: true},
+		{name: "PromQL missing label", enforcer: PromQLEnforcer{}, query: `up`, policy: policy, injected: true},
+		{name: "PromQL permitted label", enforcer: PromQLEnforcer{}, query: `up{namespace="prod"}`, policy: policy},
+		{name: "PromQL OR policy", enforcer: PromQLEnforcer{}, query: `up{namespace="prod"}`, policy: orPolicy, injected: true},
+		{name: "LogQL missing label", enforcer: LogQLEnforcer{}, query: `{app="api"}`, policy: policy, injected: true},
+		{name: "LogQL permitted label", enforcer: LogQLEnforcer{}, query: `{app="api", namespace="prod"}`, policy: policy},
+		{name: "TraceQL missing attribute", enforcer: TraceQLEnforcer{}, query: `{ span.http.status_code = 500 }`, policy: LabelPolicy{Rules: []LabelRule{{Name: "resource.namespace", Operator: "=", Values: []string{"prod"}}}, Logic: LogicAND}, injected: true},
+		{name: "TraceQL permitted attribute", enforcer: TraceQLEnforcer{}, query: `{ resource.namespace = "prod" }`, policy: LabelPolicy{Rules: []LabelRule{{Name: "resource.namespace", Operator: "=", Values: []string{"prod"}}}, Logic: LogicAND}},
+		{name: "enforcer without results", enforcer: MetadataEnforcer{MaxLimit: 10}, query: "", policy: policy},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := enforceQuery(tt.enforcer, tt.query, tt.policy)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.injected, result.Injected, result.Query)
+		})
+	}
+}
+
+func TestEnforcers_DeniedMessage(t *testing.T) {
+	policy := LabelPolicy{
+		Rules: []LabelRule{
+			{Name: "namespace", Operator: "=~", Values: []string{"prod", "staging"}},
+			{Name: "team", Operator: "!=", Values: []string{"secret"}},
+		},
+		Logic: LogicAND,
+	}
+	tracePolicy := LabelPolicy{
+		Rules: []LabelRule{
+			{Name: "resource.namespace", Operator: "=", Values: []string{"prod"}},
+			{Name: "resource.team", Operator: "!=", Values: []string{"secret"}},
+		},
+		Logic: LogicAND,
+	}
+
+	tests := []struct {
+		name      string
+		enforcer  EnforceQL
+		policy    LabelPolicy
+		query     string
+		expectErr string
+	}{
+		{name: "PromQL equal matcher", enforcer: PromQLEnforcer{}, policy: policy, query: `up{namespace="dev"}`, expectErr: "unauthorized namespace: dev (matcher namespace =, 2 allowed values)"},
+		{name: "PromQL regex matcher", enforcer: PromQLEnforcer{}, policy: policy, query: `up{namespace=~"prod|dev"}`, expectErr: "unauthorized namespace: dev (matcher namespace =~, 2 allowed values)"},
+		{name: "PromQL excluded value", enforcer: PromQLEnforcer{}, policy: policy, query: `up{team="secret"}`, expectErr: "unauthorized team: secret (matcher team =, excluded by a != rule)"},
+		{name: "LogQL equal matcher", enforcer: LogQLEnforcer{}, policy: policy, query: `{namespace="dev"}`, expectErr: "unauthorized namespace: dev (matcher namespace =, 2 allowed values)"},
+		{name: "LogQL regex matcher", enforcer: LogQLEnforcer{}, policy: policy, query: `{namespace=~"prod|dev"}`, expectErr: "unauthorized namespace: dev (matcher namespace =~, 2 allowed values)"},
+		{name: "LogQL excluded value", enforcer: LogQLEnforcer{}, policy: policy, query: `{team=~"secret"}`, expectErr: "unauthorized team: secret (matcher team =~, excluded by a != rule)"},
+		{name: "TraceQL equal attribute", enforcer: TraceQLEnforcer{}, policy: tracePolicy, query: `{ resource.namespace = "dev" }`, expectErr: "unauthorized resource.namespace: dev (matcher resource.namespace =, 1 allowed value)"},
+		{name: "TraceQL regex attribute", enforcer: TraceQLEnforcer{}, policy: tracePolicy, query: `{ resource.namespace =~ "prod|dev" }`, expectErr: "unauthorized resource.namespace: dev (matcher resource.namespace =~, 1 allowed value)"},
+		{name: "TraceQL excluded value", enforcer: TraceQLEnforcer{}, policy: tracePolicy, query: `{ resource.team = "secret" }`, expectErr: "unauthorized resource.team: secret (matcher resource.team =, excluded by a != rule)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.enforcer.Enforce(tt.query, tt.policy)
+			assert.EqualError(t, err, tt.expectErr)
+		})
+	}
+}
+
+func TestDeniedLabelError_Error(t *testing.T) {
+	assert.EqualError(t, &DeniedLabelError{Label: "tenant_id", Value: "other"}, "unauthorized tenant_id: other")
+	assert.EqualError(t, &DeniedLabelError{Label: "tenant_id", Value: "other", Operator: "=", Allowed: 0}, "unauthorized tenant_id: other (matcher tenant_id =, 0 allowed values)")
+}
+
+func TestQueryUnescapeLenient(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"a%20b", "a b"},
+		{"a+b", "a b"},
+		{"100%25", "100%"},
+		{`printf+"%-4s"`, `printf "%-4s"`},
+		{"%zz%41", "%zzA"},
+		{"trailing%", "trailing%"},
+		{"trailing%4", "trailing%4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			assert.Equal(t, tt.expected, queryUnescapeLenient(tt.input))
+		})
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/rs/zerolog/log"
@@ -11,47 +13,77 @@ import (
 )
 
 // LogQLEnforcer manipulates and enforces tenant isolation on LogQL queries.
-type LogQLEnforcer struct{}
+type LogQLEnforcer struct {
+	UserLabels        UserLabelFilter     // Restricts the stream selector labels users may filter on
+	Operators         LabelOperatorFilter // Restricts the operators users may apply to stream selector labels
+	AnchorRegexValues bool                // Anchor the regex values of queries built from policies, see web.anchor_regex_values
+}
 
 // Enforce modifies a LogQL query string to enforce multi-label policy.
 // Supports multiple label rules with different operators (=, !=, =~, !~).
 // Handles AND logic by injecting all rules as separate matchers.
 // Returns the modified query or an error if parsing/validation fails.
-func (LogQLEnforcer) Enforce(query string, policy LabelPolicy) (string, error) {
+func (e LogQLEnforcer) Enforce(query string, policy LabelPolicy) (string, error) {
+	result, err := e.EnforceResult(query, policy)
+	return result.Query, err
+}
+
+// EnforceResult enforces the query like Enforce and also reports whether policy matchers
+// were injected into any stream selector.
+func (e LogQLEnforcer) EnforceResult(query string, policy LabelPolicy) (EnforceResult, error) {
 	log.Trace().Str("function", "enforce").Str("query", query).Msg("input")
 
 	// Validate policy
 	if err := policy.Validate(); err != nil {
-		return "", fmt.Errorf("invalid policy: %w", err)
+		return EnforceResult{}, fmt.Errorf("invalid policy: %w", err)
 	}
 
 	// Check for cluster-wide access
 	if policy.HasClusterWideAccess() {
-		return query, nil
+		return EnforceResult{Query: query}, nil
 	}
 
 	// Handle empty query - build from scratch
 	if query == "" {
-		return buildLogQLQueryFromPolicy(policy), nil
+		return EnforceResult{Query: buildLogQLQueryFromPolicy(policy, e.AnchorRegexValues), Injected: true}, nil
 	}
 
 	// Parse existing query
 	expr, err := logqlv2.ParseExpr(query)
 	if err != nil {
-		return "", err
+		return EnforceResult{}, err
+	}
+
+	if err := denyLogQLPolicyLabelRewrites(query, policy); err != nil {
+		return EnforceResult{}, err
 	}
 
 	errMsg := error(nil)
+	injected := false
 
 	// Walk AST and inject matchers
 	expr.Walk(func(expr interface{}) {
 		switch labelExpression := expr.(type) {
 		case *logqlv2.StreamMatcherExpr:
+			if err := validateRegexMatchers(labelExpression.Matchers()); err != nil {
+				errMsg = err
+				return
+			}
+			if err := e.UserLabels.Validate(matcherNames(labelExpression.Matchers()), policy); err != nil {
+				errMsg = err
+				return
+			}
+			if err := e.Operators.Validate(labelExpression.Matchers(), policy); err != nil {
+				errMsg = err
+				return
+			}
+			existing := len(labelExpression.Matchers())
 			matchers, err := EnforceMultiLabelMatchers(labelExpression.Matchers(), policy)
 			if err != nil {
 				errMsg = err
 				return
 			}
+			injected = injected || len(matchers) > existing
 			labelExpression.SetMatchers(matchers)
 		default:
 			// Do nothing
@@ -59,49 +91,328 @@ func (LogQLEnforcer) Enforce(query string, policy LabelPolicy) (string, error) {
 	})
 
 	if errMsg != nil {
-		return "", errMsg
+		return EnforceResult{}, errMsg
 	}
 
-	log.Trace().Str("function", "enforce").Str("query", expr.String()).Msg("enforced")
-	return expr.String(), nil
+	enforced, err := restoreGroupedMetricOps(query, expr)
+	if err != nil {
+		return EnforceResult{}, err
+	}
+
+	log.Trace().Str("function", "enforce").Str("query", enforced).Msg("enforced")
+	return EnforceResult{Query: enforced, Injected: injected}, nil
 }
 
-// buildLogQLQueryFromPolicy constructs a minimal LogQL query from LabelPolicy.
-// Combines multiple values for same label using regex OR.
-func buildLogQLQueryFromPolicy(policy LabelPolicy) string {
-	var matchers []string
+// logQLMetricOps are the aggregation operators that can wrap a log range query.
+var logQLMetricOps = map[string]bool{
+	"count_over_time": true, "rate": true, "rate_counter": true, "bytes_over_time": true, "bytes_rate": true,
+	"avg_over_time": true, "sum_over_time": true, "min_over_time": true, "max_over_time": true,
+	"stdvar_over_time": true, "stddev_over_time": true, "quantile_over_time": true,
+	"first_over_time": true, "last_over_time": true, "absent_over_time": true,
+	"sum": true, "avg": true, "min": true, "max": true, "stddev": true, "stdvar": true,
+	"count": true, "topk": true, "bottomk": true, "sort": true, "sort_desc": true,
+}
 
-	for _, rule := range policy.Rules {
-		operator := rule.Operator
-		value := rule.Values[0]
+// restoreGroupedMetricOps serializes the enforced expression. The LogQL parser drops the
+// operator of a range aggregation with a trailing grouping and no parameter, e.g.
+// max_over_time({job="app"} | unwrap size [5m]) by (job) serializes as
+// ({job="app"} | unwrap size [5m])by(job). The operators are recovered from the original
+// query in order and re-inserted; the query is rejected if they cannot be matched up.
+func restoreGroupedMetricOps(query string, expr logqlv2.Expr) (string, error) {
+	var broken []string
+	expr.Walk(func(e interface{}) {
+		if m, ok := e.(*logqlv2.LogMetricExpr); ok && m.Selector() != nil && strings.HasPrefix(m.String(), "(") {
+			broken = append(broken, m.String())
+		}
+	})
+
+	enforced := expr.String()
+	if len(broken) == 0 {
+		return enforced, nil
+	}
+
+	ops := groupedMetricOps(query)
+	if len(ops) != len(broken) {
+		return "", fmt.Errorf("unable to serialize enforced LogQL query")
+	}
+
+	var sb strings.Builder
+	cursor := 0
+	for i, s := range broken {
+		idx := strings.Index(enforced[cursor:], s)
+		if idx < 0 {
+			return "", fmt.Errorf("unable to serialize enforced LogQL query")
+		}
+		sb.WriteString(enforced[cursor : cursor+idx])
+		sb.WriteString(ops[i])
+		sb.WriteString(s)
+		cursor += idx + len(s)
+	}
+	sb.WriteString(enforced[cursor:])
+	return sb.String(), nil
+}
+
+// groupedMetricOps returns, in query order, the metric operators applied directly to a
+// log range query and followed by a by/without grouping.
+func groupedMetricOps(query string) []string {
+	var ops []string
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '"' || c == '`':
+			i = skipLogQLString(query, i)
+		case isLogQLIdentChar(c):
+			j := i
+			for j < len(query) && isLogQLIdentChar(query[j]) {
+				j++
+			}
+			if word := query[i:j]; logQLMetricOps[word] && isGroupedRangeAggregation(query, j) {
+				ops = append(ops, word)
+			}
+			i = j
+		default:
+			i++
+		}
+	}
+	return ops
+}
+
+// isGroupedRangeAggregation reports whether the call starting at query[pos] takes a log
+// range query as its only argument and is followed by a grouping clause.
+func isGroupedRangeAggregation(query string, pos int) bool {
+	open := skipLogQLSpace(query, pos)
+	if open >= len(query) || query[open] != '(' {
+		return false
+	}
+	arg := skipLogQLSpace(query, open+1)
+	if arg >= len(query) || (query[arg] != '{' && query[arg] != '(') {
+		return false
+	}
+
+	depth := 0
+	for i := open; i < len(query); {
+		switch query[i] {
+		case '"', '`':
+			i = skipLogQLString(query, i)
+			continue
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				rest := query[skipLogQLSpace(query, i+1):]
+				for _, keyword := range []string{"by", "without"} {
+					if strings.HasPrefix(rest, keyword) && (len(rest) == len(keyword) || !isLogQLIdentChar(rest[len(keyword)])) {
+						return true
+					}
+				}
+				return false
+			}
+		}
+		i++
+	}
+	return false
+}
+
+// skipLogQLString returns the index after the string literal starting at query[start].
+func skipLogQLString(query string, start int) int {
+	quote := query[start]
+	for i := start + 1; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			if quote == '"' {
+				i++
+			}
+		case quote:
+			return i + 1
+		}
+	}
+	return len(query)
+}
+
+func skipLogQLSpace(query string, i int) int {
+	for i < len(query) && strings.ContainsRune(" \t\r\n", rune(query[i])) {
+		i++
+	}
+	return i
+}
+
+func isLogQLIdentChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
 
-		// Combine multiple values with regex OR
-		if len(rule.Values) > 1 {
-			value = strings.Join(rule.Values, "|")
-			if operator == OperatorEquals {
-				operator = OperatorRegexMatch
-			} else if operator == OperatorNotEquals {
-				operator = OperatorRegexNoMatch
+// denyLogQLPolicyLabelRewrites rejects queries using label_format or label_replace to write
+// one of the policy labels, which would pass off log lines or samples of the tenant as
+// another's. The parser does not expose either, so the query is scanned like groupedMetricOps.
+func denyLogQLPolicyLabelRewrites(query string, policy LabelPolicy) error {
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '"' || c == '`':
+			i = skipLogQLString(query, i)
+		case isLogQLIdentChar(c):
+			j := i
+			for j < len(query) && isLogQLIdentChar(query[j]) {
+				j++
 			}
+			var targets []string
+			switch query[i:j] {
+			case "label_format":
+				targets = labelFormatTargets(query, j)
+			case "label_replace":
+				targets = labelReplaceTarget(query, j)
+			}
+			for _, target := range targets {
+				if slices.ContainsFunc(policy.Rules, func(rule LabelRule) bool { return rule.Name == target }) {
+					return fmt.Errorf("%w: %s cannot rewrite the policy label %s", ErrUnenforceableQuery, query[i:j], target)
+				}
+			}
+			i = j
+		default:
+			i++
+		}
+	}
+	return nil
+}
+
+// labelFormatTargets returns the labels written by the label_format stage whose
+// assignments start at query[pos], e.g. dst="{{.src}}", dst=src, dst=ip("...").
+func labelFormatTargets(query string, pos int) []string {
+	var targets []string
+	for i := pos; ; {
+		i = skipLogQLSpace(query, i)
+		j := i
+		for j < len(query) && isLogQLIdentChar(query[j]) {
+			j++
+		}
+		eq := skipLogQLSpace(query, j)
+		if j == i || eq >= len(query) || query[eq] != '=' {
+			return targets
+		}
+		targets = append(targets, query[i:j])
+
+		// Skip the value: a string, a label name or a function call such as ip("...")
+		i = skipLogQLSpace(query, eq+1)
+		if i < len(query) && (query[i] == '"' || query[i] == '`') {
+			i = skipLogQLString(query, i)
+		} else {
+			for i < len(query) && isLogQLIdentChar(query[i]) {
+				i++
+			}
+			if open := skipLogQLSpace(query, i); open < len(query) && query[open] == '(' {
+				i = skipLogQLCall(query, open)
+			}
+		}
+		i = skipLogQLSpace(query, i)
+		if i >= len(query) || query[i] != ',' {
+			return targets
 		}
+		i++
+	}
+}
+
+// labelReplaceTarget returns the destination label of the label_replace call whose
+// argument list starts at query[pos], i.e. its second argument.
+func labelReplaceTarget(query string, pos int) []string {
+	open := skipLogQLSpace(query, pos)
+	if open >= len(query) || query[open] != '(' {
+		return nil
+	}
+	depth := 0
+	for i := open; i < len(query); {
+		switch query[i] {
+		case '"', '`':
+			i = skipLogQLString(query, i)
+			continue
+		case '(', '{', '[':
+			depth++
+		case ')', '}', ']':
+			depth--
+			if depth == 0 {
+				return nil
+			}
+		case ',':
+			if depth == 1 {
+				arg := skipLogQLSpace(query, i+1)
+				if arg >= len(query) || (query[arg] != '"' && query[arg] != '`') {
+					return nil
+				}
+				dst, err := strconv.Unquote(query[arg:skipLogQLString(query, arg)])
+				if err != nil {
+					return nil
+				}
+				return []string{dst}
+			}
+		}
+		i++
+	}
+	return nil
+}
+
+// skipLogQLCall returns the index after the parenthesized argument list starting at query[open].
+func skipLogQLCall(query string, open int) int {
+	depth := 0
+	for i := open; i < len(query); {
+		switch query[i] {
+		case '"', '`':
+			i = skipLogQLString(query, i)
+			continue
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+		i++
+	}
+	return len(query)
+}
+
+// matcherNames returns the label names of the given matchers.
+func matcherNames(matchers []*labels.Matcher) []string {
+	names := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		names = append(names, m.Name)
+	}
+	return names
+}
+
+// buildLogQLQueryFromPolicy constructs a minimal LogQL query from LabelPolicy.
+// Combines multiple values for same label using regex OR. A stream selector needs a
+// matcher not matching the empty string, so policies with only negative rules select the
+// streams having the label of their first rule, e.g. {namespace=~".+", namespace!="secret"}.
+func buildLogQLQueryFromPolicy(policy LabelPolicy, anchor bool) string {
+	var matchers []string
 
-		matchers = append(matchers, fmt.Sprintf("%s%s\"%s\"", rule.Name, operator, value))
+	if len(policy.Rules) > 0 && !slices.ContainsFunc(policy.Rules, func(rule LabelRule) bool { return !rule.IsNegative() }) {
+		matchers = append(matchers, fmt.Sprintf(`%s=~".+"`, policy.Rules[0].Name))
+	}
+	for _, rule := range streamSelectorRules(policy) {
+		operator, value := emittedMatchValue(rule, anchor)
+		matchers = append(matchers, fmt.Sprintf("%s%s%q", rule.Name, operator, value))
 	}
 
 	return fmt.Sprintf("{%s}", strings.Join(matchers, ", "))
 }
 
 // EnforceMultiLabelMatchers enforces multi-label policy on existing matchers.
-// Validates existing matchers against policy rules and injects missing ones.
+// Validates existing matchers against the positive policy rules and injects missing ones;
+// negative rules are always injected, as a query matcher cannot make them redundant.
+// A stream selector cannot express a disjunction, so all rules are injected even for OR policies.
 // Returns error if query contains unauthorized label values.
 func EnforceMultiLabelMatchers(queryMatches []*labels.Matcher, policy LabelPolicy) ([]*labels.Matcher, error) {
 	// Track which rules have been found in the query
 	foundRules := make(map[string]bool)
 
-	// Build a map of label name to ALL allowed values across all rules
+	// Build a map of label name to ALL values allowed by positive rules
 	// This handles OR logic where multiple rules may allow different values for the same label
 	allowedValuesMap := make(map[string]map[string]bool)
 	for _, rule := range policy.Rules {
+		if rule.IsNegative() {
+			continue
+		}
 		if _, exists := allowedValuesMap[rule.Name]; !exists {
 			allowedValuesMap[rule.Name] = make(map[string]bool)
 		}
@@ -109,21 +420,42 @@ func EnforceMultiLabelMatchers(queryMatches []*labels.Matcher, policy LabelPolic
 			allowedValuesMap[rule.Name][v] = true
 		}
 	}
+	regexValuesMap := policyRegexValues(policy)
 
-	// Validate existing matchers against policy
+	// Validate existing matchers against policy; like selectsLabel, only = and =~ matchers
+	// select the label, negative ones would leave the other values of the label selected
 	for _, queryMatcher := range queryMatches {
+		if !isPositiveMatcher(queryMatcher) {
+			continue
+		}
 		if allowedValues, hasRule := allowedValuesMap[queryMatcher.Name]; hasRule {
 			foundRules[queryMatcher.Name] = true
 
 			// Validate the matcher's values against all allowed values
-			if err := validateMatcherAgainstAllowedValues(queryMatcher, allowedValues); err != nil {
+			if err := validateMatcherAgainstAllowedValues(queryMatcher, allowedValues, regexValuesMap[queryMatcher.Name]); err != nil {
 				return nil, err
 			}
 		}
 	}
 
-	// Inject missing rules
-	for _, rule := range policy.Rules {
+	excluding, err := excludingMatchers(policy)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateExcludedValues(queryMatches, excluding); err != nil {
+		return nil, err
+	}
+
+	// Inject missing rules; negative rules are injected regardless of the query's matchers
+	existing := len(queryMatches)
+	for _, rule := range streamSelectorRules(policy) {
+		if rule.IsNegative() {
+			matcher := ruleToMatcher(rule)
+			if !hasMatcher(queryMatches[:existing], matcher) {
+				queryMatches = append(queryMatches, matcher)
+			}
+			continue
+		}
 		if !foundRules[rule.Name] {
 			matcher := ruleToMatcher(rule)
 			queryMatches = append(queryMatches, matcher)
@@ -133,15 +465,46 @@ func EnforceMultiLabelMatchers(queryMatches []*labels.Matcher, policy LabelPolic
 	return queryMatches, nil
 }
 
-// validateMatcherAgainstAllowedValues checks if a matcher's values are in the allowed set.
-func validateMatcherAgainstAllowedValues(matcher *labels.Matcher, allowedValues map[string]bool) error {
-	// Extract values from matcher (handle regex patterns with |)
-	matcherValues := strings.Split(matcher.Value, "|")
+// streamSelectorRules returns the rules of policy to inject into a stream selector. A stream
+// selector cannot express a disjunction, so rules of an OR policy with the same label and
+// operator, e.g. split by labelstore.max_regex_values, are joined into one rule again.
+func streamSelectorRules(policy LabelPolicy) []LabelRule {
+	if policy.Logic != LogicOR {
+		return policy.Rules
+	}
+
+	var rules []LabelRule
+	index := make(map[[2]string]int, len(policy.Rules))
+	for _, rule := range policy.Rules {
+		key := [2]string{rule.Name, rule.Operator}
+		if i, ok := index[key]; ok {
+			// Clipped so that appending never writes to the policy's values
+			rules[i].Values = append(slices.Clip(rules[i].Values), rule.Values...)
+			continue
+		}
+		index[key] = len(rules)
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// validateMatcherAgainstAllowedValues checks if a matcher's values are in the allowed set,
+// or, for regex alternatives, one of the allowed patterns.
+func validateMatcherAgainstAllowedValues(matcher *labels.Matcher, allowedValues, allowedPatterns map[string]bool) error {
+	if matcher.Type == labels.MatchEqual {
+		if !allowedValues[matcher.Value] {
+			return &DeniedLabelError{Label: matcher.Name, Value: matcher.Value, Operator: matcher.Type.String(), Allowed: len(allowedValues)}
+		}
+		return nil
+	}
+
+	// Extract values from regex matchers (handle regex patterns with |)
+	matcherValues := strings.Split(unanchorRegexValue(matcher.Value), "|")
 
 	// Check if all matcher values are allowed
 	for _, matcherValue := range matcherValues {
-		if !allowedValues[matcherValue] {
-			return fmt.Errorf("unauthorized %s: %s", matcher.Name, matcherValue)
+		if !regexAlternativeAllowed(matcherValue, allowedValues, allowedPatterns) {
+			return &DeniedLabelError{Label: matcher.Name, Value: matcherValue, Operator: matcher.Type.String(), Allowed: len(allowedValues)}
 		}
 	}
 
@@ -155,5 +518,5 @@ func validateMatcherAgainstRule(matcher *labels.Matcher, rule LabelRule) error {
 	for _, v := range rule.Values {
 		allowedValues[v] = true
 	}
-	return validateMatcherAgainstAllowedValues(matcher, allowedValues)
+	return validateMatcherAgainstAllowedValues(matcher, allowedValues, policyRegexValues(LabelPolicy{Rules: []LabelRule{rule}})[rule.Name])
 }
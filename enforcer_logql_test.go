@@ -110,7 +110,7 @@ func TestLogQLEnforcer_Enforce(t *testing.T) {
 				},
 				Logic: "AND",
 			},
-			expectedResult: `{namespace!="system"}`,
+			expectedResult: `{namespace=~".+", namespace!="system"}`,
 			expectErr:      false,
 		},
 		{
@@ -134,7 +134,7 @@ func TestLogQLEnforcer_Enforce(t *testing.T) {
 				},
 				Logic: "AND",
 			},
-			expectedResult: `{namespace!~"test.*"}`,
+			expectedResult: `{namespace=~".+", namespace!~"test.*"}`,
 			expectErr:      false,
 		},
 		{
@@ -146,7 +146,7 @@ func TestLogQLEnforcer_Enforce(t *testing.T) {
 				},
 				Logic: "AND",
 			},
-			expectedResult: `{namespace!~"system|kube-system"}`,
+			expectedResult: `{namespace=~".+", namespace!~"system|kube-system"}`,
 			expectErr:      false,
 		},
 		{
@@ -185,6 +185,29 @@ func TestLogQLEnforcer_Enforce(t *testing.T) {
 			expectedResult: `sum by(job) (rate({job="app", namespace="prod"}[5m]))`,
 			expectErr:      false,
 		},
+		{
+			name:  "NotEquals operator - excluded value selected by the query",
+			query: `{namespace="system"}`,
+			policy: LabelPolicy{
+				Rules: []LabelRule{
+					{Name: "namespace", Operator: "!=", Values: []string{"system"}},
+				},
+				Logic: "AND",
+			},
+			expectErr: true,
+		},
+		{
+			name:  "NotEquals operator - identical matcher is not duplicated",
+			query: `{job="app", namespace!="system"}`,
+			policy: LabelPolicy{
+				Rules: []LabelRule{
+					{Name: "namespace", Operator: "!=", Values: []string{"system"}},
+				},
+				Logic: "AND",
+			},
+			expectedResult: `{job="app", namespace!="system"}`,
+			expectErr:      false,
+		},
 	}
 
 	enforcer := LogQLEnforcer{}
@@ -268,6 +291,20 @@ func TestEnforceMultiLabelMatchers(t *testing.T) {
 			expectedCount: 3, // job + namespace + team
 			expectErr:     false,
 		},
+		{
+			name: "Negative matcher on policy label - inject rule",
+			matchers: []*labels.Matcher{
+				{Type: labels.MatchNotEqual, Name: "namespace", Value: "prod"},
+			},
+			policy: LabelPolicy{
+				Rules: []LabelRule{
+					{Name: "namespace", Operator: "=", Values: []string{"prod"}},
+				},
+				Logic: "AND",
+			},
+			expectedCount: 2, // namespace!="prod" + namespace="prod"
+			expectErr:     false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -286,6 +323,19 @@ func TestEnforceMultiLabelMatchers(t *testing.T) {
 	}
 }
 
+func TestLogQLEnforcer_NegativeMatcherBypass(t *testing.T) {
+	policy := LabelPolicy{
+		Rules: []LabelRule{{Name: "namespace", Operator: "=", Values: []string{"prod"}}},
+		Logic: "AND",
+	}
+
+	for _, query := range []string{`{namespace!="prod"}`, `{namespace!~"prod|dev"}`} {
+		got, err := LogQLEnforcer{}.Enforce(query, policy)
+		assert.NoError(t, err)
+		assert.Contains(t, got, `namespace="prod"`, "negative matchers do not satisfy the policy rule")
+	}
+}
+
 // TestLogQLEnforcer_EmptyQuery_ConsolidatedPolicy tests LogQL enforcer with consolidated multi-group policies
 func TestLogQLEnforcer_EmptyQuery_ConsolidatedPolicy(t *testing.T) {
 	tests := []struct {
@@ -356,6 +406,19 @@ func TestLogQLEnforcer_EmptyQuery_ConsolidatedPolicy(t *testing.T) {
 			expectedResult: `{job="app", environment="uat"}`,
 			expectErr:      false,
 		},
+		{
+			name:  "Rules split by max_regex_values are joined again",
+			query: `{job="app"}`,
+			policy: LabelPolicy{
+				Rules: []LabelRule{
+					{Name: "environment", Operator: "=~", Values: []string{"production", "staging"}},
+					{Name: "environment", Operator: "=~", Values: []string{"uat"}},
+				},
+				Logic: "OR",
+			},
+			expectedResult: `{job="app", environment=~"production|staging|uat"}`,
+			expectErr:      false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -372,3 +435,136 @@ func TestLogQLEnforcer_EmptyQuery_ConsolidatedPolicy(t *testing.T) {
 		})
 	}
 }
+
+func TestLogQLEnforcer_MetricQueries(t *testing.T) {
+	policy := LabelPolicy{
+		Rules: []LabelRule{
+			{Name: "namespace", Operator: "=", Values: []string{"prod"}},
+		},
+		Logic: "AND",
+	}
+
+	tests := []struct {
+		name           string
+		query          string
+		expectedResult string
+	}{
+		{
+			name:           "quantile_over_time with unwrap",
+			query:          `quantile_over_time(0.99, {job="app"} | unwrap latency [5m])`,
+			expectedResult: `quantile_over_time(0.99,({job="app", namespace="prod"} | unwrap latency) [5m])`,
+		},
+		{
+			name:           "quantile_over_time with unwrap and grouping",
+			query:          `quantile_over_time(0.99, {job="app"} | json | unwrap latency [5m]) by (job)`,
+			expectedResult: `quantile_over_time(0.99,({job="app", namespace="prod"} | json | unwrap latency) [5m]) by(job)`,
+		},
+		{
+			name:           "bytes_over_time",
+			query:          `bytes_over_time({job="app"}[5m])`,
+			expectedResult: `bytes_over_time({job="app", namespace="prod"}[5m])`,
+		},
+		{
+			name:           "bytes_rate aggregated",
+			query:          `sum by (job) (bytes_rate({job="app"} |= "error" [1m]))`,
+			expectedResult: `sum by(job) (bytes_rate(({job="app", namespace="prod"} |= "error") [1m]))`,
+		},
+		{
+			name:           "unwrap with grouping keeps the range operator",
+			query:          `max_over_time({job="app"} | unwrap size [5m]) by (job)`,
+			expectedResult: `max_over_time(({job="app", namespace="prod"} | unwrap size) [5m]) by(job)`,
+		},
+		{
+			name:           "unwrap with offset and without grouping",
+			query:          `avg_over_time({job="app"} | unwrap duration(latency) [5m] offset 1h) without (pod)`,
+			expectedResult: `avg_over_time(({job="app", namespace="prod"} | unwrap duration(latency)) [5m] offset 1h0m0s) without(pod)`,
+		},
+		{
+			name:           "binary operation of grouped range aggregations",
+			query:          `sum_over_time({job="app"} | unwrap size [5m]) by (job) / count_over_time({job="app", level="error"}[5m]) by (job)`,
+			expectedResult: `sum_over_time(({job="app", namespace="prod"} | unwrap size) [5m]) by(job) / count_over_time({job="app", level="error", namespace="prod"}[5m]) by(job)`,
+		},
+		{
+			name:           "grouped range aggregation nested in vector aggregation",
+			query:          `topk(5, sum(max_over_time({job="app"} | logfmt | line_format "by (x)" | unwrap size [5m]) by (pod)))`,
+			expectedResult: `topk(5,sum(max_over_time(({job="app", namespace="prod"} | logfmt | line_format "by (x)" | unwrap size) [5m]) by(pod)))`,
+		},
+	}
+
+	enforcer := LogQLEnforcer{}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := enforcer.Enforce(tt.query, policy)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedResult, result)
+		})
+	}
+}
+
+func TestLogQLEnforcer_LabelRewrites(t *testing.T) {
+	policy := LabelPolicy{
+		Rules: []LabelRule{
+			{Name: "namespace", Operator: "=", Values: []string{"prod"}},
+		},
+		Logic: "AND",
+	}
+
+	tests := []struct {
+		name           string
+		query          string
+		expectedResult string
+		expectedErr    string
+	}{
+		{
+			name:        "label_format of the tenant label",
+			query:       `{job="app"} | label_format namespace="dev"`,
+			expectedErr: "label_format cannot rewrite the policy label namespace",
+		},
+		{
+			name:        "label_format renaming into the tenant label",
+			query:       `{job="app"} | logfmt | label_format level=lvl, namespace=pod`,
+			expectedErr: "label_format cannot rewrite the policy label namespace",
+		},
+		{
+			name:        "label_format in a metric query",
+			query:       `sum(count_over_time({job="app"} | label_format namespace="{{.pod}}" [5m])) by (namespace)`,
+			expectedErr: "label_format cannot rewrite the policy label namespace",
+		},
+		{
+			name:        "label_replace of the tenant label",
+			query:       `label_replace(count_over_time({job="app", pod=~"a,b"}[5m]), "namespace", "dev", "", "")`,
+			expectedErr: "label_replace cannot rewrite the policy label namespace",
+		},
+		{
+			name:           "label_format reading the tenant label",
+			query:          `{job="app"} | label_format ns="{{.namespace}}"`,
+			expectedResult: `{job="app", namespace="prod"} | label_format ns="{{.namespace}}"`,
+		},
+		{
+			name:           "label_replace of another label",
+			query:          `label_replace(count_over_time({job="app"}[5m]), "ns", "$1", "namespace", "(.*)")`,
+			expectedResult: `label_replace(count_over_time({job="app", namespace="prod"}[5m]),"ns","$1","namespace","(.*)")`,
+		},
+		{
+			name:           "tenant label in a line filter",
+			query:          `{job="app"} |= "label_format namespace=\"dev\""`,
+			expectedResult: `{job="app", namespace="prod"} |= "label_format namespace=\"dev\""`,
+		},
+	}
+
+	enforcer := LogQLEnforcer{}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := enforcer.Enforce(tt.query, policy)
+			if tt.expectedErr != "" {
+				assert.ErrorIs(t, err, ErrUnenforceableQuery)
+				assert.ErrorContains(t, err, tt.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedResult, result)
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+// MetadataEnforcer enforces the Prometheus /api/v1/metadata endpoint. Metric metadata
+// carries no labels, so it cannot be scoped to a tenant on any backend: it is either
+// denied for enforced users or forwarded with a clamped limit. It is applied to the
+// "limit" parameter rather than a query.
+type MetadataEnforcer struct {
+	Deny     bool // Reject metadata requests of enforced users
+	MaxLimit int  // Maximum number of metrics returned; 0 disables clamping
+}
+
+// Enforce returns the limit to forward, clamped to MaxLimit, or an error if metadata is denied.
+func (e MetadataEnforcer) Enforce(limit string, policy LabelPolicy) (string, error) {
+	log.Trace().Str("function", "enforce").Str("limit", limit).Msg("metadata input")
+
+	if err := policy.Validate(); err != nil {
+		return "", fmt.Errorf("invalid policy: %w", err)
+	}
+	if e.Deny {
+		return "", fmt.Errorf("metric metadata cannot be scoped to tenant labels and is denied")
+	}
+	if e.MaxLimit <= 0 {
+		return limit, nil
+	}
+	if limit == "" {
+		return strconv.Itoa(e.MaxLimit), nil
+	}
+
+	n, err := strconv.Atoi(limit)
+	if err != nil {
+		return "", fmt.Errorf("invalid limit %q: %w", limit, err)
+	}
+	// Prometheus treats zero and negative limits as unlimited
+	if n <= 0 || n > e.MaxLimit {
+		n = e.MaxLimit
+	}
+	return strconv.Itoa(n), nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadataEnforcer_Enforce(t *testing.T) {
+	policy := LabelPolicy{
+		Rules: []LabelRule{
+			{Name: "namespace", Operator: OperatorEquals, Values: []string{"prod"}},
+		},
+		Logic: LogicAND,
+	}
+
+	tests := []struct {
+		name     string
+		enforcer MetadataEnforcer
+		limit    string
+		expected string
+		errMsg   string
+	}{
+		{name: "no clamping", enforcer: MetadataEnforcer{}, limit: "5000", expected: "5000"},
+		{name: "no clamping without limit", enforcer: MetadataEnforcer{}, limit: "", expected: ""},
+		{name: "limit below max", enforcer: MetadataEnforcer{MaxLimit: 100}, limit: "10", expected: "10"},
+		{name: "limit above max", enforcer: MetadataEnforcer{MaxLimit: 100}, limit: "5000", expected: "100"},
+		{name: "missing limit", enforcer: MetadataEnforcer{MaxLimit: 100}, limit: "", expected: "100"},
+		{name: "unlimited limit", enforcer: MetadataEnforcer{MaxLimit: 100}, limit: "-1", expected: "100"},
+		{name: "invalid limit", enforcer: MetadataEnforcer{MaxLimit: 100}, limit: "all", errMsg: "invalid limit"},
+		{name: "denied", enforcer: MetadataEnforcer{Deny: true, MaxLimit: 100}, limit: "10", errMsg: "cannot be scoped"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := tt.enforcer.Enforce(tt.limit, policy)
+			if tt.errMsg != "" {
+				assert.ErrorContains(t, err, tt.errMsg)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
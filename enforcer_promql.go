@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"slices"
 	"strings"
+	"sync"
 
 	"github.com/rs/zerolog/log"
 
@@ -11,58 +14,292 @@ import (
 )
 
 // PromQLEnforcer is a struct with methods to enforce specific rules on Prometheus Query Language (PromQL) queries.
-type PromQLEnforcer struct{}
+type PromQLEnforcer struct {
+	UserLabels        UserLabelFilter     // Restricts the non-policy labels users may filter on
+	Operators         LabelOperatorFilter // Restricts the operators users may apply to labels
+	DenyAtModifiers   bool                // Reject queries using the @ modifier, for upstreams not supporting it
+	AnchorRegexValues bool                // Anchor the regex values of queries built from policies, see web.anchor_regex_values
+}
 
 // Enforce enhances a given PromQL query with multi-label enforcement based on LabelPolicy.
-// It supports multiple label rules with different operators (=, !=, =~, !~) combined with AND logic.
+// It supports multiple label rules with different operators (=, !=, =~, !~) combined with AND logic,
+// or with OR logic by expanding the query into one branch per rule joined with the `or` operator.
 // Returns the enhanced query or an error if the query cannot be parsed or is not compliant.
-func (PromQLEnforcer) Enforce(query string, policy LabelPolicy) (string, error) {
-	log.Trace().Str("function", "enforce").Str("query", query).Interface("policy", policy).Msg("input")
+func (e PromQLEnforcer) Enforce(query string, policy LabelPolicy) (string, error) {
+	result, err := e.EnforceResult(query, policy)
+	return result.Query, err
+}
+
+// EnforceResult enforces the query like Enforce and also reports whether policy matchers
+// were injected, as opposed to the query already selecting permitted policy label values.
+func (e PromQLEnforcer) EnforceResult(query string, policy LabelPolicy) (EnforceResult, error) {
+	// Boxing the policy for the trace event allocates even when tracing is disabled
+	if event := log.Trace(); event.Enabled() {
+		event.Str("function", "enforce").Str("query", query).Interface("policy", policy).Msg("input")
+	}
 
 	// Validate policy
-	if err := policy.Validate(); err != nil {
-		return "", fmt.Errorf("invalid policy: %w", err)
+	compiled, err := compilePolicy(&policy)
+	if err != nil {
+		return EnforceResult{}, fmt.Errorf("invalid policy: %w", err)
+	}
+
+	// A single selector cannot express a disjunction, so OR policies are enforced per rule
+	if policy.Logic == LogicOR && len(policy.Rules) > 1 {
+		return e.enforceDisjunction(query, policy, compiled)
 	}
 
 	// Handle empty query - build from scratch
-	if query == "" {
-		query = buildQueryFromPolicy(policy)
+	injected := query == ""
+	if injected {
+		query = buildQueryFromPolicy(policy, e.AnchorRegexValues)
 		log.Trace().Str("function", "enforce").Str("query", query).Msg("built from empty")
 	}
 
 	// Parse the query
 	expr, err := parser.ParseExpr(query)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse query: %w", err)
+		return EnforceResult{}, fmt.Errorf("failed to parse query: %w", err)
+	}
+	if e.DenyAtModifiers {
+		if err := denyAtModifiers(expr); err != nil {
+			return EnforceResult{}, err
+		}
+	}
+	if err := denyPolicyLabelRewrites(expr, compiled.policyLabels); err != nil {
+		return EnforceResult{}, err
 	}
 
 	// Extract existing labels from query
-	queryLabels := extractAllLabelsAndMatchers(expr)
+	selectors := collectVectorSelectors(expr)
+	if len(selectors) == 0 {
+		return EnforceResult{}, errNoSelectors
+	}
+	queryLabels := labelMatchersOf(selectors)
 
 	// Validate existing matchers against policy
-	if err := validateQueryAgainstPolicy(queryLabels, policy); err != nil {
-		return "", err
+	if err := validateQueryRegexes(queryLabels); err != nil {
+		return EnforceResult{}, err
+	}
+	if err := validateQueryAgainstPolicy(queryLabels, compiled.allowedValues, compiled.regexValues); err != nil {
+		return EnforceResult{}, err
+	}
+	for _, matchers := range queryLabels {
+		if err := validateExcludedValues(matchers, compiled.excluding); err != nil {
+			return EnforceResult{}, err
+		}
+	}
+	if err := e.UserLabels.Validate(promQLUserLabels(queryLabels), policy); err != nil {
+		return EnforceResult{}, err
+	}
+	// A query built from the policy only has the policy's own matchers
+	if !injected {
+		if err := e.Operators.Validate(promQLUserMatchers(queryLabels), policy); err != nil {
+			return EnforceResult{}, err
+		}
+	}
+
+	// Inject the policy matchers into the query
+	if injectMatchers(selectors, compiled.matchers) {
+		injected = true
 	}
 
-	// Build matchers for each rule in policy
-	matchers := buildMatchersFromPolicy(policy, queryLabels)
+	result := expr.String()
+	log.Trace().Str("function", "enforce").Str("query", result).Msg("output")
+	return EnforceResult{Query: result, Injected: injected}, nil
+}
+
+// enforceDisjunction enforces an OR policy by enforcing the query once per rule and
+// joining the branches with the `or` set operator, so data matching any rule is returned.
+// Existing matchers are validated against the whole policy first; branches whose rule
+// conflicts with the query's own matchers are dropped. Queries that do not evaluate to an
+// instant vector cannot be combined with `or` and fall back to AND enforcement.
+func (e PromQLEnforcer) enforceDisjunction(query string, policy LabelPolicy, compiled *compiledPolicy) (EnforceResult, error) {
+	if query != "" {
+		expr, err := parser.ParseExpr(query)
+		if err != nil {
+			return EnforceResult{}, fmt.Errorf("failed to parse query: %w", err)
+		}
+		if e.DenyAtModifiers {
+			if err := denyAtModifiers(expr); err != nil {
+				return EnforceResult{}, err
+			}
+		}
+		// Branches only know the label of their own rule
+		if err := denyPolicyLabelRewrites(expr, compiled.policyLabels); err != nil {
+			return EnforceResult{}, err
+		}
+		selectors := collectVectorSelectors(expr)
+		if len(selectors) == 0 {
+			return EnforceResult{}, errNoSelectors
+		}
+		queryLabels := labelMatchersOf(selectors)
+		if err := validateQueryRegexes(queryLabels); err != nil {
+			return EnforceResult{}, err
+		}
+		if err := validateQueryAgainstPolicy(queryLabels, compiled.allowedValues, compiled.regexValues); err != nil {
+			return EnforceResult{}, err
+		}
+		if err := e.UserLabels.Validate(promQLUserLabels(queryLabels), policy); err != nil {
+			return EnforceResult{}, err
+		}
+		if err := e.Operators.Validate(promQLUserMatchers(queryLabels), policy); err != nil {
+			return EnforceResult{}, err
+		}
+		if expr.Type() != parser.ValueTypeVector {
+			log.Debug().Str("type", string(expr.Type())).Msg("Query cannot be combined with or, enforcing OR policy with AND logic")
+			policy.Logic = LogicAND
+			return e.EnforceResult(query, policy)
+		}
+	}
+
+	var branches []string
+	var firstErr error
+	injected := query == ""
+	// User labels were validated against the full policy above; a single-rule branch would
+	// otherwise treat the other policy labels as user labels
+	branchEnforcer := PromQLEnforcer{AnchorRegexValues: e.AnchorRegexValues}
+	for _, rule := range policy.Rules {
+		branch, err := branchEnforcer.EnforceResult(query, LabelPolicy{Rules: []LabelRule{rule}, Logic: LogicAND})
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		branches = append(branches, "("+branch.Query+")")
+		injected = injected || branch.Injected
+	}
+	if len(branches) == 0 {
+		return EnforceResult{}, firstErr
+	}
 
-	// Inject matchers into the query
-	if err := injectMatchers(expr, matchers); err != nil {
-		return "", fmt.Errorf("failed to inject matchers: %w", err)
+	expr, err := parser.ParseExpr(strings.Join(branches, " or "))
+	if err != nil {
+		return EnforceResult{}, fmt.Errorf("failed to combine policy branches: %w", err)
 	}
 
 	result := expr.String()
 	log.Trace().Str("function", "enforce").Str("query", result).Msg("output")
-	return result, nil
+	return EnforceResult{Query: result, Injected: injected}, nil
+}
+
+// maxCompiledPolicies bounds the compiled policy cache. Policies only change on label
+// store reloads, so the cache is simply reset when it fills up with stale entries.
+const maxCompiledPolicies = 4096
+
+// compiledPolicy holds what Enforce derives from a validated policy. It is shared between
+// requests and must not be modified; injected matchers are only ever read.
+type compiledPolicy struct {
+	allowedValues map[string]map[string]bool   // Label name to ALL values allowed by positive rules
+	regexValues   map[string]map[string]bool   // Label name to the regex values of =~ rules, see policyRegexValues
+	policyLabels  map[string]bool              // Names of the labels of all rules
+	matchers      []*labels.Matcher            // One matcher per rule, in rule order
+	excluding     map[string][]*labels.Matcher // Compiled negative rules of AND policies, see excludingMatchers
+}
+
+var (
+	compiledPoliciesMu sync.RWMutex
+	compiledPolicies   = make(map[string]*compiledPolicy)
+)
+
+// compilePolicy validates the policy and returns its compiled form, cached per policy.
+// Validation compiles every regex value, so it only runs on a cache miss.
+func compilePolicy(policy *LabelPolicy) (*compiledPolicy, error) {
+	key := policyKey(policy)
+
+	compiledPoliciesMu.RLock()
+	compiled, ok := compiledPolicies[key]
+	compiledPoliciesMu.RUnlock()
+	if ok {
+		// The cached entry was validated with the same logic, apply its default
+		if policy.Logic == "" {
+			policy.Logic = LogicAND
+		}
+		return compiled, nil
+	}
+
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Build a map of label name to ALL allowed values across all rules
+	// This handles OR logic where multiple rules may allow different values for the same label
+	compiled = &compiledPolicy{
+		allowedValues: make(map[string]map[string]bool, len(policy.Rules)),
+		policyLabels:  make(map[string]bool, len(policy.Rules)),
+		matchers:      make([]*labels.Matcher, len(policy.Rules)),
+	}
+	for i, rule := range policy.Rules {
+		compiled.policyLabels[rule.Name] = true
+		compiled.matchers[i] = ruleToMatcher(rule)
+		if rule.IsNegative() {
+			continue
+		}
+		allowed, exists := compiled.allowedValues[rule.Name]
+		if !exists {
+			allowed = make(map[string]bool, len(rule.Values))
+			compiled.allowedValues[rule.Name] = allowed
+		}
+		for _, v := range rule.Values {
+			allowed[v] = true
+		}
+	}
+
+	compiled.regexValues = policyRegexValues(*policy)
+
+	var err error
+	if compiled.excluding, err = excludingMatchers(*policy); err != nil {
+		return nil, err
+	}
+
+	compiledPoliciesMu.Lock()
+	if len(compiledPolicies) >= maxCompiledPolicies {
+		compiledPolicies = make(map[string]*compiledPolicy)
+	}
+	compiledPolicies[key] = compiled
+	compiledPoliciesMu.Unlock()
+	return compiled, nil
+}
+
+// policyKey returns a string identifying the policy's logic and rules.
+func policyKey(policy *LabelPolicy) string {
+	size := len(policy.Logic)
+	for _, rule := range policy.Rules {
+		size += len(rule.Name) + len(rule.Operator) + 3
+		for _, v := range rule.Values {
+			size += len(v) + 1
+		}
+	}
+
+	var b strings.Builder
+	b.Grow(size)
+	b.WriteString(policy.Logic)
+	for _, rule := range policy.Rules {
+		b.WriteByte(0)
+		b.WriteString(rule.Name)
+		b.WriteByte(0)
+		b.WriteString(rule.Operator)
+		b.WriteByte(0)
+		for _, v := range rule.Values {
+			b.WriteString(v)
+			b.WriteByte(1)
+		}
+	}
+	return b.String()
 }
 
 // buildQueryFromPolicy constructs a minimal PromQL query from LabelPolicy rules.
 // Example: {namespace=~"prod|staging", team!="frontend"}
-func buildQueryFromPolicy(policy LabelPolicy) string {
+// A selector needs a matcher not matching the empty string, so policies with only negative
+// rules select all metric names, e.g. {__name__=~".+", namespace!="secret"}.
+func buildQueryFromPolicy(policy LabelPolicy, anchor bool) string {
 	var matchers []string
+	if !slices.ContainsFunc(policy.Rules, func(rule LabelRule) bool { return !rule.IsNegative() }) {
+		matchers = append(matchers, labels.MetricName+`=~".+"`)
+	}
 	for _, rule := range policy.Rules {
-		matcher := buildMatcherString(rule)
+		matcher := buildMatcherString(rule, anchor)
 		matchers = append(matchers, matcher)
 	}
 	return fmt.Sprintf("{%s}", strings.Join(matchers, ", "))
@@ -70,58 +307,155 @@ func buildQueryFromPolicy(policy LabelPolicy) string {
 
 // buildMatcherString creates a matcher string from a LabelRule.
 // Handles multiple values by combining them with regex OR (|).
-func buildMatcherString(rule LabelRule) string {
-	operator := rule.Operator
-	value := rule.Values[0]
+func buildMatcherString(rule LabelRule, anchor bool) string {
+	operator, value := emittedMatchValue(rule, anchor)
+	return fmt.Sprintf("%s%s%q", rule.Name, operator, value)
+}
 
-	// For multiple values, use regex operator and combine with |
-	if len(rule.Values) > 1 {
-		value = strings.Join(rule.Values, "|")
-		if operator == OperatorEquals {
-			operator = OperatorRegexMatch
-		} else if operator == OperatorNotEquals {
-			operator = OperatorRegexNoMatch
+// promQLUserLabels returns the label names used in the query's matchers, excluding the metric name.
+func promQLUserLabels(queryLabels map[string][]*labels.Matcher) []string {
+	names := make([]string, 0, len(queryLabels))
+	for name := range queryLabels {
+		if name != labels.MetricName {
+			names = append(names, name)
 		}
 	}
+	return names
+}
 
-	return fmt.Sprintf("%s%s%q", rule.Name, operator, value)
+// promQLUserMatchers returns the query's matchers, excluding those on the metric name.
+func promQLUserMatchers(queryLabels map[string][]*labels.Matcher) []*labels.Matcher {
+	var matchers []*labels.Matcher
+	for name, nameMatchers := range queryLabels {
+		if name != labels.MetricName {
+			matchers = append(matchers, nameMatchers...)
+		}
+	}
+	return matchers
+}
+
+// denyAtModifiers returns an ErrUnsupportedQuery error if expr uses the @ modifier, with a
+// timestamp or with start() or end(). Enforcement itself preserves the modifier.
+func denyAtModifiers(expr parser.Expr) error {
+	var modifier string
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			modifier = atModifier(n.Timestamp, n.StartOrEnd)
+		case *parser.SubqueryExpr:
+			modifier = atModifier(n.Timestamp, n.StartOrEnd)
+		}
+		if modifier != "" {
+			return errStopInspect
+		}
+		return nil
+	})
+	if modifier != "" {
+		return fmt.Errorf("%w: the %s modifier is not allowed", ErrUnsupportedQuery, modifier)
+	}
+	return nil
 }
 
-// extractAllLabelsAndMatchers extracts all label matchers from the query expression.
-// Returns a map of label name to list of matchers for that label.
-func extractAllLabelsAndMatchers(expr parser.Expr) map[string][]*labels.Matcher {
-	labelMatchers := make(map[string][]*labels.Matcher)
+// errNoSelectors rejects queries without a vector selector, such as vector(1) or 1+1, which
+// have no series the policy matchers could be injected into.
+var errNoSelectors = fmt.Errorf("%w: the query has no series selector to scope to the tenant", ErrUnenforceableQuery)
 
+// labelRewriteFuncs are the PromQL functions writing the label named by their second
+// argument: label_replace(v, dst, replacement, src, regex) and label_join(v, dst, sep, src...).
+var labelRewriteFuncs = map[string]bool{"label_replace": true, "label_join": true}
+
+// denyPolicyLabelRewrites rejects queries using label_replace or label_join to write one
+// of the policy labels, which would overwrite the injected tenant label in the result and
+// pass off series of one tenant as another's.
+func denyPolicyLabelRewrites(expr parser.Expr, policyLabels map[string]bool) error {
+	var err error
 	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
-		if vector, ok := node.(*parser.VectorSelector); ok {
-			for _, matcher := range vector.LabelMatchers {
-				labelMatchers[matcher.Name] = append(labelMatchers[matcher.Name], matcher)
-			}
+		call, ok := node.(*parser.Call)
+		if !ok || !labelRewriteFuncs[call.Func.Name] || len(call.Args) < 2 {
+			return nil
+		}
+		dst, ok := unwrapParens(call.Args[1]).(*parser.StringLiteral)
+		if !ok {
+			return nil
+		}
+		if policyLabels[dst.Val] {
+			err = fmt.Errorf("%w: %s cannot rewrite the policy label %s", ErrUnenforceableQuery, call.Func.Name, dst.Val)
+			return errStopInspect
 		}
 		return nil
 	})
+	return err
+}
 
-	return labelMatchers
+// unwrapParens returns expr without enclosing parentheses.
+func unwrapParens(expr parser.Expr) parser.Expr {
+	for {
+		paren, ok := expr.(*parser.ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = paren.Expr
+	}
 }
 
-// validateQueryAgainstPolicy checks if existing query matchers comply with the policy.
-// Returns an error if any matcher violates the policy constraints.
-func validateQueryAgainstPolicy(queryLabels map[string][]*labels.Matcher, policy LabelPolicy) error {
-	// Build a map of label name to ALL allowed values across all rules
-	// This handles OR logic where multiple rules may allow different values for the same label
-	allowedValuesMap := make(map[string]map[string]bool)
+// errStopInspect ends a parser.Inspect walk early.
+var errStopInspect = errors.New("stop inspect")
+
+// atModifier returns the @ modifier set by timestamp or startOrEnd, or "" if none is set.
+func atModifier(timestamp *int64, startOrEnd parser.ItemType) string {
+	switch {
+	case startOrEnd == parser.START:
+		return "@ start()"
+	case startOrEnd == parser.END:
+		return "@ end()"
+	case timestamp != nil:
+		return "@ <timestamp>"
+	}
+	return ""
+}
 
-	for i := range policy.Rules {
-		rule := &policy.Rules[i]
-		if _, exists := allowedValuesMap[rule.Name]; !exists {
-			allowedValuesMap[rule.Name] = make(map[string]bool)
+// collectVectorSelectors returns all vector selectors in the query expression, so the
+// query is walked once for both validation and injection.
+func collectVectorSelectors(expr parser.Expr) []*parser.VectorSelector {
+	var selectors []*parser.VectorSelector
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		if vector, ok := node.(*parser.VectorSelector); ok {
+			selectors = append(selectors, vector)
 		}
-		// Collect all allowed values for this label across all rules
-		for _, v := range rule.Values {
-			allowedValuesMap[rule.Name][v] = true
+		return nil
+	})
+	return selectors
+}
+
+// labelMatchersOf groups the label matchers of the selectors by label name.
+func labelMatchersOf(selectors []*parser.VectorSelector) map[string][]*labels.Matcher {
+	size := 0
+	for _, vector := range selectors {
+		size += len(vector.LabelMatchers)
+	}
+	labelMatchers := make(map[string][]*labels.Matcher, size)
+	for _, vector := range selectors {
+		for _, matcher := range vector.LabelMatchers {
+			labelMatchers[matcher.Name] = append(labelMatchers[matcher.Name], matcher)
 		}
 	}
+	return labelMatchers
+}
 
+// validateQueryRegexes rejects queries with regex matchers longer than the maximum length.
+func validateQueryRegexes(queryLabels map[string][]*labels.Matcher) error {
+	for _, matchers := range queryLabels {
+		if err := validateRegexMatchers(matchers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateQueryAgainstPolicy checks if existing query matchers comply with the allowed
+// values and regex values of the policy, as built by compilePolicy.
+// Returns an error if any matcher violates the policy constraints.
+func validateQueryAgainstPolicy(queryLabels map[string][]*labels.Matcher, allowedValuesMap, regexValuesMap map[string]map[string]bool) error {
 	// Check each existing matcher
 	for labelName, matchers := range queryLabels {
 		allowedValues, hasRule := allowedValuesMap[labelName]
@@ -132,7 +466,7 @@ func validateQueryAgainstPolicy(queryLabels map[string][]*labels.Matcher, policy
 
 		// Validate each matcher for this label
 		for _, matcher := range matchers {
-			if err := validateMatcherWithValues(matcher, allowedValues); err != nil {
+			if err := validateMatcherWithValues(matcher, allowedValues, regexValuesMap[labelName]); err != nil {
 				return err
 			}
 		}
@@ -141,21 +475,22 @@ func validateQueryAgainstPolicy(queryLabels map[string][]*labels.Matcher, policy
 	return nil
 }
 
-// validateMatcherWithValues checks if a matcher complies with the allowed values.
-func validateMatcherWithValues(matcher *labels.Matcher, allowedValues map[string]bool) error {
+// validateMatcherWithValues checks if a matcher complies with the allowed values, or, for
+// regex alternatives, with the allowed patterns.
+func validateMatcherWithValues(matcher *labels.Matcher, allowedValues, allowedPatterns map[string]bool) error {
 	// For equality matchers, check if value is allowed
 	if matcher.Type == labels.MatchEqual {
 		if !allowedValues[matcher.Value] {
-			return fmt.Errorf("unauthorized %s: %s", matcher.Name, matcher.Value)
+			return &DeniedLabelError{Label: matcher.Name, Value: matcher.Value, Operator: matcher.Type.String(), Allowed: len(allowedValues)}
 		}
 	}
 
 	// For regex matchers, check if all pipe-separated values are allowed
 	if matcher.Type == labels.MatchRegexp {
-		values := strings.Split(matcher.Value, "|")
+		values := strings.Split(unanchorRegexValue(matcher.Value), "|")
 		for _, v := range values {
-			if !allowedValues[v] {
-				return fmt.Errorf("unauthorized %s: %s", matcher.Name, v)
+			if !regexAlternativeAllowed(v, allowedValues, allowedPatterns) {
+				return &DeniedLabelError{Label: matcher.Name, Value: v, Operator: matcher.Type.String(), Allowed: len(allowedValues)}
 			}
 		}
 	}
@@ -174,51 +509,58 @@ func validateMatcher(matcher *labels.Matcher, rule *LabelRule) error {
 	for _, v := range rule.Values {
 		allowedValues[v] = true
 	}
-	return validateMatcherWithValues(matcher, allowedValues)
+	return validateMatcherWithValues(matcher, allowedValues, policyRegexValues(LabelPolicy{Rules: []LabelRule{*rule}})[rule.Name])
 }
 
-// buildMatchersFromPolicy creates label matchers from policy rules.
-// Skips rules that already have valid matchers in the query.
-func buildMatchersFromPolicy(policy LabelPolicy, existingLabels map[string][]*labels.Matcher) []*labels.Matcher {
-	var matchers []*labels.Matcher
+// injectMatchers injects the policy matchers into each vector selector. A positive matcher
+// is skipped for selectors that already select its label with = or =~, as those were
+// validated against the allowed values; other selectors of the same query still get it.
+// Negative matchers are injected unless the selector already has the very same matcher,
+// and several of them for the same label, e.g. of a negative rule split by
+// labelstore.max_regex_values, are all kept. It reports whether any matcher was injected.
+func injectMatchers(selectors []*parser.VectorSelector, matchers []*labels.Matcher) bool {
+	if len(matchers) == 0 {
+		return false
+	}
 
-	for _, rule := range policy.Rules {
-		// Skip if this label already has matchers (already validated)
-		if _, exists := existingLabels[rule.Name]; exists {
-			continue
+	injected := false
+	for _, vector := range selectors {
+		existing := len(vector.LabelMatchers)
+		for _, newMatcher := range matchers {
+			if isPositiveMatcher(newMatcher) && selectsLabel(vector.LabelMatchers[:existing], newMatcher.Name) {
+				continue
+			}
+			if !isPositiveMatcher(newMatcher) && hasMatcher(vector.LabelMatchers[:existing], newMatcher) {
+				continue
+			}
+			vector.LabelMatchers = append(vector.LabelMatchers, newMatcher)
+			injected = true
 		}
-
-		matcher := ruleToMatcher(rule)
-		matchers = append(matchers, matcher)
 	}
+	return injected
+}
 
-	return matchers
+// isPositiveMatcher reports whether the matcher selects its values (=, =~) rather than excluding them.
+func isPositiveMatcher(matcher *labels.Matcher) bool {
+	return matcher.Type == labels.MatchEqual || matcher.Type == labels.MatchRegexp
 }
 
-// injectMatchers injects label matchers into all vector selectors in the expression.
-func injectMatchers(expr parser.Expr, matchers []*labels.Matcher) error {
-	if len(matchers) == 0 {
-		return nil
+// selectsLabel reports whether any of the matchers selects values of the label with = or =~.
+func selectsLabel(matchers []*labels.Matcher, name string) bool {
+	for _, matcher := range matchers {
+		if matcher.Name == name && isPositiveMatcher(matcher) {
+			return true
+		}
 	}
+	return false
+}
 
-	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
-		if vector, ok := node.(*parser.VectorSelector); ok {
-			// Add matchers that don't already exist
-			for _, newMatcher := range matchers {
-				hasLabel := false
-				for _, existing := range vector.LabelMatchers {
-					if existing.Name == newMatcher.Name {
-						hasLabel = true
-						break
-					}
-				}
-				if !hasLabel {
-					vector.LabelMatchers = append(vector.LabelMatchers, newMatcher)
-				}
-			}
+// hasMatcher reports whether the matchers contain one equal to matcher.
+func hasMatcher(matchers []*labels.Matcher, matcher *labels.Matcher) bool {
+	for _, m := range matchers {
+		if m.Name == matcher.Name && m.Type == matcher.Type && m.Value == matcher.Value {
+			return true
 		}
-		return nil
-	})
-
-	return nil
+	}
+	return false
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"strings"
 	"testing"
 
@@ -278,6 +279,60 @@ func TestPromQLEnforcer_Enforce(t *testing.T) {
 			want:    `up{namespace="prod"} / on (instance) process_cpu_seconds_total{namespace="prod"}`,
 			wantErr: false,
 		},
+
+		// OR logic tests
+		{
+			name:  "OR logic with distinct labels",
+			query: `sum(rate(http_requests_total[5m]))`,
+			policy: LabelPolicy{
+				Rules: []LabelRule{
+					{Name: "namespace", Operator: "=", Values: []string{"prod"}},
+					{Name: "team", Operator: "=", Values: []string{"backend"}},
+				},
+				Logic: LogicOR,
+			},
+			want:    `(sum(rate(http_requests_total{namespace="prod"}[5m]))) or (sum(rate(http_requests_total{team="backend"}[5m])))`,
+			wantErr: false,
+		},
+		{
+			name:  "OR logic drops branch conflicting with query matcher",
+			query: `up{namespace="staging"}`,
+			policy: LabelPolicy{
+				Rules: []LabelRule{
+					{Name: "namespace", Operator: "=", Values: []string{"dev"}},
+					{Name: "namespace", Operator: "=", Values: []string{"staging"}},
+				},
+				Logic: LogicOR,
+			},
+			want:    `(up{namespace="staging"})`,
+			wantErr: false,
+		},
+		{
+			name:  "OR logic rejects unauthorized value",
+			query: `up{namespace="kube-system"}`,
+			policy: LabelPolicy{
+				Rules: []LabelRule{
+					{Name: "namespace", Operator: "=", Values: []string{"dev"}},
+					{Name: "team", Operator: "=", Values: []string{"backend"}},
+				},
+				Logic: LogicOR,
+			},
+			wantErr: true,
+			errMsg:  "unauthorized namespace",
+		},
+		{
+			name:  "OR logic falls back to AND for range vector",
+			query: `up[5m]`,
+			policy: LabelPolicy{
+				Rules: []LabelRule{
+					{Name: "namespace", Operator: "=", Values: []string{"dev"}},
+					{Name: "team", Operator: "=", Values: []string{"backend"}},
+				},
+				Logic: LogicOR,
+			},
+			want:    `up{namespace="dev", team="backend"}[5m]`,
+			wantErr: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -369,3 +424,393 @@ func TestPromQLEnforcer_EnforceMulti_InvalidPolicy(t *testing.T) {
 		})
 	}
 }
+
+func TestPromQLEnforcer_CompiledPolicyReuse(t *testing.T) {
+	enforcer := PromQLEnforcer{}
+	policy := LabelPolicy{
+		Rules: []LabelRule{
+			{Name: "namespace", Operator: "=", Values: []string{"prod", "staging"}},
+		},
+	}
+	queries := []string{
+		`up`,
+		`up{namespace="prod"}`,
+		`sum(rate(http_requests_total[5m])) / sum(rate(http_requests_total{namespace="staging"}[5m]))`,
+	}
+
+	// The second pass hits the compiled policy cache and must not change the result,
+	// nor leak matchers injected by one query into the next
+	first := make([]string, len(queries))
+	for i, query := range queries {
+		got, err := enforcer.Enforce(query, policy)
+		if err != nil {
+			t.Fatalf("Enforce(%q) error = %v", query, err)
+		}
+		first[i] = got
+	}
+	for i, query := range queries {
+		got, err := enforcer.Enforce(query, policy)
+		if err != nil {
+			t.Fatalf("Enforce(%q) error = %v", query, err)
+		}
+		if got != first[i] {
+			t.Errorf("Enforce(%q) = %q on cache hit, want %q", query, got, first[i])
+		}
+	}
+
+	// A cached policy with an invalid rule is never served
+	policy.Rules[0].Operator = "=="
+	if _, err := enforcer.Enforce("up", policy); err == nil {
+		t.Error("Enforce() expected error for invalid policy")
+	}
+}
+
+func TestPromQLEnforcer_AtModifiers(t *testing.T) {
+	policy := LabelPolicy{
+		Rules: []LabelRule{
+			{Name: "namespace", Operator: "=", Values: []string{"prod"}},
+		},
+		Logic: LogicAND,
+	}
+	orPolicy := LabelPolicy{
+		Rules: []LabelRule{
+			{Name: "namespace", Operator: "=", Values: []string{"prod"}},
+			{Name: "team", Operator: "=", Values: []string{"backend"}},
+		},
+		Logic: LogicOR,
+	}
+	tests := []struct {
+		name    string
+		query   string
+		policy  LabelPolicy
+		allowed string // Enforced query when the @ modifier is allowed
+	}{
+		{
+			name:    "end",
+			query:   `up @ end()`,
+			policy:  policy,
+			allowed: `up{namespace="prod"} @ end()`,
+		},
+		{
+			name:    "start in range selector",
+			query:   `rate(http_requests_total[5m] @ start())`,
+			policy:  policy,
+			allowed: `rate(http_requests_total{namespace="prod"}[5m] @ start())`,
+		},
+		{
+			name:    "timestamp in subquery",
+			query:   `max_over_time(up[1h:5m] @ 1700000000)`,
+			policy:  policy,
+			allowed: `max_over_time(up{namespace="prod"}[1h:5m] @ 1700000000.000)`,
+		},
+		{
+			name:    "OR policy",
+			query:   `up @ end()`,
+			policy:  orPolicy,
+			allowed: `(up{namespace="prod"} @ end()) or (up{team="backend"} @ end())`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PromQLEnforcer{}.Enforce(tt.query, tt.policy)
+			if err != nil {
+				t.Fatalf("Enforce() error = %v", err)
+			}
+			if got != tt.allowed {
+				t.Errorf("Enforce() = %q, want %q", got, tt.allowed)
+			}
+
+			_, err = PromQLEnforcer{DenyAtModifiers: true}.Enforce(tt.query, tt.policy)
+			if !errors.Is(err, ErrUnsupportedQuery) {
+				t.Errorf("Enforce() error = %v, want ErrUnsupportedQuery", err)
+			}
+		})
+	}
+
+	// Queries without the @ modifier are unaffected
+	got, err := PromQLEnforcer{DenyAtModifiers: true}.Enforce(`rate(up[5m] offset 1h)`, policy)
+	if err != nil {
+		t.Fatalf("Enforce() error = %v", err)
+	}
+	if want := `rate(up{namespace="prod"}[5m] offset 1h)`; got != want {
+		t.Errorf("Enforce() = %q, want %q", got, want)
+	}
+}
+
+func TestPromQLEnforcer_MetricNameSelectors(t *testing.T) {
+	policy := LabelPolicy{
+		Rules: []LabelRule{
+			{Name: "namespace", Operator: "=", Values: []string{"prod"}},
+		},
+		Logic: LogicAND,
+	}
+	orPolicy := LabelPolicy{
+		Rules: []LabelRule{
+			{Name: "namespace", Operator: "=", Values: []string{"prod"}},
+			{Name: "team", Operator: "=", Values: []string{"backend"}},
+		},
+		Logic: LogicOR,
+	}
+	tests := []struct {
+		name    string
+		query   string
+		policy  LabelPolicy
+		want    string
+		wantErr string
+	}{
+		{
+			name:   "regex metric name",
+			query:  `{__name__=~"up|node_.*"}`,
+			policy: policy,
+			want:   `{__name__=~"up|node_.*",namespace="prod"}`,
+		},
+		{
+			name:   "match-all metric name",
+			query:  `{__name__=~".+"}`,
+			policy: policy,
+			want:   `{__name__=~".+",namespace="prod"}`,
+		},
+		{
+			// Selectors matching the empty metric name would select every series
+			name:    "negated metric name only",
+			query:   `{__name__!="up"}`,
+			policy:  policy,
+			wantErr: "vector selector must contain at least one non-empty matcher",
+		},
+		{
+			name:   "metric name selectors in aggregation and binary operation",
+			query:  `sum by (__name__) ({__name__=~".+"}) / {__name__="up"}`,
+			policy: policy,
+			want:   `sum by (__name__) ({__name__=~".+",namespace="prod"}) / {__name__="up",namespace="prod"}`,
+		},
+		{
+			name:   "metric name selector with OR policy",
+			query:  `{__name__="up"}`,
+			policy: orPolicy,
+			want:   `({__name__="up",namespace="prod"}) or ({__name__="up",team="backend"})`,
+		},
+		{
+			name:    "metric name selector with unauthorized tenant",
+			query:   `{__name__="up", namespace="dev"}`,
+			policy:  policy,
+			wantErr: "unauthorized namespace: dev",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PromQLEnforcer{}.Enforce(tt.query, tt.policy)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Enforce() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Enforce() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Enforce() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPromQLEnforcer_LabelRewrites(t *testing.T) {
+	policy := LabelPolicy{
+		Rules: []LabelRule{
+			{Name: "namespace", Operator: "=", Values: []string{"prod"}},
+		},
+		Logic: LogicAND,
+	}
+	orPolicy := LabelPolicy{
+		Rules: []LabelRule{
+			{Name: "namespace", Operator: "=", Values: []string{"prod"}},
+			{Name: "team", Operator: "=", Values: []string{"backend"}},
+		},
+		Logic: LogicOR,
+	}
+	tests := []struct {
+		name    string
+		query   string
+		policy  LabelPolicy
+		want    string
+		wantErr string
+	}{
+		{
+			name:    "label_replace of the tenant label",
+			query:   `label_replace(up, "namespace", "dev", "", "")`,
+			policy:  policy,
+			wantErr: "label_replace cannot rewrite the policy label namespace",
+		},
+		{
+			name:    "label_replace of the tenant label in parentheses",
+			query:   `label_replace(up, ("namespace"), "dev", "", "")`,
+			policy:  policy,
+			wantErr: "label_replace cannot rewrite the policy label namespace",
+		},
+		{
+			name:    "nested label_join of the tenant label",
+			query:   `sum by (namespace) (label_join(up, "namespace", ",", "job"))`,
+			policy:  policy,
+			wantErr: "label_join cannot rewrite the policy label namespace",
+		},
+		{
+			name:    "label_replace of a label of another OR rule",
+			query:   `label_replace(up, "team", "frontend", "", "")`,
+			policy:  orPolicy,
+			wantErr: "label_replace cannot rewrite the policy label team",
+		},
+		{
+			name:   "label_replace reading the tenant label",
+			query:  `label_replace(up, "ns", "$1", "namespace", "(.*)")`,
+			policy: policy,
+			want:   `label_replace(up{namespace="prod"}, "ns", "$1", "namespace", "(.*)")`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PromQLEnforcer{}.Enforce(tt.query, tt.policy)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Enforce() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Enforce() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Enforce() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPromQLEnforcer_Unenforceable(t *testing.T) {
+	policy := LabelPolicy{
+		Rules: []LabelRule{
+			{Name: "namespace", Operator: "=", Values: []string{"prod"}},
+		},
+		Logic: LogicAND,
+	}
+	orPolicy := LabelPolicy{
+		Rules: []LabelRule{
+			{Name: "namespace", Operator: "=", Values: []string{"prod"}},
+			{Name: "team", Operator: "=", Values: []string{"backend"}},
+		},
+		Logic: LogicOR,
+	}
+	tests := []struct {
+		name   string
+		query  string
+		policy LabelPolicy
+	}{
+		{name: "number literal", query: `1`, policy: policy},
+		{name: "scalar arithmetic", query: `1 + 1`, policy: policy},
+		{name: "vector function", query: `vector(1)`, policy: policy},
+		{name: "time function", query: `sum(vector(time()))`, policy: policy},
+		{name: "no selector with OR policy", query: `vector(1)`, policy: orPolicy},
+		{name: "label_replace of the tenant label", query: `label_replace(up, "namespace", "dev", "", "")`, policy: policy},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := PromQLEnforcer{}.Enforce(tt.query, tt.policy)
+			if !errors.Is(err, ErrUnenforceableQuery) {
+				t.Errorf("Enforce() error = %v, want ErrUnenforceableQuery", err)
+			}
+		})
+	}
+}
+
+func TestPromQLEnforcer_NegativeRules(t *testing.T) {
+	policy := LabelPolicy{
+		Rules: []LabelRule{
+			{Name: "namespace", Operator: "=", Values: []string{"prod"}},
+		},
+		Logic: LogicAND,
+	}
+	negativePolicy := LabelPolicy{
+		Rules: []LabelRule{
+			{Name: "namespace", Operator: "!=", Values: []string{"secret"}},
+		},
+		Logic: LogicAND,
+	}
+	tests := []struct {
+		name    string
+		query   string
+		policy  LabelPolicy
+		want    string
+		wantErr string
+	}{
+		{
+			name:   "negative query matcher does not skip injection",
+			query:  `up{namespace!="dev"}`,
+			policy: policy,
+			want:   `up{namespace!="dev",namespace="prod"}`,
+		},
+		{
+			name:   "every selector without the policy label is injected",
+			query:  `up{namespace="prod"} + other`,
+			policy: policy,
+			want:   `up{namespace="prod"} + other{namespace="prod"}`,
+		},
+		{
+			name:    "excluded value selected by the query",
+			query:   `up{namespace="secret"}`,
+			policy:  negativePolicy,
+			wantErr: "unauthorized namespace: secret",
+		},
+		{
+			name:    "excluded value in a regex of another selector",
+			query:   `up{namespace="prod"} / on() up{namespace=~"dev|secret"}`,
+			policy:  negativePolicy,
+			wantErr: "unauthorized namespace: secret",
+		},
+		{
+			name:   "negative rule injected next to other values",
+			query:  `up{namespace="prod"}`,
+			policy: negativePolicy,
+			want:   `up{namespace!="secret",namespace="prod"}`,
+		},
+		{
+			name:   "identical negative matcher is not duplicated",
+			query:  `up{namespace!="secret"}`,
+			policy: negativePolicy,
+			want:   `up{namespace!="secret"}`,
+		},
+		{
+			name:   "empty query with only negative rules",
+			query:  "",
+			policy: negativePolicy,
+			want:   `{__name__=~".+",namespace!="secret"}`,
+		},
+		{
+			name:    "label_replace of a negative rule label",
+			query:   `label_replace(up, "namespace", "prod", "", "")`,
+			policy:  negativePolicy,
+			wantErr: "label_replace cannot rewrite the policy label namespace",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PromQLEnforcer{}.Enforce(tt.query, tt.policy)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Enforce() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Enforce() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Enforce() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,33 +3,54 @@ package main
 import (
 	"fmt"
 	"regexp"
+	"slices"
 	"strings"
 
 	"github.com/grafana/tempo/pkg/traceql"
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/rs/zerolog/log"
 )
 
+// traceQLScopes are the attribute scope prefixes a tenant label must have. A leading dot
+// alone is the unscoped form, matching the attribute in any scope.
+var traceQLScopes = []string{"resource.", "span.", "event.", "link.", "instrumentation.", "."}
+
 // TraceQLEnforcer manipulates and enforces tenant isolation on TraceQL queries.
-type TraceQLEnforcer struct{}
+type TraceQLEnforcer struct {
+	UserLabels        UserLabelFilter     // Restricts the attributes users may filter on; intrinsics are not restricted
+	Operators         LabelOperatorFilter // Restricts the operators users may apply to attributes; intrinsics are not restricted
+	TenantLabels      []string            // Attributes policies may isolate tenants by (e.g., resource.namespace); empty allows any
+	AnchorRegexValues bool                // Anchor the regex values of filters built from policies, see web.anchor_regex_values
+}
 
 // Enforce modifies a TraceQL query string to enforce multi-label access policy.
 // It handles multiple label rules with different operators (=, !=, =~, !~) and logic (AND/OR).
 // If the input query is empty, constructs a new query from the policy.
 // If the input query is non-empty, validates existing attributes and injects policy filters.
 // Returns the modified query or an error if parsing, validation, or modification fails.
-func (TraceQLEnforcer) Enforce(query string, policy LabelPolicy) (string, error) {
+func (e TraceQLEnforcer) Enforce(query string, policy LabelPolicy) (string, error) {
+	result, err := e.EnforceResult(query, policy)
+	return result.Query, err
+}
+
+// EnforceResult enforces the query like Enforce and also reports whether the policy filter
+// was injected, as opposed to the query already filtering on permitted policy attributes.
+func (e TraceQLEnforcer) EnforceResult(query string, policy LabelPolicy) (EnforceResult, error) {
 	log.Trace().Str("function", "enforce").Str("query", query).Msg("input")
 
 	// Validate policy first
 	if err := policy.Validate(); err != nil {
-		return "", fmt.Errorf("invalid label policy: %w", err)
+		return EnforceResult{}, fmt.Errorf("invalid label policy: %w", err)
+	}
+	if err := e.validatePolicyTenantLabels(policy); err != nil {
+		return EnforceResult{}, fmt.Errorf("invalid label policy: %w", err)
 	}
 
 	// Handle empty query or just braces
 	if query == "" || strings.TrimSpace(query) == "{}" {
-		query = buildPolicyQuery(policy)
+		query = buildPolicyQuery(policy, e.AnchorRegexValues)
 		log.Trace().Str("function", "enforce").Str("query", query).Msg("enforcing empty query")
-		return query, nil
+		return EnforceResult{Query: query, Injected: true}, nil
 	}
 
 	log.Trace().Str("function", "enforce").Str("query", query).Msg("enforcing")
@@ -37,14 +58,24 @@ func (TraceQLEnforcer) Enforce(query string, policy LabelPolicy) (string, error)
 	// Parse query to validate syntax
 	ast, err := traceql.Parse(query)
 	if err != nil {
-		return "", fmt.Errorf("invalid TraceQL syntax: %w", err)
+		return EnforceResult{}, fmt.Errorf("invalid TraceQL syntax: %w", err)
 	}
 
 	// Check if it's a no-op query (e.g., "{ true }")
 	if ast.IsNoop() {
-		query = buildPolicyQuery(policy)
+		query = buildPolicyQuery(policy, e.AnchorRegexValues)
 		log.Trace().Str("function", "enforce").Str("query", query).Msg("enforcing noop query")
-		return query, nil
+		return EnforceResult{Query: query, Injected: true}, nil
+	}
+
+	if err := e.validateUserAttributes(query, policy); err != nil {
+		return EnforceResult{}, err
+	}
+	if err := e.validateOperators(query, policy); err != nil {
+		return EnforceResult{}, err
+	}
+	if err := validateTraceQLRegexes(query); err != nil {
+		return EnforceResult{}, err
 	}
 
 	// Get serialized version for manipulation
@@ -52,28 +83,124 @@ func (TraceQLEnforcer) Enforce(query string, policy LabelPolicy) (string, error)
 
 	// Validate existing attributes against policy
 	if err := validatePolicyAttributes(serialized, policy); err != nil {
-		return "", err
+		return EnforceResult{}, err
 	}
 
-	// Check if query already contains all policy attributes
-	hasPolicyAttributes := checkPolicyAttributes(serialized, policy)
-	if hasPolicyAttributes {
+	// Inject the policy filter into every spanset filter not already having the policy attributes
+	modified, injected := injectFilter(serialized, buildPolicyFilter(policy, e.AnchorRegexValues), policy)
+	if !injected {
 		log.Trace().Str("function", "enforce").Str("query", serialized).Msg("enforced (already has policy attributes)")
-		return serialized, nil
+		return EnforceResult{Query: serialized}, nil
 	}
 
-	// Inject policy filter if not present
-	filter := buildPolicyFilter(policy)
-	modified := injectFilter(serialized, filter)
-
 	// Validate modified query by re-parsing
 	_, err = traceql.Parse(modified)
 	if err != nil {
-		return "", fmt.Errorf("failed to inject policy filter: %w", err)
+		return EnforceResult{}, fmt.Errorf("failed to inject policy filter: %w", err)
 	}
 
 	log.Trace().Str("function", "enforce").Str("query", modified).Msg("enforced")
-	return modified, nil
+	return EnforceResult{Query: modified, Injected: true}, nil
+}
+
+// validateUserAttributes checks the attributes the query filters on against the user label filter.
+func (e TraceQLEnforcer) validateUserAttributes(query string, policy LabelPolicy) error {
+	if len(e.UserLabels.Allowed) == 0 && len(e.UserLabels.Forbidden) == 0 {
+		return nil
+	}
+
+	req, err := traceql.ExtractFetchSpansRequest(query)
+	if err != nil {
+		return fmt.Errorf("invalid TraceQL syntax: %w", err)
+	}
+
+	var names []string
+	for _, cond := range req.Conditions {
+		if cond.Attribute.Intrinsic != traceql.IntrinsicNone {
+			continue
+		}
+		names = append(names, cond.Attribute.String())
+	}
+	return e.UserLabels.Validate(names, policy)
+}
+
+// validateOperators checks the operators the query compares attributes with against the
+// operator filter.
+func (e TraceQLEnforcer) validateOperators(query string, policy LabelPolicy) error {
+	if !e.Operators.enabled() {
+		return nil
+	}
+
+	req, err := traceql.ExtractFetchSpansRequest(query)
+	if err != nil {
+		return fmt.Errorf("invalid TraceQL syntax: %w", err)
+	}
+
+	for _, cond := range req.Conditions {
+		if cond.Attribute.Intrinsic != traceql.IntrinsicNone || cond.Op == traceql.OpNone {
+			continue
+		}
+		if err := e.Operators.check(cond.Attribute.String(), cond.Op.String(), policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validatePolicyTenantLabels checks that every policy rule is on one of the configured tenant
+// labels, so that a policy meant for another upstream (e.g., on the Loki label namespace)
+// is rejected instead of injecting an attribute Tempo cannot resolve.
+func (e TraceQLEnforcer) validatePolicyTenantLabels(policy LabelPolicy) error {
+	if len(e.TenantLabels) == 0 {
+		return nil
+	}
+	for _, rule := range policy.Rules {
+		if !slices.Contains(e.TenantLabels, rule.Name) {
+			return fmt.Errorf("attribute %s is not a tenant label: %s", rule.Name, strings.Join(e.TenantLabels, ", "))
+		}
+	}
+	return nil
+}
+
+// validateTenantLabels checks that every tenant label is a TraceQL attribute with a scope
+// prefix, such as resource.namespace or resource.cluster.
+func validateTenantLabels(tenantLabels []string) error {
+	for _, label := range tenantLabels {
+		valid := false
+		for _, scope := range traceQLScopes {
+			if len(label) > len(scope) && strings.HasPrefix(label, scope) {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("tenant label %q must have a scope prefix: %s", label, strings.Join(traceQLScopes, ", "))
+		}
+	}
+	return nil
+}
+
+// validateTraceQLRegexes rejects queries comparing attributes to regexes longer than the
+// maximum length.
+func validateTraceQLRegexes(query string) error {
+	req, err := traceql.ExtractFetchSpansRequest(query)
+	if err != nil {
+		return fmt.Errorf("invalid TraceQL syntax: %w", err)
+	}
+	for _, cond := range req.Conditions {
+		if cond.Op != traceql.OpRegex && cond.Op != traceql.OpNotRegex {
+			continue
+		}
+		for _, operand := range cond.Operands {
+			if operand.Type != traceql.TypeString {
+				continue
+			}
+			if err := validateRegexLength(operand.EncodeToString(false)); err != nil {
+				return fmt.Errorf("invalid condition on %s: %w", cond.Attribute, err)
+			}
+		}
+	}
+	return nil
 }
 
 // buildPolicyQuery constructs a minimal TraceQL query from a LabelPolicy.
@@ -81,8 +208,8 @@ func (TraceQLEnforcer) Enforce(query string, policy LabelPolicy) (string, error)
 // - Single rule: { resource.namespace = "prod" }
 // - Multiple rules (AND): { resource.namespace = "prod" && resource.team = "backend" }
 // - Multiple values: { resource.namespace =~ "prod|staging" }
-func buildPolicyQuery(policy LabelPolicy) string {
-	filter := buildPolicyFilter(policy)
+func buildPolicyQuery(policy LabelPolicy, anchor bool) string {
+	filter := buildPolicyFilter(policy, anchor)
 	return fmt.Sprintf("{ %s }", filter)
 }
 
@@ -93,11 +220,11 @@ func buildPolicyQuery(policy LabelPolicy) string {
 // - resource.namespace =~ "prod|staging"
 // - resource.namespace = "prod" && resource.team = "backend"
 // - resource.namespace = "prod" || resource.team = "backend"
-func buildPolicyFilter(policy LabelPolicy) string {
+func buildPolicyFilter(policy LabelPolicy, anchor bool) string {
 	var filters []string
 
 	for _, rule := range policy.Rules {
-		filter := buildRuleFilter(rule)
+		filter := buildRuleFilter(rule, anchor)
 		filters = append(filters, filter)
 	}
 
@@ -117,48 +244,21 @@ func buildPolicyFilter(policy LabelPolicy) string {
 // - resource.namespace != "test"
 // - resource.namespace =~ "prod|staging"
 // - resource.team !~ "external|guest"
-func buildRuleFilter(rule LabelRule) string {
-	operator := rule.Operator
-
-	// For multiple values with = or !=, convert to regex
-	if len(rule.Values) > 1 {
-		if operator == OperatorEquals {
-			operator = OperatorRegexMatch
-		} else if operator == OperatorNotEquals {
-			operator = OperatorRegexNoMatch
-		}
-	}
-
-	// Build value expression
-	var valueExpr string
-	if operator == OperatorRegexMatch || operator == OperatorRegexNoMatch {
-		// For regex operators with multiple values, join with |
-		if len(rule.Values) > 1 {
-			// Escape regex special characters in values
-			escapedValues := make([]string, len(rule.Values))
-			for i, v := range rule.Values {
-				escapedValues[i] = escapeRegexChars(v)
-			}
-			valueExpr = fmt.Sprintf(`"%s"`, strings.Join(escapedValues, "|"))
-		} else {
-			// Single value, use as-is (user-provided regex pattern)
-			valueExpr = fmt.Sprintf(`"%s"`, rule.Values[0])
-		}
-	} else {
-		// For = and !=, use single value without escaping
-		valueExpr = fmt.Sprintf(`"%s"`, rule.Values[0])
-	}
-
-	return fmt.Sprintf("%s%s%s", rule.Name, operator, valueExpr)
+func buildRuleFilter(rule LabelRule, anchor bool) string {
+	operator, value := emittedMatchValue(rule, anchor)
+	return fmt.Sprintf(`%s%s"%s"`, rule.Name, operator, value)
 }
 
 // validatePolicyAttributes validates that any existing policy attributes in the query
 // match the allowed values in the policy. Returns error if unauthorized values are found.
 func validatePolicyAttributes(query string, policy LabelPolicy) error {
-	// Build a map of label name to ALL allowed values across all rules
+	// Build a map of label name to ALL values allowed by positive rules
 	// This handles OR logic where multiple rules may allow different values for the same label
 	allowedValuesMap := make(map[string]map[string]bool)
 	for _, rule := range policy.Rules {
+		if rule.IsNegative() {
+			continue
+		}
 		if _, exists := allowedValuesMap[rule.Name]; !exists {
 			allowedValuesMap[rule.Name] = make(map[string]bool)
 		}
@@ -167,11 +267,13 @@ func validatePolicyAttributes(query string, policy LabelPolicy) error {
 		}
 	}
 
+	regexValuesMap := policyRegexValues(policy)
+
 	// Check each label name in the policy
 	for labelName, allowedValues := range allowedValuesMap {
 		// Pattern to match attribute with value
 		// Matches: resource.namespace = "value" or resource.namespace =~ "value1|value2"
-		pattern := fmt.Sprintf(`%s\s*=~?\s*[\x60"]([^"\x60]+)[\x60"]`, regexp.QuoteMeta(labelName))
+		pattern := fmt.Sprintf(`%s\s*(=~?)\s*[\x60"]([^"\x60]+)[\x60"]`, regexp.QuoteMeta(labelName))
 		re := regexp.MustCompile(pattern)
 
 		matches := re.FindAllStringSubmatch(query, -1)
@@ -182,34 +284,79 @@ func validatePolicyAttributes(query string, policy LabelPolicy) error {
 
 		// Validate all found attribute values
 		for _, match := range matches {
-			if len(match) < 2 {
+			if len(match) < 3 {
 				continue
 			}
-			value := match[1]
+			operator, value := match[1], match[2]
+			if operator == OperatorRegexMatch {
+				value = unanchorRegexValue(value)
+			}
 
 			// Split by pipe for regex patterns
 			queryValues := strings.Split(value, "|")
 			for _, queryValue := range queryValues {
 				queryValue = strings.TrimSpace(queryValue)
-				if _, ok := allowedValues[queryValue]; !ok {
-					return fmt.Errorf("unauthorized %s: %s", labelName, queryValue)
+				allowed := allowedValues[queryValue]
+				if operator == OperatorRegexMatch {
+					allowed = regexAlternativeAllowed(queryValue, allowedValues, regexValuesMap[labelName])
+				}
+				if !allowed {
+					return &DeniedLabelError{Label: labelName, Value: queryValue, Operator: operator, Allowed: len(allowedValues)}
 				}
 			}
 		}
 	}
 
+	// Values excluded by negative rules can never be returned, deny selecting them
+	excluding, err := excludingMatchers(policy)
+	if err != nil {
+		return err
+	}
+	for labelName := range excluding {
+		pattern := fmt.Sprintf(`%s\s*(=~?)\s*[\x60"]([^"\x60]+)[\x60"]`, regexp.QuoteMeta(labelName))
+		var matchers []*labels.Matcher
+		for _, match := range regexp.MustCompile(pattern).FindAllStringSubmatch(query, -1) {
+			matchType, value := labels.MatchEqual, match[2]
+			if match[1] == "=~" {
+				matchType, value = labels.MatchRegexp, unanchorRegexValue(value)
+			}
+			for _, queryValue := range strings.Split(value, "|") {
+				matchers = append(matchers, &labels.Matcher{Type: matchType, Name: labelName, Value: strings.TrimSpace(queryValue)})
+			}
+		}
+		if err := validateExcludedValues(matchers, excluding); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-// checkPolicyAttributes checks if the query already contains all policy attributes.
-// Returns true if all attributes from the policy are present in the query.
+// checkPolicyAttributes checks if the condition of a spanset filter already restricts all
+// policy attributes. Returns true if the condition is a conjunction, so that each of its
+// conditions must hold, with a condition on every policy attribute using =, as validated by
+// validatePolicyAttributes. A condition under || or ! does not restrict the spans, e.g.
+// resource.namespace = "prod" || true. Neither does =~: TraceQL regexes are not anchored,
+// so resource.namespace =~ "prod" also matches prod-copy.
 func checkPolicyAttributes(query string, policy LabelPolicy) bool {
+	conditions, ok := traceQLConjunction(query)
+	if !ok {
+		return false
+	}
 	for _, rule := range policy.Rules {
-		// Pattern to match attribute
-		pattern := fmt.Sprintf(`%s\s*[=!]=?~?\s*[\x60"]`, regexp.QuoteMeta(rule.Name))
-		re := regexp.MustCompile(pattern)
+		// Negative rules must always be injected
+		if rule.IsNegative() {
+			return false
+		}
 
-		if !re.MatchString(query) {
+		// Pattern to match an equality condition on the attribute. Rule names
+		// without a scope match the attribute in any scope, like validatePolicyAttributes.
+		scope := ""
+		if !slices.ContainsFunc(traceQLScopes, func(s string) bool { return strings.HasPrefix(rule.Name, s) }) {
+			scope = `(\S*\.)?`
+		}
+		re := regexp.MustCompile(fmt.Sprintf(`^%s%s\s*=\s*[\x60"]`, scope, regexp.QuoteMeta(rule.Name)))
+		if !slices.ContainsFunc(conditions, re.MatchString) {
 			// Attribute not found
 			return false
 		}
@@ -219,50 +366,89 @@ func checkPolicyAttributes(query string, policy LabelPolicy) bool {
 	return true
 }
 
-// injectFilter injects a policy filter into an existing TraceQL query.
-// The filter is combined with the existing query using the AND operator.
-func injectFilter(query string, filter string) string {
-	trimmed := strings.TrimSpace(query)
+// traceQLConjunction splits the condition of a spanset filter into the conditions joined by
+// &&, without their parentheses. It returns false if the condition contains || or ! outside
+// of strings, so that its conditions need not all hold.
+func traceQLConjunction(condition string) ([]string, bool) {
+	var conditions []string
+	start := 0
+	for i := 0; i < len(condition); {
+		switch {
+		case condition[i] == '"' || condition[i] == '`':
+			i = skipLogQLString(condition, i)
+			continue
+		case strings.HasPrefix(condition[i:], "||"):
+			return nil, false
+		case condition[i] == '!' && !strings.HasPrefix(condition[i:], "!=") && !strings.HasPrefix(condition[i:], "!~"):
+			return nil, false
+		case strings.HasPrefix(condition[i:], "&&"):
+			conditions = append(conditions, strings.Trim(condition[start:i], "(){} \t\n"))
+			start = i + 2
+			i += 2
+			continue
+		}
+		i++
+	}
+	return append(conditions, strings.Trim(condition[start:], "(){} \t\n")), true
+}
 
-	// Handle { true } case (result of empty query parsing)
-	if trimmed == "{ true }" {
-		return fmt.Sprintf("{ %s }", filter)
+// injectFilter injects a policy filter into every spanset filter of a serialized TraceQL
+// query, e.g. both sides of { a } && { b } and the spanset filter of metrics queries such as
+// { a } | rate() by (b). Spanset filters already restricting all policy attributes, see
+// checkPolicyAttributes, are kept. The filter is combined with the existing condition using
+// the AND operator, parenthesizing either side containing || so that the filter applies to
+// the whole condition.
+// Returns the query and whether the filter was injected into any spanset filter.
+func injectFilter(query string, filter string, policy LabelPolicy) (string, bool) {
+	if strings.Contains(filter, "||") {
+		filter = "(" + filter + ")"
 	}
 
-	// Remove outer braces, inject filter with AND, add braces back
-	if strings.HasPrefix(trimmed, "{") && strings.HasSuffix(trimmed, "}") {
-		inner := strings.TrimSpace(trimmed[1 : len(trimmed)-1])
-		if inner == "" || inner == "true" {
-			return fmt.Sprintf("{ %s }", filter)
+	var sb strings.Builder
+	injected := false
+	for i := 0; i < len(query); {
+		switch query[i] {
+		case '"', '`':
+			end := skipLogQLString(query, i)
+			sb.WriteString(query[i:end])
+			i = end
+		case '{':
+			end := traceQLFilterEnd(query, i)
+			inner := strings.TrimSpace(query[i+1 : end])
+			switch {
+			case inner == "" || inner == "true":
+				sb.WriteString("{ " + filter + " }")
+				injected = true
+			case checkPolicyAttributes(inner, policy):
+				sb.WriteString(query[i : end+1])
+			default:
+				if strings.Contains(inner, "||") {
+					inner = "(" + inner + ")"
+				}
+				sb.WriteString("{ " + filter + " && " + inner + " }")
+				injected = true
+			}
+			i = end + 1
+		default:
+			sb.WriteByte(query[i])
+			i++
 		}
-		return fmt.Sprintf("{ %s && %s }", filter, inner)
 	}
-
-	return query
+	return sb.String(), injected
 }
 
-// escapeRegexChars escapes special regex characters in a string to prevent regex injection.
-// Escapes: . * + ? [ ] ( ) | ^ $ \
-func escapeRegexChars(s string) string {
-	// Must escape backslash first to avoid double-escaping
-	escaped := strings.ReplaceAll(s, `\`, `\\`)
-
-	// Then escape other special characters
-	replacements := map[string]string{
-		".": `\.`,
-		"*": `\*`,
-		"+": `\+`,
-		"?": `\?`,
-		"[": `\[`,
-		"]": `\]`,
-		"(": `\(`,
-		")": `\)`,
-		"|": `\|`,
-		"^": `\^`,
-		"$": `\$`,
-	}
-	for char, replacement := range replacements {
-		escaped = strings.ReplaceAll(escaped, char, replacement)
-	}
-	return escaped
+// traceQLFilterEnd returns the index of the brace closing the spanset filter starting at
+// query[start], or the end of the query if it is not closed.
+func traceQLFilterEnd(query string, start int) int {
+	for i := start + 1; i < len(query); {
+		switch query[i] {
+		case '"', '`':
+			i = skipLogQLString(query, i)
+		case '}':
+			return i
+		default:
+			i++
+		}
+	}
+	return len(query) - 1
 }
@@ -207,7 +207,7 @@ func TestTraceQLEnforcer_Enforce(t *testing.T) {
 				},
 				Logic: "OR",
 			},
-			expectedResult: `{ resource.namespace="prod" || resource.team="sre" && span.http.status_code >= 500 }`,
+			expectedResult: `{ (resource.namespace="prod" || resource.team="sre") && span.http.status_code >= 500 }`,
 			expectErr:      false,
 		},
 		{
@@ -344,7 +344,7 @@ func TestBuildPolicyQuery(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := buildPolicyQuery(tt.policy)
+			result := buildPolicyQuery(tt.policy, false)
 			normalizedResult := normalizeWhitespace(result)
 			normalizedExpected := normalizeWhitespace(tt.expectedResult)
 			assert.Equal(t, normalizedExpected, normalizedResult)
@@ -425,7 +425,7 @@ func TestBuildRuleFilter(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := buildRuleFilter(tt.rule)
+			result := buildRuleFilter(tt.rule, false)
 			assert.Equal(t, tt.expectedResult, result)
 		})
 	}
@@ -461,6 +461,18 @@ func TestValidatePolicyAttributes(t *testing.T) {
 			},
 			expectErr: false,
 		},
+		{
+			name:  "Attribute value excluded by a negative rule",
+			query: `{ resource.namespace =~ "prod|secret" }`,
+			policy: LabelPolicy{
+				Rules: []LabelRule{
+					{Name: "resource.namespace", Operator: "!=", Values: []string{"secret"}},
+				},
+				Logic: "AND",
+			},
+			expectErr:     true,
+			errorContains: "unauthorized resource.namespace: secret",
+		},
 		{
 			name:  "Unauthorized attribute",
 			query: `{ resource.namespace = "other" }`,
@@ -580,6 +592,61 @@ func TestCheckPolicyAttributes(t *testing.T) {
 			},
 			expectedResult: false,
 		},
+		{
+			name:  "Attribute only excluded by the query",
+			query: `{ resource.namespace != "dev" }`,
+			policy: LabelPolicy{
+				Rules: []LabelRule{
+					{Name: "resource.namespace", Operator: "=", Values: []string{"prod"}},
+				},
+				Logic: "AND",
+			},
+			expectedResult: false,
+		},
+		{
+			name:  "Attribute under OR",
+			query: `(resource.namespace = "prod") || true`,
+			policy: LabelPolicy{
+				Rules: []LabelRule{
+					{Name: "resource.namespace", Operator: "=", Values: []string{"prod"}},
+				},
+				Logic: "AND",
+			},
+			expectedResult: false,
+		},
+		{
+			name:  "Attribute in a conjunction",
+			query: "((resource.namespace = `prod`) && (span.a = `x || y`)) && (span.b != `z`)",
+			policy: LabelPolicy{
+				Rules: []LabelRule{
+					{Name: "resource.namespace", Operator: "=", Values: []string{"prod"}},
+				},
+				Logic: "AND",
+			},
+			expectedResult: true,
+		},
+		{
+			name:  "Attribute matched by an unanchored regex",
+			query: "resource.namespace =~ `prod`",
+			policy: LabelPolicy{
+				Rules: []LabelRule{
+					{Name: "resource.namespace", Operator: "=", Values: []string{"prod"}},
+				},
+				Logic: "AND",
+			},
+			expectedResult: false,
+		},
+		{
+			name:  "Negative rule is always injected",
+			query: `{ resource.namespace = "secret" }`,
+			policy: LabelPolicy{
+				Rules: []LabelRule{
+					{Name: "resource.namespace", Operator: "!=", Values: []string{"secret"}},
+				},
+				Logic: "AND",
+			},
+			expectedResult: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -589,3 +656,173 @@ func TestCheckPolicyAttributes(t *testing.T) {
 		})
 	}
 }
+
+func TestTraceQLEnforcer_TenantLabels(t *testing.T) {
+	enforcer := TraceQLEnforcer{TenantLabels: []string{"resource.namespace", "resource.cluster"}}
+	policy := LabelPolicy{
+		Rules: []LabelRule{
+			{Name: "resource.namespace", Operator: "=", Values: []string{"prod"}},
+			{Name: "resource.cluster", Operator: "=", Values: []string{"eu-1", "eu-2"}},
+		},
+		Logic: "AND",
+	}
+
+	tests := []struct {
+		name           string
+		query          string
+		policy         LabelPolicy
+		expectedResult string
+		errorContains  string
+	}{
+		{
+			name:           "Empty query with two tenant attributes",
+			query:          "",
+			policy:         policy,
+			expectedResult: `{ resource.namespace="prod" && resource.cluster=~"eu-1|eu-2" }`,
+		},
+		{
+			name:           "Query without tenant attributes",
+			query:          `{ span.http.status_code = 500 }`,
+			policy:         policy,
+			expectedResult: `{ resource.namespace="prod" && resource.cluster=~"eu-1|eu-2" && span.http.status_code = 500 }`,
+		},
+		{
+			name:          "Unauthorized value of the second attribute",
+			query:         `{ resource.namespace = "prod" && resource.cluster = "us-1" }`,
+			policy:        policy,
+			errorContains: "unauthorized resource.cluster: us-1",
+		},
+		{
+			name:  "Policy on an attribute that is not a tenant label",
+			query: "",
+			policy: LabelPolicy{
+				Rules: []LabelRule{{Name: "namespace", Operator: "=", Values: []string{"prod"}}},
+				Logic: "AND",
+			},
+			errorContains: "attribute namespace is not a tenant label",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := enforcer.Enforce(tt.query, tt.policy)
+			if tt.errorContains != "" {
+				assert.ErrorContains(t, err, tt.errorContains)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, normalizeWhitespace(tt.expectedResult), normalizeWhitespace(result))
+		})
+	}
+}
+
+func TestTraceQLEnforcer_SpansetFilters(t *testing.T) {
+	policy := LabelPolicy{
+		Rules: []LabelRule{{Name: "resource.namespace", Operator: "=", Values: []string{"prod"}}},
+		Logic: "AND",
+	}
+	orPolicy := LabelPolicy{
+		Rules: []LabelRule{
+			{Name: "resource.namespace", Operator: "=", Values: []string{"prod"}},
+			{Name: "resource.team", Operator: "=", Values: []string{"sre"}},
+		},
+		Logic: "OR",
+	}
+
+	tests := []struct {
+		name           string
+		query          string
+		policy         LabelPolicy
+		expectedResult string
+		errorContains  string
+	}{
+		{
+			name:           "Metrics query",
+			query:          `{ span.http.status_code >= 500 } | rate() by (resource.service.name)`,
+			policy:         policy,
+			expectedResult: `{ resource.namespace="prod" && span.http.status_code >= 500 } | rate()by(resource.service.name)`,
+		},
+		{
+			name:           "Metrics query on all spans",
+			query:          `{ } | histogram_over_time(duration)`,
+			policy:         policy,
+			expectedResult: `{ resource.namespace="prod" } | histogram_over_time(duration)`,
+		},
+		{
+			name:           "Condition with OR is scoped as a whole",
+			query:          `{ span.a = "x" || span.b = "y" }`,
+			policy:         policy,
+			expectedResult: "{ resource.namespace=\"prod\" && ((span.a = `x`) || (span.b = `y`)) }",
+		},
+		{
+			name:           "OR policy on a metrics query",
+			query:          `{ span.a = "x" } | count_over_time()`,
+			policy:         orPolicy,
+			expectedResult: "{ (resource.namespace=\"prod\" || resource.team=\"sre\") && span.a = `x` } | count_over_time()",
+		},
+		{
+			name:           "Only spansets without policy attributes are injected",
+			query:          `{ resource.namespace = "prod" } >> { span.a = "x" }`,
+			policy:         policy,
+			expectedResult: "({ resource.namespace = `prod` }) >> ({ resource.namespace=\"prod\" && span.a = `x` })",
+		},
+		{
+			name:           "Policy attribute under OR with true is scoped",
+			query:          `{ resource.namespace = "prod" || true }`,
+			policy:         policy,
+			expectedResult: "{ resource.namespace=\"prod\" && ((resource.namespace = `prod`) || true) }",
+		},
+		{
+			name:           "Policy attribute under OR with a negative condition is scoped",
+			query:          `{ resource.namespace = "prod" || resource.namespace != "x" }`,
+			policy:         policy,
+			expectedResult: "{ resource.namespace=\"prod\" && ((resource.namespace = `prod`) || (resource.namespace != `x`)) }",
+		},
+		{
+			name:           "Policy attribute in another scope is scoped",
+			query:          `{ span.resource.namespace = "prod" }`,
+			policy:         policy,
+			expectedResult: "{ resource.namespace=\"prod\" && span.resource.namespace = `prod` }",
+		},
+		{
+			name:           "Negated policy attribute is scoped",
+			query:          `{ !(resource.namespace = "prod") }`,
+			policy:         policy,
+			expectedResult: "{ resource.namespace=\"prod\" && !(resource.namespace = `prod`) }",
+		},
+		{
+			name:           "Scalar filter",
+			query:          `{ span.a = "x" } | count() > 2`,
+			policy:         policy,
+			expectedResult: "{ resource.namespace=\"prod\" && span.a = `x` }|(count()) > 2",
+		},
+		{
+			name:          "Unauthorized attribute in a metrics query",
+			query:         `{ resource.namespace = "dev" } | rate()`,
+			policy:        policy,
+			errorContains: "unauthorized resource.namespace: dev",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := TraceQLEnforcer{}.Enforce(tt.query, tt.policy)
+			if tt.errorContains != "" {
+				assert.ErrorContains(t, err, tt.errorContains)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, normalizeWhitespace(tt.expectedResult), normalizeWhitespace(result))
+		})
+	}
+}
+
+func TestValidateTenantLabels(t *testing.T) {
+	assert.NoError(t, validateTenantLabels(nil))
+	assert.NoError(t, validateTenantLabels([]string{"resource.namespace", "resource.cluster", "span.team", ".tenant"}))
+
+	for _, label := range []string{"namespace", "k8s.namespace", "resource.", "."} {
+		err := validateTenantLabels([]string{"resource.namespace", label})
+		assert.ErrorContains(t, err, "must have a scope prefix", label)
+	}
+}
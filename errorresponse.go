@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxDiscardedErrorBody is how much of a rewritten error body is drained so that the
+// upstream connection can be reused; larger bodies close the connection instead.
+const maxDiscardedErrorBody = 64 * 1024
+
+// errorResponse is the Prometheus API error envelope, which Grafana displays for Prometheus,
+// Loki and Tempo data sources alike.
+type errorResponse struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+}
+
+// rewriteErrorResponse replaces the body of an error response (4xx or 5xx) that is not JSON,
+// such as the HTML error page of a load balancer, with a JSON error naming the upstream
+// status. The status code is preserved. Successful and JSON responses are left untouched.
+func rewriteErrorResponse(resp *http.Response, upstream string) error {
+	if resp.StatusCode < http.StatusBadRequest || isJSONContentType(resp.Header.Get("Content-Type")) {
+		return nil
+	}
+
+	requestLogger(resp.Request).Debug().
+		Str("upstream", upstream).
+		Int("status", resp.StatusCode).
+		Str("content_type", resp.Header.Get("Content-Type")).
+		Msg("Rewriting non-JSON upstream error response")
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxDiscardedErrorBody))
+	_ = resp.Body.Close()
+
+	body, err := json.Marshal(errorResponse{
+		Status:    "error",
+		ErrorType: "upstream",
+		Error:     fmt.Sprintf("%s returned %s", upstream, resp.Status),
+	})
+	if err != nil {
+		return err
+	}
+	body = append(body, '\n')
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Set("Content-Type", "application/json")
+	resp.Header.Del("Content-Encoding")
+	return nil
+}
+
+// isJSONContentType reports whether contentType is application/json or a +json type.
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewriteErrorResponses(t *testing.T) {
+	const htmlPage = "<html><body><h1>500 Internal Server Error</h1></body></html>"
+	const jsonError = `{"status":"error","errorType":"execution","error":"query timed out"}`
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("respond") {
+		case "json":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = fmt.Fprint(w, jsonError)
+		case "ok":
+			w.Header().Set("Content-Type", "text/plain")
+			_, _ = fmt.Fprint(w, "ok")
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = fmt.Fprint(w, htmlPage)
+		}
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name            string
+		rewrite         bool
+		respond         string
+		wantStatus      int
+		wantContentType string
+		wantBody        string // Exact body, unless wantError is set
+		wantError       string // Error of the rewritten JSON error envelope
+	}{
+		{name: "HTML error is rewritten", rewrite: true, wantStatus: http.StatusInternalServerError, wantContentType: "application/json", wantError: "loki returned 500 Internal Server Error"},
+		{name: "HTML error passes through when disabled", wantStatus: http.StatusInternalServerError, wantContentType: "text/html; charset=utf-8", wantBody: htmlPage},
+		{name: "JSON error is left untouched", rewrite: true, respond: "json", wantStatus: http.StatusServiceUnavailable, wantContentType: "application/json", wantBody: jsonError},
+		{name: "successful response is left untouched", rewrite: true, respond: "ok", wantStatus: http.StatusOK, wantContentType: "text/plain", wantBody: "ok"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, tokens := setupTestMain()
+			app.Cfg.Loki.URL = upstream.URL
+			app.Cfg.Loki.RewriteErrorResponses = tt.rewrite
+			app.WithProxies()
+			app.WithRoutes()
+
+			req := httptest.NewRequest(http.MethodGet, "/loki/api/v1/query?query=%7Btenant_id%3D%22allowed_user%22%7D&respond="+tt.respond, nil)
+			req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+			rr := httptest.NewRecorder()
+			app.e.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.wantStatus, rr.Code)
+			assert.Equal(t, tt.wantContentType, rr.Header().Get("Content-Type"))
+			if tt.wantError == "" {
+				assert.Equal(t, tt.wantBody, rr.Body.String())
+				return
+			}
+			var resp errorResponse
+			if assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp)) {
+				assert.Equal(t, errorResponse{Status: "error", ErrorType: "upstream", Error: tt.wantError}, resp)
+			}
+		})
+	}
+}
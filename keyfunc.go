@@ -5,7 +5,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
 	"github.com/MicahParks/keyfunc/v3"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
 
 	"github.com/MicahParks/jwkset"
 )
@@ -15,8 +21,60 @@ var (
 	ErrKeyfunc = errors.New("failed keyfunc")
 )
 
-func NewCombinedJwks(ctx context.Context, urls []string, raw json.RawMessage) (keyfunc.Keyfunc, error) {
-	client, err := jwkset.NewDefaultHTTPClientCtx(ctx, urls)
+// Defaults of the initial JWKS fetch, see JWKSOptions.
+const (
+	defaultJWKSTimeout      = 10 * time.Second
+	defaultJWKSRetries      = 3
+	defaultJWKSRetryBackoff = time.Second
+)
+
+// jwksRefreshInterval is the interval at which the keys of every JWKS endpoint are refreshed.
+const jwksRefreshInterval = time.Hour
+
+// JWKSOptions configures the requests to the JWKS endpoints.
+type JWKSOptions struct {
+	Timeout      time.Duration // Timeout of each JWKS request (default: 10s)
+	Retries      int           // Retries of a failed initial fetch (default: 3)
+	RetryBackoff time.Duration // Wait before the first retry, doubled for every further one (default: 1s)
+	StaleGrace   time.Duration // How long keys are still used once a refresh is missed, zero for no limit
+
+	now func() time.Time // Clock of the key expiry, time.Now if nil
+}
+
+// withDefaults returns the options with defaults for unset values.
+func (o JWKSOptions) withDefaults() JWKSOptions {
+	if o.Timeout <= 0 {
+		o.Timeout = defaultJWKSTimeout
+	}
+	if o.Retries <= 0 {
+		o.Retries = defaultJWKSRetries
+	}
+	if o.RetryBackoff <= 0 {
+		o.RetryBackoff = defaultJWKSRetryBackoff
+	}
+	return o
+}
+
+// NewCombinedJwks returns a keyfunc validating tokens with the keys of all JWKS endpoints
+// and of the raw JWK Set, if any. Every endpoint is fetched before returning; a failed
+// fetch is retried with exponential backoff, and an error is returned once the retries
+// are exhausted. Keys are refreshed hourly afterwards; with a StaleGrace, keys of an endpoint
+// that cannot be refreshed are used for that long after the missed refresh and then dropped.
+func NewCombinedJwks(ctx context.Context, urls []string, raw json.RawMessage, options JWKSOptions) (keyfunc.Keyfunc, error) {
+	options = options.withDefaults()
+	clientOptions := jwkset.HTTPClientOptions{
+		HTTPURLs:          make(map[string]jwkset.Storage, len(urls)),
+		RateLimitWaitMax:  time.Minute,
+		RefreshUnknownKID: rate.NewLimiter(rate.Every(5*time.Minute), 1),
+	}
+	for _, u := range urls {
+		store, err := fetchJWKS(ctx, u, options)
+		if err != nil {
+			return nil, err
+		}
+		clientOptions.HTTPURLs[u] = store
+	}
+	client, err := jwkset.NewHTTPClient(clientOptions)
 	if err != nil {
 		return nil, err
 	}
@@ -39,8 +97,179 @@ func NewCombinedJwks(ctx context.Context, urls []string, raw json.RawMessage) (k
 		}
 	}
 
-	options := keyfunc.Options{
+	return keyfunc.New(keyfunc.Options{
 		Storage: client,
+	})
+}
+
+// fetchJWKS returns a storage of the JWK Set at url, refreshed hourly until ctx is done.
+// The initial fetch is retried with exponential backoff.
+func fetchJWKS(ctx context.Context, url string, options JWKSOptions) (jwkset.Storage, error) {
+	keys := newStaleJWKS(url, options)
+	backoff := options.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		// Without a refresh interval the keys are fetched once, without a refresh goroutine
+		_, err := jwkset.NewStorageFromHTTP(url, jwkset.HTTPClientStorageOptions{
+			Ctx:         ctx,
+			HTTPTimeout: options.Timeout,
+			Storage:     keys,
+		})
+		if err == nil {
+			break
+		}
+		if attempt >= options.Retries {
+			return nil, fmt.Errorf("failed to fetch JWKS from %s after %d attempts: %w", url, attempt+1, err)
+		}
+
+		log.Warn().Err(err).Str("url", url).Int("attempt", attempt+1).Dur("backoff", backoff).Msg("Failed to fetch JWKS, retrying")
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to fetch JWKS from %s: %w", url, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	// The refreshing storage fetches the keys once more; if that fails the fetched keys are kept
+	return jwkset.NewStorageFromHTTP(url, jwkset.HTTPClientStorageOptions{
+		Ctx:                       ctx,
+		HTTPTimeout:               options.Timeout,
+		NoErrorReturnFirstHTTPReq: true,
+		RefreshInterval:           jwksRefreshInterval,
+		RefreshErrorHandler: func(ctx context.Context, err error) {
+			if keys.grace > 0 {
+				log.Error().Err(err).Str("url", url).Time("keys_expire_at", keys.expiry()).Msg("Failed to refresh JWKS, using the last known keys until they expire")
+				return
+			}
+			log.Error().Err(err).Str("url", url).Msg("Failed to refresh JWKS")
+		},
+		Storage: keys,
+	})
+}
+
+// staleJWKS stores the keys of a JWKS endpoint. With auth.jwks_stale_grace, it stops serving
+// them once they were not refreshed for longer than the refresh interval, the request timeout
+// and the grace together, so that tokens are denied during longer JWKS outages.
+type staleJWKS struct {
+	jwkset.Storage
+	url       string
+	fresh     time.Duration // Age up to which keys are refreshed when the endpoint is available
+	grace     time.Duration // How long keys older than fresh are still served, zero for no limit
+	now       func() time.Time
+	refreshed atomic.Int64 // Time of the last successful fetch in Unix nanoseconds
+	stale     atomic.Bool  // Whether serving stale keys was logged since the last fetch
+	expired   atomic.Bool  // Whether the expiry of the keys was logged since the last fetch
+}
+
+func newStaleJWKS(url string, options JWKSOptions) *staleJWKS {
+	s := &staleJWKS{
+		Storage: jwkset.NewMemoryStorage(),
+		url:     url,
+		fresh:   jwksRefreshInterval + options.Timeout,
+		grace:   options.StaleGrace,
+		now:     options.now,
+	}
+	if s.now == nil {
+		s.now = time.Now
+	}
+	return s
+}
+
+// KeyReplaceAll stores the keys of a successful fetch.
+func (s *staleJWKS) KeyReplaceAll(ctx context.Context, given []jwkset.JWK) error {
+	if err := s.Storage.KeyReplaceAll(ctx, given); err != nil {
+		return err
+	}
+	s.refreshed.Store(s.now().UnixNano())
+	s.stale.Store(false)
+	if s.expired.Swap(false) {
+		log.Info().Str("url", s.url).Msg("JWKS refreshed, accepting tokens signed with its keys again")
+	}
+	return nil
+}
+
+// KeyRead reads a key, reporting it as not found once the keys expired.
+func (s *staleJWKS) KeyRead(ctx context.Context, keyID string) (jwkset.JWK, error) {
+	if err := s.checkAge(); err != nil {
+		return jwkset.JWK{}, err
+	}
+	return s.Storage.KeyRead(ctx, keyID)
+}
+
+// KeyReadAll reads all keys, none once the keys expired.
+func (s *staleJWKS) KeyReadAll(ctx context.Context) ([]jwkset.JWK, error) {
+	if s.checkAge() != nil {
+		return nil, nil
+	}
+	return s.Storage.KeyReadAll(ctx)
+}
+
+// expiry returns when the keys expire if they are not refreshed.
+func (s *staleJWKS) expiry() time.Time {
+	return time.Unix(0, s.refreshed.Load()).Add(s.fresh + s.grace)
+}
+
+// checkAge returns jwkset.ErrKeyNotFound once the keys expired, so that other endpoints are
+// still consulted. Serving stale keys and their expiry are logged once per outage.
+func (s *staleJWKS) checkAge() error {
+	if s.grace <= 0 {
+		return nil
 	}
-	return keyfunc.New(options)
+	refreshed := time.Unix(0, s.refreshed.Load())
+	age := s.now().Sub(refreshed)
+	switch {
+	case age > s.fresh+s.grace:
+		if !s.expired.Swap(true) {
+			log.Error().Str("url", s.url).Time("last_refresh", refreshed).Msg("JWKS keys expired after the stale grace, denying tokens signed with them")
+		}
+		return fmt.Errorf("%w: keys of %s not refreshed since %s", jwkset.ErrKeyNotFound, s.url, refreshed.Format(time.RFC3339))
+	case age > s.fresh:
+		if !s.stale.Swap(true) {
+			log.Warn().Str("url", s.url).Time("last_refresh", refreshed).Time("keys_expire_at", s.expiry()).Msg("JWKS not refreshed, using the last known keys during the stale grace")
+		}
+	}
+	return nil
+}
+
+// JWKSStatus reports the result of fetching a single JWKS endpoint.
+type JWKSStatus struct {
+	URL         string     `json:"url"`
+	Reachable   bool       `json:"reachable"`
+	KeyCount    int        `json:"key_count"`
+	LastRefresh *time.Time `json:"last_refresh,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// checkJWKS fetches and parses the JWK Set at url, reporting reachability and key count.
+func checkJWKS(ctx context.Context, client *http.Client, url string) JWKSStatus {
+	status := JWKSStatus{URL: url}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		status.Error = fmt.Sprintf("unexpected status code %d", resp.StatusCode)
+		return status
+	}
+
+	var jwks jwkset.JWKSMarshal
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		status.Error = fmt.Sprintf("could not parse JWK Set: %v", err)
+		return status
+	}
+
+	now := time.Now().UTC()
+	status.Reachable = true
+	status.KeyCount = len(jwks.Keys)
+	status.LastRefresh = &now
+	return status
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MicahParks/jwkset"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// newFlakyJWKSServer serves the JWK Set of pk, failing the first requests as given by
+// fail, which is called with the 1-based request number.
+func newFlakyJWKSServer(t *testing.T, pk *ecdsa.PrivateKey, fail func(w http.ResponseWriter, r *http.Request, n int32) bool) (*httptest.Server, *atomic.Int32) {
+	x := base64.RawURLEncoding.EncodeToString(pk.PublicKey.X.Bytes())
+	y := base64.RawURLEncoding.EncodeToString(pk.PublicKey.Y.Bytes())
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail(w, r, requests.Add(1)) {
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"keys":[{"kty":"EC","kid":"testKid","alg":"ES256","use":"sig","x":"%s","y":"%s","crv":"P-256"}]}`, x, y)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestNewCombinedJwks_RetriesInitialFetch(t *testing.T) {
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	// The first request is too slow, the second fails, the third succeeds
+	server, requests := newFlakyJWKSServer(t, pk, func(w http.ResponseWriter, r *http.Request, n int32) bool {
+		switch n {
+		case 1:
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			return true
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return true
+		}
+		return false
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	jwks, err := NewCombinedJwks(ctx, []string{server.URL}, nil, JWKSOptions{
+		Timeout:      50 * time.Millisecond,
+		Retries:      3,
+		RetryBackoff: 10 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, requests.Load(), int32(3))
+
+	tokenString, err := genJWKS("user", "user@example.com", nil, pk)
+	assert.NoError(t, err)
+	token, err := jwt.Parse(tokenString, jwks.Keyfunc)
+	assert.NoError(t, err)
+	assert.True(t, token.Valid)
+}
+
+func TestNewCombinedJwks_RetriesExhausted(t *testing.T) {
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	server, requests := newFlakyJWKSServer(t, pk, func(w http.ResponseWriter, r *http.Request, n int32) bool {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return true
+	})
+
+	_, err = NewCombinedJwks(context.Background(), []string{server.URL}, nil, JWKSOptions{
+		Timeout:      50 * time.Millisecond,
+		Retries:      2,
+		RetryBackoff: time.Millisecond,
+	})
+	assert.ErrorContains(t, err, "after 3 attempts")
+	assert.Equal(t, int32(3), requests.Load())
+}
+
+func TestNewCombinedJwks_StaleGrace(t *testing.T) {
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tokenString, err := genJWKS("user", "user@example.com", nil, pk)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		grace     time.Duration
+		elapsed   time.Duration // Time since the keys were fetched, during the outage
+		wantValid bool
+	}{
+		{name: "within refresh interval", grace: time.Hour, elapsed: 30 * time.Minute, wantValid: true},
+		{name: "within grace", grace: time.Hour, elapsed: jwksRefreshInterval + 30*time.Minute, wantValid: true},
+		{name: "beyond grace", grace: time.Hour, elapsed: jwksRefreshInterval + 2*time.Hour},
+		{name: "no grace keeps keys", elapsed: 100 * time.Hour, wantValid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The endpoint serves the keys once and is unavailable afterwards
+			server, _ := newFlakyJWKSServer(t, pk, func(w http.ResponseWriter, r *http.Request, n int32) bool {
+				if n > 2 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return true
+				}
+				return false
+			})
+
+			var elapsed atomic.Int64
+			start := time.Now()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			jwks, err := NewCombinedJwks(ctx, []string{server.URL}, nil, JWKSOptions{
+				Timeout:    50 * time.Millisecond,
+				StaleGrace: tt.grace,
+				now:        func() time.Time { return start.Add(time.Duration(elapsed.Load())) },
+			})
+			assert.NoError(t, err)
+
+			elapsed.Store(int64(tt.elapsed))
+			token, err := jwt.Parse(tokenString, jwks.Keyfunc)
+			if tt.wantValid {
+				assert.NoError(t, err)
+				assert.True(t, token.Valid)
+				return
+			}
+			assert.ErrorIs(t, err, jwkset.ErrKeyNotFound)
+		})
+	}
+}
+
+func TestStaleJWKS_RefreshRestoresKeys(t *testing.T) {
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	jwk, err := jwkset.NewJWKFromKey(pk.Public(), jwkset.JWKOptions{Metadata: jwkset.JWKMetadataOptions{KID: "testKid"}})
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	now := time.Now()
+	keys := newStaleJWKS("https://idp.example.com/jwks", JWKSOptions{Timeout: time.Second, StaleGrace: time.Hour, now: func() time.Time { return now }})
+	assert.NoError(t, keys.KeyReplaceAll(ctx, []jwkset.JWK{jwk}))
+
+	now = now.Add(jwksRefreshInterval + 2*time.Hour)
+	_, err = keys.KeyRead(ctx, "testKid")
+	assert.ErrorIs(t, err, jwkset.ErrKeyNotFound)
+	assert.ErrorContains(t, err, "not refreshed since")
+	all, err := keys.KeyReadAll(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, all)
+
+	// A successful refresh serves the keys again
+	assert.NoError(t, keys.KeyReplaceAll(ctx, []jwkset.JWK{jwk}))
+	_, err = keys.KeyRead(ctx, "testKid")
+	assert.NoError(t, err)
+}
+
+func TestJWKSOptions_Defaults(t *testing.T) {
+	assert.Equal(t, JWKSOptions{Timeout: 10 * time.Second, Retries: 3, RetryBackoff: time.Second}, JWKSOptions{}.withDefaults())
+	assert.Equal(t, JWKSOptions{Timeout: time.Second, Retries: 1, RetryBackoff: time.Minute}, JWKSOptions{Timeout: time.Second, Retries: 1, RetryBackoff: time.Minute}.withDefaults())
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// backendLabelsTimeout bounds each label names request of the startup label check.
+const backendLabelsTimeout = 10 * time.Second
+
+// labelsResponse is the Prometheus and Loki label names API response.
+type labelsResponse struct {
+	Status string   `json:"status"`
+	Data   []string `json:"data"`
+}
+
+// WithBackendLabelCheck warns about policy labels that none of the configured Thanos and Loki
+// backends knows, if labelstore.validate_labels_against_backend is set. Such labels are
+// usually typos (e.g. namepsace) and silently match nothing. The check is best-effort:
+// backends that cannot be queried are skipped with a warning and startup never fails.
+// It must run after WithLabelStore and WithProxies.
+func (a *App) WithBackendLabelCheck() *App {
+	if !a.Cfg.LabelStore.ValidateLabelsAgainstBackend {
+		return a
+	}
+	store, ok := a.LabelStore.(*FileLabelStore)
+	if !ok {
+		log.Warn().Msg("labelstore.validate_labels_against_backend requires the file label store, skipping the label check")
+		return a
+	}
+
+	thanosAuth, thanosAuthErr := newUpstreamAuth(a.Cfg.Thanos.AuthMode, a.Cfg.Thanos.StaticToken, a.Cfg.Thanos.ClientAuthorization, a.Cfg.Thanos.UseMutualTLS, "thanos")
+	lokiAuth, lokiAuthErr := newUpstreamAuth(a.Cfg.Loki.AuthMode, a.Cfg.Loki.StaticToken, a.Cfg.Loki.ClientAuthorization, a.Cfg.Loki.UseMutualTLS, "loki")
+	backends := []struct {
+		upstream string
+		path     string
+		auth     upstreamAuth
+		authErr  error
+		headers  map[string]string
+	}{
+		{"thanos", "/api/v1/labels", thanosAuth, thanosAuthErr, a.Cfg.Thanos.Headers},
+		{"loki", "/loki/api/v1/labels", lokiAuth, lokiAuthErr, a.Cfg.Loki.Headers},
+	}
+	known := make(map[string]bool)
+	var checked []string
+	for _, backend := range backends {
+		proxy := a.proxyFor(backend.upstream)
+		if proxy == nil {
+			continue
+		}
+		if backend.authErr != nil {
+			log.Warn().Err(backend.authErr).Str("upstream", backend.upstream).Msg("Invalid upstream auth, skipping the backend in the label check")
+			continue
+		}
+		names, err := a.fetchBackendLabels(proxy, backend.upstream, backend.path, backend.auth, backend.headers)
+		if err != nil {
+			log.Warn().Err(err).Str("upstream", backend.upstream).Msg("Could not fetch label names, skipping the backend in the label check")
+			continue
+		}
+		for _, name := range names {
+			known[name] = true
+		}
+		checked = append(checked, backend.upstream)
+	}
+	if len(checked) == 0 {
+		return a
+	}
+
+	policyLabels := store.policyLabels()
+	names := make([]string, 0, len(policyLabels))
+	for name := range policyLabels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	unknown := 0
+	for _, name := range names {
+		// Scoped TraceQL attributes (e.g. resource.namespace) only exist in Tempo
+		if strings.Contains(name, ".") || known[name] {
+			continue
+		}
+		unknown++
+		log.Warn().Str("label", name).Strs("entries", policyLabels[name]).Strs("backends", checked).Msg("Policy label is unknown to the backends, check it for typos")
+	}
+	log.Info().Int("labels", len(names)).Int("unknown", unknown).Strs("backends", checked).Msg("Policy labels checked against backends")
+	return a
+}
+
+// fetchBackendLabels returns the label names known to an upstream, queried through its proxy
+// transport with the credentials of proxied requests.
+func (a *App) fetchBackendLabels(proxy *upstreamProxy, upstream string, path string, auth upstreamAuth, headers map[string]string) ([]string, error) {
+	var target string
+	switch upstream {
+	case "thanos":
+		target = a.Cfg.Thanos.URL
+	case "loki":
+		target = a.Cfg.Loki.URL
+	}
+	base, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), backendLabelsTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base.Scheme+"://"+base.Host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	setHeaders(req, auth, headers, a.ServiceAccountToken)
+
+	resp, err := proxy.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("%s returned %s", path, resp.Status)
+	}
+
+	var labels labelsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&labels); err != nil {
+		return nil, fmt.Errorf("error decoding %s response: %w", path, err)
+	}
+	if labels.Status != "success" {
+		return nil, fmt.Errorf("%s returned status %q", path, labels.Status)
+	}
+	return labels.Data, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithBackendLabelCheck(t *testing.T) {
+	labelsBackend := func(path string, status int, labels []string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, path, r.URL.Path)
+			assert.Equal(t, "Bearer sat", r.Header.Get("Authorization"))
+			w.WriteHeader(status)
+			_ = json.NewEncoder(w).Encode(labelsResponse{Status: "success", Data: labels})
+		}))
+	}
+	thanos := labelsBackend("/api/v1/labels", http.StatusOK, []string{"__name__", "namespace", "job"})
+	defer thanos.Close()
+	loki := labelsBackend("/loki/api/v1/labels", http.StatusOK, []string{"cluster", "namespace"})
+	defer loki.Close()
+	failing := labelsBackend("/loki/api/v1/labels", http.StatusInternalServerError, nil)
+	defer failing.Close()
+
+	tests := []struct {
+		name      string
+		enabled   bool
+		lokiURL   string
+		wantWarns []string // Labels expected to be reported as unknown
+	}{
+		{name: "disabled", lokiURL: loki.URL},
+		{name: "labels known to any backend pass", enabled: true, lokiURL: loki.URL, wantWarns: []string{"namepsace"}},
+		{name: "failing backend is skipped", enabled: true, lokiURL: failing.URL, wantWarns: []string{"cluster", "namepsace"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			originalLogger := log.Logger
+			log.Logger = zerolog.New(&buf)
+			defer func() { log.Logger = originalLogger }()
+
+			app, _ := setupTestMain()
+			app.ServiceAccountToken = "sat"
+			app.Cfg.Thanos.URL = thanos.URL
+			app.Cfg.Loki.URL = tt.lokiURL
+			app.Cfg.LabelStore.ValidateLabelsAgainstBackend = tt.enabled
+			app.LabelStore = &FileLabelStore{policyCache: map[string]*LabelPolicy{
+				"entry:team-a": {Rules: []LabelRule{
+					{Name: "namespace", Operator: OperatorEquals, Values: []string{"a"}},
+					{Name: "namepsace", Operator: OperatorEquals, Values: []string{"a"}},
+				}, Logic: LogicAND},
+				"entry:team-b":  {Rules: []LabelRule{{Name: "cluster", Operator: OperatorEquals, Values: []string{"eu"}}}, Logic: LogicAND},
+				"entry:admins":  {Rules: []LabelRule{{Name: "#cluster-wide", Operator: OperatorEquals, Values: []string{"true"}}}, Logic: LogicAND},
+				"entry:tracing": {Rules: []LabelRule{{Name: "resource.namespace", Operator: OperatorEquals, Values: []string{"a"}}}, Logic: LogicAND},
+			}}
+			app.WithProxies()
+			app.WithBackendLabelCheck()
+
+			var unknown []string
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				var entry struct {
+					Level   string   `json:"level"`
+					Message string   `json:"message"`
+					Label   string   `json:"label"`
+					Entries []string `json:"entries"`
+				}
+				if json.Unmarshal([]byte(line), &entry) == nil && entry.Message == "Policy label is unknown to the backends, check it for typos" {
+					assert.Equal(t, "warn", entry.Level)
+					unknown = append(unknown, entry.Label)
+					if entry.Label == "namepsace" {
+						assert.Equal(t, []string{"team-a"}, entry.Entries)
+					}
+				}
+			}
+			assert.Equal(t, tt.wantWarns, unknown)
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// ErrInvalidUpstreamResponse marks upstream responses the proxy must rewrite but cannot
+// parse. Such responses are neither forwarded as is nor reported as unreachable upstreams:
+// they are answered with 500 Internal Server Error and the reason is logged.
+var ErrInvalidUpstreamResponse = errors.New("invalid upstream response")
+
+// labelValuesFilter carries what is needed to filter a label values response through the
+// request context, from handlerWithProxy to the proxy's ModifyResponse.
+type labelValuesFilter struct {
+	label    string
+	matchers []*labels.Matcher // Policy rules on label
+	any      bool              // Keep values matching any matcher (OR logic) instead of all
+}
+
+// newLabelValuesFilter returns a filter keeping the values of label permitted by policy, or
+// nil if policy does not restrict label. With OR logic, values of label may legitimately be
+// reached through rules on other labels, so the response is only filtered if all rules
+// restrict label.
+func newLabelValuesFilter(policy *LabelPolicy, label string) (*labelValuesFilter, error) {
+	filter := &labelValuesFilter{label: label, any: policy.Logic == LogicOR}
+	for _, rule := range policy.Rules {
+		if rule.Name != label {
+			if filter.any {
+				return nil, nil
+			}
+			continue
+		}
+		m := ruleToMatcher(rule)
+		matcher, err := labels.NewMatcher(m.Type, m.Name, m.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule for label %s: %w", label, err)
+		}
+		filter.matchers = append(filter.matchers, matcher)
+	}
+	if len(filter.matchers) == 0 {
+		return nil, nil
+	}
+	return filter, nil
+}
+
+// permits reports whether the policy permits value.
+func (f *labelValuesFilter) permits(value string) bool {
+	for _, m := range f.matchers {
+		matches := m.Matches(value)
+		if f.any && matches {
+			return true
+		}
+		if !f.any && !matches {
+			return false
+		}
+	}
+	return !f.any
+}
+
+// withLabelValuesFilter marks r for filtering of its label values response if label is
+// restricted by policy. The upstream is asked for an uncompressed response so that it can
+// be rewritten.
+func withLabelValuesFilter(r *http.Request, policy *LabelPolicy, label string) (*http.Request, error) {
+	filter, err := newLabelValuesFilter(policy, label)
+	if err != nil || filter == nil {
+		return r, err
+	}
+	r.Header.Del("Accept-Encoding")
+	return r.WithContext(context.WithValue(r.Context(), labelValuesContextKey, filter)), nil
+}
+
+// filterLabelValuesResponse removes the values not permitted by the user's policy from the
+// "data" array of a successful label values response marked by withLabelValuesFilter.
+// Responses that cannot be parsed are rejected with ErrInvalidUpstreamResponse rather than
+// forwarded unfiltered.
+func filterLabelValuesResponse(resp *http.Response) error {
+	filter, _ := resp.Request.Context().Value(labelValuesContextKey).(*labelValuesFilter)
+	if filter == nil || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return fmt.Errorf("%w: cannot filter label values response with content encoding %q", ErrInvalidUpstreamResponse, encoding)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("error reading label values response: %w", err)
+	}
+
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return fmt.Errorf("%w: error parsing label values response: %v", ErrInvalidUpstreamResponse, err)
+	}
+	var values []string
+	if data, ok := payload["data"]; ok {
+		if err := json.Unmarshal(data, &values); err != nil {
+			return fmt.Errorf("%w: error parsing label values response data: %v", ErrInvalidUpstreamResponse, err)
+		}
+	}
+
+	permitted := make([]string, 0, len(values))
+	for _, v := range values {
+		if filter.permits(v) {
+			permitted = append(permitted, v)
+		}
+	}
+	if removed := len(values) - len(permitted); removed > 0 {
+		requestLogger(resp.Request).Debug().
+			Str("label", filter.label).
+			Int("removed", removed).
+			Msg("Filtered label values not permitted by policy")
+	}
+
+	if payload["data"], err = json.Marshal(permitted); err != nil {
+		return err
+	}
+	if body, err = json.Marshal(payload); err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
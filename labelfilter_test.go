@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLabelValuesFilter_Permits(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    LabelPolicy
+		label     string
+		permitted []string
+		denied    []string
+		noFilter  bool
+	}{
+		{
+			name: "equality",
+			policy: LabelPolicy{Logic: LogicAND, Rules: []LabelRule{
+				{Name: "namespace", Operator: "=", Values: []string{"prod", "staging"}},
+			}},
+			label:     "namespace",
+			permitted: []string{"prod", "staging"},
+			denied:    []string{"dev", "prod-2"},
+		},
+		{
+			name: "regex and negation combined with AND",
+			policy: LabelPolicy{Logic: LogicAND, Rules: []LabelRule{
+				{Name: "namespace", Operator: "=~", Values: []string{"team-.*"}},
+				{Name: "namespace", Operator: "!=", Values: []string{"team-secret"}},
+				{Name: "cluster", Operator: "=", Values: []string{"eu"}},
+			}},
+			label:     "namespace",
+			permitted: []string{"team-a", "team-b"},
+			denied:    []string{"team-secret", "other"},
+		},
+		{
+			name: "OR logic on a single label",
+			policy: LabelPolicy{Logic: LogicOR, Rules: []LabelRule{
+				{Name: "namespace", Operator: "=", Values: []string{"prod"}},
+				{Name: "namespace", Operator: "=~", Values: []string{"dev-.*"}},
+			}},
+			label:     "namespace",
+			permitted: []string{"prod", "dev-1"},
+			denied:    []string{"staging"},
+		},
+		{
+			name: "OR logic across labels is not filtered",
+			policy: LabelPolicy{Logic: LogicOR, Rules: []LabelRule{
+				{Name: "namespace", Operator: "=", Values: []string{"prod"}},
+				{Name: "team", Operator: "=", Values: []string{"backend"}},
+			}},
+			label:    "namespace",
+			noFilter: true,
+		},
+		{
+			name: "unrestricted label is not filtered",
+			policy: LabelPolicy{Logic: LogicAND, Rules: []LabelRule{
+				{Name: "namespace", Operator: "=", Values: []string{"prod"}},
+			}},
+			label:    "job",
+			noFilter: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := newLabelValuesFilter(&tt.policy, tt.label)
+			assert.NoError(t, err)
+			if tt.noFilter {
+				assert.Nil(t, filter)
+				return
+			}
+			assert.NotNil(t, filter)
+			for _, v := range tt.permitted {
+				assert.True(t, filter.permits(v), "value %q should be permitted", v)
+			}
+			for _, v := range tt.denied {
+				assert.False(t, filter.permits(v), "value %q should be denied", v)
+			}
+		})
+	}
+}
+
+func TestFilterLabelResponses(t *testing.T) {
+	var acceptEncoding string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = r.Header.Get("Accept-Encoding")
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/loki/api/v1/label/tenant_id/values", "/api/v1/label/tenant_id/values":
+			_, _ = fmt.Fprint(w, `{"status":"success","data":["allowed_user","also_allowed_user","other_tenant","secret"]}`)
+		case "/loki/api/v1/label/app/values":
+			_, _ = fmt.Fprint(w, `{"status":"success","data":["api","web"]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		filter     bool
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "disallowed values are removed",
+			path:       "/loki/api/v1/label/tenant_id/values",
+			filter:     true,
+			wantStatus: http.StatusOK,
+			wantBody:   `{"data":["allowed_user","also_allowed_user"],"status":"success"}`,
+		},
+		{
+			name:       "thanos label values",
+			path:       "/api/v1/label/tenant_id/values",
+			filter:     true,
+			wantStatus: http.StatusOK,
+			wantBody:   `{"data":["allowed_user","also_allowed_user"],"status":"success"}`,
+		},
+		{
+			name:       "label without policy is left unchanged",
+			path:       "/loki/api/v1/label/app/values",
+			filter:     true,
+			wantStatus: http.StatusOK,
+			wantBody:   `{"status":"success","data":["api","web"]}`,
+		},
+		{
+			name:       "filtering disabled",
+			path:       "/loki/api/v1/label/tenant_id/values",
+			wantStatus: http.StatusOK,
+			wantBody:   `{"status":"success","data":["allowed_user","also_allowed_user","other_tenant","secret"]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, tokens := setupTestMain()
+			app.Cfg.Loki.URL = upstream.URL
+			app.Cfg.Thanos.URL = upstream.URL
+			app.Cfg.Loki.FilterLabelResponses = tt.filter
+			app.Cfg.Thanos.FilterLabelResponses = tt.filter
+			app.WithProxies()
+			app.WithRoutes()
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+			rr := httptest.NewRecorder()
+			app.e.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.wantStatus, rr.Code)
+			assert.JSONEq(t, tt.wantBody, rr.Body.String())
+			assert.Equal(t, fmt.Sprint(rr.Body.Len()), rr.Header().Get("Content-Length"))
+		})
+	}
+
+	app, tokens := setupTestMain()
+	app.Cfg.Loki.FilterLabelResponses = true
+
+	t.Run("upstream compression is disabled for filtered requests", func(t *testing.T) {
+		app.Cfg.Loki.URL = upstream.URL
+		app.WithProxies()
+		app.WithRoutes()
+
+		req := httptest.NewRequest(http.MethodGet, "/loki/api/v1/label/tenant_id/values", nil)
+		req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+		req.Header.Set("Accept-Encoding", "br")
+		rr := httptest.NewRecorder()
+		app.e.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.NotEqual(t, "br", acceptEncoding)
+	})
+
+	t.Run("unparsable upstream response is not forwarded", func(t *testing.T) {
+		invalid := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprint(w, `<html>not label values</html>`)
+		}))
+		defer invalid.Close()
+
+		app.Cfg.Loki.URL = invalid.URL
+		app.WithProxies()
+		app.WithRoutes()
+
+		req := httptest.NewRequest(http.MethodGet, "/loki/api/v1/label/tenant_id/values", nil)
+		req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+		rr := httptest.NewRecorder()
+		app.e.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusInternalServerError, rr.Code)
+		assert.Contains(t, rr.Body.String(), "error parsing label values response")
+		assert.NotContains(t, rr.Body.String(), "not label values")
+	})
+}
@@ -3,6 +3,11 @@ package main
 import (
 	"fmt"
 	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/prometheus/prometheus/model/labels"
 )
 
 // Operator constants for label matching
@@ -19,12 +24,83 @@ const (
 	LogicOR  = "OR"  // Any rule can match
 )
 
+// DefaultClusterWideLabel is the special rule name granting cluster-wide access when
+// labelstore.cluster_wide_label is not set. It can be scoped to a single upstream with a
+// suffix, e.g. "#cluster-wide:loki".
+const DefaultClusterWideLabel = "#cluster-wide"
+
+// clusterWideName is the rule name granting cluster-wide access. Nil means DefaultClusterWideLabel.
+var clusterWideName atomic.Pointer[string]
+
+// SetClusterWideLabel sets the rule name granting cluster-wide access, e.g. for label files
+// with a real label named #cluster-wide; an empty name restores the default. The name cannot
+// contain ":", which separates the upstream of scoped cluster-wide rules.
+func SetClusterWideLabel(name string) error {
+	name = strings.TrimSpace(name)
+	if strings.Contains(name, ":") {
+		return fmt.Errorf("invalid labelstore cluster_wide_label %q: must not contain ':'", name)
+	}
+	if name == "" {
+		clusterWideName.Store(nil)
+		return nil
+	}
+	clusterWideName.Store(&name)
+	return nil
+}
+
+// clusterWideLabel returns the rule name granting cluster-wide access.
+func clusterWideLabel() string {
+	if name := clusterWideName.Load(); name != nil {
+		return *name
+	}
+	return DefaultClusterWideLabel
+}
+
+// DefaultMaxRegexLength is the maximum length of regex values in policies and queries when
+// web.max_regex_length is not set.
+const DefaultMaxRegexLength = 1024
+
+// maxRegexLength bounds the length of regex values in policies and queries, limiting the cost
+// of compiling and evaluating them. Zero means DefaultMaxRegexLength.
+var maxRegexLength atomic.Int64
+
+// SetMaxRegexLength sets the maximum length of regex values; n <= 0 restores the default.
+func SetMaxRegexLength(n int) {
+	maxRegexLength.Store(int64(max(n, 0)))
+}
+
+// validateRegexLength rejects regex patterns longer than the configured maximum.
+func validateRegexLength(pattern string) error {
+	limit := int(maxRegexLength.Load())
+	if limit == 0 {
+		limit = DefaultMaxRegexLength
+	}
+	if len(pattern) > limit {
+		return fmt.Errorf("regex of %d characters exceeds the maximum length of %d", len(pattern), limit)
+	}
+	return nil
+}
+
+// validateRegexMatchers rejects query matchers whose regex exceeds the maximum length.
+func validateRegexMatchers(matchers []*labels.Matcher) error {
+	for _, m := range matchers {
+		if m.Type != labels.MatchRegexp && m.Type != labels.MatchNotRegexp {
+			continue
+		}
+		if err := validateRegexLength(m.Value); err != nil {
+			return fmt.Errorf("invalid matcher for %s: %w", m.Name, err)
+		}
+	}
+	return nil
+}
+
 // LabelRule represents a single label matching rule.
 // It defines a label name, an operator, and one or more values to match against.
 type LabelRule struct {
-	Name     string   `yaml:"name"`     // Label name (e.g., "namespace", "team")
-	Operator string   `yaml:"operator"` // Operator: "=", "!=", "=~", "!~"
-	Values   []string `yaml:"values"`   // Values to match
+	Name     string            `yaml:"name" json:"name"`                      // Label name (e.g., "namespace", "team")
+	Operator string            `yaml:"operator" json:"operator"`              // Operator: "=", "!=", "=~", "!~"
+	Values   []string          `yaml:"values" json:"values"`                  // Values to match
+	Meta     map[string]string `yaml:"_meta,omitempty" json:"meta,omitempty"` // Annotations (e.g., ticket, owner), ignored by enforcement
 }
 
 // LabelPolicy represents the complete access policy for a user or group.
@@ -56,6 +132,9 @@ func (r *LabelRule) Validate() error {
 	// Validate regex patterns for regex operators
 	if r.Operator == OperatorRegexMatch || r.Operator == OperatorRegexNoMatch {
 		for _, value := range r.Values {
+			if err := validateRegexLength(value); err != nil {
+				return err
+			}
 			if _, err := regexp.Compile(value); err != nil {
 				return fmt.Errorf("invalid regex pattern %q: %w", value, err)
 			}
@@ -65,6 +144,13 @@ func (r *LabelRule) Validate() error {
 	return nil
 }
 
+// IsNegative reports whether the rule excludes its values (!=, !~) instead of allowing them.
+// Negative rules only narrow what a query selects, so they are injected even if the query
+// already matches on their label, and their values are never allowed in query matchers.
+func (r *LabelRule) IsNegative() bool {
+	return r.Operator == OperatorNotEquals || r.Operator == OperatorRegexNoMatch
+}
+
 // Validate checks if the LabelPolicy is valid.
 // Returns an error if any rule is invalid or logic is incorrect.
 func (p *LabelPolicy) Validate() error {
@@ -94,9 +180,80 @@ func (p *LabelPolicy) Validate() error {
 // This is determined by checking if any rule has the special #cluster-wide label.
 func (p *LabelPolicy) HasClusterWideAccess() bool {
 	for _, rule := range p.Rules {
-		if rule.Name == "#cluster-wide" {
+		if rule.Name == clusterWideLabel() {
 			return true
 		}
 	}
 	return false
 }
+
+// HasClusterWideAccessFor checks if the policy grants cluster-wide access on the given
+// upstream, either globally (#cluster-wide) or scoped to it (e.g. #cluster-wide:loki).
+func (p *LabelPolicy) HasClusterWideAccessFor(upstream string) bool {
+	for _, rule := range p.Rules {
+		if rule.Name == clusterWideLabel() || rule.Name == clusterWideLabel()+":"+upstream {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRuleFor checks if the policy has at least one rule on the given label.
+func (p *LabelPolicy) HasRuleFor(label string) bool {
+	for _, rule := range p.Rules {
+		if rule.Name == label {
+			return true
+		}
+	}
+	return false
+}
+
+// ToSimpleLabels returns the values the positive rules of the policy allow, keyed by label
+// name, e.g. the tenants a user can see. Regex values are returned as the patterns they are;
+// negative rules allow everything but their values and are left out.
+func (p *LabelPolicy) ToSimpleLabels() map[string][]string {
+	simple := make(map[string][]string)
+	for _, rule := range p.Rules {
+		if rule.IsNegative() {
+			continue
+		}
+		simple[rule.Name] = append(simple[rule.Name], rule.Values...)
+	}
+	for name, values := range simple {
+		slices.Sort(values)
+		simple[name] = slices.Compact(values)
+	}
+	return simple
+}
+
+// WithoutScopedClusterWide returns a copy of the policy without upstream-scoped
+// cluster-wide rules, which must not be injected as label matchers.
+func (p *LabelPolicy) WithoutScopedClusterWide() *LabelPolicy {
+	scoped := *p
+	scoped.Rules = make([]LabelRule, 0, len(p.Rules))
+	for _, rule := range p.Rules {
+		if !isScopedClusterWide(rule.Name) {
+			scoped.Rules = append(scoped.Rules, rule)
+		}
+	}
+	return &scoped
+}
+
+// WithRenamedLabel returns a copy of the policy whose rules on label from are on label to
+// instead, e.g. to enforce a tenant label on a route whose series carry it under another name.
+func (p *LabelPolicy) WithRenamedLabel(from, to string) *LabelPolicy {
+	renamed := *p
+	renamed.Rules = make([]LabelRule, len(p.Rules))
+	for i, rule := range p.Rules {
+		if rule.Name == from {
+			rule.Name = to
+		}
+		renamed.Rules[i] = rule
+	}
+	return &renamed
+}
+
+// isScopedClusterWide reports whether a rule name grants cluster-wide access on a single upstream.
+func isScopedClusterWide(name string) bool {
+	return strings.HasPrefix(name, clusterWideLabel()+":")
+}
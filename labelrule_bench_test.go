@@ -2,6 +2,8 @@ package main
 
 import (
 	"testing"
+
+	"github.com/rs/zerolog"
 )
 
 // Benchmark policy parsing performance
@@ -180,6 +182,50 @@ func BenchmarkPromQLEnforcer_ComplexQuery(b *testing.B) {
 	}
 }
 
+// Benchmark the PromQL hot path over queries typical of Grafana dashboards
+func BenchmarkPromQLEnforcer_RealisticQueries(b *testing.B) {
+	enforcer := PromQLEnforcer{}
+	policy := LabelPolicy{
+		Rules: []LabelRule{
+			{
+				Name:     "namespace",
+				Operator: "=",
+				Values:   []string{"prod", "staging"},
+			},
+			{
+				Name:     "team",
+				Operator: "!=",
+				Values:   []string{"external"},
+			},
+		},
+		Logic: LogicAND,
+	}
+	queries := map[string]string{
+		"Selector":  `up{job="api"}`,
+		"Rate":      `sum by (pod) (rate(container_cpu_usage_seconds_total{container!=""}[5m]))`,
+		"Ratio":     `sum(rate(http_requests_total{namespace="prod",status=~"5.."}[5m])) by (handler) / sum(rate(http_requests_total{namespace="prod"}[5m])) by (handler)`,
+		"Quantile":  `histogram_quantile(0.99, sum by (le, service) (rate(http_request_duration_seconds_bucket[5m])))`,
+		"Subquery":  `max_over_time(sum(kube_pod_container_status_restarts_total)[1h:5m]) > 3`,
+		"EmptyBody": ``,
+	}
+
+	// Trace logging of every query would dominate the measurement
+	level := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	defer zerolog.SetGlobalLevel(level)
+
+	for name, query := range queries {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := enforcer.Enforce(query, policy); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 func BenchmarkPolicyParser_LargeRuleSet(b *testing.B) {
 	parser := NewPolicyParser()
 	// Simulate a user with many label rules
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -208,3 +210,160 @@ func TestLabelPolicyHasClusterWideAccess(t *testing.T) {
 	}
 }
 
+
+func TestLabelPolicyHasClusterWideAccessFor(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   LabelPolicy
+		upstream string
+		want     bool
+	}{
+		{
+			name: "global cluster-wide access",
+			policy: LabelPolicy{
+				Rules: []LabelRule{
+					{Name: "#cluster-wide", Operator: OperatorEquals, Values: []string{"true"}},
+				},
+			},
+			upstream: "thanos",
+			want:     true,
+		},
+		{
+			name: "scoped to requested upstream",
+			policy: LabelPolicy{
+				Rules: []LabelRule{
+					{Name: "#cluster-wide:loki", Operator: OperatorEquals, Values: []string{"true"}},
+					{Name: "namespace", Operator: OperatorEquals, Values: []string{"prod"}},
+				},
+			},
+			upstream: "loki",
+			want:     true,
+		},
+		{
+			name: "scoped to another upstream",
+			policy: LabelPolicy{
+				Rules: []LabelRule{
+					{Name: "#cluster-wide:loki", Operator: OperatorEquals, Values: []string{"true"}},
+					{Name: "namespace", Operator: OperatorEquals, Values: []string{"prod"}},
+				},
+			},
+			upstream: "thanos",
+			want:     false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.HasClusterWideAccessFor(tt.upstream); got != tt.want {
+				t.Errorf("LabelPolicy.HasClusterWideAccessFor(%q) = %v, want %v", tt.upstream, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLabelPolicyHasRuleFor(t *testing.T) {
+	policy := LabelPolicy{
+		Rules: []LabelRule{
+			{Name: "cluster", Operator: OperatorEquals, Values: []string{"eu-1"}},
+			{Name: "team", Operator: OperatorRegexMatch, Values: []string{"backend.*"}},
+		},
+		Logic: LogicAND,
+	}
+
+	for label, want := range map[string]bool{"cluster": true, "team": true, "namespace": false} {
+		if got := policy.HasRuleFor(label); got != want {
+			t.Errorf("LabelPolicy.HasRuleFor(%q) = %v, want %v", label, got, want)
+		}
+	}
+}
+
+func TestLabelPolicyToSimpleLabels(t *testing.T) {
+	policy := LabelPolicy{
+		Rules: []LabelRule{
+			{Name: "tenant_id", Operator: OperatorEquals, Values: []string{"team-b", "team-a"}},
+			{Name: "tenant_id", Operator: OperatorEquals, Values: []string{"team-a"}},
+			{Name: "team", Operator: OperatorRegexMatch, Values: []string{"backend.*"}},
+			{Name: "env", Operator: OperatorNotEquals, Values: []string{"prod"}},
+		},
+		Logic: LogicAND,
+	}
+
+	want := map[string][]string{"tenant_id": {"team-a", "team-b"}, "team": {"backend.*"}}
+	if got := policy.ToSimpleLabels(); !reflect.DeepEqual(got, want) {
+		t.Errorf("LabelPolicy.ToSimpleLabels() = %v, want %v", got, want)
+	}
+	if policy.Rules[0].Values[0] != "team-b" {
+		t.Errorf("ToSimpleLabels() modified the policy")
+	}
+}
+
+func TestLabelPolicyWithoutScopedClusterWide(t *testing.T) {
+	policy := LabelPolicy{
+		Rules: []LabelRule{
+			{Name: "#cluster-wide:loki", Operator: OperatorEquals, Values: []string{"true"}},
+			{Name: "namespace", Operator: OperatorEquals, Values: []string{"prod"}},
+		},
+		Logic: LogicOR,
+	}
+
+	scoped := policy.WithoutScopedClusterWide()
+
+	if len(scoped.Rules) != 1 || scoped.Rules[0].Name != "namespace" {
+		t.Errorf("WithoutScopedClusterWide() rules = %v, want only namespace", scoped.Rules)
+	}
+	if scoped.Logic != LogicOR {
+		t.Errorf("WithoutScopedClusterWide() logic = %q, want %q", scoped.Logic, LogicOR)
+	}
+	if policy.HasClusterWideAccess() {
+		t.Errorf("scoped cluster-wide rule must not grant global access")
+	}
+	if len(policy.Rules) != 2 {
+		t.Errorf("WithoutScopedClusterWide() modified the original policy")
+	}
+}
+
+func TestMaxRegexLength(t *testing.T) {
+	t.Cleanup(func() { SetMaxRegexLength(0) })
+	long := strings.Repeat("a|", DefaultMaxRegexLength/2) + "b"
+
+	rule := LabelRule{Name: "namespace", Operator: OperatorRegexMatch, Values: []string{long}}
+	if err := rule.Validate(); err == nil || !strings.Contains(err.Error(), "exceeds the maximum length of 1024") {
+		t.Errorf("Validate() error = %v, want maximum length error", err)
+	}
+	// Equality values are not regexes
+	rule.Operator = OperatorEquals
+	if err := rule.Validate(); err != nil {
+		t.Errorf("Validate() error = %v, want nil", err)
+	}
+
+	SetMaxRegexLength(8)
+	rule = LabelRule{Name: "namespace", Operator: OperatorRegexNoMatch, Values: []string{"prod-.*-eu-.*"}}
+	if err := rule.Validate(); err == nil {
+		t.Error("Validate() expected error for regex longer than the configured maximum")
+	}
+
+	policy := LabelPolicy{Rules: []LabelRule{{Name: "namespace", Operator: OperatorEquals, Values: []string{"prod"}}}, Logic: LogicAND}
+	tests := []struct {
+		name     string
+		enforcer EnforceQL
+		query    string
+	}{
+		{name: "PromQL matcher", enforcer: PromQLEnforcer{}, query: `up{job=~"api-.*-eu-.*"}`},
+		{name: "PromQL negative matcher", enforcer: PromQLEnforcer{}, query: `up{job!~"api-.*-eu-.*"}`},
+		{name: "LogQL matcher", enforcer: LogQLEnforcer{}, query: `{job=~"api-.*-eu-.*"}`},
+		{name: "TraceQL condition", enforcer: TraceQLEnforcer{}, query: `{ span.http.route =~ "/api/.*/users/.*" }`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.enforcer.Enforce(tt.query, policy)
+			if err == nil || !strings.Contains(err.Error(), "exceeds the maximum length of 8") {
+				t.Errorf("Enforce() error = %v, want maximum length error", err)
+			}
+		})
+	}
+
+	// Short regexes are still accepted
+	if _, err := (PromQLEnforcer{}).Enforce(`up{job=~"api-.*"}`, policy); err != nil {
+		t.Errorf("Enforce() error = %v, want nil", err)
+	}
+}
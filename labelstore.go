@@ -1,11 +1,15 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/rs/zerolog/log"
@@ -44,11 +48,44 @@ type Labelstore interface {
 	GetLabelPolicy(identity UserIdentity, defaultLabel string) (*LabelPolicy, error)
 }
 
-// WithLabelStore initializes and connects to the file-based label store.
+// ErrLabelStoreUnavailable is returned by label stores that cannot currently answer for any
+// user, e.g. after a failed reload with labelstore.on_reload_error fail_closed. Requests are
+// answered with 503 Service Unavailable instead of 403 Forbidden.
+var ErrLabelStoreUnavailable = errors.New("label store unavailable")
+
+// ErrInvalidPolicyResult is returned by non-file label stores whose backend answered with a
+// result that cannot be decoded into a policy, which is a fault of the backend rather than
+// of the user. Requests are answered with 500 Internal Server Error instead of 403 Forbidden.
+var ErrInvalidPolicyResult = errors.New("invalid label store result")
+
+// LabelstoreHealthChecker is implemented by label stores that can tell whether they are ready
+// to answer policy lookups. /readyz reports not ready while Health returns an error.
+type LabelstoreHealthChecker interface {
+	Health() error
+}
+
+// WithLabelStore initializes and connects to the configured label store, file-based by default.
 // It assigns the connected LabelStore to the App instance and returns it.
 // If an error occurs during the connection, it logs a fatal error.
 func (a *App) WithLabelStore() *App {
-	a.LabelStore = &FileLabelStore{}
+	switch strings.ToLower(a.Cfg.LabelStore.Type) {
+	case "", "file":
+		a.LabelStore = &FileLabelStore{}
+	case "opa":
+		a.LabelStore = &OPALabelStore{}
+	default:
+		log.Fatal().Str("type", a.Cfg.LabelStore.Type).Msg("Unknown labelstore type: must be file or opa")
+	}
+	if cache := a.Cfg.LabelStore.Cache; cache.TTL > 0 || cache.NegativeTTL > 0 {
+		if _, ok := a.LabelStore.(*FileLabelStore); ok {
+			log.Warn().Msg("labelstore.cache is ignored by the file label store, which keeps all policies in memory")
+		} else {
+			a.LabelStore = NewCachingLabelStore(a.LabelStore, cache)
+		}
+	}
+	if err := SetClusterWideLabel(a.Cfg.LabelStore.ClusterWideLabel); err != nil {
+		log.Fatal().Err(err).Msg("Error connecting to labelstore")
+	}
 	err := a.LabelStore.Connect(a.Cfg.LabelStore)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Error connecting to labelstore")
@@ -60,8 +97,14 @@ func (a *App) WithLabelStore() *App {
 // All policies are parsed and validated during initialization/reload,
 // eliminating on-demand parsing overhead and ensuring fail-fast validation.
 type FileLabelStore struct {
-	parser      *PolicyParser           // Parser for converting raw YAML to policies
-	policyCache map[string]*LabelPolicy // Cache of eagerly-parsed policies (user:username, group:groupname)
+	parser          *PolicyParser           // Parser for converting raw YAML to policies
+	mu              sync.RWMutex            // Guards policyCache, which requests add merged policies to and reloads replace
+	policyCache     map[string]*LabelPolicy // Cache of eagerly-parsed policies (user:username, group:groupname)
+	groupMergeLogic string                  // Logic used when merging multiple entries (AND or OR)
+	reloadErr       error                   // Error of the last reload while failing closed, guarded by mu
+	lastReloadErr   error                   // Error of the last reload in any on_reload_error mode, guarded by mu
+	entries         int                     // Number of entries in labels.yaml as of the last successful load, guarded by mu
+	config          LabelStoreConfig        // Settings applied on every load (simple format handling, cluster-wide audit)
 }
 
 func (c *FileLabelStore) Connect(config LabelStoreConfig) error {
@@ -69,6 +112,36 @@ func (c *FileLabelStore) Connect(config LabelStoreConfig) error {
 	c.parser = NewPolicyParser()
 	c.policyCache = make(map[string]*LabelPolicy)
 
+	groupMergeLogic, err := normalizeGroupMergeLogic(config.GroupMergeLogic)
+	if err != nil {
+		return err
+	}
+	c.groupMergeLogic = groupMergeLogic
+	if c.parser.DefaultLogic, err = normalizeDefaultLogic(config.DefaultLogic); err != nil {
+		return err
+	}
+	simpleFormat, err := normalizeSimpleFormat(config.SimpleFormat)
+	if err != nil {
+		return err
+	}
+	config.SimpleFormat = simpleFormat
+	regexValuesOverflow, err := normalizeRegexValuesOverflow(config.RegexValuesOverflow)
+	if err != nil {
+		return err
+	}
+	config.RegexValuesOverflow = regexValuesOverflow
+	onReloadError, err := normalizeOnReloadError(config.OnReloadError)
+	if err != nil {
+		return err
+	}
+	config.OnReloadError = onReloadError
+	clusterWidePrecedence, err := normalizeClusterWidePrecedence(config.ClusterWidePrecedence)
+	if err != nil {
+		return err
+	}
+	config.ClusterWidePrecedence = clusterWidePrecedence
+	c.config = config
+
 	v := viper.NewWithOptions(viper.KeyDelimiter("::"))
 	v.SetConfigName("labels")
 	v.SetConfigType("yaml")
@@ -78,7 +151,7 @@ func (c *FileLabelStore) Connect(config LabelStoreConfig) error {
 		v.AddConfigPath(path)
 	}
 
-	err := v.MergeInConfig()
+	err = v.MergeInConfig()
 	if err != nil {
 		return err
 	}
@@ -94,14 +167,7 @@ func (c *FileLabelStore) Connect(config LabelStoreConfig) error {
 	// Watch for configuration changes
 	v.OnConfigChange(func(e fsnotify.Event) {
 		log.Info().Str("file", e.Name).Msg("Config file changed")
-		err = v.MergeInConfig()
-		if err != nil {
-			log.Fatal().Err(err).Msg("Error while reloading config file")
-		}
-		err = c.loadLabels(v, config.ConfigPaths)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Error while reloading label configuration")
-		}
+		c.reload(v, config.ConfigPaths)
 	})
 	v.WatchConfig()
 
@@ -109,6 +175,48 @@ func (c *FileLabelStore) Connect(config LabelStoreConfig) error {
 	return nil
 }
 
+// reload loads the changed labels. If they fail to load, the previously loaded policies
+// keep being enforced or, with on_reload_error fail_closed, every policy lookup fails with
+// ErrLabelStoreUnavailable until a later reload succeeds.
+func (c *FileLabelStore) reload(v *viper.Viper, configPaths []string) {
+	err := v.MergeInConfig()
+	if err == nil {
+		err = c.loadLabels(v, configPaths)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastReloadErr = err
+	if err == nil {
+		if c.reloadErr != nil {
+			log.Info().Msg("Label configuration reloaded, serving requests again")
+		}
+		c.reloadErr = nil
+		return
+	}
+	if c.config.OnReloadError == OnReloadErrorFailClosed {
+		c.reloadErr = err
+		log.Error().Err(err).Msg("Error while reloading label configuration, denying all requests until it loads")
+		return
+	}
+	log.Error().Err(err).Msg("Error while reloading label configuration, keeping the previous labels")
+}
+
+// Health reports the label store as not ready if the last reload failed, even while the
+// previous policies keep being enforced, or if no entries are loaded, e.g. from an empty
+// labels.yaml.
+func (c *FileLabelStore) Health() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.lastReloadErr != nil {
+		return fmt.Errorf("labels failed to reload: %w", c.lastReloadErr)
+	}
+	if c.entries == 0 {
+		return errors.New("no label policies loaded")
+	}
+	return nil
+}
+
 // loadLabels loads label configuration from viper (extended format only)
 // loadLabels loads label configuration from YAML file with case preservation
 // We read the YAML file directly instead of using Viper to parse it, because Viper
@@ -148,11 +256,19 @@ func (c *FileLabelStore) loadLabels(v *viper.Viper, configPaths []string) error
 	for key, data := range rawData {
 		if _, hasRules := data["_rules"]; !hasRules {
 			// Skip cluster-wide entries
-			if _, hasClusterWide := data["#cluster-wide"]; hasClusterWide {
+			if _, hasClusterWide := data[clusterWideLabel()]; hasClusterWide {
 				continue
 			}
 			// Check if this looks like simple format
 			if len(data) > 0 {
+				if c.config.SimpleFormat == SimpleFormatAutoConvert {
+					rawData[key] = convertSimpleEntry(data, c.simpleFormatLabel())
+					log.Warn().
+						Str("entry", key).
+						Str("label", c.simpleFormatLabel()).
+						Msg("DEPRECATED FORMAT: Simple label format converted in memory - run migrate-labels before support is removed")
+					continue
+				}
 				simpleFormatCount++
 				log.Error().
 					Str("entry", key).
@@ -172,8 +288,8 @@ func (c *FileLabelStore) loadLabels(v *viper.Viper, configPaths []string) error
 			"See cmd/migrate-labels/README.md for detailed instructions", simpleFormatCount)
 	}
 
-	// Clear policy cache on reload - prepare for eager parsing
-	c.policyCache = make(map[string]*LabelPolicy)
+	// Parse into a new policy cache, which replaces the current one once complete
+	policyCache := make(map[string]*LabelPolicy)
 
 	// Eager parsing: Parse all policies during initialization
 	// This provides fail-fast validation and eliminates on-demand parsing overhead
@@ -192,7 +308,11 @@ func (c *FileLabelStore) loadLabels(v *viper.Viper, configPaths []string) error
 		// Store parsed policy with simple cache key format
 		// Use prefixes to distinguish users from groups
 		cacheKey := "entry:" + key
-		c.policyCache[cacheKey] = policy
+		if strings.HasPrefix(key, "@") {
+			// Email domains are case-insensitive
+			cacheKey = "entry:" + strings.ToLower(key)
+		}
+		policyCache[cacheKey] = policy
 		parsedCount++
 	}
 
@@ -204,21 +324,146 @@ func (c *FileLabelStore) loadLabels(v *viper.Viper, configPaths []string) error
 			len(parseErrors), strings.Join(parseErrors, "\n"))
 	}
 
+	if err := auditClusterWide(policyCache, c.config); err != nil {
+		return err
+	}
+
+	if c.config.CaseInsensitive.Username || c.config.CaseInsensitive.Groups {
+		c.addFoldedEntries(policyCache)
+	}
+
+	c.mu.Lock()
+	c.policyCache = policyCache
+	c.entries = parsedCount
+	c.mu.Unlock()
+
 	log.Debug().Int("parsedCount", parsedCount).Msg("Labels loaded and parsed eagerly")
 	return nil
 }
 
+// addFoldedEntries adds the entries of policyCache under their lowercased names with a
+// "folded:" prefix, which case-insensitive lookups use. Entries differing only in case are
+// merged like the entries of a user in several groups.
+func (c *FileLabelStore) addFoldedEntries(policyCache map[string]*LabelPolicy) {
+	var entries []string
+	for key := range policyCache {
+		if entry, ok := strings.CutPrefix(key, "entry:"); ok {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Strings(entries)
+
+	for _, entry := range entries {
+		key := entryKey(entry, true)
+		existing, ok := policyCache[key]
+		if !ok {
+			policyCache[key] = policyCache["entry:"+entry]
+			continue
+		}
+		log.Warn().Str("entry", entry).Msg("Merging entries differing only in case for case-insensitive matching")
+		merged, err := c.mergePolicies([]*LabelPolicy{existing, policyCache["entry:"+entry]})
+		if err != nil {
+			// Without a folded entry, the name only matches the entries by exact case
+			log.Error().Err(err).Str("entry", entry).Msg("Cannot merge entries differing only in case")
+			delete(policyCache, key)
+			continue
+		}
+		policyCache[key] = merged
+	}
+}
+
+// entryKey returns the policy cache key of the entry matching name, ignoring case if fold.
+func entryKey(name string, fold bool) string {
+	if fold {
+		return "folded:" + strings.ToLower(name)
+	}
+	return "entry:" + name
+}
+
+// auditClusterWide enumerates the entries granting cluster-wide access that are not in the
+// configured allowlist. Depending on the configuration it logs a warning for each of them
+// or returns an error so the labels are rejected.
+func auditClusterWide(policies map[string]*LabelPolicy, config LabelStoreConfig) error {
+	if !config.WarnOnClusterWide && !config.FailOnClusterWide {
+		return nil
+	}
+
+	var unexpected []string
+	for key, policy := range policies {
+		entry := strings.TrimPrefix(key, "entry:")
+		if policy.HasClusterWideAccess() && !slices.Contains(config.ClusterWideAllowlist, entry) {
+			unexpected = append(unexpected, entry)
+		}
+	}
+	if len(unexpected) == 0 {
+		return nil
+	}
+	sort.Strings(unexpected)
+
+	if config.FailOnClusterWide {
+		return fmt.Errorf("UNEXPECTED CLUSTER-WIDE ACCESS: %d entries grant %s access but are not in cluster_wide_allowlist: %s",
+			len(unexpected), clusterWideLabel(), strings.Join(unexpected, ", "))
+	}
+	for _, entry := range unexpected {
+		log.Warn().Str("entry", entry).Str("label", clusterWideLabel()).Msg("Entry grants cluster-wide access but is not in cluster_wide_allowlist")
+	}
+	return nil
+}
+
+// policyLabels returns the label names referenced by the loaded policies, mapped to the
+// sorted entries referencing them. Cluster-wide markers are not labels and are skipped.
+func (c *FileLabelStore) policyLabels() map[string][]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	labels := make(map[string][]string)
+	for key, policy := range c.policyCache {
+		entry, ok := strings.CutPrefix(key, "entry:")
+		if !ok {
+			continue
+		}
+		for _, rule := range policy.Rules {
+			if rule.Name == clusterWideLabel() || isScopedClusterWide(rule.Name) || slices.Contains(labels[rule.Name], entry) {
+				continue
+			}
+			labels[rule.Name] = append(labels[rule.Name], entry)
+		}
+	}
+	for _, entries := range labels {
+		sort.Strings(entries)
+	}
+	return labels
+}
+
 // GetLabelPolicy retrieves the label policy for a user/group identity.
 // All policies are pre-parsed during initialization, so this method only
 // performs cache lookup and merging for the specific user+groups combination.
+// The entry of the email domain (e.g. "@example.com") is used only when no
+// user or group entry matches.
 func (c *FileLabelStore) GetLabelPolicy(identity UserIdentity, defaultLabel string) (*LabelPolicy, error) {
 	username := identity.Username
 	groups := identity.Groups
+	domain := emailDomain(identity.Email)
+	// The email is only looked up if it differs from the username, whose entry is looked up anyway
+	var email string
+	if c.config.MatchEmail && identity.Email != username {
+		email = identity.Email
+	}
 
 	// Check cache for merged policy (user + specific group combination)
 	// Merged policies are cached per unique user+groups combination for performance
-	mergedCacheKey := "merged:" + username + ":" + strings.Join(groups, ",")
-	if cached, ok := c.policyCache[mergedCacheKey]; ok {
+	mergedCacheKey := "merged:" + username + ":" + strings.Join(groups, ",") + ":" + domain
+	if email != "" {
+		mergedCacheKey += ":" + email
+	}
+	c.mu.RLock()
+	if c.reloadErr != nil {
+		err := c.reloadErr
+		c.mu.RUnlock()
+		return nil, fmt.Errorf("%w: labels failed to reload: %w", ErrLabelStoreUnavailable, err)
+	}
+	policyCache := c.policyCache
+	if cached, ok := policyCache[mergedCacheKey]; ok {
+		c.mu.RUnlock()
 		return cached, nil
 	}
 
@@ -226,68 +471,354 @@ func (c *FileLabelStore) GetLabelPolicy(identity UserIdentity, defaultLabel stri
 	// All policies were eagerly parsed during loadLabels()
 	var policies []*LabelPolicy
 
-	// Look up user policy
-	userCacheKey := "entry:" + username
-	if userPolicy, ok := c.policyCache[userCacheKey]; ok {
-		policies = append(policies, userPolicy)
+	// Look up user policy; tokens without a username are matched by their groups only
+	if username != "" {
+		if userPolicy, ok := policyCache[entryKey(username, c.config.CaseInsensitive.Username)]; ok {
+			policies = append(policies, userPolicy)
+		}
+	}
+
+	// Look up the email's policy, merged with the others like a group policy
+	if email != "" {
+		if emailPolicy, ok := policyCache[entryKey(email, c.config.CaseInsensitive.Username)]; ok {
+			policies = append(policies, emailPolicy)
+		}
 	}
 
 	// Look up group policies
 	for _, group := range groups {
-		groupCacheKey := "entry:" + group
-		if groupPolicy, ok := c.policyCache[groupCacheKey]; ok {
+		if groupPolicy, ok := policyCache[entryKey(group, c.config.CaseInsensitive.Groups)]; ok {
 			policies = append(policies, groupPolicy)
 		}
 	}
 
+	// Fall back to the email domain entry
+	if len(policies) == 0 && domain != "" {
+		if domainPolicy, ok := policyCache["entry:@"+domain]; ok {
+			policies = append(policies, domainPolicy)
+		}
+	}
+	c.mu.RUnlock()
+
 	if len(policies) == 0 {
-		return nil, fmt.Errorf("no policy found for user %s", username)
+		return nil, fmt.Errorf("%w for user %s", ErrPolicyNotFound, username)
 	}
 
 	// Merge policies for this specific user+groups combination
-	mergedPolicy := c.mergePolicies(policies)
+	mergedPolicy, err := c.mergePolicies(policies)
+	if err != nil {
+		return nil, fmt.Errorf("policy of user %s: %w", username, err)
+	}
 
 	// Check for cluster-wide access
-	if mergedPolicy.HasClusterWideAccess() {
-		mergedPolicy = &LabelPolicy{
-			Rules: []LabelRule{{Name: "#cluster-wide", Operator: OperatorEquals, Values: []string{"true"}}},
+	mergedPolicy, err = c.resolveClusterWide(mergedPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("policy of user %s: %w", username, err)
+	}
+
+	mergedPolicy, err = c.limitRegexValues(mergedPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("policy of user %s: %w", username, err)
+	}
+
+	// Cache the merged policy for this user+groups combination, in the policy cache it was
+	// merged from in case the labels were reloaded meanwhile
+	c.mu.Lock()
+	policyCache[mergedCacheKey] = mergedPolicy
+	c.mu.Unlock()
+
+	return mergedPolicy, nil
+}
+
+// emailDomain returns the lowercased domain of email, or an empty string if it has none.
+func emailDomain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 || at == len(email)-1 {
+		return ""
+	}
+	return strings.ToLower(email[at+1:])
+}
+
+// normalizeGroupMergeLogic validates the configured group merge logic and applies the OR default.
+func normalizeGroupMergeLogic(logic string) (string, error) {
+	logic = strings.ToUpper(strings.TrimSpace(logic))
+	switch logic {
+	case "":
+		return LogicOR, nil
+	case LogicAND, LogicOR:
+		return logic, nil
+	default:
+		return "", fmt.Errorf("invalid labelstore group_merge_logic %q: must be AND or OR", logic)
+	}
+}
+
+// normalizeDefaultLogic validates the configured default entry logic and applies the AND default.
+func normalizeDefaultLogic(logic string) (string, error) {
+	logic = strings.ToUpper(strings.TrimSpace(logic))
+	switch logic {
+	case "":
+		return LogicAND, nil
+	case LogicAND, LogicOR:
+		return logic, nil
+	default:
+		return "", fmt.Errorf("invalid labelstore default_logic %q: must be AND or OR", logic)
+	}
+}
+
+// Simple format handling modes
+const (
+	SimpleFormatReject      = "reject"       // Refuse to load labels in simple format (default)
+	SimpleFormatAutoConvert = "auto_convert" // Convert simple format entries in memory with a warning
+)
+
+// DefaultSimpleFormatLabel is the label simple format values are converted to, matching
+// the default of cmd/migrate-labels.
+const DefaultSimpleFormatLabel = "namespace"
+
+// normalizeSimpleFormat validates the configured simple format mode and applies the reject default.
+func normalizeSimpleFormat(mode string) (string, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case "":
+		return SimpleFormatReject, nil
+	case SimpleFormatReject, SimpleFormatAutoConvert:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid labelstore simple_format %q: must be reject or auto_convert", mode)
+	}
+}
+
+// Handling modes of label reload failures
+const (
+	OnReloadErrorKeepServing = "keep_serving" // Keep enforcing the previously loaded policies (default)
+	OnReloadErrorFailClosed  = "fail_closed"  // Deny all requests until the labels load again
+)
+
+// normalizeOnReloadError validates the configured reload failure mode and applies the keep_serving default.
+func normalizeOnReloadError(mode string) (string, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case "":
+		return OnReloadErrorKeepServing, nil
+	case OnReloadErrorKeepServing, OnReloadErrorFailClosed:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid labelstore on_reload_error %q: must be keep_serving or fail_closed", mode)
+	}
+}
+
+// Precedence modes of cluster-wide access over specific rules of the same user
+const (
+	ClusterWidePrecedenceMostPermissive = "most_permissive" // Grant cluster-wide access (default)
+	ClusterWidePrecedenceSpecificWins   = "specific_wins"   // Enforce the specific rules only
+	ClusterWidePrecedenceError          = "error"           // Deny the request
+)
+
+// normalizeClusterWidePrecedence validates the configured cluster-wide precedence and applies the most_permissive default.
+func normalizeClusterWidePrecedence(mode string) (string, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case "":
+		return ClusterWidePrecedenceMostPermissive, nil
+	case ClusterWidePrecedenceMostPermissive, ClusterWidePrecedenceSpecificWins, ClusterWidePrecedenceError:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid labelstore cluster_wide_precedence %q: must be most_permissive, specific_wins or error", mode)
+	}
+}
+
+// resolveClusterWide applies labelstore.cluster_wide_precedence to a merged policy granting
+// cluster-wide access. A policy holding nothing else collapses to the cluster-wide rule.
+// If the user also holds specific rules, e.g. from another group, most_permissive collapses
+// it all the same, specific_wins drops the cluster-wide rule and error denies the request.
+// Upstream-scoped cluster-wide rules (e.g. #cluster-wide:loki) are not affected.
+func (c *FileLabelStore) resolveClusterWide(policy *LabelPolicy) (*LabelPolicy, error) {
+	if !policy.HasClusterWideAccess() {
+		return policy, nil
+	}
+
+	specific := &LabelPolicy{Logic: policy.Logic, Override: policy.Override}
+	specificRules := 0
+	for _, rule := range policy.Rules {
+		if rule.Name == clusterWideLabel() {
+			continue
+		}
+		specific.Rules = append(specific.Rules, rule)
+		if !isScopedClusterWide(rule.Name) {
+			specificRules++
+		}
+	}
+
+	switch {
+	case specificRules == 0 || c.config.ClusterWidePrecedence == ClusterWidePrecedenceMostPermissive || c.config.ClusterWidePrecedence == "":
+		return &LabelPolicy{
+			Rules: []LabelRule{{Name: clusterWideLabel(), Operator: OperatorEquals, Values: []string{"true"}}},
 			Logic: LogicAND,
+		}, nil
+	case c.config.ClusterWidePrecedence == ClusterWidePrecedenceSpecificWins:
+		return specific, nil
+	default:
+		return nil, fmt.Errorf("cluster-wide access conflicts with %d specific rules, denied by labelstore cluster_wide_precedence error", specificRules)
+	}
+}
+
+// Handling modes of rules with more than labelstore.max_regex_values values
+const (
+	RegexValuesOverflowError = "error" // Deny the request (default)
+	RegexValuesOverflowSplit = "split" // Split the rule into rules of at most max_regex_values values
+)
+
+// normalizeRegexValuesOverflow validates the configured overflow mode and applies the error default.
+func normalizeRegexValuesOverflow(mode string) (string, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case "":
+		return RegexValuesOverflowError, nil
+	case RegexValuesOverflowError, RegexValuesOverflowSplit:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid labelstore regex_values_overflow %q: must be error or split", mode)
+	}
+}
+
+// limitRegexValues applies labelstore.max_regex_values to the rules of policy, so that no
+// rule is emitted as a pathological regex alternation. Rules with more values are an error
+// or, with regex_values_overflow split, split into rules of at most max_regex_values values.
+// Split positive rules only grant access together when the policy combines its rules with
+// OR, and split negative rules only deny all their values when it combines them with AND;
+// a policy with a single rule takes the logic its split rule needs.
+func (c *FileLabelStore) limitRegexValues(policy *LabelPolicy) (*LabelPolicy, error) {
+	limit := c.config.MaxRegexValues
+	if limit <= 0 || !slices.ContainsFunc(policy.Rules, func(rule LabelRule) bool { return len(rule.Values) > limit }) {
+		return policy, nil
+	}
+
+	logic := policy.Logic
+	if logic == "" {
+		logic = LogicAND
+	}
+	split := &LabelPolicy{Logic: logic, Override: policy.Override}
+	for _, rule := range policy.Rules {
+		if len(rule.Values) <= limit {
+			split.Rules = append(split.Rules, rule)
+			continue
+		}
+		if c.config.RegexValuesOverflow != RegexValuesOverflowSplit {
+			return nil, fmt.Errorf("rule for label %s has %d values, more than labelstore max_regex_values of %d", rule.Name, len(rule.Values), limit)
+		}
+
+		needed := LogicOR
+		if rule.IsNegative() {
+			needed = LogicAND
+		}
+		if len(policy.Rules) == 1 {
+			split.Logic = needed
+		} else if logic != needed {
+			return nil, fmt.Errorf("rule for label %s has %d values, more than labelstore max_regex_values of %d, and cannot be split in a policy combining its rules with %s",
+				rule.Name, len(rule.Values), limit, logic)
+		}
+		for values := range slices.Chunk(rule.Values, limit) {
+			split.Rules = append(split.Rules, LabelRule{Name: rule.Name, Operator: rule.Operator, Values: values})
 		}
 	}
 
-	// Cache the merged policy for this user+groups combination
-	c.policyCache[mergedCacheKey] = mergedPolicy
+	log.Debug().Int("rules", len(policy.Rules)).Int("split_rules", len(split.Rules)).Int("max_regex_values", limit).Msg("Split rules exceeding max_regex_values")
+	return split, nil
+}
 
-	return mergedPolicy, nil
+// simpleFormatLabel returns the label simple format entries are converted to.
+func (c *FileLabelStore) simpleFormatLabel() string {
+	if c.config.SimpleFormatLabel != "" {
+		return c.config.SimpleFormatLabel
+	}
+	return DefaultSimpleFormatLabel
+}
+
+// convertSimpleEntry converts a simple format entry into the extended format the same way
+// cmd/migrate-labels does: every key becomes a value of a single = rule on label.
+func convertSimpleEntry(data RawLabelData, label string) RawLabelData {
+	values := make([]interface{}, 0, len(data))
+	for _, key := range slices.Sorted(maps.Keys(data)) {
+		values = append(values, key)
+	}
+	return RawLabelData{
+		"_rules": []interface{}{
+			map[string]interface{}{
+				"name":     label,
+				"operator": OperatorEquals,
+				"values":   values,
+			},
+		},
+		"_logic": LogicAND,
+	}
 }
 
 // mergePolicies combines multiple policies into a single policy.
-// Rules are merged with OR logic by default (user can access if any policy allows).
-// When merging policies from multiple groups, duplicate label names are consolidated
-// by combining their values using regex OR operators (e.g., environment=~"prod|uat").
-func (c *FileLabelStore) mergePolicies(policies []*LabelPolicy) *LabelPolicy {
+// The merged policy uses the configured group merge logic (OR by default) to combine
+// distinct label names. Duplicate label names are always consolidated by combining their
+// values using regex OR operators (e.g., environment=~"prod|uat"), regardless of that logic.
+// A policy holds a single list of rules, so an OR merge cannot keep the rules of an AND
+// entry together: "ns=a AND env=prod" merged with "ns=b" would grant env=prod in every
+// namespace. Likewise, an AND merge takes the union of the values of each label, so
+// "ns=a AND env=dev" merged with "ns=b AND env=prod" would grant ns=a with env=prod. Such
+// merges are refused with an error instead of widening the access.
+func (c *FileLabelStore) mergePolicies(policies []*LabelPolicy) (*LabelPolicy, error) {
 	if len(policies) == 0 {
-		return &LabelPolicy{Rules: []LabelRule{}, Logic: LogicAND}
+		return &LabelPolicy{Rules: []LabelRule{}, Logic: LogicAND}, nil
 	}
 
 	if len(policies) == 1 {
-		return policies[0]
+		return policies[0], nil
+	}
+
+	logic := c.groupMergeLogic
+	if logic == "" {
+		logic = LogicOR
 	}
 
 	// Merge all rules from all policies
 	merged := &LabelPolicy{
 		Rules: []LabelRule{},
-		Logic: LogicOR, // Multiple policies are combined with OR (more permissive)
+		Logic: logic,
 	}
 
+	var entries []*LabelPolicy
 	for _, policy := range policies {
 		if policy.Override {
 			// If a policy has Override=true, it replaces all previous policies
 			merged.Rules = policy.Rules
 			merged.Logic = policy.Logic
+			entries = []*LabelPolicy{policy}
 			continue
 		}
 		merged.Rules = append(merged.Rules, policy.Rules...)
+		entries = append(entries, policy)
+	}
+
+	// Entries granting cluster-wide access are resolved by resolveClusterWide, so only the
+	// entries with specific rules decide how the rules combine
+	var specific []*LabelPolicy
+	for _, policy := range entries {
+		if !policy.HasClusterWideAccess() {
+			specific = append(specific, policy)
+		}
+	}
+	switch {
+	case len(specific) == 1:
+		merged.Logic = specific[0].Logic
+		if merged.Logic == "" {
+			merged.Logic = LogicAND
+		}
+	case merged.Logic == LogicOR:
+		for _, policy := range specific {
+			if policy.Logic != LogicOR && len(policy.Rules) > 1 {
+				return nil, fmt.Errorf("an entry with several AND rules cannot be merged with other entries by labelstore group_merge_logic OR: set it to AND or use _logic: OR")
+			}
+		}
+	case merged.Logic == LogicAND:
+		if labels := crossedLabels(specific); len(labels) > 1 {
+			return nil, fmt.Errorf("entries restricting labels %s differently cannot be merged by labelstore group_merge_logic AND without granting their combinations: define one entry for these users", strings.Join(labels, ", "))
+		}
 	}
 
 	// Deduplicate exact duplicate rules (same name, operator, values)
@@ -297,21 +828,54 @@ func (c *FileLabelStore) mergePolicies(policies []*LabelPolicy) *LabelPolicy {
 	// This fixes invalid query generation for multi-group users
 	merged.Rules = c.consolidateDuplicateLabels(merged.Rules)
 
-	return merged
+	return merged, nil
 }
 
-// deduplicateRules removes duplicate rules from a slice
+// crossedLabels returns the sorted labels that are restricted differently by at least two of
+// entries. Merging the entries by AND is only exact if there is at most one such label: the
+// union of the values of each label otherwise also grants combinations no entry grants.
+// Labels restricted by a single entry only narrow the merged policy and are not returned.
+func crossedLabels(entries []*LabelPolicy) []string {
+	restrictions := make(map[string]string)
+	crossed := make(map[string]bool)
+	for _, policy := range entries {
+		byLabel := make(map[string][]string)
+		for _, rule := range policy.Rules {
+			values := append([]string(nil), rule.Values...)
+			sort.Strings(values)
+			byLabel[rule.Name] = append(byLabel[rule.Name], rule.Operator+" "+strings.Join(values, "|"))
+		}
+		for label, rules := range byLabel {
+			sort.Strings(rules)
+			restriction := strings.Join(rules, ", ")
+			if previous, ok := restrictions[label]; ok && previous != restriction {
+				crossed[label] = true
+			}
+			restrictions[label] = restriction
+		}
+	}
+	labels := make([]string, 0, len(crossed))
+	for label := range crossed {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// deduplicateRules removes duplicate rules from a slice, keeping the annotations of all of them
 func (c *FileLabelStore) deduplicateRules(rules []LabelRule) []LabelRule {
-	seen := make(map[string]bool)
+	seen := make(map[string]int)
 	result := []LabelRule{}
 
 	for _, rule := range rules {
 		// Create a unique key for the rule
 		key := fmt.Sprintf("%s|%s|%v", rule.Name, rule.Operator, rule.Values)
-		if !seen[key] {
-			seen[key] = true
-			result = append(result, rule)
+		if i, ok := seen[key]; ok {
+			result[i].Meta = joinMeta(result[i].Meta, rule.Meta)
+			continue
 		}
+		seen[key] = len(result)
+		result = append(result, rule)
 	}
 
 	return result
@@ -397,12 +961,17 @@ func (c *FileLabelStore) mergeRuleGroup(labelName string, group []LabelRule) *La
 	valueSet := make(map[string]bool)
 	var allValues []string
 
+	// Keep the annotations of every merged rule
+	var meta map[string]string
+
 	// Track operator types
 	hasPositiveMatch := false // = or =~
 	hasNegativeMatch := false // != or !~
 	hasRegexOperator := false // =~ or !~
 
 	for _, rule := range group {
+		meta = joinMeta(meta, rule.Meta)
+
 		// Track operator types
 		switch rule.Operator {
 		case OperatorEquals, OperatorRegexMatch:
@@ -459,5 +1028,6 @@ func (c *FileLabelStore) mergeRuleGroup(labelName string, group []LabelRule) *La
 		Name:     labelName,
 		Operator: finalOperator,
 		Values:   allValues,
+		Meta:     meta,
 	}
 }
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrPolicyNotFound is returned by label stores when no policy exists for a user. It is the
+// only error cached by CachingLabelStore; other errors are assumed to be transient.
+var ErrPolicyNotFound = errors.New("no policy found")
+
+// defaultLabelStoreCacheSize is the maximum number of cached identities when none is configured.
+const defaultLabelStoreCacheSize = 10000
+
+// CachingLabelStore wraps a Labelstore backed by a remote service, caching the policies it
+// returns for TTL and the identities it has no policy for for NegativeTTL, so that unknown
+// users cannot hammer the backend. When MaxSize is reached, expired entries are dropped,
+// and the whole cache if none has expired. Policies read within RefreshAhead of their expiry
+// are reloaded in the background, so that reads of active users do not wait for the backend.
+type CachingLabelStore struct {
+	Labelstore
+	config LabelStoreCacheConfig
+	now    func() time.Time
+
+	mu         sync.RWMutex
+	entries    map[string]labelStoreCacheEntry
+	refreshing map[string]bool // Keys being reloaded in the background
+}
+
+// labelStoreCacheEntry is a cached policy, or a nil policy for an identity without policy.
+type labelStoreCacheEntry struct {
+	policy  *LabelPolicy
+	err     error
+	expires time.Time
+}
+
+// NewCachingLabelStore returns store wrapped in a cache configured by config.
+func NewCachingLabelStore(store Labelstore, config LabelStoreCacheConfig) *CachingLabelStore {
+	if config.MaxSize <= 0 {
+		config.MaxSize = defaultLabelStoreCacheSize
+	}
+	if config.RefreshAhead > 0 && config.RefreshAhead >= config.TTL {
+		log.Warn().Dur("refresh_ahead", config.RefreshAhead).Dur("ttl", config.TTL).Msg("labelstore.cache.refresh_ahead is not shorter than ttl, cached policies are reloaded on every read")
+	}
+	return &CachingLabelStore{
+		Labelstore: store,
+		config:     config,
+		now:        time.Now,
+		entries:    make(map[string]labelStoreCacheEntry),
+		refreshing: make(map[string]bool),
+	}
+}
+
+// Connect connects the wrapped store and clears the cache.
+func (c *CachingLabelStore) Connect(config LabelStoreConfig) error {
+	c.mu.Lock()
+	c.entries = make(map[string]labelStoreCacheEntry)
+	c.mu.Unlock()
+	return c.Labelstore.Connect(config)
+}
+
+// GetLabelPolicy returns the cached policy of identity, or retrieves it from the wrapped store.
+func (c *CachingLabelStore) GetLabelPolicy(identity UserIdentity, defaultLabel string) (*LabelPolicy, error) {
+	key := labelStoreCacheKey(identity, defaultLabel)
+
+	c.mu.RLock()
+	entry, ok := c.entries[key]
+	c.mu.RUnlock()
+	if ok {
+		now := c.now()
+		if now.Before(entry.expires) {
+			if entry.err == nil && c.config.RefreshAhead > 0 && !now.Before(entry.expires.Add(-c.config.RefreshAhead)) {
+				c.refreshAhead(key, identity, defaultLabel)
+			}
+			return entry.policy, entry.err
+		}
+	}
+
+	return c.load(key, identity, defaultLabel)
+}
+
+// Health reports the health of the wrapped label store, if it can tell.
+func (c *CachingLabelStore) Health() error {
+	if checker, ok := c.Labelstore.(LabelstoreHealthChecker); ok {
+		return checker.Health()
+	}
+	return nil
+}
+
+// labelStoreCacheKey returns the cache key of the policy of identity.
+func labelStoreCacheKey(identity UserIdentity, defaultLabel string) string {
+	return identity.Username + "\x00" + strings.Join(identity.Groups, "\x00") + "\x00" + identity.Email + "\x00" + defaultLabel
+}
+
+// load retrieves the policy of identity from the wrapped store and caches it under key.
+func (c *CachingLabelStore) load(key string, identity UserIdentity, defaultLabel string) (*LabelPolicy, error) {
+	policy, err := c.Labelstore.GetLabelPolicy(identity, defaultLabel)
+	ttl := c.config.TTL
+	if err != nil {
+		if !errors.Is(err, ErrPolicyNotFound) {
+			return nil, err
+		}
+		ttl = c.config.NegativeTTL
+	}
+	if ttl > 0 {
+		c.store(key, labelStoreCacheEntry{policy: policy, err: err, expires: c.now().Add(ttl)})
+	}
+	return policy, err
+}
+
+// refreshAhead reloads the entry of key in the background, unless it is already being
+// reloaded. On transient errors the entry is kept until it expires.
+func (c *CachingLabelStore) refreshAhead(key string, identity UserIdentity, defaultLabel string) {
+	c.mu.Lock()
+	if c.refreshing[key] {
+		c.mu.Unlock()
+		return
+	}
+	c.refreshing[key] = true
+	c.mu.Unlock()
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.refreshing, key)
+			c.mu.Unlock()
+		}()
+		if _, err := c.load(key, identity, defaultLabel); err != nil && !errors.Is(err, ErrPolicyNotFound) {
+			log.Debug().Err(err).Str("username", identity.Username).Msg("Background refresh of cached label policy failed")
+		}
+	}()
+}
+
+// store adds entry to the cache, making room for it if the cache is full.
+func (c *CachingLabelStore) store(key string, entry labelStoreCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.config.MaxSize {
+		now := c.now()
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.config.MaxSize {
+			log.Debug().Int("max_size", c.config.MaxSize).Msg("Label store cache full, clearing it")
+			c.entries = make(map[string]labelStoreCacheEntry)
+		}
+	}
+	c.entries[key] = entry
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// countingLabelStore returns a fixed policy for known users and counts lookups per username.
+type countingLabelStore struct {
+	policies map[string]*LabelPolicy
+	err      error // Returned instead of a policy if set
+	calls    map[string]int
+}
+
+func (s *countingLabelStore) Connect(LabelStoreConfig) error { return nil }
+
+func (s *countingLabelStore) GetLabelPolicy(identity UserIdentity, _ string) (*LabelPolicy, error) {
+	s.calls[identity.Username]++
+	if s.err != nil {
+		return nil, s.err
+	}
+	if policy, ok := s.policies[identity.Username]; ok {
+		return policy, nil
+	}
+	return nil, fmt.Errorf("%w for user %s", ErrPolicyNotFound, identity.Username)
+}
+
+func newCachingTestStore(config LabelStoreCacheConfig) (*CachingLabelStore, *countingLabelStore, *time.Time) {
+	backend := &countingLabelStore{
+		policies: map[string]*LabelPolicy{
+			"alice": {Rules: []LabelRule{{Name: "namespace", Operator: "=", Values: []string{"prod"}}}, Logic: LogicAND},
+		},
+		calls: make(map[string]int),
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewCachingLabelStore(backend, config)
+	store.now = func() time.Time { return now }
+	return store, backend, &now
+}
+
+func TestCachingLabelStore_Hits(t *testing.T) {
+	store, backend, now := newCachingTestStore(LabelStoreCacheConfig{TTL: time.Minute})
+
+	for i := 0; i < 3; i++ {
+		policy, err := store.GetLabelPolicy(UserIdentity{Username: "alice"}, "")
+		if err != nil {
+			t.Fatalf("GetLabelPolicy() error = %v", err)
+		}
+		if policy != backend.policies["alice"] {
+			t.Errorf("GetLabelPolicy() = %+v, want %+v", policy, backend.policies["alice"])
+		}
+	}
+	if backend.calls["alice"] != 1 {
+		t.Errorf("Expected 1 backend lookup, got %d", backend.calls["alice"])
+	}
+
+	// Groups are part of the cache key
+	if _, err := store.GetLabelPolicy(UserIdentity{Username: "alice", Groups: []string{"team-a"}}, ""); err != nil {
+		t.Fatalf("GetLabelPolicy() error = %v", err)
+	}
+	if backend.calls["alice"] != 2 {
+		t.Errorf("Expected 2 backend lookups, got %d", backend.calls["alice"])
+	}
+
+	// Entries expire after the TTL
+	*now = now.Add(time.Minute)
+	if _, err := store.GetLabelPolicy(UserIdentity{Username: "alice"}, ""); err != nil {
+		t.Fatalf("GetLabelPolicy() error = %v", err)
+	}
+	if backend.calls["alice"] != 3 {
+		t.Errorf("Expected 3 backend lookups after expiry, got %d", backend.calls["alice"])
+	}
+}
+
+func TestCachingLabelStore_NegativeCaching(t *testing.T) {
+	store, backend, now := newCachingTestStore(LabelStoreCacheConfig{TTL: time.Hour, NegativeTTL: 10 * time.Second})
+
+	for i := 0; i < 3; i++ {
+		_, err := store.GetLabelPolicy(UserIdentity{Username: "mallory"}, "")
+		if !errors.Is(err, ErrPolicyNotFound) {
+			t.Fatalf("GetLabelPolicy() error = %v, want ErrPolicyNotFound", err)
+		}
+	}
+	if backend.calls["mallory"] != 1 {
+		t.Errorf("Expected 1 backend lookup, got %d", backend.calls["mallory"])
+	}
+
+	// Negative entries expire after NegativeTTL, independently of TTL
+	*now = now.Add(10 * time.Second)
+	_, _ = store.GetLabelPolicy(UserIdentity{Username: "mallory"}, "")
+	if backend.calls["mallory"] != 2 {
+		t.Errorf("Expected 2 backend lookups after negative expiry, got %d", backend.calls["mallory"])
+	}
+}
+
+func TestCachingLabelStore_NegativeCachingDisabled(t *testing.T) {
+	store, backend, _ := newCachingTestStore(LabelStoreCacheConfig{TTL: time.Hour})
+
+	for i := 0; i < 2; i++ {
+		_, _ = store.GetLabelPolicy(UserIdentity{Username: "mallory"}, "")
+	}
+	if backend.calls["mallory"] != 2 {
+		t.Errorf("Expected 2 backend lookups without negative caching, got %d", backend.calls["mallory"])
+	}
+}
+
+func TestCachingLabelStore_ErrorsAreNotCached(t *testing.T) {
+	store, backend, _ := newCachingTestStore(LabelStoreCacheConfig{TTL: time.Hour, NegativeTTL: time.Hour})
+	backend.err = errors.New("backend unavailable")
+
+	for i := 0; i < 2; i++ {
+		if _, err := store.GetLabelPolicy(UserIdentity{Username: "alice"}, ""); err == nil {
+			t.Fatal("GetLabelPolicy() expected error")
+		}
+	}
+	if backend.calls["alice"] != 2 {
+		t.Errorf("Expected 2 backend lookups for transient errors, got %d", backend.calls["alice"])
+	}
+}
+
+func TestCachingLabelStore_MaxSize(t *testing.T) {
+	store, backend, now := newCachingTestStore(LabelStoreCacheConfig{TTL: time.Minute, NegativeTTL: time.Second, MaxSize: 2})
+
+	_, _ = store.GetLabelPolicy(UserIdentity{Username: "alice"}, "")
+	_, _ = store.GetLabelPolicy(UserIdentity{Username: "mallory"}, "")
+
+	// The expired negative entry makes room for a new one
+	*now = now.Add(time.Second)
+	_, _ = store.GetLabelPolicy(UserIdentity{Username: "bob"}, "")
+	if len(store.entries) != 2 {
+		t.Errorf("Expected 2 cached entries, got %d", len(store.entries))
+	}
+	_, _ = store.GetLabelPolicy(UserIdentity{Username: "alice"}, "")
+	if backend.calls["alice"] != 1 {
+		t.Errorf("Expected alice to stay cached, got %d backend lookups", backend.calls["alice"])
+	}
+
+	// Without expired entries the cache is cleared
+	_, _ = store.GetLabelPolicy(UserIdentity{Username: "carol"}, "")
+	if len(store.entries) != 1 {
+		t.Errorf("Expected the cache to be cleared, got %d entries", len(store.entries))
+	}
+}
+
+// blockingLabelStore returns policy after a value is received from release, reporting each
+// lookup on started.
+type blockingLabelStore struct {
+	policy  *LabelPolicy
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingLabelStore) Connect(LabelStoreConfig) error { return nil }
+
+func (s *blockingLabelStore) GetLabelPolicy(UserIdentity, string) (*LabelPolicy, error) {
+	s.started <- struct{}{}
+	<-s.release
+	return s.policy, nil
+}
+
+func TestCachingLabelStore_RefreshAhead(t *testing.T) {
+	backend := &blockingLabelStore{
+		policy:  &LabelPolicy{Rules: []LabelRule{{Name: "namespace", Operator: "=", Values: []string{"prod"}}}, Logic: LogicAND},
+		started: make(chan struct{}, 2),
+		release: make(chan struct{}, 2),
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewCachingLabelStore(backend, LabelStoreCacheConfig{TTL: time.Minute, RefreshAhead: 10 * time.Second})
+	store.now = func() time.Time { return now }
+	identity := UserIdentity{Username: "alice"}
+
+	backend.release <- struct{}{}
+	if _, err := store.GetLabelPolicy(identity, ""); err != nil {
+		t.Fatalf("GetLabelPolicy() error = %v", err)
+	}
+	<-backend.started
+
+	// Entries outside the refresh window are served without refresh
+	now = now.Add(49 * time.Second)
+	if _, err := store.GetLabelPolicy(identity, ""); err != nil {
+		t.Fatalf("GetLabelPolicy() error = %v", err)
+	}
+	select {
+	case <-backend.started:
+		t.Fatal("Expected no refresh outside the refresh window")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Reads within the window return the cached policy while one refresh runs in the background
+	now = now.Add(time.Second)
+	for i := 0; i < 3; i++ {
+		policy, err := store.GetLabelPolicy(identity, "")
+		if err != nil {
+			t.Fatalf("GetLabelPolicy() error = %v", err)
+		}
+		if policy != backend.policy {
+			t.Errorf("GetLabelPolicy() = %+v, want %+v", policy, backend.policy)
+		}
+	}
+	select {
+	case <-backend.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a background refresh within the refresh window")
+	}
+	backend.release <- struct{}{}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		store.mu.RLock()
+		key := labelStoreCacheKey(identity, "")
+		expires, refreshing := store.entries[key].expires, store.refreshing[key]
+		store.mu.RUnlock()
+		if !refreshing {
+			if want := now.Add(time.Minute); !expires.Equal(want) {
+				t.Errorf("Expected the refreshed entry to expire at %v, got %v", want, expires)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Background refresh did not complete")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-backend.started:
+		t.Error("Expected a single background refresh")
+	default:
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/rs/zerolog/log"
+)
+
+// defaultOPAQuery is the Rego query evaluated when none is configured.
+const defaultOPAQuery = "data.lbac.policy"
+
+// OPALabelStore evaluates a Rego policy to retrieve label policies, for teams that already
+// express authorization in Rego. The query is compiled once on Connect and evaluated with
+// the user identity as input:
+//
+//	{"username": "alice", "groups": ["team-a"], "default_label": "namespace"}
+//
+// It must return an object shaped like a LabelPolicy, or be undefined if the user has no
+// access. Rules are validated like labels.yaml entries:
+//
+//	{"rules": [{"name": "namespace", "operator": "=", "values": ["prod"]}], "logic": "AND"}
+type OPALabelStore struct {
+	query  rego.PreparedEvalQuery
+	parser *PolicyParser
+}
+
+// Connect loads the Rego policy from config.OPA.PolicyPath and prepares its query.
+func (o *OPALabelStore) Connect(config LabelStoreConfig) error {
+	path := config.OPA.PolicyPath
+	if path == "" {
+		return fmt.Errorf("labelstore.opa.policy_path is required for the opa label store")
+	}
+	query := config.OPA.Query
+	if query == "" {
+		query = defaultOPAQuery
+	}
+
+	options := []func(*rego.Rego){rego.Query(query)}
+	if strings.HasSuffix(path, ".tar.gz") {
+		options = append(options, rego.LoadBundle(path))
+	} else {
+		options = append(options, rego.Load([]string{path}, nil))
+	}
+
+	prepared, err := rego.New(options...).PrepareForEval(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to compile rego policy %s: %w", path, err)
+	}
+	o.query = prepared
+	o.parser = NewPolicyParser()
+	if o.parser.DefaultLogic, err = normalizeDefaultLogic(config.DefaultLogic); err != nil {
+		return err
+	}
+
+	log.Info().Str("policy_path", path).Str("query", query).Msg("OPA label store connected")
+	return nil
+}
+
+// GetLabelPolicy evaluates the Rego policy for the identity and maps its result to a LabelPolicy.
+func (o *OPALabelStore) GetLabelPolicy(identity UserIdentity, defaultLabel string) (*LabelPolicy, error) {
+	groups := identity.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+	input := map[string]interface{}{
+		"username":      identity.Username,
+		"groups":        groups,
+		"default_label": defaultLabel,
+	}
+
+	results, err := o.query.Eval(context.Background(), rego.EvalInput(input))
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to evaluate rego policy for user %s: %w", ErrInvalidPolicyResult, identity.Username, err)
+	}
+	if len(results) == 0 || len(results[0].Expressions) == 0 {
+		return nil, fmt.Errorf("%w for user %s", ErrPolicyNotFound, identity.Username)
+	}
+
+	result, ok := results[0].Expressions[0].Value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: rego policy for user %s must return an object, got %T", ErrInvalidPolicyResult, identity.Username, results[0].Expressions[0].Value)
+	}
+	if _, ok := result["rules"]; !ok {
+		return nil, fmt.Errorf("%w: rego policy result for user %s has no rules key", ErrInvalidPolicyResult, identity.Username)
+	}
+
+	// Map the result onto the labels.yaml extended format so it is validated the same way
+	data := RawLabelData{"_rules": result["rules"]}
+	if logic, ok := result["logic"]; ok {
+		if _, ok := logic.(string); !ok {
+			return nil, fmt.Errorf("%w: rego policy result for user %s: logic must be a string, got %T", ErrInvalidPolicyResult, identity.Username, logic)
+		}
+		data["_logic"] = logic
+	}
+	policy, err := o.parser.ParseUserPolicy(data, defaultLabel)
+	if err != nil {
+		return nil, fmt.Errorf("%w: rego policy result for user %s: %w", ErrInvalidPolicyResult, identity.Username, err)
+	}
+
+	if policy.HasClusterWideAccess() {
+		policy = &LabelPolicy{
+			Rules: []LabelRule{{Name: clusterWideLabel(), Operator: OperatorEquals, Values: []string{"true"}}},
+			Logic: LogicAND,
+		}
+	}
+	return policy, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testRegoPolicy = `package lbac
+
+tenants := {
+	"team-a": ["prod", "staging"],
+	"team-b": ["dev"],
+}
+
+policy := {"rules": [{"name": "#cluster-wide", "operator": "=", "values": ["true"]}]} if {
+	input.username == "admin"
+} else := {"rules": [{"name": input.default_label, "operator": "=", "values": values}], "logic": "AND"} if {
+	values := sort({v | some g in input.groups; some v in tenants[g]})
+	count(values) > 0
+} else := {"rules": [{"name": "namespace", "operator": "==", "values": ["prod"]}]} if {
+	input.username == "broken"
+}
+`
+
+// connectOPALabelStore writes the Rego policy to a temporary file and connects a store to it.
+func connectOPALabelStore(t *testing.T, policy string) (*OPALabelStore, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "lbac.rego")
+	if err := os.WriteFile(path, []byte(policy), 0644); err != nil {
+		t.Fatalf("Failed to write rego policy: %v", err)
+	}
+	store := &OPALabelStore{}
+	return store, store.Connect(LabelStoreConfig{OPA: OPALabelStoreConfig{PolicyPath: path}})
+}
+
+func TestOPALabelStore_GetLabelPolicy(t *testing.T) {
+	store, err := connectOPALabelStore(t, testRegoPolicy)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		identity UserIdentity
+		want     *LabelPolicy
+		wantErr  string
+	}{
+		{
+			name:     "single group",
+			identity: UserIdentity{Username: "alice", Groups: []string{"team-a"}},
+			want: &LabelPolicy{
+				Rules: []LabelRule{{Name: "tenant_id", Operator: "=", Values: []string{"prod", "staging"}}},
+				Logic: LogicAND,
+			},
+		},
+		{
+			name:     "multiple groups are merged by the policy",
+			identity: UserIdentity{Username: "bob", Groups: []string{"team-b", "team-a"}},
+			want: &LabelPolicy{
+				Rules: []LabelRule{{Name: "tenant_id", Operator: "=", Values: []string{"dev", "prod", "staging"}}},
+				Logic: LogicAND,
+			},
+		},
+		{
+			name:     "cluster-wide",
+			identity: UserIdentity{Username: "admin"},
+			want: &LabelPolicy{
+				Rules: []LabelRule{{Name: clusterWideLabel(), Operator: "=", Values: []string{"true"}}},
+				Logic: LogicAND,
+			},
+		},
+		{
+			name:     "undefined result",
+			identity: UserIdentity{Username: "mallory", Groups: []string{"unknown"}},
+			wantErr:  "no policy found for user mallory",
+		},
+		{
+			name:     "invalid result",
+			identity: UserIdentity{Username: "broken"},
+			wantErr:  "invalid label store result: rego policy result for user broken",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := store.GetLabelPolicy(tt.identity, "tenant_id")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("GetLabelPolicy() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetLabelPolicy() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetLabelPolicy() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOPALabelStore_Connect(t *testing.T) {
+	if _, err := connectOPALabelStore(t, "package lbac\n\npolicy := {"); err == nil {
+		t.Error("Connect() expected error for invalid rego")
+	}
+
+	store := &OPALabelStore{}
+	if err := store.Connect(LabelStoreConfig{}); err == nil || !strings.Contains(err.Error(), "policy_path") {
+		t.Errorf("Connect() error = %v, want missing policy_path error", err)
+	}
+}
+
+// testMalformedRegoPolicy returns results of the wrong shape, keyed by username.
+const testMalformedRegoPolicy = `package lbac
+
+results := {
+	"string": "namespace=prod",
+	"no-rules": {"logic": "AND"},
+	"rules-string": {"rules": "namespace=prod"},
+	"rule-string": {"rules": ["namespace=prod"]},
+	"values-number": {"rules": [{"name": "namespace", "operator": "=", "values": 42}]},
+	"logic-number": {"rules": [{"name": "namespace", "operator": "=", "values": ["prod"]}], "logic": 1},
+}
+
+policy := results[input.username]
+
+policy := {"rules": []} if {
+	input.username == "conflict"
+}
+`
+
+func TestOPALabelStore_MalformedResults(t *testing.T) {
+	store, err := connectOPALabelStore(t, testMalformedRegoPolicy)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+
+	for _, username := range []string{"string", "no-rules", "rules-string", "rule-string", "values-number", "logic-number", "conflict"} {
+		t.Run(username, func(t *testing.T) {
+			policy, err := store.GetLabelPolicy(UserIdentity{Username: username}, "tenant_id")
+			if !errors.Is(err, ErrInvalidPolicyResult) {
+				t.Fatalf("GetLabelPolicy() = %+v, %v, want ErrInvalidPolicyResult", policy, err)
+			}
+			if !strings.Contains(err.Error(), "for user "+username) {
+				t.Errorf("GetLabelPolicy() error = %v, want error naming the user", err)
+			}
+		})
+	}
+
+	t.Run("answered with internal server error", func(t *testing.T) {
+		objectless, err := connectOPALabelStore(t, "package lbac\n\npolicy := \"namespace=prod\"\n")
+		if err != nil {
+			t.Fatalf("Connect() error = %v", err)
+		}
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("Request with an invalid policy result reached the upstream")
+		}))
+		defer upstream.Close()
+
+		app, tokens := setupTestMain()
+		app.LabelStore = objectless
+		app.Cfg.Thanos.URL = upstream.URL
+		app.WithProxies()
+		app.WithRoutes()
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+		req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+		rr := httptest.NewRecorder()
+		app.e.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusInternalServerError {
+			t.Errorf("Expected status %d, got %d: %s", http.StatusInternalServerError, rr.Code, rr.Body.String())
+		}
+	})
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 )
 
@@ -550,6 +556,35 @@ func TestConsolidateDuplicateLabels_DuplicateValues(t *testing.T) {
 	}
 }
 
+// TestMergePolicies_Meta tests that merged rules keep the annotations of every merged rule
+func TestMergePolicies_Meta(t *testing.T) {
+	store := &FileLabelStore{groupMergeLogic: LogicAND}
+
+	merged, err := store.mergePolicies([]*LabelPolicy{
+		{Logic: LogicAND, Rules: []LabelRule{
+			{Name: "environment", Operator: OperatorEquals, Values: []string{"production"}, Meta: map[string]string{"ticket": "OPS-1", "owner": "sre"}},
+			{Name: "team", Operator: OperatorEquals, Values: []string{"backend"}, Meta: map[string]string{"ticket": "OPS-2"}},
+		}},
+		{Logic: LogicAND, Rules: []LabelRule{
+			{Name: "environment", Operator: OperatorEquals, Values: []string{"uat"}, Meta: map[string]string{"ticket": "OPS-3", "owner": "sre"}},
+			{Name: "team", Operator: OperatorEquals, Values: []string{"backend"}, Meta: map[string]string{"ticket": "OPS-4"}},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Expected entries to merge, got %v", err)
+	}
+
+	if len(merged.Rules) != 2 {
+		t.Fatalf("Expected 2 merged rules, got %d", len(merged.Rules))
+	}
+	if got := merged.Rules[0].Meta; got["ticket"] != "OPS-1, OPS-3" || got["owner"] != "sre" {
+		t.Errorf("Expected consolidated rule to keep both tickets and one owner, got %v", got)
+	}
+	if got := merged.Rules[1].Meta; got["ticket"] != "OPS-2, OPS-4" {
+		t.Errorf("Expected deduplicated rule to keep both tickets, got %v", got)
+	}
+}
+
 // TestFileLabelStore_MultiGroup_ValueConsolidation tests end-to-end multi-group scenario
 func TestFileLabelStore_MultiGroup_ValueConsolidation(t *testing.T) {
 	yamlContent := `
@@ -572,6 +607,16 @@ GrafanaUAT:
     - name: cluster
       operator: =
       values: ["uat-allinone", "uat-l1-k8s"]
+
+GrafanaPRODOps:
+  _logic: AND
+  _rules:
+    - name: environment
+      operator: =
+      values: ["production"]
+    - name: cluster
+      operator: =
+      values: ["prod-ops"]
 `
 
 	tmpDir := t.TempDir()
@@ -581,17 +626,23 @@ GrafanaUAT:
 		t.Fatalf("Failed to write test YAML file: %v", err)
 	}
 
-	store := &FileLabelStore{}
+	store := &FileLabelStore{groupMergeLogic: LogicAND}
 	v := viper.NewWithOptions(viper.KeyDelimiter("::"))
 	err = store.loadLabels(v, []string{tmpDir})
 	if err != nil {
 		t.Fatalf("Failed to load labels: %v", err)
 	}
 
-	// Simulate user belonging to both groups
+	// Merging GrafanaPROD and GrafanaUAT would also grant production on the uat clusters
+	_, err = store.GetLabelPolicy(UserIdentity{Username: "testuser", Groups: []string{"GrafanaPROD", "GrafanaUAT"}}, "namespace")
+	if err == nil || !strings.Contains(err.Error(), "cluster, environment") {
+		t.Fatalf("Expected the merge of entries restricting two labels differently to be refused, got %v", err)
+	}
+
+	// Entries differing in one label only are merged exactly
 	identity := UserIdentity{
 		Username: "testuser",
-		Groups:   []string{"GrafanaPROD", "GrafanaUAT"},
+		Groups:   []string{"GrafanaPROD", "GrafanaPRODOps"},
 	}
 
 	policy, err := store.GetLabelPolicy(identity, "namespace")
@@ -618,17 +669,8 @@ GrafanaUAT:
 	if envRule == nil {
 		t.Fatal("Environment rule not found after consolidation")
 	}
-	if envRule.Operator != OperatorRegexMatch {
-		t.Errorf("Expected environment operator '=~', got '%s'", envRule.Operator)
-	}
-	expectedEnv := []string{"production", "uat"}
-	if len(envRule.Values) != 2 {
-		t.Errorf("Expected 2 environment values, got %d", len(envRule.Values))
-	}
-	for i, expected := range expectedEnv {
-		if envRule.Values[i] != expected {
-			t.Errorf("Expected environment value[%d] = '%s', got '%s'", i, expected, envRule.Values[i])
-		}
+	if envRule.Operator != OperatorEquals || len(envRule.Values) != 1 || envRule.Values[0] != "production" {
+		t.Errorf("Expected environment = production, got %s %v", envRule.Operator, envRule.Values)
 	}
 
 	// Verify cluster rule
@@ -638,9 +680,9 @@ GrafanaUAT:
 	if clusterRule.Operator != OperatorRegexMatch {
 		t.Errorf("Expected cluster operator '=~', got '%s'", clusterRule.Operator)
 	}
-	expectedCluster := []string{"prod-argocd", "prod-backoffice", "uat-allinone", "uat-l1-k8s"}
-	if len(clusterRule.Values) != 4 {
-		t.Errorf("Expected 4 cluster values, got %d", len(clusterRule.Values))
+	expectedCluster := []string{"prod-argocd", "prod-backoffice", "prod-ops"}
+	if len(clusterRule.Values) != 3 {
+		t.Errorf("Expected 3 cluster values, got %d", len(clusterRule.Values))
 	}
 	for i, expected := range expectedCluster {
 		if clusterRule.Values[i] != expected {
@@ -648,3 +690,955 @@ GrafanaUAT:
 		}
 	}
 }
+
+// TestFileLabelStore_GroupMergeLogic tests that the configured group merge logic is applied
+// end-to-end when a user belongs to two groups restricting distinct labels
+func TestFileLabelStore_GroupMergeLogic(t *testing.T) {
+	yamlContent := `
+prod-team:
+  _rules:
+    - name: namespace
+      operator: =
+      values: ["prod"]
+
+backend-team:
+  _rules:
+    - name: team
+      operator: =
+      values: ["backend"]
+`
+
+	tests := []struct {
+		name          string
+		mergeLogic    string
+		expectedLogic string
+		query         string
+		expected      string
+	}{
+		{
+			name:          "default merges with OR",
+			mergeLogic:    "",
+			expectedLogic: LogicOR,
+			query:         "up",
+			expected:      `(up{namespace="prod"}) or (up{team="backend"})`,
+		},
+		{
+			name:          "AND requires both labels",
+			mergeLogic:    "and",
+			expectedLogic: LogicAND,
+			query:         `rate(http_requests_total[5m])`,
+			expected:      `rate(http_requests_total{namespace="prod",team="backend"}[5m])`,
+		},
+		{
+			name:          "OR allows either label",
+			mergeLogic:    "OR",
+			expectedLogic: LogicOR,
+			query:         "up",
+			expected:      `(up{namespace="prod"}) or (up{team="backend"})`,
+		},
+		{
+			name:          "OR with empty query",
+			mergeLogic:    "OR",
+			expectedLogic: LogicOR,
+			query:         "",
+			expected:      `({namespace="prod"}) or ({team="backend"})`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(tmpDir, "labels.yaml"), []byte(yamlContent), 0644); err != nil {
+				t.Fatalf("Failed to write test YAML file: %v", err)
+			}
+
+			logic, err := normalizeGroupMergeLogic(tt.mergeLogic)
+			if err != nil {
+				t.Fatalf("Unexpected merge logic error: %v", err)
+			}
+			store := &FileLabelStore{parser: NewPolicyParser(), groupMergeLogic: logic}
+			v := viper.NewWithOptions(viper.KeyDelimiter("::"))
+			if err := store.loadLabels(v, []string{tmpDir}); err != nil {
+				t.Fatalf("Failed to load labels: %v", err)
+			}
+
+			policy, err := store.GetLabelPolicy(UserIdentity{Username: "alice", Groups: []string{"prod-team", "backend-team"}}, "")
+			if err != nil {
+				t.Fatalf("Failed to get label policy: %v", err)
+			}
+			if policy.Logic != tt.expectedLogic {
+				t.Errorf("Expected logic %s, got %s", tt.expectedLogic, policy.Logic)
+			}
+
+			got, err := PromQLEnforcer{}.Enforce(tt.query, *policy)
+			if err != nil {
+				t.Fatalf("Failed to enforce query: %v", err)
+			}
+			if got != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestMergePolicies_ORRefusesANDEntries tests that an OR merge refuses entries whose AND
+// rules it would split, as that would widen their access
+func TestMergePolicies_ORRefusesANDEntries(t *testing.T) {
+	scoped := &LabelPolicy{Rules: []LabelRule{
+		{Name: "namespace", Operator: OperatorEquals, Values: []string{"a"}},
+		{Name: "env", Operator: OperatorEquals, Values: []string{"prod"}},
+	}, Logic: LogicAND}
+	other := &LabelPolicy{Rules: []LabelRule{
+		{Name: "namespace", Operator: OperatorEquals, Values: []string{"b"}},
+	}, Logic: LogicAND}
+	clusterWide := &LabelPolicy{Rules: []LabelRule{
+		{Name: DefaultClusterWideLabel, Operator: OperatorEquals, Values: []string{"true"}},
+	}, Logic: LogicAND}
+
+	store := &FileLabelStore{}
+	if merged, err := store.mergePolicies([]*LabelPolicy{scoped, other}); err == nil {
+		t.Fatalf("Expected the OR merge to be refused, got %+v", merged)
+	}
+
+	merged, err := store.mergePolicies([]*LabelPolicy{scoped, clusterWide})
+	if err != nil {
+		t.Fatalf("Expected cluster-wide access to merge, got %v", err)
+	}
+	if merged.Logic != LogicAND {
+		t.Errorf("Expected the AND logic of the scoped entry, got %s", merged.Logic)
+	}
+
+	store.groupMergeLogic = LogicAND
+	merged, err = store.mergePolicies([]*LabelPolicy{scoped, other})
+	if err != nil {
+		t.Fatalf("Expected the AND merge to succeed, got %v", err)
+	}
+	if merged.Logic != LogicAND || len(merged.Rules) != 2 {
+		t.Errorf("Expected 2 rules combined with AND, got %+v", merged)
+	}
+}
+
+// TestMergePolicies_ANDRefusesCrossedLabels tests that an AND merge refuses entries restricting
+// several labels differently, as the union of their values would grant combinations of them
+func TestMergePolicies_ANDRefusesCrossedLabels(t *testing.T) {
+	dev := &LabelPolicy{Rules: []LabelRule{
+		{Name: "namespace", Operator: OperatorEquals, Values: []string{"a"}},
+		{Name: "env", Operator: OperatorEquals, Values: []string{"dev"}},
+	}, Logic: LogicAND}
+	prod := &LabelPolicy{Rules: []LabelRule{
+		{Name: "namespace", Operator: OperatorEquals, Values: []string{"b"}},
+		{Name: "env", Operator: OperatorEquals, Values: []string{"prod"}},
+	}, Logic: LogicAND}
+	namespace := &LabelPolicy{Rules: []LabelRule{
+		{Name: "namespace", Operator: OperatorEquals, Values: []string{"a"}},
+	}, Logic: LogicAND}
+
+	store := &FileLabelStore{groupMergeLogic: LogicAND}
+	if merged, err := store.mergePolicies([]*LabelPolicy{dev, prod}); err == nil {
+		t.Fatalf("Expected the AND merge to be refused, got %+v", merged)
+	}
+
+	// env is only restricted by one entry, so the merge narrows namespace=a to env=prod
+	merged, err := store.mergePolicies([]*LabelPolicy{namespace, prod})
+	if err != nil {
+		t.Fatalf("Expected the AND merge to succeed, got %v", err)
+	}
+	if len(merged.Rules) != 2 || merged.Rules[1].Name != "namespace" || len(merged.Rules[1].Values) != 2 {
+		t.Errorf("Expected env and namespace=~a|b, got %+v", merged.Rules)
+	}
+}
+
+// TestFileLabelStore_EmptyUsername tests that identities without a username, e.g. tokens
+// carrying only an email, are matched by their groups only
+func TestFileLabelStore_EmptyUsername(t *testing.T) {
+	groupPolicy := &LabelPolicy{Rules: []LabelRule{{Name: "namespace", Operator: "=", Values: []string{"prod"}}}, Logic: LogicAND}
+	store := &FileLabelStore{
+		parser: NewPolicyParser(),
+		policyCache: map[string]*LabelPolicy{
+			"entry:":          {Rules: []LabelRule{{Name: "namespace", Operator: "=", Values: []string{"everything"}}}, Logic: LogicAND},
+			"entry:prod-team": groupPolicy,
+		},
+	}
+
+	if _, err := store.GetLabelPolicy(UserIdentity{}, ""); err == nil {
+		t.Error("Expected no policy for an identity without username and groups")
+	}
+
+	policy, err := store.GetLabelPolicy(UserIdentity{Groups: []string{"prod-team"}}, "")
+	if err != nil {
+		t.Fatalf("Failed to get label policy: %v", err)
+	}
+	if !reflect.DeepEqual(policy.Rules, groupPolicy.Rules) {
+		t.Errorf("Expected group rules %+v, got %+v", groupPolicy.Rules, policy.Rules)
+	}
+}
+
+// TestFileLabelStore_EmailDomain tests that email domain entries apply only to identities
+// without a matching user or group entry
+func TestFileLabelStore_EmailDomain(t *testing.T) {
+	yamlContent := `
+alice:
+  _rules:
+    - name: namespace
+      operator: =
+      values: ["alice"]
+
+prod-team:
+  _rules:
+    - name: namespace
+      operator: =
+      values: ["prod"]
+
+"@Example.com":
+  _rules:
+    - name: namespace
+      operator: =
+      values: ["example"]
+`
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "labels.yaml"), []byte(yamlContent), 0644); err != nil {
+		t.Fatalf("Failed to write test YAML file: %v", err)
+	}
+	store := &FileLabelStore{parser: NewPolicyParser(), groupMergeLogic: LogicAND}
+	v := viper.NewWithOptions(viper.KeyDelimiter("::"))
+	if err := store.loadLabels(v, []string{tmpDir}); err != nil {
+		t.Fatalf("Failed to load labels: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		identity UserIdentity
+		expected string // Namespace allowed by the policy, empty if no policy is found
+	}{
+		{name: "user entry takes precedence", identity: UserIdentity{Username: "alice", Email: "alice@example.com"}, expected: "alice"},
+		{name: "group entry takes precedence", identity: UserIdentity{Username: "bob", Groups: []string{"prod-team"}, Email: "bob@example.com"}, expected: "prod"},
+		{name: "matching domain", identity: UserIdentity{Username: "carol", Email: "carol@EXAMPLE.com"}, expected: "example"},
+		{name: "other domain", identity: UserIdentity{Username: "dave", Email: "dave@example.org"}},
+		{name: "subdomain", identity: UserIdentity{Username: "erin", Email: "erin@mail.example.com"}},
+		{name: "no email", identity: UserIdentity{Username: "frank"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := store.GetLabelPolicy(tt.identity, "")
+			if tt.expected == "" {
+				if !errors.Is(err, ErrPolicyNotFound) {
+					t.Errorf("Expected ErrPolicyNotFound, got policy %+v and error %v", policy, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to get label policy: %v", err)
+			}
+			if len(policy.Rules) != 1 || !reflect.DeepEqual(policy.Rules[0].Values, []string{tt.expected}) {
+				t.Errorf("Expected namespace %s, got rules %+v", tt.expected, policy.Rules)
+			}
+		})
+	}
+}
+
+// TestFileLabelStore_CaseInsensitive tests that usernames and groups are matched ignoring
+// case independently of each other
+func TestFileLabelStore_CaseInsensitive(t *testing.T) {
+	yamlContent := `
+Alice:
+  _rules:
+    - name: namespace
+      operator: =
+      values: ["alice"]
+
+Prod-Team:
+  _rules:
+    - name: namespace
+      operator: =
+      values: ["prod"]
+
+prod-team:
+  _rules:
+    - name: namespace
+      operator: =
+      values: ["prod-lower"]
+`
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "labels.yaml"), []byte(yamlContent), 0644); err != nil {
+		t.Fatalf("Failed to write test YAML file: %v", err)
+	}
+
+	tests := []struct {
+		name            string
+		caseInsensitive CaseInsensitiveConfig
+		identity        UserIdentity
+		expected        []string // Namespaces allowed by the policy, nil if no policy is found
+	}{
+		{name: "case-sensitive username", caseInsensitive: CaseInsensitiveConfig{Groups: true}, identity: UserIdentity{Username: "alice"}},
+		{name: "exact username", caseInsensitive: CaseInsensitiveConfig{Groups: true}, identity: UserIdentity{Username: "Alice"}, expected: []string{"alice"}},
+		{name: "case-insensitive groups", caseInsensitive: CaseInsensitiveConfig{Groups: true}, identity: UserIdentity{Username: "bob", Groups: []string{"PROD-TEAM"}}, expected: []string{"prod", "prod-lower"}},
+		{name: "case-sensitive groups", caseInsensitive: CaseInsensitiveConfig{Username: true}, identity: UserIdentity{Username: "bob", Groups: []string{"PROD-TEAM"}}},
+		{name: "case-insensitive username", caseInsensitive: CaseInsensitiveConfig{Username: true}, identity: UserIdentity{Username: "ALICE"}, expected: []string{"alice"}},
+		{name: "case-insensitive username and exact group", caseInsensitive: CaseInsensitiveConfig{Username: true}, identity: UserIdentity{Username: "alice", Groups: []string{"prod-team"}}, expected: []string{"alice", "prod-lower"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &FileLabelStore{
+				parser:          NewPolicyParser(),
+				groupMergeLogic: LogicOR,
+				config:          LabelStoreConfig{CaseInsensitive: tt.caseInsensitive},
+			}
+			v := viper.NewWithOptions(viper.KeyDelimiter("::"))
+			if err := store.loadLabels(v, []string{tmpDir}); err != nil {
+				t.Fatalf("Failed to load labels: %v", err)
+			}
+
+			policy, err := store.GetLabelPolicy(tt.identity, "")
+			if tt.expected == nil {
+				if !errors.Is(err, ErrPolicyNotFound) {
+					t.Errorf("Expected ErrPolicyNotFound, got policy %+v and error %v", policy, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to get label policy: %v", err)
+			}
+			if len(policy.Rules) != 1 || !reflect.DeepEqual(policy.Rules[0].Values, tt.expected) {
+				t.Errorf("Expected namespaces %v, got rules %+v", tt.expected, policy.Rules)
+			}
+		})
+	}
+}
+
+// TestFileLabelStore_MatchEmail tests that users are matched by their username and email entries
+func TestFileLabelStore_MatchEmail(t *testing.T) {
+	yamlContent := `
+alice:
+  _rules:
+    - name: namespace
+      operator: =
+      values: ["alice"]
+
+alice@example.com:
+  _rules:
+    - name: namespace
+      operator: =
+      values: ["alice-mail"]
+
+bob@example.com:
+  _rules:
+    - name: namespace
+      operator: =
+      values: ["bob-mail"]
+
+'@example.com':
+  _rules:
+    - name: namespace
+      operator: =
+      values: ["example"]
+`
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "labels.yaml"), []byte(yamlContent), 0644); err != nil {
+		t.Fatalf("Failed to write test YAML file: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		matchEmail bool
+		fold       bool
+		identity   UserIdentity
+		expected   []string // Namespaces allowed by the policy, nil if no policy is found
+	}{
+		{name: "email only", matchEmail: true, identity: UserIdentity{Username: "bob", Email: "bob@example.com"}, expected: []string{"bob-mail"}},
+		{name: "username only", matchEmail: true, identity: UserIdentity{Username: "alice", Email: "alice@other.org"}, expected: []string{"alice"}},
+		{name: "username and email", matchEmail: true, identity: UserIdentity{Username: "alice", Email: "alice@example.com"}, expected: []string{"alice", "alice-mail"}},
+		{name: "email as username", matchEmail: true, identity: UserIdentity{Username: "bob@example.com", Email: "bob@example.com"}, expected: []string{"bob-mail"}},
+		{name: "email follows username case sensitivity", matchEmail: true, fold: true, identity: UserIdentity{Username: "bob", Email: "Bob@Example.com"}, expected: []string{"bob-mail"}},
+		{name: "disabled falls back to domain", identity: UserIdentity{Username: "bob", Email: "bob@example.com"}, expected: []string{"example"}},
+		{name: "disabled matches username only", identity: UserIdentity{Username: "alice", Email: "alice@example.com"}, expected: []string{"alice"}},
+		{name: "no entry", matchEmail: true, identity: UserIdentity{Username: "carol", Email: "carol@other.org"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &FileLabelStore{
+				parser:          NewPolicyParser(),
+				groupMergeLogic: LogicAND,
+				config:          LabelStoreConfig{MatchEmail: tt.matchEmail, CaseInsensitive: CaseInsensitiveConfig{Username: tt.fold}},
+			}
+			v := viper.NewWithOptions(viper.KeyDelimiter("::"))
+			if err := store.loadLabels(v, []string{tmpDir}); err != nil {
+				t.Fatalf("Failed to load labels: %v", err)
+			}
+
+			policy, err := store.GetLabelPolicy(tt.identity, "")
+			if tt.expected == nil {
+				if !errors.Is(err, ErrPolicyNotFound) {
+					t.Errorf("Expected ErrPolicyNotFound, got policy %+v and error %v", policy, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to get label policy: %v", err)
+			}
+			if len(policy.Rules) != 1 || !reflect.DeepEqual(policy.Rules[0].Values, tt.expected) {
+				t.Errorf("Expected namespaces %v, got rules %+v", tt.expected, policy.Rules)
+			}
+		})
+	}
+}
+
+// TestNormalizeGroupMergeLogic_Invalid tests that unknown merge logic values are rejected
+func TestNormalizeGroupMergeLogic_Invalid(t *testing.T) {
+	if _, err := normalizeGroupMergeLogic("XOR"); err == nil {
+		t.Error("Expected error for invalid group merge logic")
+	}
+}
+
+// TestNormalizeDefaultLogic tests the default entry logic setting
+func TestNormalizeDefaultLogic(t *testing.T) {
+	for input, want := range map[string]string{"": LogicAND, "and": LogicAND, " OR ": LogicOR} {
+		if logic, err := normalizeDefaultLogic(input); err != nil || logic != want {
+			t.Errorf("normalizeDefaultLogic(%q) = %q, %v, want %q", input, logic, err, want)
+		}
+	}
+	if _, err := normalizeDefaultLogic("XOR"); err == nil {
+		t.Error("Expected error for invalid default logic")
+	}
+}
+
+// TestFileLabelStore_ClusterWideAudit tests the warn and fail modes of the cluster-wide audit
+func TestFileLabelStore_ClusterWideAudit(t *testing.T) {
+	yamlContent := `
+cluster-admins:
+  _rules:
+    - name: '#cluster-wide'
+      operator: =
+      values: ["true"]
+
+typo-team:
+  _rules:
+    - name: '#cluster-wide'
+      operator: =
+      values: ["true"]
+
+prod-team:
+  _rules:
+    - name: namespace
+      operator: =
+      values: ["prod"]
+`
+
+	tests := []struct {
+		name        string
+		config      LabelStoreConfig
+		expectErr   bool
+		expectWarns []string
+	}{
+		{
+			name:   "audit disabled",
+			config: LabelStoreConfig{},
+		},
+		{
+			name:        "warn mode logs entries not in allowlist",
+			config:      LabelStoreConfig{WarnOnClusterWide: true, ClusterWideAllowlist: []string{"cluster-admins"}},
+			expectWarns: []string{"typo-team"},
+		},
+		{
+			name:      "fail mode rejects entries not in allowlist",
+			config:    LabelStoreConfig{FailOnClusterWide: true, ClusterWideAllowlist: []string{"cluster-admins"}},
+			expectErr: true,
+		},
+		{
+			name:   "fail mode accepts fully allowlisted entries",
+			config: LabelStoreConfig{FailOnClusterWide: true, ClusterWideAllowlist: []string{"cluster-admins", "typo-team"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(tmpDir, "labels.yaml"), []byte(yamlContent), 0644); err != nil {
+				t.Fatalf("Failed to write test YAML file: %v", err)
+			}
+
+			var buf bytes.Buffer
+			originalLogger := log.Logger
+			log.Logger = zerolog.New(&buf)
+			defer func() { log.Logger = originalLogger }()
+
+			store := &FileLabelStore{parser: NewPolicyParser(), groupMergeLogic: LogicAND, config: tt.config}
+			v := viper.NewWithOptions(viper.KeyDelimiter("::"))
+			err := store.loadLabels(v, []string{tmpDir})
+
+			if tt.expectErr {
+				if err == nil {
+					t.Fatal("Expected error for unexpected cluster-wide entry")
+				}
+				if !strings.Contains(err.Error(), "typo-team") || strings.Contains(err.Error(), "cluster-admins") {
+					t.Errorf("Expected error to name only typo-team, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to load labels: %v", err)
+			}
+
+			warnings := strings.Count(buf.String(), `"level":"warn"`)
+			if warnings != len(tt.expectWarns) {
+				t.Errorf("Expected %d warnings, got %d: %s", len(tt.expectWarns), warnings, buf.String())
+			}
+			for _, entry := range tt.expectWarns {
+				if !strings.Contains(buf.String(), `"entry":"`+entry+`"`) {
+					t.Errorf("Expected warning for entry %s, got: %s", entry, buf.String())
+				}
+			}
+		})
+	}
+}
+
+// TestFileLabelStore_SimpleFormat tests rejecting and auto-converting the deprecated simple format
+func TestFileLabelStore_SimpleFormat(t *testing.T) {
+	yamlContent := `
+legacy-team:
+  prod: true
+  staging: true
+
+modern-team:
+  _rules:
+    - name: team
+      operator: =
+      values: ["backend"]
+`
+
+	tests := []struct {
+		name          string
+		config        LabelStoreConfig
+		expectErr     bool
+		expectedRules []LabelRule
+	}{
+		{
+			name:      "default rejects simple format",
+			config:    LabelStoreConfig{},
+			expectErr: true,
+		},
+		{
+			name:      "reject fails loading",
+			config:    LabelStoreConfig{SimpleFormat: SimpleFormatReject},
+			expectErr: true,
+		},
+		{
+			name:   "auto_convert uses the default label",
+			config: LabelStoreConfig{SimpleFormat: SimpleFormatAutoConvert},
+			expectedRules: []LabelRule{
+				{Name: "namespace", Operator: OperatorEquals, Values: []string{"prod", "staging"}},
+			},
+		},
+		{
+			name:   "auto_convert uses the configured label",
+			config: LabelStoreConfig{SimpleFormat: SimpleFormatAutoConvert, SimpleFormatLabel: "tenant_id"},
+			expectedRules: []LabelRule{
+				{Name: "tenant_id", Operator: OperatorEquals, Values: []string{"prod", "staging"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(tmpDir, "labels.yaml"), []byte(yamlContent), 0644); err != nil {
+				t.Fatalf("Failed to write test YAML file: %v", err)
+			}
+
+			mode, err := normalizeSimpleFormat(tt.config.SimpleFormat)
+			if err != nil {
+				t.Fatalf("Unexpected simple format error: %v", err)
+			}
+			tt.config.SimpleFormat = mode
+			store := &FileLabelStore{parser: NewPolicyParser(), groupMergeLogic: LogicAND, config: tt.config}
+			v := viper.NewWithOptions(viper.KeyDelimiter("::"))
+			err = store.loadLabels(v, []string{tmpDir})
+
+			if tt.expectErr {
+				if err == nil || !strings.Contains(err.Error(), "DEPRECATED FORMAT") {
+					t.Fatalf("Expected simple format error, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to load labels: %v", err)
+			}
+
+			policy, err := store.GetLabelPolicy(UserIdentity{Username: "alice", Groups: []string{"legacy-team"}}, "")
+			if err != nil {
+				t.Fatalf("Failed to get label policy: %v", err)
+			}
+			if !reflect.DeepEqual(policy.Rules, tt.expectedRules) {
+				t.Errorf("Expected rules %v, got %v", tt.expectedRules, policy.Rules)
+			}
+
+			modern, err := store.GetLabelPolicy(UserIdentity{Username: "bob", Groups: []string{"modern-team"}}, "")
+			if err != nil || modern.Rules[0].Name != "team" {
+				t.Errorf("Expected extended entry to be kept, got %v (err: %v)", modern, err)
+			}
+		})
+	}
+}
+
+// TestNormalizeSimpleFormat_Invalid tests that unknown simple format modes are rejected
+func TestNormalizeSimpleFormat_Invalid(t *testing.T) {
+	if _, err := normalizeSimpleFormat("convert"); err == nil {
+		t.Error("Expected error for invalid simple format mode")
+	}
+}
+
+// TestFileLabelStore_MaxRegexValues tests that rules with more values than max_regex_values
+// are denied or split into several rules
+func TestFileLabelStore_MaxRegexValues(t *testing.T) {
+	yamlContent := `
+team-1:
+  _rules:
+    - name: namespace
+      operator: =
+      values: ["ns1"]
+team-2:
+  _rules:
+    - name: namespace
+      operator: =
+      values: ["ns2"]
+team-3:
+  _rules:
+    - name: namespace
+      operator: =
+      values: ["ns3"]
+team-4:
+  _rules:
+    - name: namespace
+      operator: =
+      values: ["ns4", "ns5"]
+backend:
+  _rules:
+    - name: team
+      operator: =
+      values: ["backend"]
+restricted:
+  _rules:
+    - name: namespace
+      operator: "!~"
+      values: ["kube-system", "monitoring", "vault", "istio-system"]
+`
+	allTeams := []string{"team-1", "team-2", "team-3", "team-4"}
+
+	tests := []struct {
+		name       string
+		mergeLogic string
+		overflow   string
+		groups     []string
+		expected   string // Enforced PromQL for "up", empty if an error is expected
+	}{
+		{
+			name:     "within the limit",
+			groups:   []string{"team-1", "team-2", "team-3"},
+			expected: `up{namespace=~"ns1|ns2|ns3"}`,
+		},
+		{
+			name:   "error by default",
+			groups: allTeams,
+		},
+		{
+			name:     "split into an OR policy",
+			overflow: RegexValuesOverflowSplit,
+			groups:   allTeams,
+			expected: `(up{namespace=~"ns1|ns2|ns3"}) or (up{namespace=~"ns4|ns5"})`,
+		},
+		{
+			name:       "split in an OR policy",
+			mergeLogic: LogicOR,
+			overflow:   RegexValuesOverflowSplit,
+			groups:     append([]string{"backend"}, allTeams...),
+			expected:   `(up{namespace=~"ns1|ns2|ns3"}) or (up{namespace=~"ns4|ns5"}) or (up{team="backend"})`,
+		},
+		{
+			name:       "positive rule cannot be split in an AND policy",
+			mergeLogic: LogicAND,
+			overflow:   RegexValuesOverflowSplit,
+			groups:     append([]string{"backend"}, allTeams...),
+		},
+		{
+			name:     "negative rule split into an AND policy",
+			overflow: RegexValuesOverflowSplit,
+			groups:   []string{"restricted"},
+			expected: `up{namespace!~"istio-system",namespace!~"kube-system|monitoring|vault"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(tmpDir, "labels.yaml"), []byte(yamlContent), 0644); err != nil {
+				t.Fatalf("Failed to write test YAML file: %v", err)
+			}
+
+			logic, err := normalizeGroupMergeLogic(tt.mergeLogic)
+			if err != nil {
+				t.Fatalf("Unexpected merge logic error: %v", err)
+			}
+			overflow, err := normalizeRegexValuesOverflow(tt.overflow)
+			if err != nil {
+				t.Fatalf("Unexpected overflow mode error: %v", err)
+			}
+			store := &FileLabelStore{
+				parser:          NewPolicyParser(),
+				groupMergeLogic: logic,
+				config:          LabelStoreConfig{MaxRegexValues: 3, RegexValuesOverflow: overflow},
+			}
+			v := viper.NewWithOptions(viper.KeyDelimiter("::"))
+			if err := store.loadLabels(v, []string{tmpDir}); err != nil {
+				t.Fatalf("Failed to load labels: %v", err)
+			}
+
+			policy, err := store.GetLabelPolicy(UserIdentity{Username: "alice", Groups: tt.groups}, "")
+			if tt.expected == "" {
+				if err == nil || !strings.Contains(err.Error(), "max_regex_values") {
+					t.Fatalf("Expected max_regex_values error, got policy %+v and error %v", policy, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to get label policy: %v", err)
+			}
+			for _, rule := range policy.Rules {
+				if len(rule.Values) > 3 {
+					t.Errorf("Rule for %s has %d values, more than the limit", rule.Name, len(rule.Values))
+				}
+			}
+
+			got, err := PromQLEnforcer{}.Enforce("up", *policy)
+			if err != nil {
+				t.Fatalf("Failed to enforce query: %v", err)
+			}
+			if got != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestFileLabelStore_ClusterWidePrecedence tests users granted cluster-wide access by one group
+// and specific rules by another
+func TestFileLabelStore_ClusterWidePrecedence(t *testing.T) {
+	yamlContent := `
+admins:
+  _rules:
+    - name: '#cluster-wide'
+      operator: =
+      values: ["true"]
+team-a:
+  _rules:
+    - name: namespace
+      operator: =
+      values: ["team-a"]
+loki-readers:
+  _rules:
+    - name: '#cluster-wide:loki'
+      operator: =
+      values: ["true"]
+`
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "labels.yaml"), []byte(yamlContent), 0644); err != nil {
+		t.Fatalf("Failed to write test YAML file: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		precedence string
+		groups     []string
+		expected   string // Enforced PromQL for "up", "cluster-wide" if unenforced, empty if an error is expected
+	}{
+		{name: "cluster-wide only", precedence: ClusterWidePrecedenceError, groups: []string{"admins"}, expected: "cluster-wide"},
+		{name: "most permissive by default", groups: []string{"admins", "team-a"}, expected: "cluster-wide"},
+		{name: "most permissive", precedence: ClusterWidePrecedenceMostPermissive, groups: []string{"team-a", "admins"}, expected: "cluster-wide"},
+		{name: "specific wins", precedence: ClusterWidePrecedenceSpecificWins, groups: []string{"admins", "team-a"}, expected: `up{namespace="team-a"}`},
+		{name: "error", precedence: ClusterWidePrecedenceError, groups: []string{"admins", "team-a"}},
+		{name: "scoped cluster-wide is not specific", precedence: ClusterWidePrecedenceError, groups: []string{"admins", "loki-readers"}, expected: "cluster-wide"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			precedence, err := normalizeClusterWidePrecedence(tt.precedence)
+			if err != nil {
+				t.Fatalf("Unexpected precedence error: %v", err)
+			}
+			store := &FileLabelStore{
+				parser:          NewPolicyParser(),
+				groupMergeLogic: LogicAND,
+				config:          LabelStoreConfig{ClusterWidePrecedence: precedence},
+			}
+			v := viper.NewWithOptions(viper.KeyDelimiter("::"))
+			if err := store.loadLabels(v, []string{tmpDir}); err != nil {
+				t.Fatalf("Failed to load labels: %v", err)
+			}
+
+			policy, err := store.GetLabelPolicy(UserIdentity{Username: "alice", Groups: tt.groups}, "")
+			if tt.expected == "" {
+				if err == nil || !strings.Contains(err.Error(), "cluster_wide_precedence") {
+					t.Fatalf("Expected cluster_wide_precedence error, got policy %+v and error %v", policy, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to get label policy: %v", err)
+			}
+			if tt.expected == "cluster-wide" {
+				if !policy.HasClusterWideAccess() || len(policy.Rules) != 1 {
+					t.Errorf("Expected the cluster-wide policy, got %+v", policy)
+				}
+				return
+			}
+
+			got, err := PromQLEnforcer{}.Enforce("up", *policy)
+			if err != nil {
+				t.Fatalf("Failed to enforce query: %v", err)
+			}
+			if got != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+
+	if _, err := normalizeClusterWidePrecedence("least_permissive"); err == nil {
+		t.Error("Expected error for invalid cluster-wide precedence")
+	}
+}
+
+// TestNormalizeRegexValuesOverflow_Invalid tests that unknown overflow modes are rejected
+func TestNormalizeRegexValuesOverflow_Invalid(t *testing.T) {
+	if _, err := normalizeRegexValuesOverflow("truncate"); err == nil {
+		t.Error("Expected error for invalid regex_values_overflow mode")
+	}
+}
+
+// TestFileLabelStore_OnReloadError tests that a failed reload keeps the previous policies or,
+// failing closed, makes the store unavailable until a reload succeeds
+func TestFileLabelStore_OnReloadError(t *testing.T) {
+	validLabels := `
+alice:
+  _rules:
+    - name: namespace
+      operator: =
+      values: ["prod"]
+`
+	invalidLabels := `
+alice:
+  _rules:
+    - name: namespace
+      operator: ==
+      values: ["prod"]
+`
+
+	tests := []struct {
+		name          string
+		onReloadError string
+		wantErr       error // Error after the failed reload, nil if the previous policy is kept
+	}{
+		{name: "keep serving by default"},
+		{name: "keep serving", onReloadError: OnReloadErrorKeepServing},
+		{name: "fail closed", onReloadError: OnReloadErrorFailClosed, wantErr: ErrLabelStoreUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			labelsPath := filepath.Join(tmpDir, "labels.yaml")
+			writeLabels := func(content string) {
+				if err := os.WriteFile(labelsPath, []byte(content), 0644); err != nil {
+					t.Fatalf("Failed to write test YAML file: %v", err)
+				}
+			}
+			writeLabels(validLabels)
+
+			onReloadError, err := normalizeOnReloadError(tt.onReloadError)
+			if err != nil {
+				t.Fatalf("Unexpected reload error mode error: %v", err)
+			}
+			store := &FileLabelStore{
+				parser:          NewPolicyParser(),
+				groupMergeLogic: LogicAND,
+				config:          LabelStoreConfig{OnReloadError: onReloadError},
+			}
+			v := viper.NewWithOptions(viper.KeyDelimiter("::"))
+			v.SetConfigName("labels")
+			v.SetConfigType("yaml")
+			v.AddConfigPath(tmpDir)
+			if err := store.loadLabels(v, []string{tmpDir}); err != nil {
+				t.Fatalf("Failed to load labels: %v", err)
+			}
+			identity := UserIdentity{Username: "alice"}
+
+			writeLabels(invalidLabels)
+			store.reload(v, []string{tmpDir})
+			policy, err := store.GetLabelPolicy(identity, "")
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Expected %v after failed reload, got policy %+v and error %v", tt.wantErr, policy, err)
+				}
+			} else if err != nil || policy.Rules[0].Values[0] != "prod" {
+				t.Fatalf("Expected previous policy after failed reload, got policy %+v and error %v", policy, err)
+			}
+
+			writeLabels(validLabels)
+			store.reload(v, []string{tmpDir})
+			if _, err := store.GetLabelPolicy(identity, ""); err != nil {
+				t.Fatalf("Failed to get label policy after successful reload: %v", err)
+			}
+		})
+	}
+}
+
+// TestFileLabelStore_Health tests that an empty labels.yaml and failed reloads report the
+// label store as not ready
+func TestFileLabelStore_Health(t *testing.T) {
+	tmpDir := t.TempDir()
+	labelsPath := filepath.Join(tmpDir, "labels.yaml")
+	writeLabels := func(content string) {
+		if err := os.WriteFile(labelsPath, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write test YAML file: %v", err)
+		}
+	}
+	writeLabels("# no entries yet\n{}\n")
+
+	store := &FileLabelStore{
+		parser:          NewPolicyParser(),
+		groupMergeLogic: LogicAND,
+		config:          LabelStoreConfig{OnReloadError: OnReloadErrorKeepServing},
+	}
+	v := viper.NewWithOptions(viper.KeyDelimiter("::"))
+	v.SetConfigName("labels")
+	v.SetConfigType("yaml")
+	v.AddConfigPath(tmpDir)
+	if err := store.loadLabels(v, []string{tmpDir}); err != nil {
+		t.Fatalf("Failed to load labels: %v", err)
+	}
+	if err := store.Health(); err == nil || !strings.Contains(err.Error(), "no label policies loaded") {
+		t.Errorf("Expected empty label store to be not ready, got %v", err)
+	}
+
+	writeLabels("alice:\n  _rules:\n    - name: namespace\n      operator: =\n      values: [\"prod\"]\n")
+	store.reload(v, []string{tmpDir})
+	if err := store.Health(); err != nil {
+		t.Errorf("Expected label store to be ready, got %v", err)
+	}
+
+	writeLabels("alice:\n  _rules:\n    - name: namespace\n      operator: ==\n      values: [\"prod\"]\n")
+	store.reload(v, []string{tmpDir})
+	if err := store.Health(); err == nil || !strings.Contains(err.Error(), "labels failed to reload") {
+		t.Errorf("Expected failed reload to be not ready, got %v", err)
+	}
+	if _, err := store.GetLabelPolicy(UserIdentity{Username: "alice"}, ""); err != nil {
+		t.Errorf("Expected previous policy to keep being served, got %v", err)
+	}
+}
+
+// TestNormalizeOnReloadError_Invalid tests that unknown reload failure modes are rejected
+func TestNormalizeOnReloadError_Invalid(t *testing.T) {
+	if _, err := normalizeOnReloadError("exit"); err == nil {
+		t.Error("Expected error for invalid on_reload_error mode")
+	}
+}
@@ -2,14 +2,99 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/netip"
+	"slices"
+	"sync/atomic"
 
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+// RequestIDHeader is the header used to accept, propagate, and return the request ID.
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds the length of a client-supplied request ID.
+const maxRequestIDLength = 128
+
+// DefaultDebugHeader is the default header requesting the log level of a single request.
+const DefaultDebugHeader = "X-LBAC-Debug"
+
+// With per-request log levels, the global level lets every event through and levelFilter
+// applies the configured level to the global logger instead, so that the loggers of debugged
+// requests, derived from unfilteredLogger, may log below it.
+var (
+	configuredLevel      atomic.Int32
+	levelFilterInstalled bool           // Only set at startup, before requests are served
+	unfilteredLogger     zerolog.Logger // The global logger without levelFilter
+)
+
+// levelFilter discards the events of the global logger below the configured level.
+type levelFilter struct{}
+
+func (levelFilter) Run(e *zerolog.Event, level zerolog.Level, _ string) {
+	if level < zerolog.Level(configuredLevel.Load()) {
+		e.Discard()
+	}
+}
+
+// installLevelFilter adds levelFilter to the global logger, keeping the logger without it
+// for debugged requests. It must be called before requests are served.
+func installLevelFilter() {
+	if levelFilterInstalled {
+		return
+	}
+	unfilteredLogger = log.Logger
+	log.Logger = log.Logger.Hook(levelFilter{})
+	levelFilterInstalled = true
+}
+
+// setLogLevel sets the level of the global logger.
+func setLogLevel(level zerolog.Level) {
+	configuredLevel.Store(int32(level))
+	if levelFilterInstalled {
+		zerolog.SetGlobalLevel(zerolog.TraceLevel)
+		return
+	}
+	zerolog.SetGlobalLevel(level)
+}
+
+// requestLogLevel returns the log level requested by the debug header of r, if the header
+// is allowed, sent from a trusted address and more verbose than the configured level.
+func (a *App) requestLogLevel(r *http.Request) (zerolog.Level, bool) {
+	cfg := requestApp(r, a).Cfg.Debug
+	if !cfg.AllowHeaderLogLevel || !levelFilterInstalled {
+		return 0, false
+	}
+	value := r.Header.Get(cfg.Header)
+	if value == "" {
+		return 0, false
+	}
+	// The header is meant for the proxy only
+	r.Header.Del(cfg.Header)
+
+	addr, err := remoteAddr(r)
+	if err != nil || !slices.ContainsFunc(cfg.trustedPrefixes, func(prefix netip.Prefix) bool { return prefix.Contains(addr) }) {
+		log.Warn().Str("header", cfg.Header).Str("remote_addr", r.RemoteAddr).Msg("Ignored log level header from untrusted address")
+		return 0, false
+	}
+	level, err := zerolog.ParseLevel(value)
+	if err != nil || level == zerolog.NoLevel {
+		log.Warn().Str("header", cfg.Header).Str("value", value).Msg("Ignored invalid log level header")
+		return 0, false
+	}
+	if level >= zerolog.Level(configuredLevel.Load()) {
+		return 0, false
+	}
+	return level, true
+}
+
 type requestData struct {
 	Method string      `json:"method"`
 	URL    string      `json:"url"`
@@ -17,13 +102,69 @@ type requestData struct {
 	Body   string      `json:"body"`
 }
 
+// requestIDMiddleware assigns a request ID to every incoming request, reusing a valid
+// client-supplied X-Request-Id or generating a new one. The ID is attached to a request-scoped
+// logger stored in the request context, set on the request header so it is forwarded to the
+// upstream, and returned in the response header (including error responses). The logger has
+// the level requested by the debug header, if it is accepted.
+func (a *App) requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if !isValidRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		r.Header.Set(RequestIDHeader, requestID)
+		w.Header().Set(RequestIDHeader, requestID)
+
+		logger := log.With().Str("request_id", requestID).Logger()
+		ctx := r.Context()
+		if level, ok := a.requestLogLevel(r); ok {
+			logger = unfilteredLogger.Level(level).With().Str("request_id", requestID).Str("log_level", level.String()).Logger()
+			ctx = context.WithValue(ctx, logLevelContextKey, level)
+		}
+		next.ServeHTTP(w, r.WithContext(logger.WithContext(ctx)))
+	})
+}
+
+// newRequestID generates a random 128-bit hex encoded request ID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Error().Err(err).Msg("Error while generating request ID")
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// isValidRequestID reports whether a client-supplied request ID is safe to reuse in logs and headers.
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestLogger returns the request-scoped logger carrying the request ID,
+// falling back to the global logger when the request has none.
+func requestLogger(r *http.Request) *zerolog.Logger {
+	if logger := zerolog.Ctx(r.Context()); logger != zerolog.DefaultContextLogger && logger.GetLevel() != zerolog.Disabled {
+		return logger
+	}
+	return &log.Logger
+}
+
 // loggingMiddleware returns a middleware that logs details of incoming HTTP requests and passes control to the next HTTP handler in the chain.
 // If trace level is enabled (level == -1), the request body is read and logged with all headers.
 // Otherwise, the body content is redacted and sensitive headers are removed.
 func (a *App) loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var bodyBytes []byte
-		isTraceLevel := a.Cfg.Log.Level == -1
+		isTraceLevel := requestApp(r, a).Cfg.Log.Level == -1 || r.Context().Value(logLevelContextKey) == zerolog.TraceLevel
 		if isTraceLevel {
 			bodyBytes = readBody(r)
 		} else {
@@ -31,7 +172,7 @@ func (a *App) loggingMiddleware(next http.Handler) http.Handler {
 		}
 		logRequestData(r, bodyBytes, isTraceLevel)
 		next.ServeHTTP(w, r)
-		log.Debug().Str("path", r.URL.Path).Msg("Request complete")
+		requestLogger(r).Debug().Str("path", r.URL.Path).Msg("Request complete")
 	})
 }
 
@@ -63,14 +204,15 @@ func logRequestData(r *http.Request, bodyBytes []byte, isTraceLevel bool) {
 	}
 	jsonData, err := json.Marshal(rd)
 	if err != nil {
-		log.Error().Err(err).Msg("Error while marshalling request")
+		requestLogger(r).Error().Err(err).Msg("Error while marshalling request")
 		return
 	}
-	log.Debug().Str("verb", r.Method).Str("request", string(jsonData)).Str("path", r.URL.Path).Msg("")
+	requestLogger(r).Debug().Str("verb", r.Method).Str("request", string(jsonData)).Str("path", r.URL.Path).Msg("")
 }
 
 // cleanSensitiveHeaders creates and returns a copy of the provided HTTP headers with sensitive headers removed.
-// Sensitive headers like "Authorization", "X-Plugin-Id", and "X-Id-Token" are deleted to prevent them from being logged.
+// Sensitive headers like "Authorization", "X-Plugin-Id", "X-Id-Token", and "X-Forwarded-Access-Token"
+// are deleted to prevent them from being logged.
 func cleanSensitiveHeaders(headers http.Header) http.Header {
 	copyHeader := make(http.Header)
 	for k, v := range headers {
@@ -79,6 +221,7 @@ func cleanSensitiveHeaders(headers http.Header) http.Header {
 	copyHeader.Del("Authorization")
 	copyHeader.Del("X-Plugin-Id")
 	copyHeader.Del("X-Id-Token")
+	copyHeader.Del("X-Forwarded-Access-Token")
 	return copyHeader
 }
 
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	app, tokens := setupTestMain()
+
+	var upstreamRequestID string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequestID = r.Header.Get(RequestIDHeader)
+		_, _ = fmt.Fprintln(w, "Upstream server response")
+	}))
+	defer upstream.Close()
+	app.Cfg.Thanos.URL = upstream.URL
+	app.WithProxies()
+	app.WithRoutes()
+
+	var buf bytes.Buffer
+	originalLogger := log.Logger
+	originalLevel := zerolog.GlobalLevel()
+	log.Logger = zerolog.New(&buf)
+	zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	defer func() {
+		log.Logger = originalLogger
+		zerolog.SetGlobalLevel(originalLevel)
+	}()
+
+	t.Run("generated ID", func(t *testing.T) {
+		buf.Reset()
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+		req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+		rr := httptest.NewRecorder()
+
+		app.e.ServeHTTP(rr, req)
+
+		requestID := rr.Header().Get(RequestIDHeader)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Len(t, requestID, 32)
+		assert.Equal(t, requestID, upstreamRequestID)
+		assert.Contains(t, buf.String(), `"request_id":"`+requestID+`"`)
+	})
+
+	t.Run("reused incoming ID on error response", func(t *testing.T) {
+		buf.Reset()
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+		req.Header.Set(RequestIDHeader, "abc-123")
+		rr := httptest.NewRecorder()
+
+		app.e.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		assert.Equal(t, "abc-123", rr.Header().Get(RequestIDHeader))
+		assert.Contains(t, buf.String(), `"request_id":"abc-123"`)
+	})
+
+	t.Run("invalid incoming ID is replaced", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+		req.Header.Set(RequestIDHeader, strings.Repeat("a", maxRequestIDLength+1))
+		rr := httptest.NewRecorder()
+
+		app.e.ServeHTTP(rr, req)
+
+		assert.Len(t, rr.Header().Get(RequestIDHeader), 32)
+	})
+}
+
+func TestLogDeniedQuery(t *testing.T) {
+	app, tokens := setupTestMain()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintln(w, "Upstream server response")
+	}))
+	defer upstream.Close()
+	app.Cfg.Thanos.URL = upstream.URL
+	app.WithProxies()
+	app.WithRoutes()
+
+	var buf bytes.Buffer
+	originalLogger := log.Logger
+	originalLevel := zerolog.GlobalLevel()
+	log.Logger = zerolog.New(&buf)
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	defer func() {
+		log.Logger = originalLogger
+		zerolog.SetGlobalLevel(originalLevel)
+	}()
+
+	tests := []struct {
+		name      string
+		enabled   bool
+		level     int
+		query     string
+		expected  []string
+		forbidden []string
+	}{
+		{
+			name:     "denied query",
+			enabled:  true,
+			level:    1,
+			query:    `up{tenant_id="forbidden_user"}`,
+			expected: []string{`"level":"warn"`, `"event":"denied_query"`, `"user":"user"`, `"upstream":"thanos"`, `"label":"tenant_id"`, `"value":"forbidden_user"`},
+			// The query is only logged at trace level
+			forbidden: []string{`"query"`},
+		},
+		{
+			name:     "query at trace level",
+			enabled:  true,
+			level:    -1,
+			query:    `up{tenant_id="forbidden_user"}`,
+			expected: []string{`"event":"denied_query"`, `"query":"up{tenant_id=\"forbidden_user\"}"`},
+		},
+		{
+			name:      "disabled",
+			query:     `up{tenant_id="forbidden_user"}`,
+			forbidden: []string{`"event":"denied_query"`},
+		},
+		{
+			name:      "allowed query",
+			enabled:   true,
+			query:     `up{tenant_id="allowed_user"}`,
+			forbidden: []string{`"event":"denied_query"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			app.Cfg.Log.LogDeniedQueries = tt.enabled
+			app.Cfg.Log.Level = tt.level
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query="+url.QueryEscape(tt.query), nil)
+			req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+			rr := httptest.NewRecorder()
+
+			app.e.ServeHTTP(rr, req)
+
+			for _, s := range tt.expected {
+				assert.Contains(t, buf.String(), s)
+			}
+			for _, s := range tt.forbidden {
+				assert.NotContains(t, buf.String(), s)
+			}
+		})
+	}
+}
+
+func TestRequestLogLevelHeader(t *testing.T) {
+	var buf bytes.Buffer
+	originalLogger := log.Logger
+	originalLevel := zerolog.GlobalLevel()
+	originalConfigured := configuredLevel.Load()
+	log.Logger = zerolog.New(&buf)
+	installLevelFilter()
+	setLogLevel(zerolog.InfoLevel)
+	defer func() {
+		log.Logger = originalLogger
+		levelFilterInstalled = false
+		configuredLevel.Store(originalConfigured)
+		zerolog.SetGlobalLevel(originalLevel)
+	}()
+
+	app := &App{Cfg: &Config{Log: LogConfig{Level: int(zerolog.InfoLevel)}, Debug: DebugConfig{
+		AllowHeaderLogLevel: true,
+		TrustedCIDRs:        []string{"192.0.2.0/24"},
+	}}}
+	assert.NoError(t, app.validateDebugConfig())
+
+	var forwardedHeader string
+	handler := app.requestIDMiddleware(app.loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedHeader = r.Header.Get(DefaultDebugHeader)
+		requestLogger(r).Trace().Msg("request trace")
+		log.Debug().Msg("global debug")
+	})))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		expected   []string
+		forbidden  []string
+	}{
+		{
+			name:     "trace from trusted address",
+			header:   "trace",
+			expected: []string{`"message":"request trace"`, `"log_level":"trace"`, `"request":`, `"message":"Request complete"`},
+			// Only the request's own logger is more verbose
+			forbidden: []string{`"global debug"`},
+		},
+		{
+			name:      "no header",
+			forbidden: []string{`"request trace"`, `"Request complete"`, `"global debug"`},
+		},
+		{
+			name:      "debug does not log trace",
+			header:    "debug",
+			expected:  []string{`"message":"Request complete"`, `"log_level":"debug"`},
+			forbidden: []string{`"request trace"`},
+		},
+		{
+			name:       "untrusted address",
+			remoteAddr: "198.51.100.7:4321",
+			header:     "trace",
+			expected:   []string{`"message":"Ignored log level header from untrusted address"`},
+			forbidden:  []string{`"request trace"`, `"Request complete"`},
+		},
+		{
+			name:      "invalid level",
+			header:    "verbose",
+			expected:  []string{`"message":"Ignored invalid log level header"`},
+			forbidden: []string{`"request trace"`},
+		},
+		{
+			name:      "less verbose than configured",
+			header:    "error",
+			forbidden: []string{`"request trace"`, `"Request complete"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+			if tt.remoteAddr != "" {
+				req.RemoteAddr = tt.remoteAddr
+			}
+			if tt.header != "" {
+				req.Header.Set(DefaultDebugHeader, tt.header)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			assert.Empty(t, forwardedHeader, "debug header is not forwarded")
+			for _, s := range tt.expected {
+				assert.Contains(t, buf.String(), s)
+			}
+			for _, s := range tt.forbidden {
+				assert.NotContains(t, buf.String(), s)
+			}
+		})
+	}
+}
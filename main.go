@@ -1,12 +1,23 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
 	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/MicahParks/keyfunc/v3"
 	"github.com/gorilla/mux"
@@ -17,6 +28,7 @@ import (
 	metrics "github.com/slok/go-http-metrics/metrics/prometheus"
 	"github.com/slok/go-http-metrics/middleware"
 	"github.com/slok/go-http-metrics/middleware/std"
+	"golang.org/x/sync/singleflight"
 )
 
 type App struct {
@@ -25,11 +37,17 @@ type App struct {
 	TlS                 *tls.Config
 	ServiceAccountToken string
 	LabelStore          Labelstore
-	lokiProxy           *httputil.ReverseProxy
-	thanosProxy         *httputil.ReverseProxy
-	tempoProxy          *httputil.ReverseProxy
+	lokiProxy           *upstreamProxy
+	lokiShadow          *shadowUpstream
+	thanosProxy         *upstreamProxy
+	tempoProxy          *upstreamProxy
+	mu                  *sync.RWMutex // Guards Cfg, healthy, the router, the proxies and shadows, which are replaced on reload
+	coalesced           *singleflight.Group
+	audit               *auditWebhook
 	i                   *mux.Router
-	e                   *mux.Router
+	e                   http.Handler   // Serves each request with the router of its snapshot
+	router              *mux.Router    // Routes of the configuration, rebuilt on reload
+	servers             []*http.Server // Started by StartServer, stopped by Shutdown
 	healthy             bool
 }
 
@@ -46,90 +64,493 @@ func main() {
 
 	app := App{}
 	app.WithConfig().
+		WithSecrets().
 		WithSAT().
 		WithTLSConfig().
 		WithJWKS().
 		WithLabelStore().
 		WithProxies().
+		WithBackendLabelCheck().
+		WithAudit().
 		WithHealthz().
 		WithRoutes().
 		StartServer()
 
 	log.Info().Any("config", app.Cfg)
 	log.Info().Msg("------Init Complete------")
-	select {}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	log.Info().Msg("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := app.Shutdown(ctx); err != nil {
+		log.Error().Err(err).Msg("Error while shutting down")
+	}
 }
 
-// StartServer starts the HTTP server for the proxy and metrics.
+// shutdownTimeout bounds how long Shutdown waits for in-flight requests on termination.
+const shutdownTimeout = 10 * time.Second
+
+// StartServer starts the HTTP server for the proxy and metrics. Each listens on its Unix
+// domain socket if one is configured, and on its TCP port on the host otherwise.
 func (a *App) StartServer() {
+	metricsListener, err := listen(a.Cfg.Web.Host, a.Cfg.Web.MetricsPort, a.Cfg.Web.MetricsSocket)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error while listening for metrics")
+	}
+	mdlw := middleware.New(middleware.Config{
+		Recorder: metrics.NewRecorder(metrics.Config{}),
+		Service:  "lgtm_lbac_proxy",
+	})
+	proxyListener, err := listen(a.Cfg.Web.Host, a.Cfg.Web.ProxyPort, a.Cfg.Web.ProxySocket)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error while listening for proxy")
+	}
+
+	metricsServer := a.newServer(a.i)
+	proxyServer := a.newServer(std.Handler("/", mdlw, a.e))
+	a.servers = []*http.Server{metricsServer, proxyServer}
+
 	go func() {
-		if err := http.ListenAndServe(fmt.Sprintf("%s:%d", a.Cfg.Web.Host, a.Cfg.Web.MetricsPort), a.i); err != nil {
+		if err := metricsServer.Serve(metricsListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatal().Err(err).Msg("Error while serving metrics")
 		}
 	}()
 
 	go func() {
-		mdlw := middleware.New(middleware.Config{
-			Recorder: metrics.NewRecorder(metrics.Config{}),
-			Service:  "lgtm_lbac_proxy",
-		})
-
-		if err := http.ListenAndServe(fmt.Sprintf("%s:%d", a.Cfg.Web.Host, a.Cfg.Web.ProxyPort), std.Handler("/", mdlw, a.e)); err != nil {
+		if err := proxyServer.Serve(proxyListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatal().Err(err).Msg("Error while serving proxy")
 		}
 	}()
 }
 
+// Defaults of the server timeouts, see WebConfig.
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+)
+
+// newServer returns a server of handler with the configured timeouts.
+func (a *App) newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: timeoutOrDefault(a.Cfg.Web.ReadHeaderTimeout, defaultReadHeaderTimeout),
+		ReadTimeout:       a.Cfg.Web.ReadTimeout,
+		WriteTimeout:      a.Cfg.Web.WriteTimeout,
+		IdleTimeout:       timeoutOrDefault(a.Cfg.Web.IdleTimeout, defaultIdleTimeout),
+	}
+}
+
+// timeoutOrDefault returns the default of an unset timeout; a negative one disables it.
+func timeoutOrDefault(timeout, def time.Duration) time.Duration {
+	switch {
+	case timeout < 0:
+		return 0
+	case timeout == 0:
+		return def
+	default:
+		return timeout
+	}
+}
+
+// Shutdown gracefully stops the servers started by StartServer, waiting for in-flight
+// requests until ctx is done. Closing a Unix domain socket listener removes its socket file.
+func (a *App) Shutdown(ctx context.Context) error {
+	var errs []error
+	for _, server := range a.servers {
+		errs = append(errs, server.Shutdown(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// listen listens on the Unix domain socket at socket if set, and on port of host otherwise.
+// A socket file left behind by a process that did not shut down cleanly is removed first,
+// as it would make listening fail; other files at socket are never removed.
+func listen(host string, port int, socket string) (net.Listener, error) {
+	if socket == "" {
+		return net.Listen("tcp", fmt.Sprintf("%s:%d", host, port))
+	}
+	if info, err := os.Stat(socket); err == nil && info.Mode().Type() == os.ModeSocket {
+		if err := os.Remove(socket); err != nil {
+			return nil, fmt.Errorf("error removing stale socket %s: %w", socket, err)
+		}
+	}
+	log.Info().Str("socket", socket).Msg("Listening on Unix domain socket")
+	return net.Listen("unix", socket)
+}
+
+// responseHeaderDenylist lists headers that are always removed from upstream responses.
+// They carry credentials the proxy or the client sent upstream and must never reach clients.
+var responseHeaderDenylist = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"X-Forwarded-Access-Token",
+	"X-Id-Token",
+	"X-Plugin-Id",
+}
+
+// traceContextHeaders lists the W3C Trace Context and B3 headers. They are forwarded to the
+// upstream unchanged, whether or not tracing is enabled in the proxy, so that traces started
+// by clients continue in the upstream.
+var traceContextHeaders = []string{
+	"Traceparent",
+	"Tracestate",
+	"B3",
+	"X-B3-Traceid",
+	"X-B3-Spanid",
+	"X-B3-Parentspanid",
+	"X-B3-Sampled",
+	"X-B3-Flags",
+}
+
+// upstreamProxy is the reverse proxy of an upstream together with the proxy configuration it
+// was built with. It is replaced as a whole when the proxy configuration is reloaded.
+type upstreamProxy struct {
+	*httputil.ReverseProxy
+	cfg    ProxyConfig
+	routes map[string]*upstreamProxy // Proxies of routes with their own upstream URL, keyed by lowercased route pattern
+}
+
+// forRoute returns the proxy of the route pattern, which is p unless the route has its own
+// upstream URL.
+func (p *upstreamProxy) forRoute(pattern string) *upstreamProxy {
+	if route, ok := p.routes[strings.ToLower(pattern)]; ok {
+		return route
+	}
+	return p
+}
+
 // WithProxies initializes reverse proxy instances for each configured upstream.
 // Each proxy gets its own dedicated transport with per-upstream configuration.
 func (a *App) WithProxies() *App {
 	log.Info().Msg("Initializing reverse proxies")
+	if a.mu == nil {
+		a.mu = &sync.RWMutex{}
+	}
+	if a.coalesced == nil {
+		a.coalesced = &singleflight.Group{}
+	}
 
+	var err error
 	// Initialize Loki proxy if URL is configured
 	if a.Cfg.Loki.URL != "" {
-		proxyCfg := a.Cfg.GetProxyConfig(a.Cfg.Loki.Proxy)
-		transport := a.createTransport(proxyCfg, a.TlS)
-		a.lokiProxy = a.createProxy(a.Cfg.Loki.URL, a.Cfg.Loki.ActorHeader, transport, "loki")
+		if a.lokiProxy, err = a.newUpstreamProxy("loki"); err != nil {
+			log.Fatal().Err(err).Str("upstream", "loki").Msg("Invalid proxy configuration")
+		}
+		if a.lokiShadow, err = a.newLokiShadow(a.lokiProxy.cfg); err != nil {
+			log.Fatal().Err(err).Str("upstream", "loki").Msg("Invalid shadow configuration")
+		}
 		log.Info().
 			Str("url", a.Cfg.Loki.URL).
-			Dur("request_timeout", proxyCfg.RequestTimeout).
-			Int("max_idle_conns_per_host", proxyCfg.MaxIdleConnsPerHost).
+			Dur("request_timeout", a.lokiProxy.cfg.RequestTimeout).
+			Int("max_idle_conns_per_host", a.lokiProxy.cfg.MaxIdleConnsPerHost).
+			Dur("flush_interval", a.lokiProxy.cfg.FlushInterval).
+			Str("shadow_url", a.Cfg.Loki.Shadow.URL).
+			Any("route_urls", a.Cfg.Loki.RouteURLs).
 			Msg("Loki proxy initialized")
 	}
 
 	// Initialize Thanos proxy if URL is configured
 	if a.Cfg.Thanos.URL != "" {
-		proxyCfg := a.Cfg.GetProxyConfig(a.Cfg.Thanos.Proxy)
-		transport := a.createTransport(proxyCfg, a.TlS)
-		a.thanosProxy = a.createProxy(a.Cfg.Thanos.URL, a.Cfg.Thanos.ActorHeader, transport, "thanos")
+		if a.thanosProxy, err = a.newUpstreamProxy("thanos"); err != nil {
+			log.Fatal().Err(err).Str("upstream", "thanos").Msg("Invalid proxy configuration")
+		}
 		log.Info().
 			Str("url", a.Cfg.Thanos.URL).
-			Dur("request_timeout", proxyCfg.RequestTimeout).
-			Int("max_idle_conns_per_host", proxyCfg.MaxIdleConnsPerHost).
+			Dur("request_timeout", a.thanosProxy.cfg.RequestTimeout).
+			Int("max_idle_conns_per_host", a.thanosProxy.cfg.MaxIdleConnsPerHost).
+			Dur("flush_interval", a.thanosProxy.cfg.FlushInterval).
 			Msg("Thanos proxy initialized")
 	}
 
 	// Initialize Tempo proxy if URL is configured
 	if a.Cfg.Tempo.URL != "" {
-		proxyCfg := a.Cfg.GetProxyConfig(a.Cfg.Tempo.Proxy)
-		transport := a.createTransport(proxyCfg, a.TlS)
-		a.tempoProxy = a.createProxy(a.Cfg.Tempo.URL, a.Cfg.Tempo.ActorHeader, transport, "tempo")
+		if a.tempoProxy, err = a.newUpstreamProxy("tempo"); err != nil {
+			log.Fatal().Err(err).Str("upstream", "tempo").Msg("Invalid proxy configuration")
+		}
 		log.Info().
 			Str("url", a.Cfg.Tempo.URL).
-			Dur("request_timeout", proxyCfg.RequestTimeout).
-			Int("max_idle_conns_per_host", proxyCfg.MaxIdleConnsPerHost).
+			Dur("request_timeout", a.tempoProxy.cfg.RequestTimeout).
+			Int("max_idle_conns_per_host", a.tempoProxy.cfg.MaxIdleConnsPerHost).
+			Dur("flush_interval", a.tempoProxy.cfg.FlushInterval).
 			Msg("Tempo proxy initialized")
 	}
 
 	return a
 }
 
+// newUpstreamProxy builds the reverse proxy of the named upstream, with a new transport,
+// from the current configuration. Loki routes with their own upstream URL get a reverse
+// proxy of their own, sharing the transport.
+func (a *App) newUpstreamProxy(upstream string) (*upstreamProxy, error) {
+	var targetURL, actorHeader, actorFormat, trailingSlash string
+	var headers map[string]string
+	var override *ProxyConfig
+	switch upstream {
+	case "loki":
+		targetURL, actorHeader, actorFormat, trailingSlash = a.Cfg.Loki.URL, a.Cfg.Loki.ActorHeader, a.Cfg.Loki.ActorFormat, a.Cfg.Loki.NormalizeTrailingSlash
+		headers, override = a.Cfg.Loki.Headers, a.Cfg.Loki.Proxy
+	case "thanos":
+		targetURL, actorHeader, actorFormat, trailingSlash = a.Cfg.Thanos.URL, a.Cfg.Thanos.ActorHeader, a.Cfg.Thanos.ActorFormat, a.Cfg.Thanos.NormalizeTrailingSlash
+		headers, override = a.Cfg.Thanos.Headers, a.Cfg.Thanos.Proxy
+	case "tempo":
+		targetURL, actorHeader, actorFormat, trailingSlash = a.Cfg.Tempo.URL, a.Cfg.Tempo.ActorHeader, a.Cfg.Tempo.ActorFormat, a.Cfg.Tempo.NormalizeTrailingSlash
+		headers, override = a.Cfg.Tempo.Headers, a.Cfg.Tempo.Proxy
+	}
+	proxyCfg := a.Cfg.GetProxyConfig(override)
+	baseTransport, err := a.createTransport(proxyCfg, a.TlS)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := newResilientTransport(trackTransport(baseTransport, upstream), proxyCfg, upstream)
+	if err != nil {
+		return nil, err
+	}
+	reverseProxy, err := a.createProxy(targetURL, actorHeader, actorFormat, headers, trailingSlash, transport, proxyCfg.FlushInterval, upstream)
+	if err != nil {
+		return nil, err
+	}
+	proxy := &upstreamProxy{ReverseProxy: reverseProxy, cfg: proxyCfg}
+	if upstream == "loki" && len(a.Cfg.Loki.RouteURLs) > 0 {
+		proxy.routes = make(map[string]*upstreamProxy, len(a.Cfg.Loki.RouteURLs))
+		for pattern, routeURL := range a.Cfg.Loki.RouteURLs {
+			routeProxy, err := a.createProxy(routeURL, actorHeader, actorFormat, headers, trailingSlash, transport, proxyCfg.FlushInterval, upstream)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %w", pattern, err)
+			}
+			proxy.routes[strings.ToLower(pattern)] = &upstreamProxy{ReverseProxy: routeProxy, cfg: proxyCfg}
+		}
+	}
+	return proxy, nil
+}
+
+// newLokiShadow returns the Loki shadow of the current configuration, with a transport of
+// its own configured by proxyCfg, or nil if no shadow URL is configured.
+func (a *App) newLokiShadow(proxyCfg ProxyConfig) (*shadowUpstream, error) {
+	if a.Cfg.Loki.Shadow.URL == "" {
+		return nil, nil
+	}
+	transport, err := a.createTransport(proxyCfg, a.TlS)
+	if err != nil {
+		return nil, err
+	}
+	return newShadowUpstream(a.Cfg.Loki.Shadow, transport, proxyCfg.RequestTimeout, "loki")
+}
+
+// snapshot returns a copy of the App with the configuration, proxies and shadows current at
+// the time of the call. Request handlers use it throughout the request, so that a reload
+// cannot change them midway.
+func (a *App) snapshot() *App {
+	if a.mu == nil {
+		return a
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	snapshot := *a
+	return &snapshot
+}
+
+// requestApp returns the snapshot of the App a request is served with, taken once when a.e
+// routes it, so that the handlers, the proxy and its response handling of the request all use
+// the same configuration. Requests not routed by a.e get a new snapshot.
+func requestApp(r *http.Request, a *App) *App {
+	if snapshot, ok := r.Context().Value(appContextKey).(*App); ok {
+		return snapshot
+	}
+	return a.snapshot()
+}
+
+// proxyFor returns the current reverse proxy of the named upstream.
+func (a *App) proxyFor(upstream string) *upstreamProxy {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	switch upstream {
+	case "loki":
+		return a.lokiProxy
+	case "thanos":
+		return a.thanosProxy
+	case "tempo":
+		return a.tempoProxy
+	}
+	return nil
+}
+
+// reloadProxies rebuilds the proxies of the upstreams whose proxy configuration changed, so
+// that timeouts and pool sizes apply without a restart, builds those of upstreams added to
+// the configuration and drops those of removed ones. Requests in flight complete on the proxy
+// they started with; idle connections of replaced transports are closed. If any proxy cannot
+// be built, none is replaced.
+func (a *App) reloadProxies() error {
+	if a.mu == nil {
+		return nil // Proxies are not initialized yet
+	}
+	next := a.snapshot()
+	replaced, err := next.rebuildProxies()
+	if err != nil {
+		return err
+	}
+	a.replace(next, replaced)
+	return nil
+}
+
+// rebuildProxies rebuilds the proxies of a whose proxy configuration differs from a.Cfg, or
+// that a.Cfg adds or removes, in place. a must be a snapshot no request uses yet. It returns
+// the replaced proxies by upstream, nil for added ones.
+func (a *App) rebuildProxies() (map[string]*upstreamProxy, error) {
+	replaced := make(map[string]*upstreamProxy)
+	for _, upstream := range []string{"loki", "thanos", "tempo"} {
+		var targetURL string
+		var override *ProxyConfig
+		var current **upstreamProxy
+		switch upstream {
+		case "loki":
+			targetURL, override, current = a.Cfg.Loki.URL, a.Cfg.Loki.Proxy, &a.lokiProxy
+		case "thanos":
+			targetURL, override, current = a.Cfg.Thanos.URL, a.Cfg.Thanos.Proxy, &a.thanosProxy
+		case "tempo":
+			targetURL, override, current = a.Cfg.Tempo.URL, a.Cfg.Tempo.Proxy, &a.tempoProxy
+		}
+		if targetURL == "" {
+			if *current != nil {
+				replaced[upstream] = *current
+				*current = nil
+				if upstream == "loki" {
+					a.lokiShadow = nil
+				}
+			}
+			continue
+		}
+		if *current != nil && reflect.DeepEqual((*current).cfg, a.Cfg.GetProxyConfig(override)) {
+			if upstream == "loki" && !a.lokiShadow.configuredBy(a.Cfg.Loki.Shadow) {
+				shadow, err := a.newLokiShadow((*current).cfg)
+				if err != nil {
+					return nil, fmt.Errorf("loki shadow: %w", err)
+				}
+				a.lokiShadow.closeIdleConnections()
+				a.lokiShadow = shadow
+			}
+			continue
+		}
+
+		next, err := a.newUpstreamProxy(upstream)
+		if err != nil {
+			return nil, fmt.Errorf("%s proxy: %w", upstream, err)
+		}
+		if upstream == "loki" {
+			if a.lokiShadow, err = a.newLokiShadow(next.cfg); err != nil {
+				return nil, fmt.Errorf("loki shadow: %w", err)
+			}
+		}
+		replaced[upstream] = *current
+		*current = next
+	}
+	return replaced, nil
+}
+
+// replace replaces the configuration, router, proxies and shadows of a with those of next,
+// a snapshot of a prepared by applyConfig or reloadProxies, and closes the idle connections
+// of the replaced proxies.
+func (a *App) replace(next *App, replaced map[string]*upstreamProxy) {
+	a.mu.Lock()
+	a.Cfg = next.Cfg
+	if next.router != nil {
+		a.router = next.router
+	}
+	a.lokiProxy, a.thanosProxy, a.tempoProxy = next.lokiProxy, next.thanosProxy, next.tempoProxy
+	a.lokiShadow = next.lokiShadow
+	a.healthy = next.healthy
+	a.mu.Unlock()
+
+	for upstream, current := range replaced {
+		if current != nil {
+			if transport, ok := current.Transport.(interface{ CloseIdleConnections() }); ok {
+				transport.CloseIdleConnections()
+			}
+		}
+		next := a.proxyFor(upstream)
+		if next == nil {
+			log.Info().Str("upstream", upstream).Msg("Proxy removed")
+			continue
+		}
+		cfg := next.cfg
+		log.Info().
+			Str("upstream", upstream).
+			Dur("request_timeout", cfg.RequestTimeout).
+			Int("max_idle_conns_per_host", cfg.MaxIdleConnsPerHost).
+			Dur("flush_interval", cfg.FlushInterval).
+			Msg("Proxy configuration reloaded")
+	}
+}
+
+// Trailing slash normalization modes
+const (
+	TrailingSlashAdd   = "add"   // Append a trailing slash to paths without one
+	TrailingSlashStrip = "strip" // Remove the trailing slash from paths other than "/"
+)
+
+// normalizeTrailingSlash adds or strips the trailing slash of path according to mode.
+// An empty mode leaves the path unchanged.
+func normalizeTrailingSlash(path string, mode string) (string, error) {
+	switch mode {
+	case "":
+		return path, nil
+	case TrailingSlashAdd:
+		if !strings.HasSuffix(path, "/") {
+			path += "/"
+		}
+		return path, nil
+	case TrailingSlashStrip:
+		if len(path) > 1 {
+			path = strings.TrimRight(path, "/")
+			if path == "" {
+				path = "/"
+			}
+		}
+		return path, nil
+	default:
+		return path, fmt.Errorf("invalid normalize_trailing_slash %q: must be add, strip, or empty", mode)
+	}
+}
+
 // createProxy creates a reverse proxy with custom Director, ErrorHandler, and ModifyResponse.
 // Using direct ReverseProxy instantiation instead of NewSingleHostReverseProxy for better control.
-func (a *App) createProxy(targetURL string, actorHeader string, transport *http.Transport, upstream string) *httputil.ReverseProxy {
+// Headers the proxy injects into upstream requests (headers, actorHeader) are stripped from
+// responses together with responseHeaderDenylist, so an upstream echoing them cannot leak them.
+// Response bodies are streamed to the client and flushed every flushInterval (negative flushes
+// after every write); ModifyResponse must therefore never read or wrap resp.Body, except for
+// the small label values responses rewritten by filterLabelValuesResponse, the trace by ID
+// responses verified by verifyTraceTenantResponse and the non-JSON error responses rewritten
+// by rewriteErrorResponse. It returns an error if the URL, actor format or trailing slash
+// normalization is invalid.
+func (a *App) createProxy(targetURL string, actorHeader string, actorFormat string, headers map[string]string, trailingSlash string, transport http.RoundTripper, flushInterval time.Duration, upstream string) (*httputil.ReverseProxy, error) {
 	target, err := url.Parse(targetURL)
 	if err != nil {
-		log.Fatal().Err(err).Str("url", targetURL).Str("upstream", upstream).Msg("Failed to parse upstream URL")
+		return nil, fmt.Errorf("invalid upstream URL: %w", err)
+	}
+	if actorHeader != "" {
+		if _, err := formatActorHeader(actorFormat, "", "", ""); err != nil {
+			return nil, fmt.Errorf("invalid actor header format: %w", err)
+		}
+	}
+	if _, err := normalizeTrailingSlash("/", trailingSlash); err != nil {
+		return nil, err
+	}
+
+	for k := range headers {
+		if slices.Contains(traceContextHeaders, http.CanonicalHeaderKey(k)) {
+			log.Warn().Str("header", k).Str("upstream", upstream).Msg("Configured header overrides the trace context of every request")
+		}
+	}
+
+	stripHeaders := append([]string{}, responseHeaderDenylist...)
+	if actorHeader != "" {
+		stripHeaders = append(stripHeaders, actorHeader)
+	}
+	for k := range headers {
+		stripHeaders = append(stripHeaders, k)
 	}
 
 	proxy := &httputil.ReverseProxy{
@@ -138,17 +559,29 @@ func (a *App) createProxy(targetURL string, actorHeader string, transport *http.
 			req.URL.Scheme = target.Scheme
 			req.URL.Host = target.Host
 			req.Host = target.Host
+			if trailingSlash != "" {
+				req.URL.Path, _ = normalizeTrailingSlash(req.URL.Path, trailingSlash)
+				if req.URL.RawPath != "" {
+					req.URL.RawPath, _ = normalizeTrailingSlash(req.URL.RawPath, trailingSlash)
+				}
+			}
 
-			// Inject actor header if configured (base64 encoded username for fair usage tracking)
+			// Inject actor header if configured (formatted user identity for fair usage tracking)
 			if actorHeader != "" {
-				if username, ok := req.Context().Value("username").(string); ok && username != "" {
-					req.Header.Set(actorHeader, username)
-				} else if email, ok := req.Context().Value("email").(string); ok && email != "" {
-					req.Header.Set(actorHeader, email)
+				username, _ := req.Context().Value(usernameContextKey).(string)
+				email, _ := req.Context().Value(emailContextKey).(string)
+				claim, _ := req.Context().Value(actorClaimContextKey).(string)
+				if username != "" || email != "" || claim != "" {
+					value, err := formatActorHeader(actorFormat, username, email, claim)
+					if err != nil {
+						requestLogger(req).Error().Err(err).Str("upstream", upstream).Msg("Error while formatting actor header")
+					} else if value != "" {
+						req.Header.Set(actorHeader, value)
+					}
 				}
 			}
 
-			log.Debug().
+			requestLogger(req).Debug().
 				Str("upstream", upstream).
 				Str("method", req.Method).
 				Str("path", req.URL.Path).
@@ -157,7 +590,28 @@ func (a *App) createProxy(targetURL string, actorHeader string, transport *http.
 
 		// Custom ErrorHandler with detailed logging per upstream
 		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
-			log.Error().
+			if errors.Is(err, ErrTraceTenantDenied) {
+				username, _ := r.Context().Value(usernameContextKey).(string)
+				email, _ := r.Context().Value(emailContextKey).(string)
+				requestApp(r, a).writeDenied(w, upstream, OAuthToken{PreferredUsername: username, Email: email}, err)
+				return
+			}
+			if errors.Is(err, ErrUpstreamUnavailable) {
+				requestLogger(r).Warn().Str("upstream", upstream).Str("path", r.URL.Path).Msg("Circuit breaker open, request rejected")
+				logAndWriteError(w, http.StatusServiceUnavailable, err, "")
+				return
+			}
+			if errors.Is(err, ErrInvalidUpstreamResponse) {
+				requestLogger(r).Error().
+					Err(err).
+					Str("upstream", upstream).
+					Str("method", r.Method).
+					Str("path", r.URL.Path).
+					Msg("Invalid upstream response")
+				logAndWriteError(w, http.StatusInternalServerError, err, "")
+				return
+			}
+			requestLogger(r).Error().
 				Err(err).
 				Str("upstream", upstream).
 				Str("method", r.Method).
@@ -166,9 +620,26 @@ func (a *App) createProxy(targetURL string, actorHeader string, transport *http.
 			http.Error(w, "Bad Gateway", http.StatusBadGateway)
 		},
 
-		// ModifyResponse for response inspection and metrics logging
+		// ModifyResponse for response inspection, metrics logging and header stripping
 		ModifyResponse: func(resp *http.Response) error {
-			log.Debug().
+			if err := filterLabelValuesResponse(resp); err != nil {
+				return err
+			}
+			if err := verifyTraceTenantResponse(resp); err != nil {
+				return err
+			}
+			if requestApp(resp.Request, a).rewriteErrorResponses(upstream) {
+				if err := rewriteErrorResponse(resp, upstream); err != nil {
+					return err
+				}
+			}
+			for _, h := range stripHeaders {
+				if resp.Header.Get(h) != "" {
+					requestLogger(resp.Request).Warn().Str("upstream", upstream).Str("header", h).Msg("Stripped sensitive header from upstream response")
+					resp.Header.Del(h)
+				}
+			}
+			requestLogger(resp.Request).Debug().
 				Str("upstream", upstream).
 				Int("status", resp.StatusCode).
 				Str("content_length", resp.Header.Get("Content-Length")).
@@ -176,8 +647,9 @@ func (a *App) createProxy(targetURL string, actorHeader string, transport *http.
 			return nil
 		},
 
-		Transport: transport,
+		Transport:     transport,
+		FlushInterval: flushInterval,
 	}
 
-	return proxy
+	return proxy, nil
 }
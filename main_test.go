@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -9,14 +11,22 @@ import (
 	"encoding/base64"
 	"encoding/pem"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/rs/zerolog/log"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -133,6 +143,16 @@ func setupTestMainWithPrivateKey() (App, map[string]string, *ecdsa.PrivateKey) {
 			Email:    "testmail",
 			Groups:   []string{"group1"},
 		},
+		{
+			name:     "usernameOnly",
+			Username: "user",
+			Groups:   []string{},
+		},
+		{
+			name:   "emailOnly",
+			Email:  "test@email.com",
+			Groups: []string{"group1"},
+		},
 	}
 	tokens := make(map[string]string, len(jwks))
 	for _, jwk := range jwks {
@@ -225,6 +245,7 @@ func setupTestMainWithPrivateKey() (App, map[string]string, *ecdsa.PrivateKey) {
 	cmh := FileLabelStore{
 		parser:      parser,
 		policyCache: policyCache,
+		entries:     len(policyCache),
 	}
 
 	app.LabelStore = &cmh
@@ -276,7 +297,7 @@ func Test_reverseProxy(t *testing.T) {
 			setAuthorization: true,
 			URL:              "/api/v1/query_range",
 			authorization:    "Bearer " + "skk",
-			expectedBody:     "error parsing token\n",
+			expectedBody:     "error parsing token: token is malformed: token contains an invalid number of segments\n",
 		},
 		{
 			name:             "Missing_tenant_labels_for_user",
@@ -374,14 +395,30 @@ func Test_reverseProxy(t *testing.T) {
 			expectedStatus:   http.StatusForbidden,
 			expectedBody:     "unauthorized tenant_id",
 		},
-		//{
-		//	name:             "Email_query",
-		//	authorization:    "Bearer " + tokens["userWithOutProperEmail"],
-		//	setAuthorization: true,
-		//	URL:              "/loki/api/v1/query?&query=up",
-		//	expectedStatus:   http.StatusOK,
-		//	expectedBody:     "Upstream server response\n",
-		//},
+		{
+			name:             "Email_query",
+			authorization:    "Bearer " + tokens["userWithOutProperEmail"],
+			setAuthorization: true,
+			URL:              "/api/v1/query?query=up",
+			expectedStatus:   http.StatusOK,
+			expectedBody:     "Upstream server response\n",
+		},
+		{
+			name:             "Username_only_query",
+			authorization:    "Bearer " + tokens["usernameOnly"],
+			setAuthorization: true,
+			URL:              "/api/v1/query?query=up",
+			expectedStatus:   http.StatusOK,
+			expectedBody:     "Upstream server response\n",
+		},
+		{
+			name:             "Email_only_query",
+			authorization:    "Bearer " + tokens["emailOnly"],
+			setAuthorization: true,
+			URL:              "/api/v1/query?query=up",
+			expectedStatus:   http.StatusOK,
+			expectedBody:     "Upstream server response\n",
+		},
 	}
 
 	app.WithRoutes()
@@ -460,7 +497,7 @@ func TestAlertAuth(t *testing.T) {
 			setAuthorization: true,
 			URL:              "/api/v1/query_range",
 			authorization:    "Bearer skk",
-			expectedBody:     "error parsing token\n",
+			expectedBody:     "error parsing token: token is malformed: token contains an invalid number of segments\n",
 		},
 		{
 			name:             "Missing_tenant_labels_for_user",
@@ -592,6 +629,57 @@ func TestAlertAuth(t *testing.T) {
 	}
 }
 
+func TestAlertAuth_AllowedPaths(t *testing.T) {
+	app, tokens := setupTestMain()
+	app.Cfg.Alert.Enabled = true
+	app.Cfg.Alert.TokenHeader = "X-LGTM-Alert-Token"
+	app.Cfg.Alert.AllowedPaths = []string{"/api/v1/query", "/loki/api/v1/*"}
+	app.WithRoutes()
+
+	cases := []struct {
+		name           string
+		header         string
+		URL            string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "alert token on allowed path", header: app.Cfg.Alert.TokenHeader, URL: "/api/v1/query?query=up", expectedStatus: http.StatusOK},
+		{name: "alert token on allowed path pattern", header: app.Cfg.Alert.TokenHeader, URL: "/loki/api/v1/query_range?query={app=\"api\"}", expectedStatus: http.StatusOK},
+		{name: "alert token on disallowed path", header: app.Cfg.Alert.TokenHeader, URL: "/api/v1/query_range?query=up", expectedStatus: http.StatusForbidden, expectedBody: "X-LGTM-Alert-Token header not accepted on /api/v1/query_range\n"},
+		{name: "authorization header on disallowed path", header: "Authorization", URL: "/api/v1/query_range?query=up", expectedStatus: http.StatusOK},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.URL, nil)
+			req.Header.Set(tc.header, "Bearer "+tokens["userTenant"])
+			rr := httptest.NewRecorder()
+			app.e.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.expectedStatus, rr.Code)
+			if tc.expectedBody != "" {
+				assert.Equal(t, tc.expectedBody, rr.Body.String())
+			}
+		})
+	}
+
+	t.Run("disallowed path is a token error", func(t *testing.T) {
+		counter := authFailuresTotal.WithLabelValues(TokenPathNotAllowed)
+		before := testutil.ToFloat64(counter)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query_range?query=up", nil)
+		req.Header.Set(app.Cfg.Alert.TokenHeader, "Bearer "+tokens["userTenant"])
+		_, err := getToken(req, &app)
+		assert.Equal(t, TokenPathNotAllowed, tokenErrorReason(err))
+
+		app.Cfg.Auth.TokenErrorStatus = map[string]int{TokenPathNotAllowed: http.StatusUnauthorized}
+		rr := httptest.NewRecorder()
+		app.e.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Equal(t, before+1, testutil.ToFloat64(counter))
+	})
+}
+
 func TestIsAdminSkip(t *testing.T) {
 	a := assert.New(t)
 
@@ -845,6 +933,34 @@ func TestProxyUsesDirectReverseProxy(t *testing.T) {
 	}
 }
 
+func TestUnmarshalConfig_StrictConfig(t *testing.T) {
+	const config = `
+web:
+  strict_config: %t
+thanos:
+  url: http://thanos:9090
+  tenent_label: namespace
+`
+	for _, strict := range []bool{false, true} {
+		t.Run(strconv.FormatBool(strict), func(t *testing.T) {
+			v := viper.NewWithOptions(viper.KeyDelimiter("::"))
+			v.SetConfigType("yaml")
+			assert.NoError(t, v.ReadConfig(bytes.NewBufferString(fmt.Sprintf(config, strict))))
+
+			cfg := &Config{}
+			err := unmarshalConfig(v, cfg)
+
+			if strict {
+				assert.ErrorContains(t, err, "tenent_label")
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "http://thanos:9090", cfg.Thanos.URL)
+			assert.Empty(t, cfg.Thanos.TenantLabel)
+		})
+	}
+}
+
 // TestGetProxyConfigDefaults tests default proxy configuration values
 func TestGetProxyConfigDefaults(t *testing.T) {
 	cfg := &Config{}
@@ -858,6 +974,9 @@ func TestGetProxyConfigDefaults(t *testing.T) {
 	assert.Equal(t, 500, proxyCfg.MaxIdleConns, "MaxIdleConns should be 500")
 	assert.Equal(t, 100, proxyCfg.MaxIdleConnsPerHost, "MaxIdleConnsPerHost should be 100")
 	assert.True(t, proxyCfg.ForceHTTP2, "ForceHTTP2 should be true")
+	assert.Equal(t, 30*time.Second, proxyCfg.KeepAlive, "KeepAlive should be 30s")
+	assert.Zero(t, proxyCfg.HTTP2PingInterval, "HTTP2PingInterval should be disabled")
+	assert.Equal(t, time.Duration(-1), proxyCfg.FlushInterval, "FlushInterval should flush after every write")
 }
 
 // TestGetProxyConfigGlobalOverrides tests global proxy configuration overrides
@@ -894,8 +1013,9 @@ func TestGetProxyConfigUpstreamOverrides(t *testing.T) {
 	}
 
 	upstreamCfg := &ProxyConfig{
-		RequestTimeout:      300 * time.Second, // Override for slow queries
-		MaxIdleConnsPerHost: 50,                // Override for lower volume
+		RequestTimeout:      300 * time.Second,      // Override for slow queries
+		MaxIdleConnsPerHost: 50,                     // Override for lower volume
+		FlushInterval:       100 * time.Millisecond, // Override to batch flushes
 	}
 
 	// Get config with upstream-specific overrides
@@ -903,6 +1023,7 @@ func TestGetProxyConfigUpstreamOverrides(t *testing.T) {
 
 	assert.Equal(t, 300*time.Second, proxyCfg.RequestTimeout, "RequestTimeout should use upstream override")
 	assert.Equal(t, 50, proxyCfg.MaxIdleConnsPerHost, "MaxIdleConnsPerHost should use upstream override")
+	assert.Equal(t, 100*time.Millisecond, proxyCfg.FlushInterval, "FlushInterval should use upstream override")
 	// Other values should still use built-in or global defaults
 	assert.Equal(t, 90*time.Second, proxyCfg.IdleConnTimeout, "IdleConnTimeout should use built-in default")
 }
@@ -931,6 +1052,33 @@ func TestGetProxyConfigPrecedence(t *testing.T) {
 	assert.Equal(t, 90*time.Second, proxyCfg.IdleConnTimeout, "Built-in default should be used")
 }
 
+// TestGetProxyConfigRouteTimeouts tests that upstream route timeouts add to the global ones
+func TestGetProxyConfigRouteTimeouts(t *testing.T) {
+	cfg := &Config{
+		Proxy: ProxyConfig{
+			RouteTimeouts: map[string]time.Duration{
+				"/api/v1/query_range": 5 * time.Minute,
+				"/api/v1/labels":      10 * time.Second,
+			},
+		},
+	}
+
+	upstreamCfg := &ProxyConfig{
+		RouteTimeouts: map[string]time.Duration{
+			"/api/v1/labels":        5 * time.Second,
+			"/api/traces/{traceID}": 30 * time.Second,
+		},
+	}
+
+	proxyCfg := cfg.GetProxyConfig(upstreamCfg)
+
+	assert.Equal(t, 5*time.Minute, proxyCfg.requestTimeout("/api/v1/query_range"), "Global route timeout should apply")
+	assert.Equal(t, 5*time.Second, proxyCfg.requestTimeout("/api/v1/labels"), "Upstream route timeout should win")
+	assert.Equal(t, 30*time.Second, proxyCfg.requestTimeout("/api/traces/{traceID}"), "Route patterns should match case-insensitively")
+	assert.Equal(t, 60*time.Second, proxyCfg.requestTimeout("/api/v1/query"), "Other routes should use request_timeout")
+	assert.Equal(t, 10*time.Second, cfg.Proxy.RouteTimeouts["/api/v1/labels"], "Global route timeouts should not be modified")
+}
+
 // TestCreateTransport tests HTTP transport creation with proxy configuration
 func TestCreateTransport(t *testing.T) {
 	app := &App{}
@@ -945,7 +1093,8 @@ func TestCreateTransport(t *testing.T) {
 		ForceHTTP2:          true,
 	}
 
-	transport := app.createTransport(proxyCfg, tlsConfig)
+	transport, err := app.createTransport(proxyCfg, tlsConfig)
+	assert.NoError(t, err)
 
 	assert.NotNil(t, transport, "Transport should not be nil")
 	assert.Equal(t, tlsConfig, transport.TLSClientConfig, "TLS config should match")
@@ -958,6 +1107,83 @@ func TestCreateTransport(t *testing.T) {
 	assert.True(t, transport.ForceAttemptHTTP2, "ForceAttemptHTTP2 should match")
 }
 
+// TestCreateTransportKeepAlive tests that TCP keep-alive and HTTP/2 pings follow the proxy configuration
+func TestCreateTransportKeepAlive(t *testing.T) {
+	cfg := &Config{
+		Proxy: ProxyConfig{
+			KeepAlive:         60 * time.Second,
+			HTTP2PingInterval: 20 * time.Second,
+		},
+	}
+
+	proxyCfg := cfg.GetProxyConfig(nil)
+	assert.Equal(t, 60*time.Second, newDialer(proxyCfg).KeepAlive, "Dialer should use global keep-alive")
+
+	transport, err := (&App{}).createTransport(proxyCfg, &tls.Config{})
+	assert.NoError(t, err)
+	assert.NotNil(t, transport.DialContext, "Transport should dial with the configured dialer")
+	if assert.NotNil(t, transport.HTTP2, "HTTP/2 config should be set") {
+		assert.Equal(t, 20*time.Second, transport.HTTP2.SendPingTimeout, "HTTP/2 ping interval should match")
+	}
+
+	// A negative upstream keep-alive disables probes, overriding the global default
+	proxyCfg = cfg.GetProxyConfig(&ProxyConfig{KeepAlive: -1})
+	assert.Equal(t, time.Duration(-1), newDialer(proxyCfg).KeepAlive, "Upstream override should disable keep-alive")
+
+	// HTTP/2 pings are disabled by default
+	transport, _ = (&App{}).createTransport((&Config{}).GetProxyConfig(nil), &tls.Config{})
+	assert.Nil(t, transport.HTTP2, "HTTP/2 pings should be disabled by default")
+}
+
+// TestCreateTransportTLSSettings tests that the TLS minimum version and cipher suites are applied
+func TestCreateTransportTLSSettings(t *testing.T) {
+	app := &App{}
+	app.WithConfig()
+	app.Cfg.Proxy.TLSMinVersion = "1.2"
+	app.Cfg.Proxy.TLSCipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}
+	upstreamProxy := &ProxyConfig{TLSMinVersion: "1.3"}
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+
+	transport, err := app.createTransport(app.Cfg.GetProxyConfig(nil), tlsConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), transport.TLSClientConfig.MinVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, transport.TLSClientConfig.CipherSuites)
+	assert.True(t, transport.TLSClientConfig.InsecureSkipVerify, "Base TLS settings should be kept")
+
+	// Upstream override wins, global cipher suites still apply
+	transport, _ = app.createTransport(app.Cfg.GetProxyConfig(upstreamProxy), tlsConfig)
+	assert.Equal(t, uint16(tls.VersionTLS13), transport.TLSClientConfig.MinVersion)
+	assert.Len(t, transport.TLSClientConfig.CipherSuites, 2)
+
+	// The shared base config is never modified
+	assert.Zero(t, tlsConfig.MinVersion)
+	assert.Nil(t, tlsConfig.CipherSuites)
+
+	// Settings apply without a base config
+	transport, _ = app.createTransport(app.Cfg.GetProxyConfig(nil), nil)
+	assert.Equal(t, uint16(tls.VersionTLS12), transport.TLSClientConfig.MinVersion)
+}
+
+func TestApplyTLSSettings_Invalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		proxyCfg ProxyConfig
+		errMsg   string
+	}{
+		{name: "unknown version", proxyCfg: ProxyConfig{TLSMinVersion: "1.4"}, errMsg: "invalid tls_min_version"},
+		{name: "unknown cipher suite", proxyCfg: ProxyConfig{TLSCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", "TLS_FAKE"}}, errMsg: "unknown cipher suite TLS_FAKE"},
+		{name: "insecure cipher suite", proxyCfg: ProxyConfig{TLSCipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}, errMsg: "insecure"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := applyTLSSettings(&tls.Config{}, tt.proxyCfg)
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+}
+
 // TestEachUpstreamGetsOwnTransport verifies that each upstream has its own transport instance
 func TestEachUpstreamGetsOwnTransport(t *testing.T) {
 	app := &App{}
@@ -990,6 +1216,199 @@ func TestEachUpstreamGetsOwnTransport(t *testing.T) {
 	}
 }
 
+// TestReloadProxies tests that a changed proxy configuration rebuilds the transport of the
+// affected upstream only, while a request in flight completes on the previous transport.
+func TestReloadProxies(t *testing.T) {
+	arrived, release := make(chan struct{}), make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("wait") != "" {
+			close(arrived)
+			<-release
+		}
+		_, _ = fmt.Fprint(w, "ok")
+	}))
+	defer upstream.Close()
+
+	app, tokens := setupTestMain()
+	app.Cfg.Loki.URL = upstream.URL
+	app.Cfg.Thanos.URL = upstream.URL
+	app.WithProxies()
+	app.WithRoutes()
+
+	transportOf := func(p *upstreamProxy) *http.Transport { return p.Transport.(*poolTracker).transport }
+	oldLoki, oldThanos := app.lokiProxy, app.thanosProxy
+	assert.Equal(t, 100, transportOf(oldLoki).MaxIdleConnsPerHost)
+
+	inFlight := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest(http.MethodGet, "/loki/api/v1/query?query=%7Btenant_id%3D%22allowed_user%22%7D&wait=1", nil)
+		req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+		app.e.ServeHTTP(inFlight, req)
+	}()
+	<-arrived
+
+	app.Cfg.Loki.Proxy = &ProxyConfig{MaxIdleConnsPerHost: 7, RequestTimeout: 5 * time.Second}
+	assert.NoError(t, app.reloadProxies())
+
+	assert.NotSame(t, oldLoki, app.lokiProxy, "Loki proxy should be rebuilt")
+	assert.Equal(t, 7, transportOf(app.lokiProxy).MaxIdleConnsPerHost)
+	assert.Equal(t, 5*time.Second, app.proxyFor("loki").cfg.RequestTimeout)
+	assert.Same(t, oldThanos, app.thanosProxy, "Thanos proxy should be kept")
+
+	close(release)
+	<-done
+	assert.Equal(t, http.StatusOK, inFlight.Code)
+	assert.Equal(t, "ok", inFlight.Body.String())
+
+	// New requests use the new proxy
+	req := httptest.NewRequest(http.MethodGet, "/loki/api/v1/query?query=%7Btenant_id%3D%22allowed_user%22%7D", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+	rr := httptest.NewRecorder()
+	app.e.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// Reloading an unchanged configuration keeps the proxy
+	current := app.lokiProxy
+	assert.NoError(t, app.reloadProxies())
+	assert.Same(t, current, app.lokiProxy)
+}
+
+// TestReloadConfigWhileServing reloads the configuration while requests are served, which
+// the race detector checks for unsynchronized access to the replaced configuration.
+func TestReloadConfigWhileServing(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, "ok")
+	}))
+	defer upstream.Close()
+
+	app, tokens := setupTestMain()
+	app.Cfg.Loki.URL = upstream.URL
+	app.WithProxies()
+	app.WithHealthz()
+	app.WithRoutes()
+
+	v := viper.NewWithOptions(viper.KeyDelimiter("::"))
+	v.SetConfigName("config")
+	v.SetConfigType("yaml")
+	v.AddConfigPath("./configs")
+	assert.NoError(t, v.MergeInConfig())
+	v.Set("loki::url", upstream.URL)
+	v.Set("web::denied_message", "denied 1")
+	app.reloadConfig(v)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				req := httptest.NewRequest(http.MethodGet, "/loki/api/v1/query?query="+url.QueryEscape(`{tenant_id="forbidden_user"}`), nil)
+				req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+				rr := httptest.NewRecorder()
+				app.e.ServeHTTP(rr, req)
+				assert.Equal(t, http.StatusForbidden, rr.Code)
+				assert.Contains(t, []string{"denied 1", "denied 2"}, strings.TrimSpace(rr.Body.String()))
+
+				req = httptest.NewRequest(http.MethodGet, "/loki/api/v1/query?query="+url.QueryEscape(`{tenant_id="allowed_user"}`), nil)
+				req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+				rr = httptest.NewRecorder()
+				app.e.ServeHTTP(rr, req)
+				assert.Equal(t, http.StatusOK, rr.Code)
+			}
+		}()
+	}
+
+	for i := range 20 {
+		v.Set("web::denied_message", fmt.Sprintf("denied %d", i%2+1))
+		v.Set("loki::proxy::request_timeout", time.Duration(i%2+1)*time.Minute)
+		v.Set("loki::rewrite_error_responses", i%2 == 0)
+		app.reloadConfig(v)
+	}
+	close(stop)
+	wg.Wait()
+
+	assert.Equal(t, "denied 2", app.Cfg.Web.DeniedMessage)
+	assert.Equal(t, 2*time.Minute, app.proxyFor("loki").cfg.RequestTimeout)
+
+	// Route settings are reloaded with the rest of the configuration
+	push := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/loki/api/v1/push", strings.NewReader(`{"streams":[{"stream":{"tenant_id":"allowed_user"},"values":[]}]}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+		rr := httptest.NewRecorder()
+		app.e.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	assert.Equal(t, http.StatusNotFound, push())
+	v.Set("loki::push::enabled", true)
+	app.reloadConfig(v)
+	assert.Equal(t, http.StatusOK, push())
+
+	// An invalid configuration keeps the previous one and marks the proxy unhealthy
+	healthz := func() int {
+		rr := httptest.NewRecorder()
+		app.i.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		return rr.Code
+	}
+	port := app.Cfg.Web.ProxyPort
+	v.Set("web::proxy_port", "not-a-port")
+	cfg := app.Cfg
+	app.reloadConfig(v)
+	assert.Same(t, cfg, app.Cfg)
+	assert.Equal(t, http.StatusInternalServerError, healthz())
+	v.Set("web::proxy_port", port)
+
+	// So does a configuration failing validation, of the config, routes or proxies, and the
+	// previous one keeps serving
+	for key, value := range map[string]any{
+		"auth::token_error_status":      map[string]int{"expired": 500},
+		"debug::allow_header_log_level": true,
+		"web::not_found_format":         "xml",
+		"loki::auth_mode":               "bogus",
+		"loki::label_operators":         []string{"=", "~~"},
+		"loki::proxy::tls_min_version":  "0.9",
+		"loki::shadow::url":             upstream.URL,
+	} {
+		v.Set(key, value)
+		if key == "debug::allow_header_log_level" {
+			v.Set("debug::trusted_cidrs", []string{"not-a-cidr"})
+		}
+		if key == "loki::shadow::url" {
+			v.Set("loki::shadow::sample_rate", 2)
+		}
+		app.reloadConfig(v)
+		assert.Same(t, cfg, app.Cfg, key)
+		assert.Equal(t, http.StatusOK, push(), key)
+		v.Set(key, nil)
+		v.Set("debug::trusted_cidrs", nil)
+		v.Set("loki::shadow::sample_rate", nil)
+	}
+
+	// A valid configuration is loaded again, and upstreams added by a reload get a proxy
+	v.Set("thanos::url", "")
+	app.reloadConfig(v)
+	assert.NotSame(t, cfg, app.Cfg)
+	assert.Equal(t, http.StatusOK, healthz())
+	assert.Nil(t, app.proxyFor("thanos"))
+	v.Set("thanos::url", upstream.URL)
+	app.reloadConfig(v)
+	if assert.NotNil(t, app.proxyFor("thanos")) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query="+url.QueryEscape(`up{tenant_id="allowed_user"}`), nil)
+		req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+		rr := httptest.NewRecorder()
+		app.e.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	}
+}
+
 // TestBackwardCompatibilityMissingProxyConfig tests that missing proxy config sections work
 func TestBackwardCompatibilityMissingProxyConfig(t *testing.T) {
 	cfg := &Config{
@@ -1006,3 +1425,210 @@ func TestBackwardCompatibilityMissingProxyConfig(t *testing.T) {
 	assert.Equal(t, 60*time.Second, proxyCfg.RequestTimeout, "Should use built-in defaults")
 	assert.Equal(t, 100, proxyCfg.MaxIdleConnsPerHost, "Should use built-in defaults")
 }
+
+func TestProxyStripsSensitiveResponseHeaders(t *testing.T) {
+	echoUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Misbehaving upstream echoing request headers back to the client
+		for _, h := range []string{"Authorization", "X-Scope-OrgID", "X-Loki-User"} {
+			w.Header().Set(h, r.Header.Get(h))
+		}
+		w.Header().Set("X-Id-Token", "upstream-token")
+		w.Header().Set("X-Upstream-Info", "kept")
+		_, _ = fmt.Fprintln(w, "Upstream server response")
+	}))
+	defer echoUpstream.Close()
+
+	app, tokens := setupTestMain()
+	app.ServiceAccountToken = "service-account-token"
+	app.Cfg.Loki.URL = echoUpstream.URL
+	app.Cfg.Loki.Headers = map[string]string{"X-Scope-OrgID": "tenant-a"}
+	app.Cfg.Loki.ActorHeader = "X-Loki-User"
+	app.WithProxies()
+	app.WithRoutes()
+
+	req := httptest.NewRequest(http.MethodGet, "/loki/api/v1/query?query=%7Btenant_id%3D%22allowed_user%22%7D", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+	rr := httptest.NewRecorder()
+	app.e.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	for _, h := range []string{"Authorization", "X-Scope-OrgID", "X-Loki-User", "X-Id-Token"} {
+		assert.Empty(t, rr.Header().Get(h), "header %s must be stripped", h)
+	}
+	assert.Equal(t, "kept", rr.Header().Get("X-Upstream-Info"))
+}
+
+// flushRecorder records how many body bytes had been written at every Flush call.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushedAt []int
+}
+
+func (f *flushRecorder) Flush() {
+	f.flushedAt = append(f.flushedAt, f.Body.Len())
+	f.ResponseRecorder.Flush()
+}
+
+func TestProxyStreamsLargeResponses(t *testing.T) {
+	const chunkSize = 64 * 1024
+	const chunks = 64 // 4 MiB
+	chunk := bytes.Repeat([]byte("x"), chunkSize)
+
+	largeUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A known Content-Length disables the reverse proxy's implicit streaming flushes
+		w.Header().Set("Content-Length", strconv.Itoa(chunkSize*chunks))
+		for i := 0; i < chunks; i++ {
+			_, _ = w.Write(chunk)
+		}
+	}))
+	defer largeUpstream.Close()
+
+	app, tokens := setupTestMain()
+	app.Cfg.Loki.URL = largeUpstream.URL
+	app.WithProxies()
+	app.WithRoutes()
+
+	req := httptest.NewRequest(http.MethodGet, "/loki/api/v1/query?query=%7Btenant_id%3D%22allowed_user%22%7D", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+	rr := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	app.e.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, chunkSize*chunks, rr.Body.Len())
+	// The body must reach the client in many flushes, the first long before it is complete
+	assert.Greater(t, len(rr.flushedAt), chunks/2, "response should be flushed while streaming")
+	if assert.NotEmpty(t, rr.flushedAt) {
+		assert.Less(t, rr.flushedAt[0], chunkSize*chunks/4, "first flush should happen before the response is buffered")
+	}
+}
+
+func TestStreamingRouteFlushesIncrementally(t *testing.T) {
+	const chunkSize = 64 * 1024
+	const chunks = 16 // 1 MiB
+	chunk := bytes.Repeat([]byte("x"), chunkSize)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A known Content-Length disables the reverse proxy's implicit streaming flushes
+		w.Header().Set("Content-Length", strconv.Itoa(chunkSize*chunks))
+		for i := 0; i < chunks; i++ {
+			_, _ = w.Write(chunk)
+		}
+	}))
+	defer upstream.Close()
+
+	app, tokens := setupTestMain()
+	app.Cfg.Loki.URL = upstream.URL
+	// Batch flushes for regular routes, so that only streaming routes flush on every write
+	app.Cfg.Loki.Proxy = &ProxyConfig{FlushInterval: time.Hour}
+	app.WithProxies()
+	app.WithRoutes()
+
+	serve := func(path string) *flushRecorder {
+		req := httptest.NewRequest(http.MethodGet, path+"?query=%7Btenant_id%3D%22allowed_user%22%7D", nil)
+		req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+		rr := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		app.e.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, chunkSize*chunks, rr.Body.Len())
+		return rr
+	}
+
+	tail := serve("/loki/api/v1/tail")
+	assert.Greater(t, len(tail.flushedAt), 1, "streaming route should flush while streaming")
+	if assert.NotEmpty(t, tail.flushedAt) {
+		assert.Less(t, tail.flushedAt[0], chunkSize*chunks, "first flush should happen before the response is complete")
+	}
+
+	query := serve("/loki/api/v1/query")
+	assert.Empty(t, query.flushedAt, "regular route should honor the upstream flush interval")
+}
+
+func TestStartServer_UnixSocket(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	app, tokens := setupTestMain()
+	app.Cfg.Loki.URL = upstream.URL
+	app.WithProxies()
+	app.WithHealthz()
+	app.WithRoutes()
+
+	dir := t.TempDir()
+	app.Cfg.Web.ProxySocket = dir + "/proxy.sock"
+	app.Cfg.Web.MetricsSocket = dir + "/metrics.sock"
+	// A socket file left behind by an unclean shutdown is replaced
+	stale, err := net.Listen("unix", app.Cfg.Web.ProxySocket)
+	assert.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	assert.NoError(t, stale.Close())
+	app.Cfg.Web.ReadHeaderTimeout = 5 * time.Second
+	app.Cfg.Web.IdleTimeout = 30 * time.Second
+
+	app.StartServer()
+	for _, server := range app.servers {
+		assert.Equal(t, 5*time.Second, server.ReadHeaderTimeout)
+		assert.Equal(t, 30*time.Second, server.IdleTimeout)
+	}
+
+	client := func(socket string) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		}}
+	}
+
+	resp, err := client(app.Cfg.Web.MetricsSocket).Get("http://unix/healthz")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_ = resp.Body.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://unix/loki/api/v1/query?query="+url.QueryEscape(`{tenant_id="allowed_user"}`), nil)
+	req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+	resp, err = client(app.Cfg.Web.ProxySocket).Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_ = resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, app.Shutdown(ctx))
+	for _, socket := range []string{app.Cfg.Web.ProxySocket, app.Cfg.Web.MetricsSocket} {
+		_, err := os.Stat(socket)
+		assert.True(t, os.IsNotExist(err), "socket %s not removed on shutdown", socket)
+	}
+}
+
+func TestNewServer_Timeouts(t *testing.T) {
+	tests := []struct {
+		name                                 string
+		web                                  WebConfig
+		readHeader, read, write, idleTimeout time.Duration
+	}{
+		{name: "defaults", readHeader: 10 * time.Second, idleTimeout: 2 * time.Minute},
+		{
+			name: "configured",
+			web: WebConfig{
+				ReadHeaderTimeout: 5 * time.Second,
+				ReadTimeout:       30 * time.Second,
+				WriteTimeout:      10 * time.Minute,
+				IdleTimeout:       time.Minute,
+			},
+			readHeader: 5 * time.Second, read: 30 * time.Second, write: 10 * time.Minute, idleTimeout: time.Minute,
+		},
+		{name: "negative disables", web: WebConfig{ReadHeaderTimeout: -1, IdleTimeout: -1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &App{Cfg: &Config{Web: tt.web}}
+			server := app.newServer(http.NotFoundHandler())
+			assert.Equal(t, tt.readHeader, server.ReadHeaderTimeout)
+			assert.Equal(t, tt.read, server.ReadTimeout)
+			assert.Equal(t, tt.write, server.WriteTimeout)
+			assert.Equal(t, tt.idleTimeout, server.IdleTimeout)
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Query language label values for enforcement metrics
+const (
+	QLProm    = "prom"
+	QLLog     = "log"
+	QLTrace   = "trace"
+	QLUnknown = "unknown"
+)
+
+// Enforcement result label values
+const (
+	EnforcementAllowed  = "allowed"  // Query enforced and forwarded
+	EnforcementDenied   = "denied"   // Query rejected by the enforcer
+	EnforcementBypassed = "bypassed" // Enforcement skipped for admins and cluster-wide users
+)
+
+// Enforcement decision label values, telling apart how allowed queries were scoped
+const (
+	DecisionInjected  = "injected"  // Policy matchers were added to the query
+	DecisionValidated = "validated" // The query already selected permitted policy label values
+	DecisionDenied    = "denied"    // Query rejected by the enforcer
+	DecisionSkipped   = "skipped"   // Enforcement skipped for admins and cluster-wide users
+)
+
+var (
+	// enforcementTotal counts enforcement decisions per query language, result and decision.
+	enforcementTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "lgtm_lbac_proxy",
+		Name:      "enforcements_total",
+		Help:      "Total number of query enforcement decisions by query language, result and decision.",
+	}, []string{"ql", "result", "decision"})
+
+	// enforcementDuration observes the time spent enforcing queries per query language.
+	enforcementDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "lgtm_lbac_proxy",
+		Name:      "enforcement_duration_seconds",
+		Help:      "Time spent enforcing queries by query language.",
+		Buckets:   []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05},
+	}, []string{"ql"})
+
+	// authFailuresTotal counts requests rejected for their token per failure reason.
+	authFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "lgtm_lbac_proxy",
+		Name:      "auth_failures_total",
+		Help:      "Total number of requests rejected for a missing or invalid token by reason.",
+	}, []string{"reason"})
+)
+
+// queryLanguage returns the ql metric label for an enforcer.
+func queryLanguage(enforcer EnforceQL) string {
+	switch enforcer.(type) {
+	case PromQLEnforcer, MetadataEnforcer:
+		return QLProm
+	case LogQLEnforcer:
+		return QLLog
+	case TraceQLEnforcer:
+		return QLTrace
+	default:
+		return QLUnknown
+	}
+}
+
+// allowedDecision returns the decision label of an allowed query.
+func allowedDecision(injected bool) string {
+	if injected {
+		return DecisionInjected
+	}
+	return DecisionValidated
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestQueryLanguage(t *testing.T) {
+	tests := []struct {
+		name     string
+		enforcer EnforceQL
+		want     string
+	}{
+		{"PromQL", PromQLEnforcer{}, QLProm},
+		{"LogQL", LogQLEnforcer{}, QLLog},
+		{"TraceQL", TraceQLEnforcer{}, QLTrace},
+		{"nil", nil, QLUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := queryLanguage(tt.enforcer); got != tt.want {
+				t.Errorf("queryLanguage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnforcementMetrics_Labels(t *testing.T) {
+	app, tokens := setupTestMain()
+	app.Cfg.Tempo.URL = app.Cfg.Loki.URL
+	app.WithProxies()
+	app.WithRoutes()
+
+	tests := []struct {
+		name     string
+		path     string
+		param    string
+		query    string
+		ql       string
+		result   string
+		decision string
+		status   int
+	}{
+		{"Loki validated", "/loki/api/v1/query", "query", `{tenant_id="allowed_user"}`, QLLog, EnforcementAllowed, DecisionValidated, http.StatusOK},
+		{"Loki injected", "/loki/api/v1/query", "query", `{app="api"}`, QLLog, EnforcementAllowed, DecisionInjected, http.StatusOK},
+		{"Loki denied", "/loki/api/v1/query", "query", `{tenant_id="forbidden"}`, QLLog, EnforcementDenied, DecisionDenied, http.StatusForbidden},
+		{"Thanos injected", "/api/v1/query", "query", `up`, QLProm, EnforcementAllowed, DecisionInjected, http.StatusOK},
+		{"Thanos validated", "/api/v1/query", "query", `up{tenant_id=~"allowed_user|also_allowed_user"}`, QLProm, EnforcementAllowed, DecisionValidated, http.StatusOK},
+		{"Thanos injected into one of several selectors", "/api/v1/query", "query", `up{tenant_id="allowed_user"} + up`, QLProm, EnforcementAllowed, DecisionInjected, http.StatusOK},
+		{"Thanos denied", "/api/v1/query", "query", `up{tenant_id="forbidden"}`, QLProm, EnforcementDenied, DecisionDenied, http.StatusForbidden},
+		{"Tempo injected", "/api/search", "q", `{}`, QLTrace, EnforcementAllowed, DecisionInjected, http.StatusOK},
+		{"Tempo validated", "/api/search", "q", `{ resource.tenant_id = "allowed_user" }`, QLTrace, EnforcementAllowed, DecisionValidated, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := enforcementTotal.WithLabelValues(tt.ql, tt.result, tt.decision)
+			before := testutil.ToFloat64(counter)
+
+			req := httptest.NewRequest(http.MethodGet, tt.path+"?"+tt.param+"="+url.QueryEscape(tt.query), nil)
+			req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+			rr := httptest.NewRecorder()
+			app.e.ServeHTTP(rr, req)
+
+			if rr.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.status, rr.Body.String())
+			}
+			if got := testutil.ToFloat64(counter) - before; got != 1 {
+				t.Errorf("enforcements_total{ql=%q,result=%q,decision=%q} increased by %v, want 1", tt.ql, tt.result, tt.decision, got)
+			}
+		})
+	}
+
+	// Every enforced query language must have observed at least one duration
+	if got := testutil.CollectAndCount(enforcementDuration); got < 3 {
+		t.Errorf("enforcement_duration_seconds has %d series, want at least 3", got)
+	}
+}
+
+func TestEnforcementMetrics_Bypassed(t *testing.T) {
+	app, tokens := setupTestMain()
+	app.Cfg.Admin.Bypass = true
+	app.Cfg.Admin.Group = "admins"
+	app.WithRoutes()
+
+	counter := enforcementTotal.WithLabelValues(QLLog, EnforcementBypassed, DecisionSkipped)
+	before := testutil.ToFloat64(counter)
+
+	req := httptest.NewRequest(http.MethodGet, "/loki/api/v1/query?query="+url.QueryEscape(`{tenant_id="anything"}`), nil)
+	req.Header.Set("Authorization", "Bearer "+tokens["adminUserToken"])
+	rr := httptest.NewRecorder()
+	app.e.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	if got := testutil.ToFloat64(counter) - before; got != 1 {
+		t.Errorf("bypassed counter increased by %v, want 1", got)
+	}
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"fmt"
+	"maps"
+	"slices"
+	"strings"
 )
 
 // RawLabelData represents the raw YAML structure from labels.yaml.
@@ -10,7 +13,9 @@ type RawLabelData map[string]interface{}
 
 // PolicyParser handles parsing of label configurations
 // from YAML format to LabelPolicy structures.
-type PolicyParser struct{}
+type PolicyParser struct {
+	DefaultLogic string // Logic of entries without _logic (default: AND)
+}
 
 // NewPolicyParser creates a new PolicyParser instance.
 func NewPolicyParser() *PolicyParser {
@@ -27,6 +32,30 @@ func NewPolicyParser() *PolicyParser {
 //	    operator: "="
 //	    values: ["prod", "staging"]
 //	_logic: AND
+//
+// Entries without _logic use the parser's DefaultLogic.
+//
+// Rules without a name apply to the entry's _default_label, which overrides the upstream
+// default label for that entry:
+//
+//	_default_label: kubernetes_namespace_name
+//	_rules:
+//	  - operator: "="
+//	    values: ["prod"]
+//	  - name: team
+//	    operator: "="
+//	    values: ["backend"]
+//
+// Entries and rules may carry _meta annotations, e.g. the ticket that granted access. They
+// are ignored by enforcement and reported in audit events. Rules inherit the entry's _meta,
+// overriding its keys with their own:
+//
+//	_meta: {owner: platform-team}
+//	_rules:
+//	  - name: namespace
+//	    operator: "="
+//	    values: ["prod"]
+//	    _meta: {ticket: OPS-1234}
 func (p *PolicyParser) ParseUserPolicy(data RawLabelData, defaultLabel string) (*LabelPolicy, error) {
 	if len(data) == 0 {
 		return nil, fmt.Errorf("empty label data")
@@ -63,6 +92,10 @@ func (p *PolicyParser) parseExtendedFormat(data RawLabelData, rulesData interfac
 		Logic: LogicAND, // Default
 		Rules: []LabelRule{},
 	}
+	// Stores built without a parser use a nil *PolicyParser, which has no default logic
+	if p != nil && p.DefaultLogic != "" {
+		policy.Logic = p.DefaultLogic
+	}
 
 	// Parse _logic if present
 	if logicData, ok := data["_logic"]; ok {
@@ -78,6 +111,26 @@ func (p *PolicyParser) parseExtendedFormat(data RawLabelData, rulesData interfac
 		}
 	}
 
+	// Parse _default_label if present, naming the rules that do not declare a label
+	defaultLabel := ""
+	if labelData, ok := data["_default_label"]; ok {
+		label, ok := labelData.(string)
+		if !ok || label == "" {
+			return nil, fmt.Errorf("_default_label must be a non-empty string")
+		}
+		defaultLabel = label
+	}
+
+	// Parse _meta if present, annotating every rule of the entry
+	var entryMeta map[string]string
+	if metaData, ok := data["_meta"]; ok {
+		meta, err := parseMeta(metaData)
+		if err != nil {
+			return nil, err
+		}
+		entryMeta = meta
+	}
+
 	// Parse _rules array
 	rulesArray, ok := rulesData.([]interface{})
 	if !ok {
@@ -98,10 +151,11 @@ func (p *PolicyParser) parseExtendedFormat(data RawLabelData, rulesData interfac
 			return nil, fmt.Errorf("rule %d: must be a map", i)
 		}
 
-		rule, err := p.parseRule(ruleMap)
+		rule, err := p.parseRule(ruleMap, defaultLabel)
 		if err != nil {
 			return nil, fmt.Errorf("rule %d: %w", i, err)
 		}
+		rule.Meta = mergeMeta(entryMeta, rule.Meta)
 
 		policy.Rules = append(policy.Rules, rule)
 	}
@@ -119,7 +173,7 @@ func hasClusterWideOnly(data RawLabelData) bool {
 		return false
 	}
 	for key := range data {
-		if key != "#cluster-wide" {
+		if key != clusterWideLabel() {
 			return false
 		}
 	}
@@ -127,11 +181,15 @@ func hasClusterWideOnly(data RawLabelData) bool {
 }
 
 // parseRule converts a map representing a rule into a LabelRule struct.
-func (p *PolicyParser) parseRule(ruleMap map[string]interface{}) (LabelRule, error) {
+// Rules without a name use defaultLabel, if it is set.
+func (p *PolicyParser) parseRule(ruleMap map[string]interface{}, defaultLabel string) (LabelRule, error) {
 	rule := LabelRule{}
 
 	// Parse name
 	name, ok := ruleMap["name"].(string)
+	if _, hasName := ruleMap["name"]; !hasName && defaultLabel != "" {
+		name, ok = defaultLabel, true
+	}
 	if !ok || name == "" {
 		return rule, fmt.Errorf("rule must have a 'name' field")
 	}
@@ -163,9 +221,74 @@ func (p *PolicyParser) parseRule(ruleMap map[string]interface{}) (LabelRule, err
 		rule.Values = append(rule.Values, strValue)
 	}
 
+	// Parse _meta if present
+	if metaData, ok := ruleMap["_meta"]; ok {
+		meta, err := parseMeta(metaData)
+		if err != nil {
+			return rule, err
+		}
+		rule.Meta = meta
+	}
+
 	if err := rule.Validate(); err != nil {
 		return rule, err
 	}
 
 	return rule, nil
 }
+
+// parseMeta converts a _meta map of annotations into strings. Values must be scalars.
+func parseMeta(data interface{}) (map[string]string, error) {
+	var metaMap map[string]interface{}
+	switch v := data.(type) {
+	case map[string]interface{}:
+		metaMap = v
+	case RawLabelData:
+		metaMap = map[string]interface{}(v)
+	default:
+		return nil, fmt.Errorf("_meta must be a map")
+	}
+
+	meta := make(map[string]string, len(metaMap))
+	for key, value := range metaMap {
+		switch value.(type) {
+		case nil, map[string]interface{}, RawLabelData, []interface{}:
+			return nil, fmt.Errorf("_meta %q must be a string, number or boolean", key)
+		}
+		meta[key] = fmt.Sprint(value)
+	}
+	return meta, nil
+}
+
+// mergeMeta returns the annotations of base overridden by those of override, without
+// modifying either.
+func mergeMeta(base, override map[string]string) map[string]string {
+	if len(base) == 0 {
+		return override
+	}
+	if len(override) == 0 {
+		return base
+	}
+	merged := maps.Clone(base)
+	maps.Copy(merged, override)
+	return merged
+}
+
+// joinMeta returns the annotations of a and b, without modifying either. Keys with
+// different values in both keep both, separated by ", ".
+func joinMeta(a, b map[string]string) map[string]string {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+	joined := maps.Clone(a)
+	for key, value := range b {
+		if existing, ok := joined[key]; ok && !slices.Contains(strings.Split(existing, ", "), value) {
+			value = existing + ", " + value
+		}
+		joined[key] = value
+	}
+	return joined
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"maps"
 	"testing"
 
 	"gopkg.in/yaml.v3"
@@ -325,7 +326,7 @@ func TestPolicyParserParseRule(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, err := parser.parseRule(tt.ruleMap)
+			_, err := parser.parseRule(tt.ruleMap, "")
 			if (err != nil) != tt.wantErr {
 				t.Errorf("parseRule() error = %v, wantErr %v", err, tt.wantErr)
 			}
@@ -336,6 +337,116 @@ func TestPolicyParserParseRule(t *testing.T) {
 // TestYAMLUnmarshallingIssue demonstrates the root cause:
 // YAML unmarshalling creates map[interface{}]interface{} instead of map[string]interface{}
 // This causes type assertions to fail in parseRule()
+func TestPolicyParserDefaultLabel(t *testing.T) {
+	yamlData := `
+entry-default:
+  _default_label: kubernetes_namespace_name
+  _rules:
+    - operator: '='
+      values: ['prod']
+    - name: team
+      operator: '='
+      values: ['backend']
+no-default:
+  _rules:
+    - operator: '=~'
+      values: ['prod-.*']
+invalid-default:
+  _default_label: 42
+  _rules:
+    - operator: '='
+      values: ['prod']
+`
+	var rawData map[string]RawLabelData
+	if err := yaml.Unmarshal([]byte(yamlData), &rawData); err != nil {
+		t.Fatalf("Failed to unmarshal YAML: %v", err)
+	}
+	parser := NewPolicyParser()
+
+	tests := []struct {
+		name         string
+		entry        string
+		defaultLabel string
+		wantNames    []string
+		wantErr      bool
+	}{
+		{name: "entry default overrides upstream default", entry: "entry-default", defaultLabel: "namespace", wantNames: []string{"kubernetes_namespace_name", "team"}},
+		{name: "entry default without upstream default", entry: "entry-default", defaultLabel: "", wantNames: []string{"kubernetes_namespace_name", "team"}},
+		{name: "unnamed rule without entry default", entry: "no-default", defaultLabel: "namespace", wantErr: true},
+		{name: "non-string entry default", entry: "invalid-default", defaultLabel: "namespace", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := parser.ParseUserPolicy(rawData[tt.entry], tt.defaultLabel)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseUserPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(policy.Rules) != len(tt.wantNames) {
+				t.Fatalf("ParseUserPolicy() got %d rules, want %d", len(policy.Rules), len(tt.wantNames))
+			}
+			for i, rule := range policy.Rules {
+				if rule.Name != tt.wantNames[i] {
+					t.Errorf("rule %d name = %q, want %q", i, rule.Name, tt.wantNames[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPolicyParserDefaultLogic(t *testing.T) {
+	yamlData := `
+no-logic:
+  _rules:
+    - name: namespace
+      operator: '='
+      values: ['prod']
+    - name: team
+      operator: '='
+      values: ['backend']
+own-logic:
+  _logic: AND
+  _rules:
+    - name: namespace
+      operator: '='
+      values: ['prod']
+    - name: team
+      operator: '='
+      values: ['backend']
+`
+	var rawData map[string]RawLabelData
+	if err := yaml.Unmarshal([]byte(yamlData), &rawData); err != nil {
+		t.Fatalf("Failed to unmarshal YAML: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		entry        string
+		defaultLogic string
+		wantLogic    string
+	}{
+		{name: "AND without default logic", entry: "no-logic", defaultLogic: "", wantLogic: LogicAND},
+		{name: "default logic applies", entry: "no-logic", defaultLogic: LogicOR, wantLogic: LogicOR},
+		{name: "entry logic overrides default", entry: "own-logic", defaultLogic: LogicOR, wantLogic: LogicAND},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser := &PolicyParser{DefaultLogic: tt.defaultLogic}
+			policy, err := parser.ParseUserPolicy(rawData[tt.entry], "")
+			if err != nil {
+				t.Fatalf("ParseUserPolicy() error = %v", err)
+			}
+			if policy.Logic != tt.wantLogic {
+				t.Errorf("ParseUserPolicy() logic = %q, want %q", policy.Logic, tt.wantLogic)
+			}
+		})
+	}
+}
+
 func TestYAMLUnmarshallingIssue(t *testing.T) {
 	yamlData := `
 GrafanaAdmin:
@@ -597,3 +708,90 @@ user1:
 	t.Logf("✓✓✓ All actual configuration tests passed!")
 }
 
+
+func TestPolicyParserMeta(t *testing.T) {
+	yamlData := `
+annotated:
+  _meta:
+    owner: platform-team
+    ticket: OPS-1
+  _rules:
+    - name: namespace
+      operator: '='
+      values: ['prod']
+      _meta:
+        ticket: OPS-2
+        reviewed: true
+    - name: team
+      operator: '='
+      values: ['backend']
+plain:
+  _rules:
+    - name: namespace
+      operator: '='
+      values: ['prod']
+    - name: team
+      operator: '='
+      values: ['backend']
+entry-meta-list:
+  _meta: ['OPS-1']
+  _rules:
+    - name: namespace
+      operator: '='
+      values: ['prod']
+rule-meta-map:
+  _rules:
+    - name: namespace
+      operator: '='
+      values: ['prod']
+      _meta:
+        owner: {name: platform-team}
+`
+	var rawData map[string]RawLabelData
+	if err := yaml.Unmarshal([]byte(yamlData), &rawData); err != nil {
+		t.Fatalf("Failed to unmarshal YAML: %v", err)
+	}
+	parser := NewPolicyParser()
+
+	policy, err := parser.ParseUserPolicy(rawData["annotated"], "")
+	if err != nil {
+		t.Fatalf("ParseUserPolicy() error = %v", err)
+	}
+	wantMeta := []map[string]string{
+		{"owner": "platform-team", "ticket": "OPS-2", "reviewed": "true"},
+		{"owner": "platform-team", "ticket": "OPS-1"},
+	}
+	for i, rule := range policy.Rules {
+		if !maps.Equal(rule.Meta, wantMeta[i]) {
+			t.Errorf("rule %d meta = %v, want %v", i, rule.Meta, wantMeta[i])
+		}
+	}
+
+	for _, entry := range []string{"entry-meta-list", "rule-meta-map"} {
+		if _, err := parser.ParseUserPolicy(rawData[entry], ""); err == nil {
+			t.Errorf("ParseUserPolicy(%s) expected error for invalid _meta", entry)
+		}
+	}
+
+	// Annotations do not change enforcement
+	plain, err := parser.ParseUserPolicy(rawData["plain"], "")
+	if err != nil {
+		t.Fatalf("ParseUserPolicy() error = %v", err)
+	}
+	tests := []struct {
+		enforcer EnforceQL
+		query    string
+	}{
+		{enforcer: PromQLEnforcer{}, query: `up`},
+		{enforcer: PromQLEnforcer{}, query: `up{namespace="dev"}`},
+		{enforcer: LogQLEnforcer{}, query: `{app="api"}`},
+		{enforcer: LogQLEnforcer{}, query: `{namespace="dev"}`},
+	}
+	for _, tt := range tests {
+		want, wantErr := tt.enforcer.Enforce(tt.query, *plain)
+		got, gotErr := tt.enforcer.Enforce(tt.query, *policy)
+		if got != want || (gotErr == nil) != (wantErr == nil) {
+			t.Errorf("Enforce(%q) with _meta = %q, %v, want %q, %v", tt.query, got, gotErr, want, wantErr)
+		}
+	}
+}
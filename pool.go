@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// upstreamDialsTotal counts new connections dialed to each upstream.
+	upstreamDialsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "lgtm_lbac_proxy",
+		Name:      "upstream_dials_total",
+		Help:      "Total number of connections dialed to the upstream.",
+	}, []string{"upstream"})
+
+	// upstreamConnectionsOpen tracks connections to each upstream that are not yet closed.
+	upstreamConnectionsOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "lgtm_lbac_proxy",
+		Name:      "upstream_connections_open",
+		Help:      "Number of open connections to the upstream, idle or active.",
+	}, []string{"upstream"})
+
+	// upstreamConnectionsIdle estimates the idle connections in each upstream pool.
+	upstreamConnectionsIdle = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "lgtm_lbac_proxy",
+		Name:      "upstream_connections_idle",
+		Help:      "Estimated idle connections to the upstream (open connections minus in-flight requests; approximate with HTTP/2 multiplexing).",
+	}, []string{"upstream"})
+
+	// upstreamRequestsInFlight tracks requests to each upstream whose response body is not yet closed.
+	upstreamRequestsInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "lgtm_lbac_proxy",
+		Name:      "upstream_requests_in_flight",
+		Help:      "Number of requests to the upstream currently in flight.",
+	}, []string{"upstream"})
+)
+
+// poolTracker records connection pool utilization of an upstream transport. http.Transport
+// does not expose its pool, so connections are counted by wrapping DialContext and in-flight
+// requests by wrapping RoundTrip until the response body is closed.
+type poolTracker struct {
+	upstream  string
+	transport *http.Transport
+	*poolCounts
+}
+
+// poolCounts are the connection pool counters of an upstream. They are shared by all its
+// transports, so that the gauges stay correct while a transport replaced on reload drains.
+type poolCounts struct {
+	open     atomic.Int64
+	inFlight atomic.Int64
+}
+
+// upstreamPoolCounts holds the *poolCounts of each upstream.
+var upstreamPoolCounts sync.Map
+
+// poolCountsFor returns the pool counters of upstream.
+func poolCountsFor(upstream string) *poolCounts {
+	counts, _ := upstreamPoolCounts.LoadOrStore(upstream, &poolCounts{})
+	return counts.(*poolCounts)
+}
+
+// trackTransport instruments transport with connection pool metrics for upstream and returns
+// the RoundTripper to use in its place.
+func trackTransport(transport *http.Transport, upstream string) http.RoundTripper {
+	p := &poolTracker{upstream: upstream, transport: transport, poolCounts: poolCountsFor(upstream)}
+
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		upstreamDialsTotal.WithLabelValues(upstream).Inc()
+		p.open.Add(1)
+		p.update()
+		return &trackedConn{Conn: conn, onClose: func() {
+			p.open.Add(-1)
+			p.update()
+		}}, nil
+	}
+
+	p.update()
+	return p
+}
+
+// RoundTrip counts the request as in flight until its response body is closed.
+func (p *poolTracker) RoundTrip(req *http.Request) (*http.Response, error) {
+	p.inFlight.Add(1)
+	p.update()
+	done := func() {
+		p.inFlight.Add(-1)
+		p.update()
+	}
+
+	resp, err := p.transport.RoundTrip(req)
+	if err != nil {
+		done()
+		return nil, err
+	}
+	resp.Body = &trackedBody{ReadCloser: resp.Body, onClose: done}
+	return resp, nil
+}
+
+// CloseIdleConnections closes the idle connections of the tracked transport.
+func (p *poolTracker) CloseIdleConnections() {
+	p.transport.CloseIdleConnections()
+}
+
+// update publishes the current pool utilization to the gauges.
+func (p *poolTracker) update() {
+	open, inFlight := p.open.Load(), p.inFlight.Load()
+	upstreamConnectionsOpen.WithLabelValues(p.upstream).Set(float64(open))
+	upstreamRequestsInFlight.WithLabelValues(p.upstream).Set(float64(inFlight))
+	upstreamConnectionsIdle.WithLabelValues(p.upstream).Set(float64(max(open-inFlight, 0)))
+}
+
+// trackedConn calls onClose once when the connection is closed.
+type trackedConn struct {
+	net.Conn
+	once    sync.Once
+	onClose func()
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.onClose)
+	return c.Conn.Close()
+}
+
+// trackedBody calls onClose once when the response body is closed.
+type trackedBody struct {
+	io.ReadCloser
+	once    sync.Once
+	onClose func()
+}
+
+func (b *trackedBody) Close() error {
+	b.once.Do(b.onClose)
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrackTransport_PoolMetrics(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		_, _ = fmt.Fprintln(w, "done")
+	}))
+	defer upstream.Close()
+
+	const name = "pool-test"
+	transport := &http.Transport{}
+	client := &http.Client{Transport: trackTransport(transport, name)}
+
+	open := func() float64 { return testutil.ToFloat64(upstreamConnectionsOpen.WithLabelValues(name)) }
+	idle := func() float64 { return testutil.ToFloat64(upstreamConnectionsIdle.WithLabelValues(name)) }
+	inFlight := func() float64 { return testutil.ToFloat64(upstreamRequestsInFlight.WithLabelValues(name)) }
+	dials := func() float64 { return testutil.ToFloat64(upstreamDialsTotal.WithLabelValues(name)) }
+
+	dialsBefore := dials()
+	assert.Equal(t, float64(0), open())
+	assert.Equal(t, float64(0), inFlight())
+
+	// The request stays in flight until its body is read and closed
+	resp, err := client.Get(upstream.URL + "/slow")
+	assert.NoError(t, err)
+	assert.Equal(t, dialsBefore+1, dials())
+	assert.Equal(t, float64(1), open())
+	assert.Equal(t, float64(1), inFlight())
+	assert.Equal(t, float64(0), idle())
+
+	close(release)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	assert.Equal(t, float64(0), inFlight())
+	assert.Equal(t, float64(1), idle())
+
+	// A second request reuses the pooled connection
+	resp, err = client.Get(upstream.URL + "/fast")
+	assert.NoError(t, err)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	assert.Equal(t, dialsBefore+1, dials())
+
+	transport.CloseIdleConnections()
+	assert.Eventually(t, func() bool { return open() == 0 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, float64(0), idle())
+}
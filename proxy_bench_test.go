@@ -80,7 +80,7 @@ func BenchmarkCreateTransport(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_ = app.createTransport(proxyCfg, tlsConfig)
+		_, _ = app.createTransport(proxyCfg, tlsConfig)
 	}
 }
 
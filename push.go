@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// lokiPushRoute is the Loki push route, served with loki.push.enabled.
+// https://grafana.com/docs/loki/latest/reference/loki-http-api/#ingest-logs
+const lokiPushRoute = "/api/v1/push"
+
+// errInvalidPush marks push requests whose payload cannot be decoded. They are answered
+// with 400 Bad Request rather than 403 Forbidden.
+var errInvalidPush = errors.New("invalid push request")
+
+// errPushTooLarge marks push requests whose body exceeds loki.push.max_body_size, as
+// received or decompressed. They are answered with 413 Request Entity Too Large.
+var errPushTooLarge = errors.New("push request too large")
+
+// DefaultMaxPushBodySize is the maximum size of a push body when loki.push.max_body_size
+// is not set.
+const DefaultMaxPushBodySize int64 = 100 << 20
+
+// Protobuf field numbers of Loki's PushRequest and StreamAdapter messages.
+const (
+	pushRequestStreamsField = 1
+	streamLabelsField       = 1
+)
+
+// pushVerifier verifies the labels of pushed streams against a label policy.
+type pushVerifier struct {
+	matchers []*labels.Matcher // Policy rules
+	any      bool              // Permit streams matching any matcher (OR logic) instead of all
+	inject   map[string]string // Values of policy labels added to streams without them
+}
+
+// newPushVerifier returns a verifier permitting the streams policy permits. With inject, the
+// labels of positive single-value rules (e.g. namespace = team-a) are added to streams that
+// lack them. Under OR logic no label is required, so nothing is injected.
+func newPushVerifier(policy *LabelPolicy, inject bool) (*pushVerifier, error) {
+	verifier := &pushVerifier{any: policy.Logic == LogicOR, inject: map[string]string{}}
+	for _, rule := range policy.Rules {
+		m := ruleToMatcher(rule)
+		matcher, err := labels.NewMatcher(m.Type, m.Name, m.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule for label %s: %w", rule.Name, err)
+		}
+		verifier.matchers = append(verifier.matchers, matcher)
+		if inject && !verifier.any && rule.Operator == OperatorEquals && len(rule.Values) == 1 {
+			verifier.inject[rule.Name] = rule.Values[0]
+		}
+	}
+	return verifier, nil
+}
+
+// verify returns the labels of a stream permitted by the policy, with missing policy labels
+// injected, and whether any label was injected. Missing labels are matched as empty values.
+func (v *pushVerifier) verify(stream labels.Labels) (labels.Labels, bool, error) {
+	if v.any {
+		for _, m := range v.matchers {
+			if m.Matches(stream.Get(m.Name)) {
+				return stream, false, nil
+			}
+		}
+		return stream, false, fmt.Errorf("stream %s matches no rule of the policy", stream)
+	}
+
+	builder := labels.NewBuilder(stream)
+	injected := false
+	for _, m := range v.matchers {
+		if stream.Has(m.Name) {
+			if value := stream.Get(m.Name); !m.Matches(value) {
+				return stream, false, fmt.Errorf("stream %s: %w", stream, &DeniedLabelError{Label: m.Name, Value: value})
+			}
+			continue
+		}
+		if value, ok := v.inject[m.Name]; ok {
+			builder.Set(m.Name, value)
+			injected = true
+			continue
+		}
+		if !m.Matches("") {
+			return stream, false, fmt.Errorf("stream %s has no %s label", stream, m.Name)
+		}
+	}
+	return builder.Labels(), injected, nil
+}
+
+// enforcePush verifies every stream of a Loki push request against policy, rejecting the
+// whole push if any stream is not permitted, and writes the streams back with injected
+// labels. JSON bodies and snappy-compressed protobuf bodies, the default of Loki clients,
+// are supported; gzip-encoded bodies are decoded and forwarded uncompressed. Bodies larger
+// than maxSize bytes, as received or decompressed, are rejected with errPushTooLarge.
+func enforcePush(r *http.Request, policy *LabelPolicy, inject bool, maxSize int64) (bool, error) {
+	verifier, err := newPushVerifier(policy, inject)
+	if err != nil {
+		return false, err
+	}
+
+	body, err := readPushBody(r, maxSize)
+	if err != nil {
+		return false, err
+	}
+
+	injected := false
+	verify := func(stream labels.Labels) (labels.Labels, error) {
+		enforced, streamInjected, err := verifier.verify(stream)
+		injected = injected || streamInjected
+		return enforced, err
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		body, err = rewritePushJSON(body, verify)
+	} else {
+		body, err = rewritePushProtobuf(body, verify, maxSize)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return injected, nil
+}
+
+// readPushBody reads the body of a push request, decoding it if it is gzip-encoded. Bodies
+// longer than maxSize bytes, before or after decoding, are rejected with errPushTooLarge.
+func readPushBody(r *http.Request, maxSize int64) ([]byte, error) {
+	defer func() { _ = r.Body.Close() }()
+	raw := io.LimitReader(r.Body, maxSize+1)
+	switch encoding := strings.ToLower(r.Header.Get("Content-Encoding")); encoding {
+	case "", "identity":
+		return readPushLimited(raw, maxSize)
+	case "gzip":
+		reader, err := gzip.NewReader(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidPush, err)
+		}
+		body, err := readPushLimited(io.LimitReader(reader, maxSize+1), maxSize)
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Del("Content-Encoding")
+		return body, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported content encoding %s", errInvalidPush, encoding)
+	}
+}
+
+// readPushLimited reads reader, which is limited to maxSize+1 bytes, rejecting it with
+// errPushTooLarge if it holds more than maxSize bytes.
+func readPushLimited(reader io.Reader, maxSize int64) ([]byte, error) {
+	body, err := io.ReadAll(reader)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return nil, fmt.Errorf("%w: body exceeds %d bytes", errPushTooLarge, maxSize)
+	case err != nil:
+		return nil, fmt.Errorf("%w: %w", errInvalidPush, err)
+	case int64(len(body)) > maxSize:
+		return nil, fmt.Errorf("%w: body exceeds %d bytes", errPushTooLarge, maxSize)
+	}
+	return body, nil
+}
+
+// pushJSONRequest is a Loki JSON push request. Unknown fields are rejected rather than
+// forwarded unverified.
+type pushJSONRequest struct {
+	Streams []pushJSONStream `json:"streams"`
+}
+
+// pushJSONStream is a stream of a Loki JSON push request. Its entries are kept as is.
+type pushJSONStream struct {
+	Stream map[string]string `json:"stream"`
+	Values json.RawMessage   `json:"values"`
+}
+
+// rewritePushJSON verifies the streams of a JSON push request with verify and returns the
+// request with the labels verify returned.
+func rewritePushJSON(body []byte, verify func(labels.Labels) (labels.Labels, error)) ([]byte, error) {
+	var request pushJSONRequest
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		return nil, fmt.Errorf("%w: invalid JSON body: %w", errInvalidPush, err)
+	}
+	for i, stream := range request.Streams {
+		enforced, err := verify(labels.FromMap(stream.Stream))
+		if err != nil {
+			return nil, err
+		}
+		request.Streams[i].Stream = enforced.Map()
+	}
+	return json.Marshal(request)
+}
+
+// rewritePushProtobuf verifies the streams of a snappy-compressed protobuf push request with
+// verify and returns the request with the labels verify returned. Only the labels of each
+// stream are decoded; all other fields are copied unchanged. Bodies that decompress to more
+// than maxSize bytes are rejected with errPushTooLarge before being decoded.
+func rewritePushProtobuf(body []byte, verify func(labels.Labels) (labels.Labels, error), maxSize int64) ([]byte, error) {
+	length, err := snappy.DecodedLen(body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid snappy body: %w", errInvalidPush, err)
+	}
+	if int64(length) > maxSize {
+		return nil, fmt.Errorf("%w: decoded body of %d bytes exceeds %d bytes", errPushTooLarge, length, maxSize)
+	}
+	decoded, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid snappy body: %w", errInvalidPush, err)
+	}
+
+	var request []byte
+	err = rewriteProtobufField(decoded, pushRequestStreamsField, func(stream []byte) ([]byte, error) {
+		hasLabels := false
+		rewritten := []byte(nil)
+		err := rewriteProtobufField(stream, streamLabelsField, func(value []byte) ([]byte, error) {
+			hasLabels = true
+			return rewritePushLabels(string(value), verify)
+		}, &rewritten)
+		if err != nil || hasLabels {
+			return rewritten, err
+		}
+		// A stream without labels is verified as an empty label set
+		value, err := rewritePushLabels("", verify)
+		if err != nil {
+			return nil, err
+		}
+		return protowire.AppendBytes(protowire.AppendTag(rewritten, streamLabelsField, protowire.BytesType), value), nil
+	}, &request)
+	if err != nil {
+		return nil, err
+	}
+	return snappy.Encode(nil, request), nil
+}
+
+// rewriteProtobufField appends the fields of message to out, with the values of the
+// length-delimited fields numbered field replaced by the result of rewrite.
+func rewriteProtobufField(message []byte, field protowire.Number, rewrite func([]byte) ([]byte, error), out *[]byte) error {
+	for len(message) > 0 {
+		number, typ, n := protowire.ConsumeTag(message)
+		if n < 0 {
+			return fmt.Errorf("%w: invalid protobuf body: %w", errInvalidPush, protowire.ParseError(n))
+		}
+		length := protowire.ConsumeFieldValue(number, typ, message[n:])
+		if length < 0 {
+			return fmt.Errorf("%w: invalid protobuf body: %w", errInvalidPush, protowire.ParseError(length))
+		}
+		if number != field {
+			*out = append(*out, message[:n+length]...)
+			message = message[n+length:]
+			continue
+		}
+		if typ != protowire.BytesType {
+			return fmt.Errorf("%w: invalid protobuf body: field %d is not length-delimited", errInvalidPush, number)
+		}
+		value, _ := protowire.ConsumeBytes(message[n:])
+		rewritten, err := rewrite(value)
+		if err != nil {
+			return err
+		}
+		*out = protowire.AppendBytes(protowire.AppendTag(*out, number, protowire.BytesType), rewritten)
+		message = message[n+length:]
+	}
+	return nil
+}
+
+// rewritePushLabels verifies the labels of a protobuf stream, in the Prometheus text format
+// Loki uses (e.g. {app="api", namespace="team-a"}), and returns the labels verify returned.
+func rewritePushLabels(value string, verify func(labels.Labels) (labels.Labels, error)) ([]byte, error) {
+	stream := labels.EmptyLabels()
+	if strings.TrimSpace(value) != "" {
+		var err error
+		if stream, err = parser.ParseMetric(value); err != nil {
+			return nil, fmt.Errorf("%w: invalid stream labels %s: %w", errInvalidPush, value, err)
+		}
+	}
+	enforced, err := verify(stream)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(enforced.String()), nil
+}
+
+// pushHandler serves the Loki push route: requests are authenticated like queries, and the
+// streams they push are verified against the user's policy by enforcePush before they are
+// forwarded. Users with cluster-wide access push unchanged. Pushes are never mirrored to a
+// shadow upstream nor coalesced.
+func pushHandler(route Route, auth upstreamAuth, headers map[string]string, a *App) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a := requestApp(r, a)
+		if a.Cfg.Web.MaintenanceMode {
+			writeMaintenanceResponse(w, a.Cfg.Web)
+			return
+		}
+
+		upstream := a.proxyFor("loki").forRoute(route.Url)
+		ctx, cancel := context.WithTimeout(r.Context(), upstream.cfg.requestTimeout(route.Url))
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		oauthToken, err := getToken(r, a)
+		if err != nil {
+			a.auditDecision(r, oauthToken, "loki", EnforcementDenied, nil, err)
+			a.writeTokenError(w, r, err)
+			return
+		}
+
+		if err := validateScopes(oauthToken, a.requiredScopes("loki")); err != nil {
+			a.auditDecision(r, oauthToken, "loki", EnforcementDenied, nil, err)
+			a.writeDenied(w, "loki", oauthToken, err)
+			return
+		}
+
+		policy, skip, err := validateLabelPolicy(oauthToken, a, "loki", route.TenantLabel)
+		if err != nil {
+			a.auditDecision(r, oauthToken, "loki", EnforcementDenied, nil, err)
+			a.writeDenied(w, "loki", oauthToken, err)
+			return
+		}
+
+		ctx = context.WithValue(ctx, usernameContextKey, oauthToken.PreferredUsername)
+		ctx = context.WithValue(ctx, emailContextKey, oauthToken.Email)
+		ctx = context.WithValue(ctx, actorClaimContextKey, oauthToken.claimValues(a.actorClaim("loki")))
+		r = r.WithContext(ctx)
+
+		if skip {
+			enforcementTotal.WithLabelValues(QLLog, EnforcementBypassed, DecisionSkipped).Inc()
+			a.auditDecision(r, oauthToken, "loki", EnforcementBypassed, nil, nil)
+		} else {
+			maxSize := a.Cfg.Loki.Push.MaxBodySize
+			if maxSize <= 0 {
+				maxSize = DefaultMaxPushBodySize
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+			injected, err := enforcePush(r, policy, a.Cfg.Loki.Push.InjectLabels, maxSize)
+			if err != nil {
+				enforcementTotal.WithLabelValues(QLLog, EnforcementDenied, DecisionDenied).Inc()
+				a.auditDecision(r, oauthToken, "loki", EnforcementDenied, policy, err)
+				if errors.Is(err, errPushTooLarge) {
+					logAndWriteError(w, http.StatusRequestEntityTooLarge, err, "")
+					return
+				}
+				if errors.Is(err, errInvalidPush) {
+					logAndWriteError(w, http.StatusBadRequest, err, "")
+					return
+				}
+				a.writeDenied(w, "loki", oauthToken, err)
+				return
+			}
+			requestLogger(r).Debug().Str("user", oauthToken.PreferredUsername).Str("upstream", "loki").Str("decision", allowedDecision(injected)).Msg("Push enforced")
+			enforcementTotal.WithLabelValues(QLLog, EnforcementAllowed, allowedDecision(injected)).Inc()
+			a.auditDecision(r, oauthToken, "loki", EnforcementAllowed, policy, nil)
+		}
+
+		setHeaders(r, auth, headers, a.ServiceAccountToken)
+		upstream.ReverseProxy.ServeHTTP(w, r)
+	}
+}
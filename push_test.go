@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// pushProtobuf returns a snappy-compressed protobuf push request with a stream of one entry
+// per label set.
+func pushProtobuf(streams ...string) []byte {
+	var request []byte
+	for _, streamLabels := range streams {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, "log line")
+		var stream []byte
+		stream = protowire.AppendTag(stream, 1, protowire.BytesType)
+		stream = protowire.AppendString(stream, streamLabels)
+		stream = protowire.AppendTag(stream, 2, protowire.BytesType)
+		stream = protowire.AppendBytes(stream, entry)
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, stream)
+	}
+	return snappy.Encode(nil, request)
+}
+
+// pushProtobufLabels returns the labels of the streams of a protobuf push request.
+func pushProtobufLabels(t *testing.T, body []byte) []string {
+	decoded, err := snappy.Decode(nil, body)
+	assert.NoError(t, err)
+	var streamLabels []string
+	var out []byte
+	err = rewriteProtobufField(decoded, pushRequestStreamsField, func(stream []byte) ([]byte, error) {
+		var streamOut []byte
+		return stream, rewriteProtobufField(stream, streamLabelsField, func(value []byte) ([]byte, error) {
+			streamLabels = append(streamLabels, string(value))
+			return value, nil
+		}, &streamOut)
+	}, &out)
+	assert.NoError(t, err)
+	return streamLabels
+}
+
+func TestEnforcePush(t *testing.T) {
+	policy := &LabelPolicy{Rules: []LabelRule{
+		{Name: "namespace", Operator: OperatorEquals, Values: []string{"team-a"}},
+		{Name: "env", Operator: OperatorNotEquals, Values: []string{"prod"}},
+	}, Logic: LogicAND}
+	orPolicy := &LabelPolicy{Rules: []LabelRule{
+		{Name: "namespace", Operator: OperatorEquals, Values: []string{"team-a"}},
+		{Name: "team", Operator: OperatorRegexMatch, Values: []string{"sre|ops"}},
+	}, Logic: LogicOR}
+
+	tests := []struct {
+		name        string
+		policy      *LabelPolicy
+		inject      bool
+		contentType string
+		body        []byte
+		injected    bool
+		expected    string   // JSON body forwarded upstream
+		labels      []string // Stream labels of the protobuf body forwarded upstream
+		wantErr     string
+	}{
+		{
+			name:        "authorized JSON",
+			policy:      policy,
+			contentType: "application/json",
+			body:        []byte(`{"streams":[{"stream":{"namespace":"team-a","app":"api"},"values":[["1700000000000000000","line",{"trace_id":"abc"}]]}]}`),
+			expected:    `{"streams":[{"stream":{"app":"api","namespace":"team-a"},"values":[["1700000000000000000","line",{"trace_id":"abc"}]]}]}`,
+		},
+		{
+			name:        "unauthorized JSON stream rejects the push",
+			policy:      policy,
+			contentType: "application/json",
+			body:        []byte(`{"streams":[{"stream":{"namespace":"team-a"},"values":[]},{"stream":{"namespace":"team-b"},"values":[]}]}`),
+			wantErr:     `stream {namespace="team-b"}: unauthorized namespace: team-b`,
+		},
+		{
+			name:        "excluded JSON stream",
+			policy:      policy,
+			contentType: "application/json",
+			body:        []byte(`{"streams":[{"stream":{"namespace":"team-a","env":"prod"},"values":[]}]}`),
+			wantErr:     `stream {env="prod", namespace="team-a"}: unauthorized env: prod`,
+		},
+		{
+			name:        "missing label",
+			policy:      policy,
+			contentType: "application/json",
+			body:        []byte(`{"streams":[{"stream":{"app":"api"},"values":[]}]}`),
+			wantErr:     `stream {app="api"} has no namespace label`,
+		},
+		{
+			name:        "missing label injected",
+			policy:      policy,
+			inject:      true,
+			contentType: "application/json",
+			body:        []byte(`{"streams":[{"stream":{"app":"api"},"values":[]}]}`),
+			injected:    true,
+			expected:    `{"streams":[{"stream":{"app":"api","namespace":"team-a"},"values":[]}]}`,
+		},
+		{
+			name:        "unknown JSON field",
+			policy:      policy,
+			contentType: "application/json",
+			body:        []byte(`{"streams":[{"labels":"{namespace=\"team-b\"}","entries":[]}]}`),
+			wantErr:     "invalid push request: invalid JSON body",
+		},
+		{
+			name:        "OR policy",
+			policy:      orPolicy,
+			inject:      true,
+			contentType: "application/json",
+			body:        []byte(`{"streams":[{"stream":{"namespace":"team-b","team":"sre"},"values":[]}]}`),
+			expected:    `{"streams":[{"stream":{"namespace":"team-b","team":"sre"},"values":[]}]}`,
+		},
+		{
+			name:        "OR policy without matching rule",
+			policy:      orPolicy,
+			inject:      true,
+			contentType: "application/json",
+			body:        []byte(`{"streams":[{"stream":{"app":"api"},"values":[]}]}`),
+			wantErr:     `stream {app="api"} matches no rule of the policy`,
+		},
+		{
+			name:        "authorized protobuf",
+			policy:      policy,
+			contentType: "application/x-protobuf",
+			body:        pushProtobuf(`{namespace="team-a", app="api"}`),
+			labels:      []string{`{app="api", namespace="team-a"}`},
+		},
+		{
+			name:    "unauthorized protobuf stream rejects the push",
+			policy:  policy,
+			body:    pushProtobuf(`{namespace="team-a"}`, `{namespace="team-b"}`),
+			wantErr: `stream {namespace="team-b"}: unauthorized namespace: team-b`,
+		},
+		{
+			name:     "protobuf label injected",
+			policy:   policy,
+			inject:   true,
+			body:     pushProtobuf(`{app="api"}`, `{}`),
+			injected: true,
+			labels:   []string{`{app="api", namespace="team-a"}`, `{namespace="team-a"}`},
+		},
+		{
+			name:    "invalid protobuf labels",
+			policy:  policy,
+			body:    pushProtobuf(`{namespace=}`),
+			wantErr: "invalid push request: invalid stream labels",
+		},
+		{
+			name:    "invalid snappy body",
+			policy:  policy,
+			body:    []byte("not snappy"),
+			wantErr: "invalid push request: invalid snappy body",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/loki/api/v1/push", bytes.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+
+			injected, err := enforcePush(req, tt.policy, tt.inject, DefaultMaxPushBodySize)
+
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.injected, injected)
+			body, _ := io.ReadAll(req.Body)
+			assert.Equal(t, int64(len(body)), req.ContentLength)
+			if tt.expected != "" {
+				assert.JSONEq(t, tt.expected, string(body))
+			}
+			if tt.labels != nil {
+				assert.Equal(t, tt.labels, pushProtobufLabels(t, body))
+			}
+		})
+	}
+}
+
+func TestEnforcePush_Gzip(t *testing.T) {
+	policy := &LabelPolicy{Rules: []LabelRule{{Name: "namespace", Operator: OperatorEquals, Values: []string{"team-a"}}}, Logic: LogicAND}
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, _ = gz.Write([]byte(`{"streams":[{"stream":{"namespace":"team-a"},"values":[]}]}`))
+	_ = gz.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/loki/api/v1/push", &compressed)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	_, err := enforcePush(req, policy, false, DefaultMaxPushBodySize)
+	assert.NoError(t, err)
+	assert.Empty(t, req.Header.Get("Content-Encoding"), "the body is forwarded uncompressed")
+
+	req = httptest.NewRequest(http.MethodPost, "/loki/api/v1/push", strings.NewReader("{}"))
+	req.Header.Set("Content-Encoding", "br")
+	_, err = enforcePush(req, policy, false, DefaultMaxPushBodySize)
+	assert.ErrorIs(t, err, errInvalidPush)
+}
+
+func TestEnforcePush_MaxBodySize(t *testing.T) {
+	policy := &LabelPolicy{Rules: []LabelRule{{Name: "namespace", Operator: OperatorEquals, Values: []string{"team-a"}}}, Logic: LogicAND}
+	const body = `{"streams":[{"stream":{"namespace":"team-a"},"values":[]}]}`
+	limit := int64(len(body))
+
+	req := httptest.NewRequest(http.MethodPost, "/loki/api/v1/push", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	_, err := enforcePush(req, policy, false, limit)
+	assert.NoError(t, err, "a body of exactly the limit is accepted")
+
+	req = httptest.NewRequest(http.MethodPost, "/loki/api/v1/push", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	_, err = enforcePush(req, policy, false, limit-1)
+	assert.ErrorIs(t, err, errPushTooLarge)
+
+	// A small gzip body expanding beyond the limit
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, _ = gz.Write([]byte(body + strings.Repeat(" ", 1<<20)))
+	_ = gz.Close()
+	req = httptest.NewRequest(http.MethodPost, "/loki/api/v1/push", &compressed)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	_, err = enforcePush(req, policy, false, 1<<10)
+	assert.ErrorIs(t, err, errPushTooLarge)
+
+	// A small snappy body whose decoded length exceeds the limit is rejected before decoding
+	req = httptest.NewRequest(http.MethodPost, "/loki/api/v1/push", bytes.NewReader(snappy.Encode(nil, make([]byte, 1<<20))))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	_, err = enforcePush(req, policy, false, 1<<10)
+	assert.ErrorIs(t, err, errPushTooLarge)
+}
+
+func TestLokiPushRoute(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = fmt.Fprintf(w, "%s %s", r.URL.Path, body)
+	}))
+	defer upstream.Close()
+
+	app, tokens := setupTestMain()
+	app.Cfg.Loki.URL = upstream.URL
+	app.WithProxies()
+	app.WithRoutes()
+
+	push := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/loki/api/v1/push", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+		rr := httptest.NewRecorder()
+		app.e.ServeHTTP(rr, req)
+		return rr
+	}
+	const authorized = `{"streams":[{"stream":{"tenant_id":"allowed_user"},"values":[]}]}`
+
+	assert.Equal(t, http.StatusNotFound, push(authorized).Code, "push is disabled by default")
+
+	app.Cfg.Loki.Push.Enabled = true
+	app.WithRoutes()
+
+	rr := push(authorized)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "/loki/api/v1/push "+authorized, rr.Body.String())
+
+	rr = push(`{"streams":[{"stream":{"tenant_id":"allowed_user"},"values":[]},{"stream":{"tenant_id":"forbidden_user"},"values":[]}]}`)
+	assert.Equal(t, http.StatusForbidden, rr.Code, rr.Body.String())
+
+	rr = push(`{"streams":`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code, rr.Body.String())
+
+	app.Cfg.Loki.Push.MaxBodySize = int64(len(authorized)) - 1
+	rr = push(authorized)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code, rr.Body.String())
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ErrUpstreamUnavailable marks requests rejected while the circuit breaker of their upstream
+// is open. They are answered with 503 Service Unavailable without reaching the upstream.
+var ErrUpstreamUnavailable = errors.New("upstream unavailable: circuit breaker open")
+
+var (
+	// upstreamRetriesTotal counts the retries of failed requests to each upstream.
+	upstreamRetriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "lgtm_lbac_proxy",
+		Name:      "upstream_retries_total",
+		Help:      "Total number of retried requests to the upstream.",
+	}, []string{"upstream"})
+
+	// upstreamBreakerRejectionsTotal counts the requests rejected by the open circuit breaker of
+	// each upstream.
+	upstreamBreakerRejectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "lgtm_lbac_proxy",
+		Name:      "upstream_breaker_rejections_total",
+		Help:      "Total number of requests rejected while the circuit breaker of the upstream was open.",
+	}, []string{"upstream"})
+)
+
+// resilientTransport retries failed requests to an upstream and stops sending requests to it
+// while it keeps failing. A request fails with a connection error or with a status of
+// retryOn, for retries, or of breakerOn, for the breaker.
+type resilientTransport struct {
+	next      http.RoundTripper
+	upstream  string
+	attempts  int // Retries after the first attempt
+	backoff   time.Duration
+	retryOn   []int
+	breakerOn []int
+	breaker   *circuitBreaker // nil if the breaker is disabled
+}
+
+// newResilientTransport wraps next with the retries and circuit breaker of proxyCfg, or returns
+// next if both are disabled. It returns an error for statuses that are not 4xx or 5xx.
+func newResilientTransport(next http.RoundTripper, proxyCfg ProxyConfig, upstream string) (http.RoundTripper, error) {
+	for name, statuses := range map[string][]int{"retry_on_status": proxyCfg.RetryOnStatus, "breaker_on_status": proxyCfg.BreakerOnStatus} {
+		for _, status := range statuses {
+			if status < 400 || status > 599 {
+				return nil, fmt.Errorf("%s: status %d must be a 4xx or 5xx status", name, status)
+			}
+		}
+	}
+	if proxyCfg.RetryAttempts <= 0 && proxyCfg.BreakerThreshold <= 0 {
+		return next, nil
+	}
+	t := &resilientTransport{
+		next:      next,
+		upstream:  upstream,
+		attempts:  max(proxyCfg.RetryAttempts, 0),
+		backoff:   proxyCfg.RetryBackoff,
+		retryOn:   proxyCfg.RetryOnStatus,
+		breakerOn: proxyCfg.BreakerOnStatus,
+	}
+	if proxyCfg.BreakerThreshold > 0 {
+		t.breaker = &circuitBreaker{threshold: proxyCfg.BreakerThreshold, cooldown: proxyCfg.BreakerCooldown, now: time.Now}
+	}
+	return t, nil
+}
+
+// RoundTrip sends req, retrying it if it is a GET or HEAD request without body and fails.
+// The response of the last attempt is returned as is, whether it failed or not.
+func (t *resilientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempts := 0
+	if (req.Method == http.MethodGet || req.Method == http.MethodHead) && (req.Body == nil || req.Body == http.NoBody) {
+		attempts = t.attempts
+	}
+	for attempt := 0; ; attempt++ {
+		if !t.breaker.allow() {
+			upstreamBreakerRejectionsTotal.WithLabelValues(t.upstream).Inc()
+			return nil, ErrUpstreamUnavailable
+		}
+		resp, err := t.next.RoundTrip(req)
+		// Requests canceled by the client say nothing about the upstream
+		if req.Context().Err() != nil {
+			t.breaker.release()
+		} else {
+			t.breaker.record(err != nil || slices.Contains(t.breakerOn, resp.StatusCode))
+		}
+		if attempt >= attempts || req.Context().Err() != nil || (err == nil && !slices.Contains(t.retryOn, resp.StatusCode)) {
+			return resp, err
+		}
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			_ = resp.Body.Close()
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(t.backoff):
+		}
+		upstreamRetriesTotal.WithLabelValues(t.upstream).Inc()
+	}
+}
+
+// CloseIdleConnections closes the idle connections of the wrapped transport.
+func (t *resilientTransport) CloseIdleConnections() {
+	if transport, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		transport.CloseIdleConnections()
+	}
+}
+
+// circuitBreaker opens after threshold consecutive failures and rejects requests for
+// cooldown. It then lets a single trial request through, closing again if it succeeds and
+// reopening if it fails. A nil *circuitBreaker allows every request.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+	failures  int       // Consecutive failures
+	openUntil time.Time // End of the cooldown of the open breaker
+	probing   bool      // A trial request is in flight
+}
+
+// allow reports whether a request may be sent.
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || b.now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record records the outcome of a request allowed by allow.
+func (b *circuitBreaker) record(failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = b.now().Add(b.cooldown)
+	}
+}
+
+// release records a request allowed by allow without outcome, such as one canceled by the
+// client, so that another trial request can be sent.
+func (b *circuitBreaker) release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
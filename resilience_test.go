@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// statusServer answers with the given statuses in turn, repeating the last one, and counts
+// the requests it receives.
+func statusServer(t *testing.T, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := int(calls.Add(1)) - 1
+		w.WriteHeader(statuses[min(i, len(statuses)-1)])
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestResilientTransport_RetryOnStatus(t *testing.T) {
+	tests := []struct {
+		name      string
+		retryOn   []int
+		method    string
+		statuses  []int
+		wantCode  int
+		wantCalls int32
+	}{
+		{name: "configured status is retried", retryOn: []int{429}, method: http.MethodGet, statuses: []int{429, 200}, wantCode: 200, wantCalls: 2},
+		{name: "other statuses pass through", retryOn: []int{429}, method: http.MethodGet, statuses: []int{503, 200}, wantCode: 503, wantCalls: 1},
+		{name: "default statuses", method: http.MethodGet, statuses: []int{503, 200}, wantCode: 200, wantCalls: 2},
+		{name: "429 is not retried by default", method: http.MethodGet, statuses: []int{429, 200}, wantCode: 429, wantCalls: 1},
+		{name: "last attempt is returned", retryOn: []int{429}, method: http.MethodGet, statuses: []int{429}, wantCode: 429, wantCalls: 3},
+		{name: "POST is never retried", retryOn: []int{429}, method: http.MethodPost, statuses: []int{429, 200}, wantCode: 429, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, calls := statusServer(t, tt.statuses...)
+			proxyCfg := (&Config{}).GetProxyConfig(&ProxyConfig{RetryAttempts: 2, RetryBackoff: time.Millisecond, RetryOnStatus: tt.retryOn})
+			transport, err := newResilientTransport(http.DefaultTransport, proxyCfg, "retry-test")
+			assert.NoError(t, err)
+
+			req, _ := http.NewRequest(tt.method, server.URL, nil)
+			if tt.method == http.MethodPost {
+				req, _ = http.NewRequest(tt.method, server.URL, strings.NewReader("query=up"))
+			}
+			resp, err := transport.RoundTrip(req)
+			if assert.NoError(t, err) {
+				_ = resp.Body.Close()
+				assert.Equal(t, tt.wantCode, resp.StatusCode)
+			}
+			assert.Equal(t, tt.wantCalls, calls.Load())
+		})
+	}
+}
+
+func TestResilientTransport_BreakerOnStatus(t *testing.T) {
+	const name = "breaker-test"
+	server, calls := statusServer(t, 429, 429, 500, 500, 500, 200)
+	proxyCfg := (&Config{}).GetProxyConfig(&ProxyConfig{BreakerThreshold: 2, BreakerCooldown: time.Minute, BreakerOnStatus: []int{500}})
+	rt, err := newResilientTransport(http.DefaultTransport, proxyCfg, name)
+	assert.NoError(t, err)
+	transport := rt.(*resilientTransport)
+	now := time.Now()
+	transport.breaker.now = func() time.Time { return now }
+
+	send := func() (int, error) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			return 0, err
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	// Statuses not configured as failures pass through without opening the breaker
+	for range 2 {
+		code, err := send()
+		assert.NoError(t, err)
+		assert.Equal(t, 429, code)
+	}
+
+	// Two consecutive configured failures open it
+	for range 2 {
+		code, err := send()
+		assert.NoError(t, err)
+		assert.Equal(t, 500, code)
+	}
+	rejected := testutil.ToFloat64(upstreamBreakerRejectionsTotal.WithLabelValues(name))
+	_, err = send()
+	assert.ErrorIs(t, err, ErrUpstreamUnavailable)
+	assert.Equal(t, int32(4), calls.Load(), "the open breaker does not reach the upstream")
+	assert.Equal(t, rejected+1, testutil.ToFloat64(upstreamBreakerRejectionsTotal.WithLabelValues(name)))
+
+	// After the cooldown a failed trial request reopens it, and a successful one closes it
+	now = now.Add(time.Minute)
+	code, err := send()
+	assert.NoError(t, err)
+	assert.Equal(t, 500, code)
+	_, err = send()
+	assert.ErrorIs(t, err, ErrUpstreamUnavailable)
+
+	now = now.Add(time.Minute)
+	code, err = send()
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	code, err = send()
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+}
+
+func TestResilientTransport_Config(t *testing.T) {
+	next := http.DefaultTransport
+	transport, err := newResilientTransport(next, (&Config{}).GetProxyConfig(nil), "config-test")
+	assert.NoError(t, err)
+	assert.Same(t, next, transport, "retries and breaker are disabled by default")
+
+	_, err = newResilientTransport(next, ProxyConfig{RetryAttempts: 1, RetryOnStatus: []int{200}}, "config-test")
+	assert.ErrorContains(t, err, "retry_on_status")
+	_, err = newResilientTransport(next, ProxyConfig{BreakerOnStatus: []int{600}}, "config-test")
+	assert.ErrorContains(t, err, "breaker_on_status")
+
+	// Upstream statuses replace the global ones
+	cfg := &Config{Proxy: ProxyConfig{RetryOnStatus: []int{503}, BreakerOnStatus: []int{503}}}
+	proxyCfg := cfg.GetProxyConfig(&ProxyConfig{RetryOnStatus: []int{429}})
+	assert.Equal(t, []int{429}, proxyCfg.RetryOnStatus)
+	assert.Equal(t, []int{503}, proxyCfg.BreakerOnStatus)
+}
+
+// TestUpstreamProxy_BreakerOpen tests that requests rejected by the open breaker are answered
+// with 503 by the reverse proxy.
+func TestUpstreamProxy_BreakerOpen(t *testing.T) {
+	server, _ := statusServer(t, http.StatusServiceUnavailable)
+	app := &App{Cfg: &Config{Thanos: ThanosConfig{URL: server.URL, Proxy: &ProxyConfig{BreakerThreshold: 1}}}}
+	proxy, err := app.newUpstreamProxy("thanos")
+	assert.NoError(t, err)
+
+	// The upstream's 503 opens the breaker, which answers the next request itself
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.NotContains(t, rr.Body.String(), "circuit breaker open")
+
+	rr = httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Contains(t, rr.Body.String(), "circuit breaker open")
+}
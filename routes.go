@@ -3,30 +3,74 @@ package main
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httputil"
 	"net/http/pprof"
 	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
 
 	"github.com/rs/zerolog/log"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Route struct {
 	Url       string
 	MatchWord string
+	// Streaming marks long-lived endpoints such as tail, whose responses are flushed to the
+	// client as soon as they are written and never buffered, mirrored or rewritten.
+	Streaming bool
+	// TenantLabel overrides the upstream's tenant label on this route, set from the
+	// upstream's route_tenant_labels.
+	TenantLabel string
+	// Query sets how requests with an absent or empty query parameter are handled, set from
+	// the upstream's route_query_handling.
+	Query QueryHandling
+	// ValidateOnly marks routes that parse the query without executing it, whose query is
+	// checked against the policy but forwarded unchanged.
+	ValidateOnly bool
 }
 
-// WithHealthz sets up and adds health check endpoints (/healthz and /debug/pprof/)
-// and metrics endpoint (/metrics) to a new router
+// formatQueryHandling rejects format_query requests without a query, which would otherwise
+// format the query built from the user's policy.
+var formatQueryHandling = QueryHandling{Absent: QueryReject, Empty: QueryReject}
+
+// Maintenance mode response defaults
+const (
+	DefaultMaintenanceMessage    = "Service is under maintenance, please retry later"
+	DefaultMaintenanceRetryAfter = 300
+)
+
+// Response formats for unregistered paths
+const (
+	NotFoundFormatText = "text"
+	NotFoundFormatJSON = "json"
+)
+
+// notFoundJSON is the JSON 404 body, shaped like a Prometheus API error.
+const notFoundJSON = `{"status":"error","errorType":"not_found","error":"not found"}`
+
+// jwksCheckTimeout bounds how long /-/jwks-check waits for each JWKS endpoint.
+const jwksCheckTimeout = 10 * time.Second
+
+// WithHealthz sets up and adds health check endpoints (/healthz, /readyz, /-/jwks-check and
+// /debug/pprof/) and metrics endpoint (/metrics) to a new router. Unlike /healthz, /readyz
+// also reports not ready while the label store cannot serve policies.
 func (a *App) WithHealthz() *App {
 	i := mux.NewRouter()
 	a.healthy = true
 	i.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		if a.healthy {
+		if a.snapshot().healthy {
 			w.WriteHeader(http.StatusOK)
 			_, _ = w.Write([]byte("Ok"))
 		} else {
@@ -34,34 +78,228 @@ func (a *App) WithHealthz() *App {
 			_, _ = w.Write([]byte("Not Ok"))
 		}
 	})
+	i.HandleFunc("/readyz", a.readyzHandler)
+	i.HandleFunc("/-/jwks-check", a.jwksCheckHandler).Methods(http.MethodGet)
 	i.HandleFunc("/debug/pprof/", pprof.Index)
 	i.Handle("/metrics", promhttp.Handler())
 	a.i = i
 	return a
 }
 
-// WithRoutes initializes a new router, sets up logging middleware, and assigns
-// the router to the App's router field, returning the updated App.
+// readyzHandler reports whether the proxy is ready to serve requests: the configuration is
+// healthy and the label store, if it can tell, has policies loaded from a successful reload.
+func (a *App) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	a = a.snapshot()
+	if !a.healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("Not Ready: invalid configuration"))
+		return
+	}
+	if checker, ok := a.LabelStore.(LabelstoreHealthChecker); ok {
+		if err := checker.Health(); err != nil {
+			log.Debug().Err(err).Msg("Label store not ready")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("Not Ready: " + err.Error()))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("Ok"))
+}
+
+// jwksCheckHandler re-fetches every configured JWKS URL and reports reachability, key count
+// and refresh time as JSON. It responds with 503 if any endpoint is unreachable or invalid.
+func (a *App) jwksCheckHandler(w http.ResponseWriter, r *http.Request) {
+	a = a.snapshot()
+	ctx, cancel := context.WithTimeout(r.Context(), jwksCheckTimeout)
+	defer cancel()
+
+	client := &http.Client{Timeout: jwksCheckTimeout}
+	result := struct {
+		Healthy   bool         `json:"healthy"`
+		Endpoints []JWKSStatus `json:"endpoints"`
+	}{Healthy: true}
+
+	for _, u := range a.jwksURLs() {
+		status := checkJWKS(ctx, client, u)
+		if !status.Reachable {
+			result.Healthy = false
+			log.Warn().Str("url", u).Str("error", status.Error).Msg("JWKS check failed")
+		}
+		result.Endpoints = append(result.Endpoints, status)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// configHandler serves the effective configuration, after migration of legacy settings and
+// defaults, as JSON with credentials redacted. It is only available to admins.
+func (a *App) configHandler(w http.ResponseWriter, r *http.Request) {
+	a = requestApp(r, a)
+	token, err := getToken(r, a)
+	if err != nil {
+		a.writeTokenError(w, r, err)
+		return
+	}
+	if !isAdmin(token, a) {
+		logAndWriteError(w, http.StatusForbidden, nil, "admin access required")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(a.Cfg.Redacted())
+}
+
+// myTenantsResponse is the body of /-/my-tenants.
+type myTenantsResponse struct {
+	ClusterWide bool                `json:"cluster_wide"`
+	Logic       string              `json:"logic,omitempty"`
+	Labels      map[string][]string `json:"labels"`             // Values allowed per label, from LabelPolicy.ToSimpleLabels
+	Excluded    map[string][]string `json:"excluded,omitempty"` // Values excluded per label by negative rules
+}
+
+// myTenantsHandler answers with the label values the caller's policy allows, so that
+// dashboards can populate template variables with the tenants the user can see. The
+// optional upstream parameter (thanos, loki or tempo) resolves the policy as requests to
+// that upstream would, including its tenant label and scoped cluster-wide access. Users
+// with cluster-wide access get the #cluster-wide sentinel instead of their labels.
+func (a *App) myTenantsHandler(w http.ResponseWriter, r *http.Request) {
+	a = requestApp(r, a)
+	token, err := getToken(r, a)
+	if err != nil {
+		a.writeTokenError(w, r, err)
+		return
+	}
+
+	upstream := r.URL.Query().Get("upstream")
+	switch upstream {
+	case "", "thanos", "loki", "tempo":
+	default:
+		logAndWriteError(w, http.StatusBadRequest, nil, fmt.Sprintf("unknown upstream %q: must be thanos, loki or tempo", upstream))
+		return
+	}
+
+	policy, skip, err := validateLabelPolicy(token, a, upstream, "")
+	if err != nil {
+		a.writeDenied(w, upstream, token, err)
+		return
+	}
+
+	response := myTenantsResponse{ClusterWide: true, Labels: map[string][]string{clusterWideLabel(): {"true"}}}
+	if !skip {
+		response = myTenantsResponse{Logic: policy.Logic, Labels: policy.ToSimpleLabels()}
+		for _, rule := range policy.Rules {
+			if !rule.IsNegative() {
+				continue
+			}
+			if response.Excluded == nil {
+				response.Excluded = make(map[string][]string)
+			}
+			response.Excluded[rule.Name] = append(response.Excluded[rule.Name], rule.Values...)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// writeMaintenanceResponse rejects a request with 503 and a Retry-After hint while
+// maintenance mode is enabled.
+func writeMaintenanceResponse(w http.ResponseWriter, cfg WebConfig) {
+	retryAfter := cfg.MaintenanceRetryAfter
+	if retryAfter <= 0 {
+		retryAfter = DefaultMaintenanceRetryAfter
+	}
+	message := cfg.MaintenanceMessage
+	if message == "" {
+		message = DefaultMaintenanceMessage
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	logAndWriteError(w, http.StatusServiceUnavailable, nil, message)
+}
+
+// WithRoutes builds the router of the configuration with newRouter and serves requests with
+// it through a.e, returning the updated App. Each request is routed with the router of the
+// snapshot it is served with, so a reload replacing the router never mixes the routes of one
+// configuration with the settings of another.
 func (a *App) WithRoutes() *App {
+	router, err := a.newRouter()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid route configuration")
+	}
+	if a.mu != nil {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+	}
+	a.router = router
+	a.e = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		snapshot := a.snapshot()
+		snapshot.router.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), appContextKey, snapshot)))
+	})
+	return a
+}
+
+// newRouter returns a router with request ID and logging middleware and the routes of a.Cfg.
+// Besides the upstream routes, it serves the effective configuration to admins on /-/config.
+// The route settings, such as the enforcers and their operators, are taken from a.Cfg, so the
+// router is rebuilt on reload. It returns an error if the route settings are invalid.
+func (a *App) newRouter() (*mux.Router, error) {
 	e := mux.NewRouter()
+	e.Use(a.requestIDMiddleware)
 	e.Use(a.loggingMiddleware)
 	e.SkipClean(true)
-	a.e = e
-	a.WithLoki()
-	a.WithThanos()
-	a.WithTempo()
-	return a
+	notFound, err := a.notFoundHandler()
+	if err != nil {
+		return nil, err
+	}
+	e.NotFoundHandler = notFound
+	e.HandleFunc("/-/config", a.configHandler).Methods(http.MethodGet)
+	e.HandleFunc("/-/my-tenants", a.myTenantsHandler).Methods(http.MethodGet)
+	for _, withRoutes := range []func(*mux.Router) error{a.WithLoki, a.WithThanos, a.WithTempo} {
+		if err := withRoutes(e); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
 }
 
-// WithLoki configures and adds a set of Loki API routes to the App's router,
-// logging warnings if the Loki URL is not set, and returns the updated App.
+// notFoundHandler answers every unregistered path with the same 404, in the configured text
+// or JSON format, so responses do not reveal which upstreams are configured. Router middleware
+// does not run for unmatched routes, so request ID and logging middleware are applied here.
+func (a *App) notFoundHandler() (http.Handler, error) {
+	format := strings.ToLower(a.Cfg.Web.NotFoundFormat)
+	switch format {
+	case "", NotFoundFormatText, NotFoundFormatJSON:
+	default:
+		return nil, fmt.Errorf("invalid web.not_found_format %q: must be text or json", a.Cfg.Web.NotFoundFormat)
+	}
+
+	return a.requestIDMiddleware(a.loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if format == NotFoundFormatJSON {
+			w.Header().Set("Content-Type", "application/json")
+			logAndWriteError(w, http.StatusNotFound, nil, notFoundJSON)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		logAndWriteError(w, http.StatusNotFound, nil, "not found")
+	}))), nil
+}
+
+// WithLoki configures and adds a set of Loki API routes to the router e,
+// logging warnings if the Loki URL is not set. It returns an error if the Loki route
+// settings are invalid.
 //
 // Routes are based on Loki HTTP API Query Endpoints:
 // https://grafana.com/docs/loki/latest/reference/loki-http-api/#query-endpoints
-func (a *App) WithLoki() *App {
+func (a *App) WithLoki(e *mux.Router) error {
 	if a.Cfg.Loki.URL == "" {
 		log.Warn().Msg("Loki URL not set, skipping Loki routes")
-		return a
+		return nil
 	}
 	routes := []Route{
 		// Query Endpoints - https://grafana.com/docs/loki/latest/reference/loki-http-api/#instant-queries
@@ -82,34 +320,77 @@ func (a *App) WithLoki() *App {
 		{Url: "/api/v1/index/volume_range", MatchWord: "query"},
 		// Patterns - https://grafana.com/docs/loki/latest/reference/loki-http-api/#detected-patterns
 		{Url: "/api/v1/patterns", MatchWord: "query"},
+		// Detected Fields - https://grafana.com/docs/loki/latest/reference/loki-http-api/#query-detected-fields
+		{Url: "/api/v1/detected_fields", MatchWord: "query"},
+		// Detected Field Values - https://grafana.com/docs/loki/latest/reference/loki-http-api/#query-detected-field-values
+		{Url: "/api/v1/detected_field/{name}/values", MatchWord: "query"},
+		// Detected Labels - https://grafana.com/docs/loki/latest/reference/loki-http-api/#query-detected-labels
+		// Note: The query is optional; without one the labels of all streams of the policy are returned
+		{Url: "/api/v1/detected_labels", MatchWord: "query"},
+		// Drilldown Limits - used by Grafana Logs Drilldown; returns tenant limits, no log data
+		{Url: "/api/v1/drilldown-limits", MatchWord: "query"},
 		// Tail - https://grafana.com/docs/loki/latest/reference/loki-http-api/#stream-logs
-		{Url: "/api/v1/tail", MatchWord: "query"},
+		{Url: "/api/v1/tail", MatchWord: "query", Streaming: true},
 		// Additional Loki endpoints (not query endpoints)
 		// Format Query - https://grafana.com/docs/loki/latest/reference/loki-http-api/#format-a-logql-query
-		{Url: "/api/v1/format_query", MatchWord: "query"},
+		// Note: The query is only formatted, so it is validated but not scoped
+		{Url: "/api/v1/format_query", MatchWord: "query", Query: formatQueryHandling, ValidateOnly: true},
 		// Build Info - https://grafana.com/docs/loki/latest/reference/loki-http-api/#show-build-information
 		{Url: "/api/v1/status/buildinfo", MatchWord: "query"},
 		// Query Exemplars - Prometheus endpoint (https://prometheus.io/docs/prometheus/latest/querying/api/#querying-exemplars)
 		// Note: This is a Prometheus/Thanos endpoint, not a Loki endpoint, but included for compatibility
 		{Url: "/api/v1/query_exemplars", MatchWord: "query"},
 	}
-	lokiRouter := a.e.PathPrefix("/loki").Subrouter()
-	proxyCfg := a.Cfg.GetProxyConfig(a.Cfg.Loki.Proxy)
+	lokiRouter := e.PathPrefix("/loki").Subrouter()
+	auth, err := newUpstreamAuth(a.Cfg.Loki.AuthMode, a.Cfg.Loki.StaticToken, a.Cfg.Loki.ClientAuthorization, a.Cfg.Loki.UseMutualTLS, "loki")
+	if err != nil {
+		return err
+	}
+	if a.Cfg.Loki.Push.Enabled {
+		// Push - https://grafana.com/docs/loki/latest/reference/loki-http-api/#ingest-logs
+		// Note: The pushed streams are verified instead of a query, usually on another URL (route_urls)
+		routes = append(routes, Route{Url: lokiPushRoute})
+	}
+	routes = withRouteTenantLabels(routes, a.Cfg.Loki.RouteTenantLabels, "loki")
+	if routes, err = withRouteQueryHandling(routes, a.Cfg.Loki.RouteQueryHandling, "loki"); err != nil {
+		return err
+	}
+	validateRouteURLs(a.Cfg.Loki.RouteURLs, routes, "loki")
+	if err := validateExtraQueryParams(a.Cfg.Loki.ExtraQueryParams, routes, "loki"); err != nil {
+		return err
+	}
+	validateRouteTimeouts(a.Cfg.Loki.Proxy, routes, "loki")
 	for _, route := range routes {
 		log.Trace().Any("route", route).Msg("Loki route")
-		lokiRouter.HandleFunc(route.Url, handlerWithProxy(route.MatchWord,
-			LogQLEnforcer(struct{}{}),
-			a.lokiProxy,
-			proxyCfg,
-			a.Cfg.Loki.UseMutualTLS,
+		if route.Url == lokiPushRoute {
+			lokiRouter.HandleFunc(route.Url, pushHandler(route, auth, a.Cfg.Loki.Headers, a)).Methods(http.MethodPost).Name(route.Url)
+			continue
+		}
+		operators, err := newLabelOperatorFilter(routeTenantLabels(route, a.Cfg.Loki.TenantLabel),
+			a.Cfg.Loki.TenantLabelOperators, a.Cfg.Loki.LabelOperators, matcherOperators, "loki")
+		if err != nil {
+			return err
+		}
+		lokiRouter.HandleFunc(route.Url, handlerWithProxy(route,
+			a.Cfg.Loki.QueryJSONPath,
+			LogQLEnforcer{
+				UserLabels: UserLabelFilter{
+					Allowed:   a.Cfg.Loki.AllowedUserLabels,
+					Forbidden: a.Cfg.Loki.ForbiddenUserLabels,
+				},
+				Operators:         operators,
+				AnchorRegexValues: a.Cfg.Web.AnchorRegexValues,
+			},
+			auth,
 			a.Cfg.Loki.Headers,
 			a)).Name(route.Url)
 	}
-	return a
+	return nil
 }
 
-// WithTempo configures and adds a set of Tempo API routes to the App's router,
-// logging warnings if the Tempo URL is not set, and returns the updated App.
+// WithTempo configures and adds a set of Tempo API routes to the router e,
+// logging warnings if the Tempo URL is not set. It returns an error if the Tempo route
+// settings are invalid.
 //
 // Routes are based on Tempo HTTP API:
 // https://grafana.com/docs/tempo/latest/api_docs/
@@ -118,10 +399,10 @@ func (a *App) WithLoki() *App {
 // There are no conflicts with Thanos routes because:
 // - Thanos uses /api/v1/* exclusively
 // - Tempo uses /api/search, /api/v2/*, /api/metrics/*, /api/echo, /api/traces/*
-func (a *App) WithTempo() *App {
+func (a *App) WithTempo(e *mux.Router) error {
 	if a.Cfg.Tempo.URL == "" {
 		log.Warn().Msg("Tempo URL not set, skipping Tempo routes")
-		return a
+		return nil
 	}
 	routes := []Route{
 		// Query Echo - https://grafana.com/docs/tempo/latest/api_docs/#query-echo-endpoint
@@ -140,34 +421,58 @@ func (a *App) WithTempo() *App {
 		{Url: "/api/metrics/query_range", MatchWord: "q"},
 		{Url: "/api/metrics/query", MatchWord: "q"},
 		// Trace Retrieval - https://grafana.com/docs/tempo/latest/api_docs/#query
-		// Note: These endpoints don't use query parameters, so enforcement is skipped
+		// Note: These endpoints don't use query parameters, so enforcement is skipped; with
+		// tempo.verify_trace_tenant the returned trace is verified against the policy instead
 		{Url: "/api/traces/{traceID}", MatchWord: ""},
 		{Url: "/api/v2/traces/{traceID}", MatchWord: ""},
 	}
-	tempoRouter := a.e.PathPrefix("").Subrouter()
-	proxyCfg := a.Cfg.GetProxyConfig(a.Cfg.Tempo.Proxy)
+	tempoRouter := e.PathPrefix("").Subrouter()
+	auth, err := newUpstreamAuth(a.Cfg.Tempo.AuthMode, a.Cfg.Tempo.StaticToken, a.Cfg.Tempo.ClientAuthorization, a.Cfg.Tempo.UseMutualTLS, "tempo")
+	if err != nil {
+		return err
+	}
+	if routes, err = withRouteQueryHandling(routes, a.Cfg.Tempo.RouteQueryHandling, "tempo"); err != nil {
+		return err
+	}
+	if err := validateExtraQueryParams(a.Cfg.Tempo.ExtraQueryParams, routes, "tempo"); err != nil {
+		return err
+	}
+	validateRouteTimeouts(a.Cfg.Tempo.Proxy, routes, "tempo")
+	operators, err := newLabelOperatorFilter(a.Cfg.Tempo.TenantLabels,
+		a.Cfg.Tempo.TenantLabelOperators, a.Cfg.Tempo.LabelOperators, traceQLOperators, "tempo")
+	if err != nil {
+		return err
+	}
 	for _, route := range routes {
 		log.Trace().Any("route", route).Msg("Tempo route")
-		tempoRouter.HandleFunc(route.Url, handlerWithProxy(route.MatchWord,
-			TraceQLEnforcer(struct{}{}),
-			a.tempoProxy,
-			proxyCfg,
-			a.Cfg.Tempo.UseMutualTLS,
+		tempoRouter.HandleFunc(route.Url, handlerWithProxy(route,
+			a.Cfg.Tempo.QueryJSONPath,
+			TraceQLEnforcer{
+				UserLabels: UserLabelFilter{
+					Allowed:   a.Cfg.Tempo.AllowedUserLabels,
+					Forbidden: a.Cfg.Tempo.ForbiddenUserLabels,
+				},
+				Operators:         operators,
+				TenantLabels:      a.Cfg.Tempo.TenantLabels,
+				AnchorRegexValues: a.Cfg.Web.AnchorRegexValues,
+			},
+			auth,
 			a.Cfg.Tempo.Headers,
 			a)).Name(route.Url)
 	}
-	return a
+	return nil
 }
 
-// WithThanos configures and adds a set of Thanos API routes to the App's router,
-// logging warnings if the Thanos URL is not set, and returns the updated App.
+// WithThanos configures and adds a set of Thanos API routes to the router e,
+// logging warnings if the Thanos URL is not set. It returns an error if the Thanos route
+// settings are invalid.
 //
 // Routes are based on Prometheus HTTP API:
 // https://prometheus.io/docs/prometheus/latest/querying/api/
-func (a *App) WithThanos() *App {
+func (a *App) WithThanos(e *mux.Router) error {
 	if a.Cfg.Thanos.URL == "" {
 		log.Warn().Msg("Thanos URL not set, skipping Thanos routes")
-		return a
+		return nil
 	}
 	routes := []Route{
 		// Query Endpoints - https://prometheus.io/docs/prometheus/latest/querying/api/#instant-queries
@@ -175,7 +480,8 @@ func (a *App) WithThanos() *App {
 		// Range Queries - https://prometheus.io/docs/prometheus/latest/querying/api/#range-queries
 		{Url: "/api/v1/query_range", MatchWord: "query"},
 		// Format Query - https://prometheus.io/docs/prometheus/latest/querying/api/#formatting-query-expressions
-		{Url: "/api/v1/format_query", MatchWord: "query"},
+		// Note: The query is only formatted, so it is validated but not scoped
+		{Url: "/api/v1/format_query", MatchWord: "query", Query: formatQueryHandling, ValidateOnly: true},
 		// Metadata Endpoints
 		// Series - https://prometheus.io/docs/prometheus/latest/querying/api/#finding-series-by-label-matchers
 		{Url: "/api/v1/series", MatchWord: "match[]"},
@@ -185,77 +491,215 @@ func (a *App) WithThanos() *App {
 		{Url: "/api/v1/label/{label}/values", MatchWord: "match[]"},
 		// Query Exemplars - https://prometheus.io/docs/prometheus/latest/querying/api/#querying-exemplars
 		{Url: "/api/v1/query_exemplars", MatchWord: "query"},
-		// Metadata - https://prometheus.io/docs/prometheus/latest/querying/api/#querying-metric-metadata
-		{Url: "/api/v1/metadata", MatchWord: "query"},
 		// Status Endpoints
 		// Build Info - https://prometheus.io/docs/prometheus/latest/querying/api/#build-information
 		{Url: "/api/v1/status/buildinfo", MatchWord: "query"},
 		// Non-Prometheus endpoints (Thanos or compatibility)
 		// Note: These endpoints are not part of standard Prometheus API
-		{Url: "/api/v1/tail", MatchWord: "query"},
+		{Url: "/api/v1/tail", MatchWord: "query", Streaming: true},
 		{Url: "/api/v1/index/stats", MatchWord: "query"},
 	}
-	thanosRouter := a.e.PathPrefix("").Subrouter()
-	proxyCfg := a.Cfg.GetProxyConfig(a.Cfg.Thanos.Proxy)
+	thanosRouter := e.PathPrefix("").Subrouter()
+	auth, err := newUpstreamAuth(a.Cfg.Thanos.AuthMode, a.Cfg.Thanos.StaticToken, a.Cfg.Thanos.ClientAuthorization, a.Cfg.Thanos.UseMutualTLS, "thanos")
+	if err != nil {
+		return err
+	}
+	// Metadata has no labels to enforce, so the limit parameter is enforced instead.
+	metadataRoute := Route{Url: "/api/v1/metadata", MatchWord: "limit"}
+	routes = withRouteTenantLabels(append(routes, metadataRoute), a.Cfg.Thanos.RouteTenantLabels, "thanos")
+	if routes, err = withRouteQueryHandling(routes, a.Cfg.Thanos.RouteQueryHandling, "thanos"); err != nil {
+		return err
+	}
+	routes, metadataRoute = routes[:len(routes)-1], routes[len(routes)-1]
+	if err := validateExtraQueryParams(a.Cfg.Thanos.ExtraQueryParams, append(routes, metadataRoute), "thanos"); err != nil {
+		return err
+	}
+	validateRouteTimeouts(a.Cfg.Thanos.Proxy, append(routes, metadataRoute), "thanos")
 	for _, route := range routes {
 		log.Trace().Any("route", route).Msg("Thanos route")
+		operators, err := newLabelOperatorFilter(routeTenantLabels(route, a.Cfg.Thanos.TenantLabel),
+			a.Cfg.Thanos.TenantLabelOperators, a.Cfg.Thanos.LabelOperators, matcherOperators, "thanos")
+		if err != nil {
+			return err
+		}
 		thanosRouter.HandleFunc(route.Url,
-			handlerWithProxy(route.MatchWord,
-				PromQLEnforcer(struct{}{}),
-				a.thanosProxy,
-				proxyCfg,
-				a.Cfg.Thanos.UseMutualTLS,
+			handlerWithProxy(route,
+				a.Cfg.Thanos.QueryJSONPath,
+				PromQLEnforcer{
+					UserLabels: UserLabelFilter{
+						Allowed:   a.Cfg.Thanos.AllowedUserLabels,
+						Forbidden: a.Cfg.Thanos.ForbiddenUserLabels,
+					},
+					Operators:         operators,
+					DenyAtModifiers:   a.Cfg.Thanos.DenyAtModifiers,
+					AnchorRegexValues: a.Cfg.Web.AnchorRegexValues,
+				},
+				auth,
 				a.Cfg.Thanos.Headers,
 				a)).Name(route.Url)
 
 	}
-	return a
+
+	// Metadata - https://prometheus.io/docs/prometheus/latest/querying/api/#querying-metric-metadata
+	thanosRouter.HandleFunc(metadataRoute.Url,
+		handlerWithProxy(metadataRoute,
+			"",
+			MetadataEnforcer{Deny: a.Cfg.Thanos.DenyMetadata, MaxLimit: a.Cfg.Thanos.MetadataLimit},
+			auth,
+			a.Cfg.Thanos.Headers,
+			a)).Name(metadataRoute.Url)
+	return nil
 }
 
+// contextKey is the type of the request context keys set by the proxy, so they cannot
+// collide with keys set by other packages.
+type contextKey int
+
+const (
+	usernameContextKey    contextKey = iota // Username of the authenticated user, read for the actor header
+	emailContextKey                         // Email of the authenticated user, read for the actor header
+	actorClaimContextKey                    // Values of the actor claims of the authenticated user, read for the actor header
+	labelValuesContextKey                   // *labelValuesFilter of label values responses to filter
+	traceTenantContextKey                   // *traceTenantVerifier of trace by ID responses to verify
+	logLevelContextKey                      // zerolog.Level requested by the debug header, if accepted
+	appContextKey                           // *App snapshot the request is served with, see requestApp
+)
+
 // handlerWithProxy orchestrates the request flow through the proxy using pre-created
 // reverse proxy instances, comprising authentication, conditional enforcement, request
 // timeouts, and forwarding to the upstream server.
 //
 // This function uses pre-created proxy instances for better performance through connection
-// reuse and per-upstream configuration. Request timeouts are enforced using context deadlines.
-func handlerWithProxy(matchWord string, enforcer EnforceQL, proxy *httputil.ReverseProxy, proxyCfg ProxyConfig, tls bool, headers map[string]string, a *App) func(http.ResponseWriter, *http.Request) {
+// reuse and per-upstream configuration. Request timeouts are enforced using context deadlines,
+// with the timeout of the route if one is configured.
+// When queryJSONPath is set, queries in JSON POST bodies are enforced at that path.
+//
+// Streaming routes are flushed immediately regardless of the upstream flush_interval, and
+// their responses are neither mirrored to a shadow upstream nor filtered.
+func handlerWithProxy(route Route, queryJSONPath string, enforcer EnforceQL, auth upstreamAuth, headers map[string]string, a *App) func(http.ResponseWriter, *http.Request) {
+	ql := queryLanguage(enforcer)
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Create timeout context for the request
-		ctx, cancel := context.WithTimeout(r.Context(), proxyCfg.RequestTimeout)
+		// The request keeps the configuration and proxy it starts with if they are reloaded
+		a := requestApp(r, a)
+		if a.Cfg.Web.MaintenanceMode {
+			writeMaintenanceResponse(w, a.Cfg.Web)
+			return
+		}
+
+		upstream := a.proxyFor(upstreamName(ql)).forRoute(route.Url)
+		proxy := upstream.ReverseProxy
+		if route.Streaming {
+			streamingProxy := *proxy
+			streamingProxy.FlushInterval = -1
+			proxy = &streamingProxy
+		}
+
+		// Create timeout context for the request, overridden per route by proxy.route_timeouts
+		ctx, cancel := context.WithTimeout(r.Context(), upstream.cfg.requestTimeout(route.Url))
 		defer cancel()
 		r = r.WithContext(ctx)
 
 		oauthToken, err := getToken(r, a)
 		if err != nil {
-			logAndWriteError(w, http.StatusForbidden, err, "")
+			a.auditDecision(r, oauthToken, upstreamName(ql), EnforcementDenied, nil, err)
+			a.writeTokenError(w, r, err)
+			return
+		}
+
+		if err := validateScopes(oauthToken, a.requiredScopes(upstreamName(ql))); err != nil {
+			a.auditDecision(r, oauthToken, upstreamName(ql), EnforcementDenied, nil, err)
+			a.writeDenied(w, upstreamName(ql), oauthToken, err)
 			return
 		}
 
 		// Policy-based enforcement (only method supported)
-		policy, skip, err := validateLabelPolicy(oauthToken, a)
+		policy, skip, err := validateLabelPolicy(oauthToken, a, upstreamName(ql), route.TenantLabel)
 		if err != nil {
-			logAndWriteError(w, http.StatusForbidden, err, "")
+			a.auditDecision(r, oauthToken, upstreamName(ql), EnforcementDenied, nil, err)
+			a.writeDenied(w, upstreamName(ql), oauthToken, err)
 			return
 		}
 
 		// Store user information in context for actor header injection in Director function
-		ctx = context.WithValue(ctx, "username", oauthToken.PreferredUsername)
-		ctx = context.WithValue(ctx, "email", oauthToken.Email)
+		ctx = context.WithValue(ctx, usernameContextKey, oauthToken.PreferredUsername)
+		ctx = context.WithValue(ctx, emailContextKey, oauthToken.Email)
+		ctx = context.WithValue(ctx, actorClaimContextKey, oauthToken.claimValues(a.actorClaim(upstreamName(ql))))
 		r = r.WithContext(ctx)
 
+		_, span := tracer().Start(ctx, "enforce", trace.WithAttributes(
+			AttrUpstream.String(upstreamName(ql)),
+			AttrQL.String(ql),
+		))
 		if skip {
-			setHeaders(r, tls, headers, a.ServiceAccountToken)
+			enforcementTotal.WithLabelValues(ql, EnforcementBypassed, DecisionSkipped).Inc()
+			endEnforcementSpan(span, EnforcementBypassed, nil)
+			a.auditDecision(r, oauthToken, upstreamName(ql), EnforcementBypassed, nil, nil)
+			setHeaders(r, auth, headers, a.ServiceAccountToken)
+			setQueryParams(r, a.extraQueryParams(upstreamName(ql)), route.MatchWord)
+			if a.coalesceRequests(upstreamName(ql)) && !route.Streaming {
+				a.serveCoalesced(w, r, upstream, upstreamName(ql), nil)
+				return
+			}
 			proxy.ServeHTTP(w, r)
 			return
 		}
 
-		err = enforceRequest(r, enforcer, policy, matchWord)
+		var deniedQuery string
+		var traced EnforceQL = tracedEnforcer{EnforceQL: enforcer, span: span, includeRewritten: a.Cfg.Log.Level == -1, denied: &deniedQuery}
+		if route.ValidateOnly {
+			traced = validatingEnforcer{traced}
+		}
+		start := time.Now()
+		injected, err := enforceRequest(r, traced, policy, route.MatchWord, queryJSONPath, route.Query)
+		enforcementDuration.WithLabelValues(ql).Observe(time.Since(start).Seconds())
 		if err != nil {
-			logAndWriteError(w, http.StatusForbidden, err, "")
+			enforcementTotal.WithLabelValues(ql, EnforcementDenied, DecisionDenied).Inc()
+			endEnforcementSpan(span, EnforcementDenied, err)
+			a.auditDecision(r, oauthToken, upstreamName(ql), EnforcementDenied, policy, err)
+			if errors.Is(err, ErrUnsupportedQuery) {
+				logAndWriteError(w, http.StatusBadRequest, err, "")
+				return
+			}
+			if errors.Is(err, ErrUnenforceableQuery) {
+				logAndWriteError(w, http.StatusUnprocessableEntity, err, "")
+				return
+			}
+			a.logDeniedQuery(r, upstreamName(ql), oauthToken, deniedQuery, err)
+			a.writeDenied(w, upstreamName(ql), oauthToken, err)
 			return
 		}
+		decision := allowedDecision(injected)
+		requestLogger(r).Debug().Str("user", oauthToken.PreferredUsername).Str("upstream", upstreamName(ql)).Str("decision", decision).Msg("Query enforced")
+		requestLogger(r).Trace().Str("query", r.URL.RawQuery).Msg("Enforced request query")
+		enforcementTotal.WithLabelValues(ql, EnforcementAllowed, decision).Inc()
+		endEnforcementSpan(span, EnforcementAllowed, nil)
+		a.auditDecision(r, oauthToken, upstreamName(ql), EnforcementAllowed, policy, nil)
+
+		if label := mux.Vars(r)["label"]; label != "" && !route.Streaming && a.filterLabelResponses(upstreamName(ql)) {
+			if r, err = withLabelValuesFilter(r, policy, label); err != nil {
+				logAndWriteError(w, http.StatusForbidden, err, "")
+				return
+			}
+		}
+		if mux.Vars(r)["traceID"] != "" && a.Cfg.Tempo.VerifyTraceTenant {
+			if r, err = withTraceTenantVerification(r, policy); err != nil {
+				logAndWriteError(w, http.StatusForbidden, err, "")
+				return
+			}
+		}
 
-		setHeaders(r, tls, headers, a.ServiceAccountToken)
+		setHeaders(r, auth, headers, a.ServiceAccountToken)
+		setQueryParams(r, a.extraQueryParams(upstreamName(ql)), route.MatchWord)
+		if route.Streaming {
+			proxy.ServeHTTP(w, r)
+			return
+		}
+		w, release := a.shadowFor(upstreamName(ql)).mirror(w, r)
+		defer release()
+		if a.coalesceRequests(upstreamName(ql)) {
+			a.serveCoalesced(w, r, upstream, upstreamName(ql), policy)
+			return
+		}
 		proxy.ServeHTTP(w, r)
 	}
 }
@@ -270,15 +714,22 @@ func handler(matchWord string, enforcer EnforceQL, dsURL string, tls bool, heade
 		log.Fatal().Err(err).Str("url", dsURL).Msg("Error parsing URL")
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
+		a := a.snapshot()
 		oauthToken, err := getToken(r, a)
 		if err != nil {
 			logAndWriteError(w, http.StatusForbidden, err, "")
 		}
 
 		// Policy-based enforcement (only method supported)
-		policy, skip, err := validateLabelPolicy(oauthToken, a)
+		policy, skip, err := validateLabelPolicy(oauthToken, a, upstreamName(queryLanguage(enforcer)), "")
 		if err != nil {
-			logAndWriteError(w, http.StatusForbidden, err, "")
+			status := http.StatusForbidden
+			if errors.Is(err, ErrLabelStoreUnavailable) {
+				status = http.StatusServiceUnavailable
+			} else if errors.Is(err, ErrInvalidPolicyResult) {
+				status = http.StatusInternalServerError
+			}
+			logAndWriteError(w, status, err, "")
 			return
 		}
 
@@ -287,7 +738,7 @@ func handler(matchWord string, enforcer EnforceQL, dsURL string, tls bool, heade
 			return
 		}
 
-		err = enforceRequest(r, enforcer, policy, matchWord)
+		_, err = enforceRequest(r, enforcer, policy, matchWord, "", QueryHandling{})
 		if err != nil {
 			logAndWriteError(w, http.StatusForbidden, err, "")
 			return
@@ -320,46 +771,225 @@ func handler(matchWord string, enforcer EnforceQL, dsURL string, tls bool, heade
 }
 
 func setActorHeaderLogQL(r *http.Request, token OAuthToken, a *App) error {
-	if a.Cfg.Loki.ActorHeader != "" {
-		data := fmt.Sprintf("%s%s", token.PreferredUsername, token.Email)
-		encoded := base64.StdEncoding.EncodeToString([]byte(data))
-		r.Header.Set(a.Cfg.Loki.ActorHeader, encoded)
-	}
-	return nil
+	return setActorHeader(r, a.Cfg.Loki.ActorHeader, a.Cfg.Loki.ActorFormat, a.Cfg.Loki.ActorClaim, token)
 }
 
 func setActorHeaderPromQL(r *http.Request, token OAuthToken, a *App) error {
-	if a.Cfg.Thanos.ActorHeader != "" {
-		data := fmt.Sprintf("%s%s", token.PreferredUsername, token.Email)
-		encoded := base64.StdEncoding.EncodeToString([]byte(data))
-		r.Header.Set(a.Cfg.Thanos.ActorHeader, encoded)
-	}
-	return nil
+	return setActorHeader(r, a.Cfg.Thanos.ActorHeader, a.Cfg.Thanos.ActorFormat, a.Cfg.Thanos.ActorClaim, token)
 }
 
 func setActorHeaderTraceQL(r *http.Request, token OAuthToken, a *App) error {
-	if a.Cfg.Tempo.ActorHeader != "" {
-		data := fmt.Sprintf("%s%s", token.PreferredUsername, token.Email)
-		encoded := base64.StdEncoding.EncodeToString([]byte(data))
-		r.Header.Set(a.Cfg.Tempo.ActorHeader, encoded)
+	return setActorHeader(r, a.Cfg.Tempo.ActorHeader, a.Cfg.Tempo.ActorFormat, a.Cfg.Tempo.ActorClaim, token)
+}
+
+// setActorHeader sets the actor header, if configured, to the token's identity rendered in the given format.
+// The values of the actor claims identify the user instead of the username and email if the token has any.
+func setActorHeader(r *http.Request, header string, format string, actorClaim []string, token OAuthToken) error {
+	if header == "" {
+		return nil
 	}
+	value, err := formatActorHeader(format, token.PreferredUsername, token.Email, token.claimValues(actorClaim))
+	if err != nil {
+		return err
+	}
+	r.Header.Set(header, value)
 	return nil
 }
 
+// Actor header formats
+const (
+	ActorFormatBase64   = "base64"   // base64(username + email) (default)
+	ActorFormatPlain    = "plain"    // username + email
+	ActorFormatUsername = "username" // username only, email if the token has no username
+	ActorFormatEmail    = "email"    // email only, username if the token has no email
+)
+
+// actorTemplates caches parsed actor header templates by format string.
+var actorTemplates sync.Map
+
+// formatActorHeader renders the actor header value for a user according to format.
+// Formats containing "{{" are Go templates with .Username, .Email and .Claim fields,
+// e.g. "{{.Username}} <{{.Email}}>". An empty format uses ActorFormatBase64.
+// Tokens may carry only one of username and email, so the username and email formats
+// fall back to the other one rather than producing an empty actor. claim, the values of
+// the configured actor claims, replaces both in the predefined formats when set.
+func formatActorHeader(format string, username string, email string, claim string) (string, error) {
+	if claim != "" {
+		switch format {
+		case "", ActorFormatBase64:
+			return base64.StdEncoding.EncodeToString([]byte(claim)), nil
+		case ActorFormatPlain, ActorFormatUsername, ActorFormatEmail:
+			return claim, nil
+		}
+	}
+
+	switch format {
+	case "", ActorFormatBase64:
+		return base64.StdEncoding.EncodeToString([]byte(username + email)), nil
+	case ActorFormatPlain:
+		return username + email, nil
+	case ActorFormatUsername:
+		if username == "" {
+			return email, nil
+		}
+		return username, nil
+	case ActorFormatEmail:
+		if email == "" {
+			return username, nil
+		}
+		return email, nil
+	}
+
+	if !strings.Contains(format, "{{") {
+		return "", fmt.Errorf("invalid actor format %q: must be base64, plain, username, email, or a template", format)
+	}
+
+	var tmpl *template.Template
+	if cached, ok := actorTemplates.Load(format); ok {
+		tmpl = cached.(*template.Template)
+	} else {
+		parsed, err := template.New("actor").Option("missingkey=error").Parse(format)
+		if err != nil {
+			return "", fmt.Errorf("invalid actor format template: %w", err)
+		}
+		actorTemplates.Store(format, parsed)
+		tmpl = parsed
+	}
+
+	var value strings.Builder
+	data := struct{ Username, Email, Claim string }{Username: username, Email: email, Claim: claim}
+	if err := tmpl.Execute(&value, data); err != nil {
+		return "", fmt.Errorf("error executing actor format template: %w", err)
+	}
+	return value.String(), nil
+}
+
 // streamUp forwards the provided HTTP request to the specified upstream URL using
 // a reverse proxy.It serves the upstream content back to the original client.
 func streamUp(w http.ResponseWriter, r *http.Request, upstreamURL *url.URL, tls bool, headers map[string]string, a *App) {
-	setHeaders(r, tls, headers, a.ServiceAccountToken)
+	// The default auth mode and client authorization handling are always valid
+	auth, _ := newUpstreamAuth("", "", "", tls, upstreamURL.Host)
+	setHeaders(r, auth, headers, a.ServiceAccountToken)
 	proxy := httputil.NewSingleHostReverseProxy(upstreamURL)
 	proxy.ServeHTTP(w, r)
 }
 
+// setQueryParams adds the configured extra query parameters to r unless the client already
+// set them. The enforced parameter matchWord is never added, as it would reach the upstream
+// unenforced.
+func setQueryParams(r *http.Request, params map[string]string, matchWord string) {
+	if len(params) == 0 {
+		return
+	}
+	query := r.URL.Query()
+	added := false
+	for k, v := range params {
+		if k == matchWord || query.Has(k) || r.PostForm.Has(k) {
+			continue
+		}
+		query.Set(k, v)
+		added = true
+	}
+	if added {
+		r.URL.RawQuery = query.Encode()
+	}
+}
+
+// validateExtraQueryParams returns an error if extra query parameters of upstream include a
+// parameter enforced by one of its routes.
+func validateExtraQueryParams(params map[string]string, routes []Route, upstream string) error {
+	for _, route := range routes {
+		if _, ok := params[route.MatchWord]; ok && route.MatchWord != "" {
+			return fmt.Errorf("%s: extra query parameters cannot include the enforced parameter %s", upstream, route.MatchWord)
+		}
+	}
+	return nil
+}
+
+// validateRouteTimeouts warns about route timeouts of the upstream's proxy configuration
+// that match none of its routes, such as misspelled patterns, as they are never applied.
+func validateRouteTimeouts(proxy *ProxyConfig, routes []Route, upstream string) {
+	if proxy == nil {
+		return
+	}
+	for pattern := range proxy.RouteTimeouts {
+		if !slices.ContainsFunc(routes, func(route Route) bool { return strings.EqualFold(route.Url, pattern) }) {
+			log.Warn().Str("route", pattern).Str("upstream", upstream).Msg("Route timeout does not match any route of the upstream")
+		}
+	}
+}
+
+// validateRouteURLs warns about route URLs of the upstream that match none of its routes, such
+// as misspelled patterns, as they are never used.
+func validateRouteURLs(routeURLs map[string]string, routes []Route, upstream string) {
+	for pattern := range routeURLs {
+		if !slices.ContainsFunc(routes, func(route Route) bool { return strings.EqualFold(route.Url, pattern) }) {
+			log.Warn().Str("route", pattern).Str("upstream", upstream).Msg("Route URL does not match any route of the upstream")
+		}
+	}
+}
+
+// withRouteTenantLabels sets the tenant label of the routes overridden by tenantLabels, keyed
+// by route pattern, and warns about patterns matching none of the routes, as they are never
+// applied.
+func withRouteTenantLabels(routes []Route, tenantLabels map[string]string, upstream string) []Route {
+	for pattern, label := range tenantLabels {
+		i := slices.IndexFunc(routes, func(route Route) bool { return strings.EqualFold(route.Url, pattern) })
+		if i < 0 {
+			log.Warn().Str("route", pattern).Str("upstream", upstream).Msg("Route tenant label does not match any route of the upstream")
+			continue
+		}
+		routes[i].TenantLabel = label
+	}
+	return routes
+}
+
+// withRouteQueryHandling sets how the routes in handling, keyed by route pattern, handle
+// absent and empty query parameters. It warns about patterns matching none of the routes and
+// returns an error for invalid handling.
+func withRouteQueryHandling(routes []Route, handling map[string]QueryHandling, upstream string) ([]Route, error) {
+	for pattern, query := range handling {
+		for _, mode := range []string{query.Absent, query.Empty} {
+			if mode != "" && mode != QueryInject && mode != QueryReject {
+				return nil, fmt.Errorf("%s: invalid query handling %q of route %s: must be inject or reject", upstream, mode, pattern)
+			}
+		}
+		i := slices.IndexFunc(routes, func(route Route) bool { return strings.EqualFold(route.Url, pattern) })
+		if i < 0 {
+			log.Warn().Str("route", pattern).Str("upstream", upstream).Msg("Route query handling does not match any route of the upstream")
+			continue
+		}
+		routes[i].Query = query
+	}
+	return routes, nil
+}
+
+// newLabelOperatorFilter returns the operator filter of an upstream, applying
+// tenantOperators to tenantLabels. It returns an error for operators not in valid.
+func newLabelOperatorFilter(tenantLabels, tenantOperators, operators, valid []string, upstream string) (LabelOperatorFilter, error) {
+	for _, ops := range [][]string{tenantOperators, operators} {
+		if err := validateLabelOperators(ops, valid); err != nil {
+			return LabelOperatorFilter{}, fmt.Errorf("%s: invalid label operators: %w", upstream, err)
+		}
+	}
+	return LabelOperatorFilter{TenantLabels: tenantLabels, TenantOperators: tenantOperators, Operators: operators}, nil
+}
+
+// routeTenantLabels returns the tenant label of route, which overrides that of the upstream.
+func routeTenantLabels(route Route, tenantLabel string) []string {
+	if route.TenantLabel != "" {
+		tenantLabel = route.TenantLabel
+	}
+	if tenantLabel == "" {
+		return nil
+	}
+	return []string{tenantLabel}
+}
+
 // setHeaders modifies the HTTP request headers to set the Authorization and
 // other headers based on the provided arguments.
-func setHeaders(r *http.Request, tls bool, header map[string]string, sat string) {
-	if !tls {
-		r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", sat))
-	}
+func setHeaders(r *http.Request, auth upstreamAuth, header map[string]string, sat string) {
+	auth.setAuthorization(r, sat)
 	for k, v := range header {
 		r.Header.Set(k, v)
 	}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// secretRefPrefix marks configuration values referencing a secret of the secret provider,
+// e.g. "secret:lbac/loki#token", instead of holding the value itself.
+const secretRefPrefix = "secret:"
+
+// SecretProviderVault selects the HashiCorp Vault KV v2 secret provider (secrets.provider).
+const SecretProviderVault = "vault"
+
+// Defaults of the secret provider, see SecretsConfig.
+const (
+	defaultSecretsRefreshInterval = 5 * time.Minute
+	defaultSecretsTimeout         = 10 * time.Second
+	defaultVaultMount             = "secret"
+	defaultVaultSecretKey         = "value"
+)
+
+// SecretProvider fetches secrets from a secret manager. ref is the secret reference without
+// the secret: prefix.
+type SecretProvider interface {
+	GetSecret(ctx context.Context, ref string) (string, error)
+}
+
+// secretStore is the cache secret references are resolved with. It is global because the
+// credentials it holds are resolved deep within request handling and TLS handshakes.
+var secretStore atomic.Pointer[secretCache]
+
+// isSecretRef reports whether value references a secret of the secret provider.
+func isSecretRef(value string) bool {
+	return strings.HasPrefix(value, secretRefPrefix)
+}
+
+// resolveSecret returns the value of the secret referenced by value, or value itself if it
+// is no secret reference. An unresolvable reference yields an empty value.
+func resolveSecret(value string) string {
+	if !isSecretRef(value) {
+		return value
+	}
+	cache := secretStore.Load()
+	if cache == nil {
+		log.Error().Str("ref", value).Msg("Secret reference without a secret provider")
+		return ""
+	}
+	secret, err := cache.get(value)
+	if err != nil {
+		log.Error().Err(err).Str("ref", value).Msg("Error while resolving secret")
+		return ""
+	}
+	return secret
+}
+
+// secretCache caches the values of secret references, fetched from the provider on first
+// use and on every refresh, so rotated secrets are picked up without a restart. A failed
+// refresh keeps the previous value.
+type secretCache struct {
+	provider SecretProvider
+	timeout  time.Duration
+	mu       sync.RWMutex
+	values   map[string]string
+	version  atomic.Uint64 // Incremented whenever a refresh changed a value
+}
+
+func newSecretCache(provider SecretProvider, timeout time.Duration) *secretCache {
+	if timeout <= 0 {
+		timeout = defaultSecretsTimeout
+	}
+	return &secretCache{provider: provider, timeout: timeout, values: make(map[string]string)}
+}
+
+// get returns the value of the secret reference ref, fetching it if it is not cached yet.
+func (c *secretCache) get(ref string) (string, error) {
+	c.mu.RLock()
+	value, ok := c.values[ref]
+	c.mu.RUnlock()
+	if ok {
+		return value, nil
+	}
+	value, err := c.fetch(ref)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.values[ref] = value
+	c.mu.Unlock()
+	return value, nil
+}
+
+func (c *secretCache) fetch(ref string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	value, err := c.provider.GetSecret(ctx, strings.TrimPrefix(ref, secretRefPrefix))
+	if err != nil {
+		return "", fmt.Errorf("fetching secret %s: %w", ref, err)
+	}
+	return value, nil
+}
+
+// refresh refetches every cached secret.
+func (c *secretCache) refresh() {
+	c.mu.RLock()
+	refs := make([]string, 0, len(c.values))
+	for ref := range c.values {
+		refs = append(refs, ref)
+	}
+	c.mu.RUnlock()
+
+	for _, ref := range refs {
+		value, err := c.fetch(ref)
+		if err != nil {
+			log.Error().Err(err).Str("ref", ref).Msg("Error while refreshing secret, keeping the previous value")
+			continue
+		}
+		c.mu.Lock()
+		if c.values[ref] != value {
+			c.values[ref] = value
+			c.version.Add(1)
+			log.Info().Str("ref", ref).Msg("Secret rotated")
+		}
+		c.mu.Unlock()
+	}
+}
+
+// run refreshes the cached secrets every interval.
+func (c *secretCache) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.refresh()
+	}
+}
+
+// newSecretProvider returns the secret provider selected by cfg, nil if none is.
+func newSecretProvider(cfg SecretsConfig) (SecretProvider, error) {
+	switch cfg.Provider {
+	case "":
+		return nil, nil
+	case SecretProviderVault:
+		return newVaultSecretProvider(cfg.Vault, cfg.Timeout)
+	default:
+		return nil, fmt.Errorf("unknown secret provider %q, must be vault", cfg.Provider)
+	}
+}
+
+// vaultSecretProvider reads secrets from a HashiCorp Vault KV v2 secrets engine. References
+// have the form path#key, the key defaulting to "value".
+type vaultSecretProvider struct {
+	address   string
+	token     string
+	mount     string
+	namespace string
+	client    *http.Client
+}
+
+func newVaultSecretProvider(cfg VaultSecretsConfig, timeout time.Duration) (*vaultSecretProvider, error) {
+	p := &vaultSecretProvider{
+		address:   cfg.Address,
+		token:     cfg.Token,
+		mount:     cfg.Mount,
+		namespace: cfg.Namespace,
+		client:    &http.Client{Timeout: timeout},
+	}
+	if p.address == "" {
+		p.address = os.Getenv("VAULT_ADDR")
+	}
+	if p.token == "" {
+		p.token = os.Getenv("VAULT_TOKEN")
+	}
+	if p.mount == "" {
+		p.mount = defaultVaultMount
+	}
+	if p.address == "" {
+		return nil, errors.New("vault address is required, set secrets.vault.address or VAULT_ADDR")
+	}
+	if p.token == "" {
+		return nil, errors.New("vault token is required, set secrets.vault.token or VAULT_TOKEN")
+	}
+	p.address = strings.TrimSuffix(p.address, "/")
+	return p, nil
+}
+
+func (p *vaultSecretProvider) GetSecret(ctx context.Context, ref string) (string, error) {
+	path, key, found := strings.Cut(ref, "#")
+	if !found {
+		key = defaultVaultSecretKey
+	}
+	endpoint := fmt.Sprintf("%s/v1/%s/data/%s", p.address, url.PathEscape(p.mount), strings.TrimPrefix(path, "/"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", p.token)
+	if p.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.namespace)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return "", fmt.Errorf("vault returned %s for %s", resp.Status, path)
+	}
+
+	var body struct {
+		Data struct {
+			Data map[string]any `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decoding vault response for %s: %w", path, err)
+	}
+	value, ok := body.Data.Data[key]
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no key %q", path, key)
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("vault secret %s key %q is not a string", path, key)
+	}
+	return s, nil
+}
+
+// secretRefs returns the configuration values that reference secrets.
+func (c *Config) secretRefs() []string {
+	var refs []string
+	for _, value := range []string{
+		c.Web.ServiceAccountToken,
+		c.Thanos.StaticToken, c.Thanos.Cert, c.Thanos.Key,
+		c.Loki.StaticToken, c.Loki.Cert, c.Loki.Key,
+		c.Tempo.StaticToken, c.Tempo.Cert, c.Tempo.Key,
+	} {
+		if isSecretRef(value) {
+			refs = append(refs, value)
+		}
+	}
+	return refs
+}
+
+// WithSecrets sets up the secret provider and resolves every secret reference of the
+// configuration, so that a missing secret fails the startup rather than a request.
+func (a *App) WithSecrets() *App {
+	refs := a.Cfg.secretRefs()
+	provider, err := newSecretProvider(a.Cfg.Secrets)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error while creating secret provider")
+	}
+	if provider == nil {
+		if len(refs) > 0 {
+			log.Fatal().Strs("refs", refs).Msg("Secret references require secrets.provider")
+		}
+		return a
+	}
+
+	cache := newSecretCache(provider, a.Cfg.Secrets.Timeout)
+	for _, ref := range refs {
+		if _, err := cache.get(ref); err != nil {
+			log.Fatal().Err(err).Msg("Error while resolving secret")
+		}
+	}
+	secretStore.Store(cache)
+
+	interval := a.Cfg.Secrets.RefreshInterval
+	if interval <= 0 {
+		interval = defaultSecretsRefreshInterval
+	}
+	go cache.run(interval)
+	log.Info().Str("provider", a.Cfg.Secrets.Provider).Int("refs", len(refs)).Dur("refresh_interval", interval).Msg("Secret provider enabled")
+	return a
+}
+
+// loadX509KeyPair loads a certificate and its key from files, or from the PEM values of
+// the secrets they reference.
+func loadX509KeyPair(certFile, keyFile string) (tls.Certificate, error) {
+	if !isSecretRef(certFile) && !isSecretRef(keyFile) {
+		return tls.LoadX509KeyPair(certFile, keyFile)
+	}
+	certPEM, err := readSecretOrFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := readSecretOrFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+func readSecretOrFile(value string) ([]byte, error) {
+	if !isSecretRef(value) {
+		return os.ReadFile(value)
+	}
+	secret := resolveSecret(value)
+	if secret == "" {
+		return nil, fmt.Errorf("secret %s is empty or unresolvable", value)
+	}
+	return []byte(secret), nil
+}
+
+// secretCertificates serves the client certificates of the upstreams, reloading them once
+// the secrets they are read from were rotated.
+type secretCertificates struct {
+	load    func() []tls.Certificate
+	mu      sync.Mutex
+	version uint64
+	certs   []tls.Certificate
+}
+
+// GetClientCertificate selects the first certificate supported by the server, like the
+// Certificates of a tls.Config, and an empty one if none is.
+func (s *secretCertificates) GetClientCertificate(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	s.mu.Lock()
+	if cache := secretStore.Load(); cache != nil {
+		if version := cache.version.Load(); version != s.version {
+			s.certs = s.load()
+			s.version = version
+		}
+	}
+	certs := s.certs
+	s.mu.Unlock()
+
+	for i := range certs {
+		if cri.SupportsCertificate(&certs[i]) == nil {
+			return &certs[i], nil
+		}
+	}
+	return &tls.Certificate{}, nil
+}
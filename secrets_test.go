@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockSecretProvider serves secrets from a map; missing refs fail.
+type mockSecretProvider struct {
+	mu      sync.Mutex
+	secrets map[string]string
+	fetches int
+}
+
+func (p *mockSecretProvider) GetSecret(_ context.Context, ref string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fetches++
+	value, ok := p.secrets[ref]
+	if !ok {
+		return "", errors.New("secret not found")
+	}
+	return value, nil
+}
+
+func (p *mockSecretProvider) set(ref, value string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.secrets[ref] = value
+}
+
+func (p *mockSecretProvider) remove(ref string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.secrets, ref)
+}
+
+// useSecretProvider installs a secret cache of provider for the duration of the test.
+func useSecretProvider(t *testing.T, provider SecretProvider) *secretCache {
+	t.Helper()
+	cache := newSecretCache(provider, time.Second)
+	previous := secretStore.Swap(cache)
+	t.Cleanup(func() { secretStore.Store(previous) })
+	return cache
+}
+
+func TestSecretCache_Refresh(t *testing.T) {
+	provider := &mockSecretProvider{secrets: map[string]string{"lbac/loki#token": "token-1"}}
+	cache := useSecretProvider(t, provider)
+
+	assert.Equal(t, "token-1", resolveSecret("secret:lbac/loki#token"))
+	assert.Equal(t, "token-1", resolveSecret("secret:lbac/loki#token"))
+	assert.Equal(t, 1, provider.fetches, "cached after the first fetch")
+	assert.Equal(t, "plain-token", resolveSecret("plain-token"), "literal values are kept")
+	assert.Empty(t, resolveSecret("secret:lbac/missing"))
+
+	provider.set("lbac/loki#token", "token-2")
+	cache.refresh()
+	assert.Equal(t, "token-2", resolveSecret("secret:lbac/loki#token"))
+	assert.Equal(t, uint64(1), cache.version.Load())
+
+	provider.remove("lbac/loki#token")
+	cache.refresh()
+	assert.Equal(t, "token-2", resolveSecret("secret:lbac/loki#token"), "a failed refresh keeps the previous value")
+	assert.Equal(t, uint64(1), cache.version.Load())
+}
+
+func TestSecretProvider_UpstreamCredentials(t *testing.T) {
+	provider := &mockSecretProvider{secrets: map[string]string{
+		"lbac/loki#token": "loki-token-1",
+		"lbac/sat#token":  "sat-token-1",
+	}}
+	cache := useSecretProvider(t, provider)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, r.Header.Get("Authorization"))
+	}))
+	defer upstream.Close()
+
+	app, tokens := setupTestMain()
+	app.Cfg.Loki.URL = upstream.URL
+	app.Cfg.Loki.AuthMode = AuthModeStaticToken
+	app.Cfg.Loki.StaticToken = "secret:lbac/loki#token"
+	app.Cfg.Thanos.URL = upstream.URL
+	app.Cfg.Thanos.AuthMode = AuthModeSAT
+	app.Cfg.Web.ServiceAccountToken = "secret:lbac/sat#token"
+	app.WithSAT()
+	app.WithProxies()
+	app.WithRoutes()
+
+	request := func(path string) string {
+		req := httptest.NewRequest(http.MethodGet, path+"?query="+url.QueryEscape(`{app="api"}`), nil)
+		req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+		rr := httptest.NewRecorder()
+		app.e.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		return rr.Body.String()
+	}
+
+	assert.Equal(t, "Bearer loki-token-1", request("/loki/api/v1/query"))
+	assert.Equal(t, "Bearer sat-token-1", request("/api/v1/query"))
+
+	provider.set("lbac/loki#token", "loki-token-2")
+	provider.set("lbac/sat#token", "sat-token-2")
+	cache.refresh()
+	assert.Equal(t, "Bearer loki-token-2", request("/loki/api/v1/query"), "rotated static token is sent")
+	assert.Equal(t, "Bearer sat-token-2", request("/api/v1/query"), "rotated service account token is sent")
+}
+
+func TestVaultSecretProvider(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" || r.Header.Get("X-Vault-Namespace") != "team" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/kv/data/lbac/loki":
+			_, _ = fmt.Fprint(w, `{"data":{"data":{"token":"loki-token","value":"default-value","port":8080},"metadata":{"version":3}}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer vault.Close()
+
+	provider, err := newSecretProvider(SecretsConfig{
+		Provider: SecretProviderVault,
+		Timeout:  time.Second,
+		Vault:    VaultSecretsConfig{Address: vault.URL + "/", Token: "vault-token", Mount: "kv", Namespace: "team"},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		ref     string
+		want    string
+		wantErr string
+	}{
+		{ref: "lbac/loki#token", want: "loki-token"},
+		{ref: "lbac/loki", want: "default-value"},
+		{ref: "lbac/loki#password", wantErr: `vault secret lbac/loki has no key "password"`},
+		{ref: "lbac/loki#port", wantErr: `vault secret lbac/loki key "port" is not a string`},
+		{ref: "lbac/tempo#token", wantErr: "vault returned 404 Not Found for lbac/tempo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			value, err := provider.GetSecret(context.Background(), tt.ref)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, value)
+		})
+	}
+
+	t.Run("Configuration errors", func(t *testing.T) {
+		t.Setenv("VAULT_ADDR", "")
+		t.Setenv("VAULT_TOKEN", "")
+		_, err := newSecretProvider(SecretsConfig{Provider: SecretProviderVault, Vault: VaultSecretsConfig{Token: "vault-token"}})
+		assert.ErrorContains(t, err, "vault address is required")
+		_, err = newSecretProvider(SecretsConfig{Provider: SecretProviderVault, Vault: VaultSecretsConfig{Address: vault.URL}})
+		assert.ErrorContains(t, err, "vault token is required")
+		_, err = newSecretProvider(SecretsConfig{Provider: "aws"})
+		assert.ErrorContains(t, err, "unknown secret provider")
+	})
+}
+
+func TestSecretCertificates_Rotation(t *testing.T) {
+	cert1, key1 := selfSignedPEM(t, "loki-client-1")
+	cert2, key2 := selfSignedPEM(t, "loki-client-2")
+	provider := &mockSecretProvider{secrets: map[string]string{
+		"lbac/loki#tls.crt": cert1,
+		"lbac/loki#tls.key": key1,
+	}}
+	cache := useSecretProvider(t, provider)
+
+	cfg := &Config{}
+	cfg.Loki.Cert = "secret:lbac/loki#tls.crt"
+	cfg.Loki.Key = "secret:lbac/loki#tls.key"
+	assert.True(t, cfg.hasSecretCertificates())
+
+	certs := &secretCertificates{load: func() []tls.Certificate { return clientCertificates(cfg) }}
+	certs.certs = certs.load()
+	require.Len(t, certs.certs, 1)
+
+	clientCN := func() string {
+		cert, err := certs.GetClientCertificate(&tls.CertificateRequestInfo{Version: tls.VersionTLS13, SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256}})
+		require.NoError(t, err)
+		require.NotEmpty(t, cert.Certificate)
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(t, err)
+		return parsed.Subject.CommonName
+	}
+	assert.Equal(t, "loki-client-1", clientCN())
+
+	provider.set("lbac/loki#tls.crt", cert2)
+	provider.set("lbac/loki#tls.key", key2)
+	cache.refresh()
+	assert.Equal(t, "loki-client-2", clientCN(), "rotated certificate is presented")
+}
+
+// selfSignedPEM returns a self-signed certificate and its key as PEM.
+func selfSignedPEM(t *testing.T, cn string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Shadow comparison result label values
+const (
+	ShadowMatch    = "match"    // Shadow returned the same status code as the primary
+	ShadowMismatch = "mismatch" // Shadow returned a different status code
+	ShadowError    = "error"    // Shadow request failed
+)
+
+var (
+	// shadowRequestsTotal counts mirrored requests per upstream and comparison result.
+	shadowRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "lgtm_lbac_proxy",
+		Name:      "shadow_requests_total",
+		Help:      "Total number of requests mirrored to the shadow upstream by comparison result.",
+	}, []string{"upstream", "result"})
+
+	// shadowDuration observes the response time of the shadow upstream.
+	shadowDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "lgtm_lbac_proxy",
+		Name:      "shadow_duration_seconds",
+		Help:      "Time until the shadow upstream response was fully read.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"upstream"})
+)
+
+// shadowUpstream mirrors a sample of enforced requests to a secondary upstream. Mirrored
+// requests run in the background and their responses are discarded, so the shadow never
+// affects the client-facing response or latency.
+type shadowUpstream struct {
+	upstream string
+	target   *url.URL
+	rate     float64
+	client   *http.Client
+	sample   func() float64 // Returns a value in [0, 1); requests below rate are mirrored
+}
+
+// newShadowUpstream returns the shadow of upstream, or nil if no shadow URL is configured.
+// It returns an error if the URL or sample rate is invalid.
+func newShadowUpstream(cfg ShadowConfig, transport http.RoundTripper, timeout time.Duration, upstream string) (*shadowUpstream, error) {
+	if cfg.URL == "" {
+		return nil, nil
+	}
+	target, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid shadow URL: %w", err)
+	}
+	if cfg.SampleRate < 0 || cfg.SampleRate > 1 {
+		return nil, fmt.Errorf("shadow sample rate must be between 0 and 1, got %v", cfg.SampleRate)
+	}
+	return &shadowUpstream{
+		upstream: upstream,
+		target:   target,
+		rate:     cfg.SampleRate,
+		client:   &http.Client{Transport: transport, Timeout: timeout},
+		sample:   rand.Float64,
+	}, nil
+}
+
+// configuredBy reports whether s is the shadow configured by cfg; a nil shadow is configured
+// by an empty URL.
+func (s *shadowUpstream) configuredBy(cfg ShadowConfig) bool {
+	if s == nil {
+		return cfg.URL == ""
+	}
+	return s.target.String() == cfg.URL && s.rate == cfg.SampleRate
+}
+
+// closeIdleConnections closes the idle connections of the transport of s, if it has one.
+func (s *shadowUpstream) closeIdleConnections() {
+	if s != nil {
+		s.client.CloseIdleConnections()
+	}
+}
+
+// shadowFor returns the shadow of the named upstream, or nil if it has none.
+func (a *App) shadowFor(upstream string) *shadowUpstream {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if upstream == "loki" {
+		return a.lokiShadow
+	}
+	return nil
+}
+
+// mirror replays r to the shadow upstream if it is sampled. It returns the response writer
+// to serve the primary response with and a function to call once the primary response is
+// complete, which releases the comparison. The request body must already be in memory, as
+// it is after enforcement.
+func (s *shadowUpstream) mirror(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	// Streaming connections such as Loki tail cannot be replayed
+	if s == nil || s.rate <= 0 || r.Header.Get("Upgrade") != "" || s.sample() >= s.rate {
+		return w, func() {}
+	}
+
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		body, _ = io.ReadAll(r.Body)
+		_ = r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	target := *r.URL
+	target.Scheme = s.target.Scheme
+	target.Host = s.target.Host
+	// The primary request context is canceled as soon as its response is served
+	req, err := http.NewRequestWithContext(context.WithoutCancel(r.Context()), r.Method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		requestLogger(r).Error().Err(err).Str("upstream", s.upstream).Msg("Error while creating shadow request")
+		return w, func() {}
+	}
+	req.Header = r.Header.Clone()
+
+	primary := make(chan int, 1)
+	go s.replay(req, primary)
+
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	return rec, func() { primary <- rec.status }
+}
+
+// replay sends the mirrored request, discards the response and records how it compares
+// to the primary status code received on primary.
+func (s *shadowUpstream) replay(req *http.Request, primary <-chan int) {
+	start := time.Now()
+	resp, err := s.client.Do(req)
+	if err == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+	shadowDuration.WithLabelValues(s.upstream).Observe(time.Since(start).Seconds())
+
+	primaryStatus := <-primary
+	result := ShadowMatch
+	switch {
+	case err != nil:
+		result = ShadowError
+		requestLogger(req).Debug().Err(err).Str("upstream", s.upstream).Msg("Shadow request failed")
+	case resp.StatusCode != primaryStatus:
+		result = ShadowMismatch
+		requestLogger(req).Debug().
+			Str("upstream", s.upstream).
+			Str("path", req.URL.Path).
+			Int("status", primaryStatus).
+			Int("shadow_status", resp.StatusCode).
+			Msg("Shadow response status differs")
+	}
+	shadowRequestsTotal.WithLabelValues(s.upstream, result).Inc()
+}
+
+// statusRecorder records the status code written to the wrapped response writer.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if !r.wroteHeader {
+		r.status = code
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap exposes the wrapped writer to http.ResponseController, which the reverse proxy
+// uses for flushing.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// setupShadowTest returns an app proxying Loki to a primary upstream answering "primary"
+// and mirroring to shadow with the given sample rate.
+func setupShadowTest(t *testing.T, shadow *httptest.Server, rate float64) (App, map[string]string) {
+	t.Helper()
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, "primary")
+	}))
+	t.Cleanup(primary.Close)
+
+	app, tokens := setupTestMain()
+	app.Cfg.Loki.URL = primary.URL
+	app.Cfg.Loki.Shadow = ShadowConfig{URL: shadow.URL, SampleRate: rate}
+	app.WithProxies()
+	app.WithRoutes()
+	return app, tokens
+}
+
+func TestShadowUpstream_SampleRate(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		queries []string
+	)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queries = append(queries, r.URL.Query().Get("query"))
+		mu.Unlock()
+		_, _ = fmt.Fprint(w, "shadow")
+	}))
+	defer shadow.Close()
+
+	app, tokens := setupShadowTest(t, shadow, 0.25)
+	// Deterministic sampler mirroring exactly one request in four
+	var n atomic.Int64
+	app.lokiShadow.sample = func() float64 { return float64(n.Add(1)%4) / 4 }
+
+	matchesBefore := testutil.ToFloat64(shadowRequestsTotal.WithLabelValues("loki", ShadowMatch))
+	for i := 0; i < 100; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/loki/api/v1/query_range?query="+url.QueryEscape(`{app="api"}`), nil)
+		req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+		rr := httptest.NewRecorder()
+		app.e.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "primary", rr.Body.String())
+	}
+
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(shadowRequestsTotal.WithLabelValues("loki", ShadowMatch)) == matchesBefore+25
+	}, 2*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, queries, 25)
+	// The shadow receives the enforced query
+	assert.Contains(t, queries[0], `tenant_id=~"allowed_user|also_allowed_user"`)
+}
+
+func TestShadowUpstream_FailureDoesNotAffectPrimary(t *testing.T) {
+	release := make(chan struct{})
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+	defer close(release)
+
+	app, tokens := setupShadowTest(t, shadow, 1)
+	mismatchesBefore := testutil.ToFloat64(shadowRequestsTotal.WithLabelValues("loki", ShadowMismatch))
+
+	// The primary response is served while the shadow is still hanging
+	req := httptest.NewRequest(http.MethodGet, "/loki/api/v1/query?query="+url.QueryEscape(`{app="api"}`), nil)
+	req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+	rr := httptest.NewRecorder()
+	app.e.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "primary", rr.Body.String())
+
+	release <- struct{}{}
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(shadowRequestsTotal.WithLabelValues("loki", ShadowMismatch)) == mismatchesBefore+1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// An unreachable shadow is recorded as an error
+	shadow.Close()
+	errorsBefore := testutil.ToFloat64(shadowRequestsTotal.WithLabelValues("loki", ShadowError))
+	req = httptest.NewRequest(http.MethodGet, "/loki/api/v1/query?query="+url.QueryEscape(`{app="api"}`), nil)
+	req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+	rr = httptest.NewRecorder()
+	app.e.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "primary", rr.Body.String())
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(shadowRequestsTotal.WithLabelValues("loki", ShadowError)) == errorsBefore+1
+	}, 2*time.Second, 10*time.Millisecond)
+}
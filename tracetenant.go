@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// ErrTraceTenantDenied marks trace by ID responses denied because the trace spans a tenant
+// the policy does not permit. They are answered like other authorization failures.
+var ErrTraceTenantDenied = errors.New("unauthorized trace")
+
+// traceTenantVerifier carries what is needed to verify a trace by ID response through the
+// request context, from handlerWithProxy to the proxy's ModifyResponse.
+type traceTenantVerifier struct {
+	matchers []*labels.Matcher // Policy rules on resource attribute names
+	any      bool              // Permit resources matching any matcher (OR logic) instead of all
+}
+
+// newTraceTenantVerifier returns a verifier permitting the resources of a trace that policy
+// permits. Only rules on resource attributes can be verified: rules on attributes of other
+// scopes are rejected, so that traces are denied rather than returned unverified.
+func newTraceTenantVerifier(policy *LabelPolicy) (*traceTenantVerifier, error) {
+	verifier := &traceTenantVerifier{any: policy.Logic == LogicOR}
+	for _, rule := range policy.Rules {
+		name, ok := resourceAttributeName(rule.Name)
+		if !ok {
+			return nil, fmt.Errorf("cannot verify trace tenant: %s is not a resource attribute", rule.Name)
+		}
+		m := ruleToMatcher(rule)
+		matcher, err := labels.NewMatcher(m.Type, name, m.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule for attribute %s: %w", rule.Name, err)
+		}
+		verifier.matchers = append(verifier.matchers, matcher)
+	}
+	return verifier, nil
+}
+
+// resourceAttributeName returns the resource attribute a policy rule is on: the name without
+// its resource. or unscoped . prefix, or the name itself if it has no scope prefix.
+func resourceAttributeName(name string) (string, bool) {
+	for _, scope := range traceQLScopes {
+		if !strings.HasPrefix(name, scope) {
+			continue
+		}
+		if scope != "resource." && scope != "." {
+			return "", false
+		}
+		return strings.TrimPrefix(name, scope), true
+	}
+	return name, true
+}
+
+// permits reports whether the policy permits a resource with attributes. Missing attributes
+// are matched as empty values, like missing labels.
+func (v *traceTenantVerifier) permits(attributes map[string]string) bool {
+	for _, m := range v.matchers {
+		matches := m.Matches(attributes[m.Name])
+		if v.any && matches {
+			return true
+		}
+		if !v.any && !matches {
+			return false
+		}
+	}
+	return !v.any
+}
+
+// withTraceTenantVerification marks r for verification of its trace by ID response against
+// policy. The upstream is asked for an uncompressed JSON response so that it can be parsed.
+func withTraceTenantVerification(r *http.Request, policy *LabelPolicy) (*http.Request, error) {
+	verifier, err := newTraceTenantVerifier(policy)
+	if err != nil {
+		return r, err
+	}
+	r.Header.Set("Accept", "application/json")
+	r.Header.Del("Accept-Encoding")
+	return r.WithContext(context.WithValue(r.Context(), traceTenantContextKey, verifier)), nil
+}
+
+// otlpResource is the resource of a batch of spans in a Tempo trace by ID response.
+type otlpResource struct {
+	Resource struct {
+		Attributes []struct {
+			Key   string                     `json:"key"`
+			Value map[string]json.RawMessage `json:"value"`
+		} `json:"attributes"`
+	} `json:"resource"`
+}
+
+// otlpTrace is a Tempo trace by ID response: a list of batches (v1) or a trace object with
+// resource spans (v2).
+type otlpTrace struct {
+	Batches       []otlpResource `json:"batches"`
+	ResourceSpans []otlpResource `json:"resourceSpans"`
+	Trace         *struct {
+		Batches       []otlpResource `json:"batches"`
+		ResourceSpans []otlpResource `json:"resourceSpans"`
+	} `json:"trace"`
+}
+
+// resources returns the resources of all batches of the trace.
+func (t otlpTrace) resources() []otlpResource {
+	if t.Trace == nil {
+		return slices.Concat(t.Batches, t.ResourceSpans)
+	}
+	return slices.Concat(t.Batches, t.ResourceSpans, t.Trace.Batches, t.Trace.ResourceSpans)
+}
+
+// attributes returns the resource attributes of the batch as strings.
+func (r otlpResource) attributes() map[string]string {
+	attributes := make(map[string]string, len(r.Resource.Attributes))
+	for _, attribute := range r.Resource.Attributes {
+		for _, raw := range attribute.Value {
+			var value string
+			if err := json.Unmarshal(raw, &value); err != nil {
+				value = string(raw) // Non-string scalars, e.g. boolValue
+			}
+			attributes[attribute.Key] = value
+		}
+	}
+	return attributes
+}
+
+// verifyTraceTenantResponse rejects a successful trace by ID response marked by
+// withTraceTenantVerification with ErrTraceTenantDenied unless the policy permits every
+// resource of the trace, so that a trace spanning other tenants is not returned. Responses
+// that cannot be parsed are rejected with ErrInvalidUpstreamResponse rather than forwarded
+// unverified.
+func verifyTraceTenantResponse(resp *http.Response) error {
+	verifier, _ := resp.Request.Context().Value(traceTenantContextKey).(*traceTenantVerifier)
+	if verifier == nil || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return fmt.Errorf("%w: cannot verify trace response with content encoding %q", ErrInvalidUpstreamResponse, encoding)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("error reading trace response: %w", err)
+	}
+	var trace otlpTrace
+	if err := json.Unmarshal(body, &trace); err != nil {
+		return fmt.Errorf("%w: error parsing trace response: %v", ErrInvalidUpstreamResponse, err)
+	}
+
+	for _, resource := range trace.resources() {
+		if !verifier.permits(resource.attributes()) {
+			requestLogger(resp.Request).Warn().Str("path", resp.Request.URL.Path).Msg("Denied trace of a tenant not permitted by policy")
+			return fmt.Errorf("%w: belongs to a tenant not permitted by your policy", ErrTraceTenantDenied)
+		}
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
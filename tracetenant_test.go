@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceTenantVerifier_Permits(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    LabelPolicy
+		permitted []map[string]string
+		denied    []map[string]string
+		wantErr   string
+	}{
+		{
+			name: "resource attributes with AND logic",
+			policy: LabelPolicy{Logic: LogicAND, Rules: []LabelRule{
+				{Name: "resource.namespace", Operator: "=~", Values: []string{"prod", "staging"}},
+				{Name: ".cluster", Operator: "!=", Values: []string{"secret"}},
+			}},
+			permitted: []map[string]string{{"namespace": "prod"}, {"namespace": "staging", "cluster": "eu"}},
+			denied:    []map[string]string{{"namespace": "dev"}, {"namespace": "prod", "cluster": "secret"}, {}},
+		},
+		{
+			name: "unscoped rule names with OR logic",
+			policy: LabelPolicy{Logic: LogicOR, Rules: []LabelRule{
+				{Name: "namespace", Operator: "=", Values: []string{"prod"}},
+				{Name: "team", Operator: "=", Values: []string{"backend"}},
+			}},
+			permitted: []map[string]string{{"namespace": "prod"}, {"team": "backend"}},
+			denied:    []map[string]string{{"namespace": "dev", "team": "frontend"}},
+		},
+		{
+			name: "span attributes cannot be verified",
+			policy: LabelPolicy{Logic: LogicAND, Rules: []LabelRule{
+				{Name: "span.namespace", Operator: "=", Values: []string{"prod"}},
+			}},
+			wantErr: "span.namespace is not a resource attribute",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier, err := newTraceTenantVerifier(&tt.policy)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			for _, attributes := range tt.permitted {
+				assert.True(t, verifier.permits(attributes), "%v should be permitted", attributes)
+			}
+			for _, attributes := range tt.denied {
+				assert.False(t, verifier.permits(attributes), "%v should be denied", attributes)
+			}
+		})
+	}
+}
+
+func TestVerifyTraceTenant(t *testing.T) {
+	resource := func(tenant string) string {
+		return fmt.Sprintf(`{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"api"}},{"key":"tenant_id","value":{"stringValue":%q}}]},"scopeSpans":[]}`, tenant)
+	}
+	var accept string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept = r.Header.Get("Accept")
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/traces/allowed":
+			_, _ = fmt.Fprintf(w, `{"batches":[%s,%s]}`, resource("allowed_user"), resource("also_allowed_user"))
+		case "/api/v2/traces/allowed":
+			_, _ = fmt.Fprintf(w, `{"trace":{"resourceSpans":[%s]},"status":"complete"}`, resource("allowed_user"))
+		case "/api/traces/forbidden":
+			_, _ = fmt.Fprintf(w, `{"batches":[%s]}`, resource("forbidden_user"))
+		case "/api/v2/traces/mixed":
+			_, _ = fmt.Fprintf(w, `{"trace":{"resourceSpans":[%s,%s]}}`, resource("allowed_user"), resource("forbidden_user"))
+		case "/api/traces/invalid":
+			_, _ = fmt.Fprint(w, `not a trace`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		verify     bool
+		wantStatus int
+	}{
+		{name: "allowed tenant", path: "/api/traces/allowed", verify: true, wantStatus: http.StatusOK},
+		{name: "allowed tenant v2", path: "/api/v2/traces/allowed", verify: true, wantStatus: http.StatusOK},
+		{name: "disallowed tenant", path: "/api/traces/forbidden", verify: true, wantStatus: http.StatusForbidden},
+		{name: "trace spanning a disallowed tenant", path: "/api/v2/traces/mixed", verify: true, wantStatus: http.StatusForbidden},
+		{name: "unparsable trace", path: "/api/traces/invalid", verify: true, wantStatus: http.StatusInternalServerError},
+		{name: "trace not found", path: "/api/traces/missing", verify: true, wantStatus: http.StatusNotFound},
+		{name: "verification disabled", path: "/api/traces/forbidden", wantStatus: http.StatusOK},
+	}
+
+	app, tokens := setupTestMain()
+	app.Cfg.Tempo.URL = upstream.URL
+	app.WithProxies()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app.Cfg.Tempo.VerifyTraceTenant = tt.verify
+			app.WithRoutes()
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+			req.Header.Set("Accept", "application/protobuf")
+			rr := httptest.NewRecorder()
+			app.e.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.wantStatus, rr.Code, rr.Body.String())
+			if tt.verify {
+				assert.Equal(t, "application/json", accept)
+			}
+			switch tt.wantStatus {
+			case http.StatusForbidden:
+				assert.Contains(t, rr.Body.String(), "unauthorized trace")
+			case http.StatusInternalServerError:
+				assert.Contains(t, rr.Body.String(), "error parsing trace response")
+			}
+		})
+	}
+
+	t.Run("denied message", func(t *testing.T) {
+		app.Cfg.Tempo.VerifyTraceTenant = true
+		app.Cfg.Tempo.DeniedMessage = "{{.Username}} may not see this trace: {{.Error}}"
+		app.WithRoutes()
+
+		req := httptest.NewRequest(http.MethodGet, "/api/traces/forbidden", nil)
+		req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+		rr := httptest.NewRecorder()
+		app.e.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		assert.Equal(t, "user may not see this trace: unauthorized trace: belongs to a tenant not permitted by your policy\n", rr.Body.String())
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies spans created by the proxy.
+const tracerName = "github.com/binhnguyenduc/lgtm-lbac-proxy"
+
+// maxSpanQueryLength bounds the rewritten query recorded on enforcement spans.
+const maxSpanQueryLength = 1024
+
+// Span attribute keys for query enforcement
+const (
+	AttrUpstream       = attribute.Key("lbac.upstream")
+	AttrQL             = attribute.Key("lbac.ql")
+	AttrDecision       = attribute.Key("lbac.decision")
+	AttrQueryLength    = attribute.Key("lbac.query.original_length")
+	AttrRewrittenQuery = attribute.Key("lbac.query.rewritten")
+)
+
+// tracer returns the proxy tracer from the global provider, which is a no-op until
+// a TracerProvider is registered.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// upstreamName returns the upstream a query language is proxied to.
+func upstreamName(ql string) string {
+	switch ql {
+	case QLProm:
+		return "thanos"
+	case QLLog:
+		return "loki"
+	case QLTrace:
+		return "tempo"
+	default:
+		return QLUnknown
+	}
+}
+
+// tracedEnforcer records the original query length and the rewritten query of every
+// enforced query on span. The rewritten query is only recorded at trace log level,
+// matching the request body redaction in loggingMiddleware.
+type tracedEnforcer struct {
+	EnforceQL
+	span             trace.Span
+	includeRewritten bool
+	denied           *string // Receives the query that failed enforcement, if set
+}
+
+// Enforce delegates to the wrapped enforcer and annotates the span with the result.
+func (t tracedEnforcer) Enforce(query string, policy LabelPolicy) (string, error) {
+	result, err := t.EnforceResult(query, policy)
+	return result.Query, err
+}
+
+// EnforceResult is Enforce, keeping the wrapped enforcer's report of injected matchers.
+func (t tracedEnforcer) EnforceResult(query string, policy LabelPolicy) (EnforceResult, error) {
+	t.span.SetAttributes(AttrQueryLength.Int(len(query)))
+	result, err := enforceQuery(t.EnforceQL, query, policy)
+	if err != nil && t.denied != nil {
+		*t.denied = query
+	}
+	if err == nil && t.includeRewritten {
+		t.span.SetAttributes(AttrRewrittenQuery.String(truncate(result.Query, maxSpanQueryLength)))
+	}
+	return result, err
+}
+
+// endEnforcementSpan records the enforcement decision and ends the span.
+func endEnforcementSpan(span trace.Span, decision string, err error) {
+	span.SetAttributes(AttrDecision.String(decision))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// truncate shortens s to at most n bytes.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func setupTestTracer(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		_ = provider.Shutdown(t.Context())
+	})
+	return exporter
+}
+
+func spanAttributes(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func TestEnforcementSpanAttributes(t *testing.T) {
+	query := `{tenant_id="allowed_user"}`
+
+	tests := []struct {
+		name             string
+		logLevel         int
+		query            string
+		expectedDecision string
+		expectRewritten  bool
+	}{
+		{name: "Allowed query redacted", logLevel: 1, query: query, expectedDecision: EnforcementAllowed},
+		{name: "Allowed query at trace level", logLevel: -1, query: query, expectedDecision: EnforcementAllowed, expectRewritten: true},
+		{name: "Denied query", logLevel: 1, query: `{tenant_id="forbidden"}`, expectedDecision: EnforcementDenied},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := setupTestTracer(t)
+			app, tokens := setupTestMain()
+			app.Cfg.Log.Level = tt.logLevel
+			app.WithRoutes()
+
+			req := httptest.NewRequest(http.MethodGet, "/loki/api/v1/query?query="+url.QueryEscape(tt.query), nil)
+			req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+			app.e.ServeHTTP(httptest.NewRecorder(), req)
+
+			spans := exporter.GetSpans()
+			assert.Len(t, spans, 1)
+			assert.Equal(t, "enforce", spans[0].Name)
+
+			attrs := spanAttributes(spans[0])
+			assert.Equal(t, "loki", attrs[AttrUpstream].AsString())
+			assert.Equal(t, QLLog, attrs[AttrQL].AsString())
+			assert.Equal(t, tt.expectedDecision, attrs[AttrDecision].AsString())
+			assert.Equal(t, int64(len(tt.query)), attrs[AttrQueryLength].AsInt64())
+
+			rewritten, ok := attrs[AttrRewrittenQuery]
+			assert.Equal(t, tt.expectRewritten, ok)
+			if tt.expectRewritten {
+				assert.Equal(t, query, rewritten.AsString())
+			}
+		})
+	}
+}
+
+func TestTracedEnforcer_TruncatesRewrittenQuery(t *testing.T) {
+	exporter := setupTestTracer(t)
+	policy := LabelPolicy{
+		Rules: []LabelRule{{Name: "tenant_id", Operator: "=", Values: []string{"t1"}}},
+		Logic: LogicAND,
+	}
+	query := `{app="` + strings.Repeat("a", 2*maxSpanQueryLength) + `"}`
+
+	_, span := tracer().Start(t.Context(), "enforce")
+	_, err := tracedEnforcer{EnforceQL: LogQLEnforcer{}, span: span, includeRewritten: true}.Enforce(query, policy)
+	assert.NoError(t, err)
+	span.End()
+
+	attrs := spanAttributes(exporter.GetSpans()[0])
+	assert.Len(t, attrs[AttrRewrittenQuery].AsString(), maxSpanQueryLength)
+}
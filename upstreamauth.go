@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Upstream authentication modes (auth_mode), selecting the credential sent to an upstream
+const (
+	AuthModeSAT         = "sat"          // Kubernetes service account token as bearer token
+	AuthModeStaticToken = "static_token" // Configured static_token as bearer token
+	AuthModeMTLS        = "mtls"         // Client certificate only, no Authorization header is set
+	AuthModeNone        = "none"         // No credential, no Authorization header is set
+)
+
+// Handling of the client's own Authorization header (client_authorization)
+const (
+	ClientAuthorizationReplace = "replace" // Replaced by the auth_mode credential; default of sat and static_token
+	ClientAuthorizationStrip   = "strip"   // Removed; the auth_mode credential is still sent, if any
+	ClientAuthorizationForward = "forward" // Sent unchanged; default of mtls and none
+)
+
+// upstreamAuth is the resolved authentication of requests to an upstream.
+type upstreamAuth struct {
+	mode   string
+	token  string // Bearer token of the static_token mode
+	client string // Handling of the client's Authorization header
+}
+
+// newUpstreamAuth resolves the authentication mode of upstream. Without an explicit mode,
+// the service account token is sent unless useMutualTLS is set, as before auth_mode existed.
+// Without an explicit clientAuthorization, the client's Authorization header is replaced by
+// modes sending a bearer token and forwarded by the others. It returns an error for
+// unknown or contradictory settings.
+func newUpstreamAuth(mode, staticToken, clientAuthorization string, useMutualTLS bool, upstream string) (upstreamAuth, error) {
+	if mode == "" {
+		mode = AuthModeSAT
+		if useMutualTLS {
+			mode = AuthModeMTLS
+		}
+	}
+	var auth upstreamAuth
+	switch mode {
+	case AuthModeSAT, AuthModeMTLS, AuthModeNone:
+		if staticToken != "" {
+			log.Warn().Str("auth_mode", mode).Str("upstream", upstream).Msg("static_token is ignored unless auth_mode is static_token")
+		}
+		auth = upstreamAuth{mode: mode}
+	case AuthModeStaticToken:
+		if staticToken == "" {
+			return upstreamAuth{}, fmt.Errorf("%s: static_token is required when auth_mode is static_token", upstream)
+		}
+		auth = upstreamAuth{mode: mode, token: staticToken}
+	default:
+		return upstreamAuth{}, fmt.Errorf("%s: invalid upstream auth mode %q, must be one of sat, static_token, mtls, none", upstream, mode)
+	}
+
+	_, sendsToken := auth.bearerToken("")
+	switch clientAuthorization {
+	case "":
+		auth.client = ClientAuthorizationForward
+		if sendsToken {
+			auth.client = ClientAuthorizationReplace
+		}
+	case ClientAuthorizationStrip:
+		auth.client = clientAuthorization
+	case ClientAuthorizationReplace:
+		if !sendsToken {
+			return upstreamAuth{}, fmt.Errorf("%s: client_authorization replace requires auth_mode sat or static_token, got %s", upstream, mode)
+		}
+		auth.client = clientAuthorization
+	case ClientAuthorizationForward:
+		if sendsToken {
+			return upstreamAuth{}, fmt.Errorf("%s: client_authorization forward requires auth_mode mtls or none, got %s", upstream, mode)
+		}
+		auth.client = clientAuthorization
+	default:
+		return upstreamAuth{}, fmt.Errorf("%s: invalid client authorization handling %q, must be one of strip, replace, forward", upstream, clientAuthorization)
+	}
+	return auth, nil
+}
+
+// bearerToken returns the bearer token to authenticate to the upstream with, if the mode
+// sends one. sat is the service account token. Secret references are resolved on every
+// call, so that rotated secrets are sent.
+func (u upstreamAuth) bearerToken(sat string) (string, bool) {
+	switch u.mode {
+	case AuthModeSAT:
+		return resolveSecret(sat), true
+	case AuthModeStaticToken:
+		return resolveSecret(u.token), true
+	default:
+		return "", false
+	}
+}
+
+// setAuthorization sets the Authorization header of r sent to the upstream. sat is the
+// service account token.
+func (u upstreamAuth) setAuthorization(r *http.Request, sat string) {
+	if token, ok := u.bearerToken(sat); ok {
+		r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		return
+	}
+	if u.client != ClientAuthorizationForward {
+		r.Header.Del("Authorization")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamAuthModes(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, r.Header.Get("Authorization"))
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name                string
+		mode                string
+		staticToken         string
+		clientAuthorization string
+		useMutualTLS        bool
+		wantAuthorization   string // Authorization header received by the upstream
+	}{
+		{name: "default sends service account token", wantAuthorization: "Bearer sat-token"},
+		{name: "default with mutual TLS forwards client header", useMutualTLS: true, wantAuthorization: "Bearer client-token"},
+		{name: "sat", mode: AuthModeSAT, useMutualTLS: true, wantAuthorization: "Bearer sat-token"},
+		{name: "static token", mode: AuthModeStaticToken, staticToken: "static-secret", wantAuthorization: "Bearer static-secret"},
+		{name: "static token with mutual TLS", mode: AuthModeStaticToken, staticToken: "static-secret", useMutualTLS: true, wantAuthorization: "Bearer static-secret"},
+		{name: "mtls forwards client header", mode: AuthModeMTLS, wantAuthorization: "Bearer client-token"},
+		{name: "none forwards client header", mode: AuthModeNone, wantAuthorization: "Bearer client-token"},
+		{name: "mtls strips client header", mode: AuthModeMTLS, clientAuthorization: ClientAuthorizationStrip, wantAuthorization: ""},
+		{name: "default with mutual TLS strips client header", useMutualTLS: true, clientAuthorization: ClientAuthorizationStrip, wantAuthorization: ""},
+		{name: "none strips client header", mode: AuthModeNone, clientAuthorization: ClientAuthorizationStrip, wantAuthorization: ""},
+		{name: "none forwards client header explicitly", mode: AuthModeNone, clientAuthorization: ClientAuthorizationForward, wantAuthorization: "Bearer client-token"},
+		{name: "sat strips client header", mode: AuthModeSAT, clientAuthorization: ClientAuthorizationStrip, wantAuthorization: "Bearer sat-token"},
+		{name: "static token replaces client header", mode: AuthModeStaticToken, staticToken: "static-secret", clientAuthorization: ClientAuthorizationReplace, wantAuthorization: "Bearer static-secret"},
+	}
+
+	app, tokens := setupTestMain()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app.ServiceAccountToken = "sat-token"
+			app.Cfg.Loki.URL = upstream.URL
+			app.Cfg.Loki.AuthMode = tt.mode
+			app.Cfg.Loki.StaticToken = tt.staticToken
+			app.Cfg.Loki.ClientAuthorization = tt.clientAuthorization
+			app.Cfg.Loki.UseMutualTLS = tt.useMutualTLS
+			// Authenticate with another header so the client Authorization header stays distinct
+			app.Cfg.Web.AuthHeader = "X-Auth-Token"
+			app.WithProxies()
+			app.WithRoutes()
+
+			req := httptest.NewRequest(http.MethodGet, "/loki/api/v1/query?query="+url.QueryEscape(`{app="api"}`), nil)
+			req.Header.Set("X-Auth-Token", "Bearer "+tokens["userTenant"])
+			req.Header.Set("Authorization", "Bearer client-token")
+			rr := httptest.NewRecorder()
+			app.e.ServeHTTP(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, tt.wantAuthorization, rr.Body.String())
+		})
+	}
+}
+
+func TestUpstreamAuth_BearerToken(t *testing.T) {
+	auth, err := newUpstreamAuth(AuthModeStaticToken, "static-secret", "", false, "loki")
+	assert.NoError(t, err)
+	token, ok := auth.bearerToken("sat-token")
+	assert.True(t, ok)
+	assert.Equal(t, "static-secret", token)
+
+	auth, err = newUpstreamAuth(AuthModeNone, "", "", false, "loki")
+	assert.NoError(t, err)
+	_, ok = auth.bearerToken("sat-token")
+	assert.False(t, ok)
+}
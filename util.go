@@ -1,6 +1,9 @@
 package main
 
 import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
 	"sort"
 	"strings"
 
@@ -33,22 +36,105 @@ func MapKeysToArray[K comparable, V any](tenantLabel map[K]V) []K {
 	return tenantLabelKeys
 }
 
+// ruleMatchValue returns the operator and value a LabelRule is emitted with.
+// Multiple values are combined into a regex alternation: values of = and != rules are
+// literals and are escaped so that separators or metacharacters inside a value cannot
+// widen the match, while values of =~ and !~ rules are patterns and are joined as-is.
+func ruleMatchValue(rule LabelRule) (string, string) {
+	if len(rule.Values) == 1 {
+		return rule.Operator, rule.Values[0]
+	}
+
+	switch rule.Operator {
+	case OperatorEquals, OperatorNotEquals:
+		escaped := make([]string, len(rule.Values))
+		for i, v := range rule.Values {
+			escaped[i] = regexp.QuoteMeta(v)
+		}
+		operator := OperatorRegexMatch
+		if rule.Operator == OperatorNotEquals {
+			operator = OperatorRegexNoMatch
+		}
+		return operator, strings.Join(escaped, "|")
+	default:
+		return rule.Operator, strings.Join(rule.Values, "|")
+	}
+}
+
+// emittedMatchValue returns the operator and value of a LabelRule like ruleMatchValue, with
+// regex values anchored as ^(...)$ if anchor is set (web.anchor_regex_values). Prometheus
+// and Loki fully anchor regex matchers anyway, but TraceQL regexes are not, so an unanchored
+// prod|staging would also match prod-copy.
+func emittedMatchValue(rule LabelRule, anchor bool) (string, string) {
+	operator, value := ruleMatchValue(rule)
+	if anchor && (operator == OperatorRegexMatch || operator == OperatorRegexNoMatch) {
+		value = "^(" + value + ")$"
+	}
+	return operator, value
+}
+
+// unanchorRegexValue strips the ^(...)$ emittedMatchValue anchors a regex value with, so
+// that its alternatives can be checked against the allowed values. Prometheus and Loki fully
+// anchor regexes, so both forms match the same values.
+func unanchorRegexValue(value string) string {
+	if len(value) >= 4 && strings.HasPrefix(value, "^(") && strings.HasSuffix(value, ")$") {
+		return value[2 : len(value)-2]
+	}
+	return value
+}
+
+// regexAlternativeValue returns the value a regex alternative of a query matcher matches,
+// if it is a literal such as prod or escaped as a\.b. Alternatives with regex
+// metacharacters, such as a.b, match more than one value and are not literals.
+func regexAlternativeValue(alternative string) (string, bool) {
+	re, err := syntax.Parse(alternative, syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	re = re.Simplify()
+	switch {
+	case re.Op == syntax.OpLiteral && re.Flags&syntax.FoldCase == 0:
+		return string(re.Rune), true
+	case re.Op == syntax.OpEmptyMatch:
+		return "", true
+	}
+	return "", false
+}
+
+// regexAlternativeAllowed reports whether a regex alternative of a query matcher selects no
+// more than allowedValues and allowedPatterns, the regex values of the positive =~ rules on
+// the label, permit: it is either a literal allowed value or exactly one of the patterns.
+func regexAlternativeAllowed(alternative string, allowedValues, allowedPatterns map[string]bool) bool {
+	if allowedPatterns[alternative] {
+		return true
+	}
+	value, ok := regexAlternativeValue(alternative)
+	return ok && allowedValues[value]
+}
+
+// policyRegexValues returns the regex values of the positive =~ rules of policy by label
+// name, for regexAlternativeAllowed.
+func policyRegexValues(policy LabelPolicy) map[string]map[string]bool {
+	patterns := make(map[string]map[string]bool)
+	for _, rule := range policy.Rules {
+		if rule.Operator != OperatorRegexMatch {
+			continue
+		}
+		if patterns[rule.Name] == nil {
+			patterns[rule.Name] = make(map[string]bool, len(rule.Values))
+		}
+		for _, v := range rule.Values {
+			patterns[rule.Name][v] = true
+		}
+	}
+	return patterns
+}
+
 // ruleToMatcher converts a LabelRule to a prometheus labels.Matcher.
 // This is a shared utility function used by both PromQL and LogQL enforcers.
 func ruleToMatcher(rule LabelRule) *labels.Matcher {
 	var matchType labels.MatchType
-	operator := rule.Operator
-	value := rule.Values[0]
-
-	// For multiple values, combine with regex OR
-	if len(rule.Values) > 1 {
-		value = strings.Join(rule.Values, "|")
-		if operator == OperatorEquals {
-			operator = OperatorRegexMatch
-		} else if operator == OperatorNotEquals {
-			operator = OperatorRegexNoMatch
-		}
-	}
+	operator, value := ruleMatchValue(rule)
 
 	// Map operator to MatchType
 	switch operator {
@@ -68,3 +154,51 @@ func ruleToMatcher(rule LabelRule) *labels.Matcher {
 		Value: value,
 	}
 }
+
+// excludingMatchers returns the compiled matchers of the negative rules of an AND policy,
+// grouped by label name. Values they exclude can never be returned, so queries selecting
+// them are denied rather than answered with an empty result. Under OR logic another rule
+// may still permit such values, and nil is returned.
+func excludingMatchers(policy LabelPolicy) (map[string][]*labels.Matcher, error) {
+	if policy.Logic == LogicOR && len(policy.Rules) > 1 {
+		return nil, nil
+	}
+	var excluding map[string][]*labels.Matcher
+	for _, rule := range policy.Rules {
+		if !rule.IsNegative() {
+			continue
+		}
+		m := ruleToMatcher(rule)
+		matcher, err := labels.NewMatcher(m.Type, m.Name, m.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule for label %s: %w", rule.Name, err)
+		}
+		if excluding == nil {
+			excluding = make(map[string][]*labels.Matcher)
+		}
+		excluding[rule.Name] = append(excluding[rule.Name], matcher)
+	}
+	return excluding, nil
+}
+
+// validateExcludedValues checks that no = or =~ matcher selects a value excluded by the
+// matchers of excludingMatchers. Regex matchers are checked per pipe-separated value.
+func validateExcludedValues(matchers []*labels.Matcher, excluding map[string][]*labels.Matcher) error {
+	for _, matcher := range matchers {
+		if matcher.Type != labels.MatchEqual && matcher.Type != labels.MatchRegexp {
+			continue
+		}
+		for _, exclude := range excluding[matcher.Name] {
+			values := []string{matcher.Value}
+			if matcher.Type == labels.MatchRegexp {
+				values = strings.Split(unanchorRegexValue(matcher.Value), "|")
+			}
+			for _, v := range values {
+				if !exclude.Matches(v) {
+					return &DeniedLabelError{Label: matcher.Name, Value: v, Operator: matcher.Type.String(), ExcludedBy: exclude.Type.String()}
+				}
+			}
+		}
+	}
+	return nil
+}
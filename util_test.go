@@ -1,9 +1,12 @@
 package main
 
 import (
+	"regexp"
 	"sort"
+	"strings"
 	"testing"
 
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -41,3 +44,259 @@ func TestMapKeysToArray(t *testing.T) {
 	expectedIntKeys := []int{1, 2, 3}
 	assert.Equal(t, expectedIntKeys, intKeys)
 }
+
+func TestRuleMatchValue(t *testing.T) {
+	tests := []struct {
+		name             string
+		rule             LabelRule
+		expectedOperator string
+		expectedValue    string
+	}{
+		{
+			name:             "single literal value is not escaped",
+			rule:             LabelRule{Name: "tenant_id", Operator: OperatorEquals, Values: []string{"a.b"}},
+			expectedOperator: OperatorEquals,
+			expectedValue:    "a.b",
+		},
+		{
+			name:             "multiple literal values are escaped",
+			rule:             LabelRule{Name: "tenant_id", Operator: OperatorEquals, Values: []string{"a|b", "c.d", "e(f"}},
+			expectedOperator: OperatorRegexMatch,
+			expectedValue:    `a\|b|c\.d|e\(f`,
+		},
+		{
+			name:             "multiple negated literal values are escaped",
+			rule:             LabelRule{Name: "tenant_id", Operator: OperatorNotEquals, Values: []string{"a|b", "c.d"}},
+			expectedOperator: OperatorRegexNoMatch,
+			expectedValue:    `a\|b|c\.d`,
+		},
+		{
+			name:             "regex patterns are joined as-is",
+			rule:             LabelRule{Name: "tenant_id", Operator: OperatorRegexMatch, Values: []string{"prod-.*", "dev-.*"}},
+			expectedOperator: OperatorRegexMatch,
+			expectedValue:    "prod-.*|dev-.*",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			operator, value := ruleMatchValue(tt.rule)
+			assert.Equal(t, tt.expectedOperator, operator)
+			assert.Equal(t, tt.expectedValue, value)
+		})
+	}
+}
+
+func TestValidateExcludedValues(t *testing.T) {
+	policy := LabelPolicy{
+		Rules: []LabelRule{
+			{Name: "tenant_id", Operator: OperatorNotEquals, Values: []string{"secret"}},
+			{Name: "tenant_id", Operator: OperatorRegexNoMatch, Values: []string{"vault-.*"}},
+		},
+		Logic: LogicAND,
+	}
+	excluding, err := excludingMatchers(policy)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		matcher       *labels.Matcher
+		expectedValue string // Denied value, empty if the matcher is allowed
+	}{
+		{name: "allowed value", matcher: labels.MustNewMatcher(labels.MatchEqual, "tenant_id", "prod")},
+		{name: "value excluded by !=", matcher: labels.MustNewMatcher(labels.MatchEqual, "tenant_id", "secret"), expectedValue: "secret"},
+		{name: "value excluded by !~", matcher: labels.MustNewMatcher(labels.MatchEqual, "tenant_id", "vault-a"), expectedValue: "vault-a"},
+		{name: "excluded regex alternative", matcher: labels.MustNewMatcher(labels.MatchRegexp, "tenant_id", "prod|secret"), expectedValue: "secret"},
+		{name: "negative matchers only narrow", matcher: labels.MustNewMatcher(labels.MatchNotEqual, "tenant_id", "secret")},
+		{name: "other labels are not checked", matcher: labels.MustNewMatcher(labels.MatchEqual, "job", "secret")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateExcludedValues([]*labels.Matcher{tt.matcher}, excluding)
+			if tt.expectedValue == "" {
+				assert.NoError(t, err)
+				return
+			}
+			var denied *DeniedLabelError
+			if assert.ErrorAs(t, err, &denied) {
+				assert.Equal(t, "tenant_id", denied.Label)
+				assert.Equal(t, tt.expectedValue, denied.Value)
+			}
+		})
+	}
+
+	// Under OR logic another rule may permit excluded values
+	policy.Rules = append(policy.Rules, LabelRule{Name: "team", Operator: OperatorEquals, Values: []string{"ops"}})
+	policy.Logic = LogicOR
+	excluding, err = excludingMatchers(policy)
+	assert.NoError(t, err)
+	assert.Nil(t, excluding)
+}
+
+func TestEnforcers_EscapeSeparatorInTenantValues(t *testing.T) {
+	policy := LabelPolicy{
+		Rules: []LabelRule{{Name: "tenant_id", Operator: OperatorEquals, Values: []string{"a|b", "c.d", "e(f"}}},
+		Logic: LogicAND,
+	}
+
+	t.Run("ruleToMatcher", func(t *testing.T) {
+		rule := ruleToMatcher(policy.Rules[0])
+		matcher, err := labels.NewMatcher(rule.Type, rule.Name, rule.Value)
+		assert.NoError(t, err)
+		assert.True(t, matcher.Matches("a|b"))
+		assert.True(t, matcher.Matches("c.d"))
+		assert.True(t, matcher.Matches("e(f"))
+		assert.False(t, matcher.Matches("a"))
+		assert.False(t, matcher.Matches("cXd"))
+	})
+
+	t.Run("buildQueryFromPolicy", func(t *testing.T) {
+		assert.Equal(t, `{tenant_id=~"a\\|b|c\\.d|e\\(f"}`, buildQueryFromPolicy(policy, false))
+	})
+
+	t.Run("buildLogQLQueryFromPolicy", func(t *testing.T) {
+		assert.Equal(t, `{tenant_id=~"a\\|b|c\\.d|e\\(f"}`, buildLogQLQueryFromPolicy(policy, false))
+	})
+
+	t.Run("buildPolicyQuery", func(t *testing.T) {
+		assert.Equal(t, `{ tenant_id=~"a\|b|c\.d|e\(f" }`, buildPolicyQuery(policy, false))
+	})
+
+	t.Run("PromQL enforce", func(t *testing.T) {
+		got, err := PromQLEnforcer{}.Enforce("up", policy)
+		assert.NoError(t, err)
+		assert.Equal(t, `up{tenant_id=~"a\\|b|c\\.d|e\\(f"}`, got)
+	})
+
+	t.Run("LogQL enforce", func(t *testing.T) {
+		got, err := LogQLEnforcer{}.Enforce(`{app="api"}`, policy)
+		assert.NoError(t, err)
+		assert.Contains(t, got, `tenant_id=~"a\\|b|c\\.d|e\\(f"`)
+	})
+
+	t.Run("LogQL enforce empty query", func(t *testing.T) {
+		got, err := LogQLEnforcer{}.Enforce("", policy)
+		assert.NoError(t, err)
+		assert.Equal(t, `{tenant_id=~"a\\|b|c\\.d|e\\(f"}`, got)
+	})
+}
+
+func TestEnforcers_RegexMetacharactersInQueryValues(t *testing.T) {
+	policy := LabelPolicy{
+		Rules: []LabelRule{{Name: "namespace", Operator: OperatorEquals, Values: []string{"a.b", "prod"}}},
+		Logic: LogicAND,
+	}
+
+	t.Run("PromQL", func(t *testing.T) {
+		_, err := PromQLEnforcer{}.Enforce(`up{namespace=~"a.b"}`, policy)
+		assert.ErrorContains(t, err, "unauthorized namespace: a.b", "a.b also matches axb")
+
+		got, err := PromQLEnforcer{}.Enforce(`up{namespace=~"a\\.b|prod"}`, policy)
+		assert.NoError(t, err)
+		assert.Equal(t, `up{namespace=~"a\\.b|prod"}`, got)
+	})
+
+	t.Run("LogQL", func(t *testing.T) {
+		_, err := LogQLEnforcer{}.Enforce(`{namespace=~"a.b"}`, policy)
+		assert.ErrorContains(t, err, "unauthorized namespace: a.b", "a.b also matches axb")
+
+		_, err = LogQLEnforcer{}.Enforce(`{namespace=~"prod.*"}`, policy)
+		assert.ErrorContains(t, err, "unauthorized namespace: prod.*")
+
+		got, err := LogQLEnforcer{}.Enforce(`{namespace=~"a\\.b|prod"}`, policy)
+		assert.NoError(t, err)
+		assert.Equal(t, `{namespace=~"a\\.b|prod"}`, got)
+	})
+}
+
+func TestEnforcers_PolicyPatternsInQueryValues(t *testing.T) {
+	policy := LabelPolicy{
+		Rules: []LabelRule{{Name: "namespace", Operator: OperatorRegexMatch, Values: []string{"backend-.*", "prod"}}},
+		Logic: LogicAND,
+	}
+
+	t.Run("PromQL", func(t *testing.T) {
+		got, err := PromQLEnforcer{}.Enforce(`up{namespace=~"backend-.*|prod"}`, policy)
+		assert.NoError(t, err, "the policy's own patterns are allowed")
+		assert.Equal(t, `up{namespace=~"backend-.*|prod"}`, got)
+
+		_, err = PromQLEnforcer{}.Enforce(`up{namespace=~"backend-.*|.*"}`, policy)
+		assert.ErrorContains(t, err, "unauthorized namespace: .*")
+	})
+
+	t.Run("LogQL", func(t *testing.T) {
+		got, err := LogQLEnforcer{}.Enforce(`{namespace=~"backend-.*"}`, policy)
+		assert.NoError(t, err, "the policy's own patterns are allowed")
+		assert.Equal(t, `{namespace=~"backend-.*"}`, got)
+
+		_, err = LogQLEnforcer{}.Enforce(`{namespace=~"backend.*"}`, policy)
+		assert.ErrorContains(t, err, "unauthorized namespace: backend.*")
+	})
+
+	t.Run("TraceQL", func(t *testing.T) {
+		tracePolicy := LabelPolicy{
+			Rules: []LabelRule{{Name: "resource.namespace", Operator: OperatorRegexMatch, Values: []string{"backend-.*"}}},
+			Logic: LogicAND,
+		}
+		_, err := TraceQLEnforcer{}.Enforce(`{ resource.namespace =~ "backend-.*" }`, tracePolicy)
+		assert.NoError(t, err, "the policy's own patterns are allowed")
+
+		_, err = TraceQLEnforcer{}.Enforce(`{ resource.namespace =~ "backend.*" }`, tracePolicy)
+		assert.ErrorContains(t, err, "unauthorized resource.namespace: backend.*")
+	})
+}
+
+func TestAnchorRegexValues(t *testing.T) {
+	policy := LabelPolicy{
+		Rules: []LabelRule{{Name: "resource.namespace", Operator: OperatorEquals, Values: []string{"prod", "staging"}}},
+		Logic: LogicAND,
+	}
+	rule := policy.Rules[0]
+
+	// TraceQL regexes are not anchored, so the emitted value is matched as a substring
+	matchesPrefixBypass := func(filter string) bool {
+		value := filter[strings.Index(filter, `"`)+1 : len(filter)-1]
+		return regexp.MustCompile(value).MatchString("prod-copy")
+	}
+
+	unanchored := buildRuleFilter(rule, false)
+	assert.Equal(t, `resource.namespace=~"prod|staging"`, unanchored)
+	assert.Equal(t, `resource.namespace=~"prod|staging"`, buildMatcherString(rule, false))
+	assert.Equal(t, `{resource.namespace=~"prod|staging"}`, buildLogQLQueryFromPolicy(policy, false))
+	assert.True(t, matchesPrefixBypass(unanchored))
+
+	anchored := buildRuleFilter(rule, true)
+	assert.Equal(t, `resource.namespace=~"^(prod|staging)$"`, anchored)
+	assert.Equal(t, `resource.namespace=~"^(prod|staging)$"`, buildMatcherString(rule, true))
+	assert.Equal(t, `{resource.namespace=~"^(prod|staging)$"}`, buildLogQLQueryFromPolicy(policy, true))
+	assert.False(t, matchesPrefixBypass(anchored))
+	assert.Equal(t, `resource.namespace="prod"`, buildRuleFilter(LabelRule{Name: "resource.namespace", Operator: OperatorEquals, Values: []string{"prod"}}, true), "single literal values are not regexes")
+	assert.Equal(t, `resource.team!~"^(ext-.*)$"`, buildRuleFilter(LabelRule{Name: "resource.team", Operator: OperatorRegexNoMatch, Values: []string{"ext-.*"}}, true))
+
+	t.Run("TraceQL enforce", func(t *testing.T) {
+		got, err := TraceQLEnforcer{AnchorRegexValues: true}.Enforce(`{ span.http.status_code = 500 }`, policy)
+		assert.NoError(t, err)
+		assert.Contains(t, got, `resource.namespace=~"^(prod|staging)$"`)
+
+		// A regex of the query is not anchored, so it does not restrict the attribute
+		got, err = TraceQLEnforcer{AnchorRegexValues: true}.Enforce(`{ resource.namespace =~ "prod" }`, policy)
+		assert.NoError(t, err)
+		assert.Equal(t, "{ resource.namespace=~\"^(prod|staging)$\" && resource.namespace =~ `prod` }", got)
+	})
+
+	t.Run("PromQL enforce empty query", func(t *testing.T) {
+		promPolicy := LabelPolicy{Rules: []LabelRule{{Name: "namespace", Operator: OperatorEquals, Values: []string{"prod", "staging"}}}, Logic: LogicAND}
+		got, err := PromQLEnforcer{AnchorRegexValues: true}.Enforce("", promPolicy)
+		assert.NoError(t, err)
+		assert.Equal(t, `{namespace=~"^(prod|staging)$"}`, got)
+
+		orPolicy := LabelPolicy{Rules: []LabelRule{promPolicy.Rules[0], {Name: "team", Operator: OperatorEquals, Values: []string{"a", "b"}}}, Logic: LogicOR}
+		got, err = PromQLEnforcer{AnchorRegexValues: true}.Enforce("", orPolicy)
+		assert.NoError(t, err)
+		assert.Equal(t, `({namespace=~"^(prod|staging)$"}) or ({team=~"^(a|b)$"})`, got, "OR branches are anchored too")
+
+		_, err = PromQLEnforcer{AnchorRegexValues: true}.Enforce(`up{namespace=~"^(prod|dev)$"}`, promPolicy)
+		assert.ErrorContains(t, err, "unauthorized namespace: dev", "anchored query matchers are checked like unanchored ones")
+	})
+}